@@ -0,0 +1,617 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Alert rule kinds
+const (
+	// Average rate of an interface over the window as a percentage of its
+	// bandwidth, or of its speed when no bandwidth is set
+	alertInterfaceUtilization = "interface_utilization"
+	// Bytes sent or received by each host over the window, from flows_hourly
+	alertHostOctets = "host_octets"
+	// Percentage of the bytes over the window carried by one IP protocol
+	alertProtocolShare = "protocol_share"
+)
+
+// Alert event states
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// AlertRule is a threshold rule. A rule fires once its value reaches
+// Threshold on For consecutive evaluations and resolves when the value
+// drops below ClearThreshold, so values hovering around the threshold do
+// not flap.
+type AlertRule struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Enabled bool   `json:"enabled"`
+	// Exporter ID; 0 matches every exporter in flow rules
+	Exporter uint64 `json:"exporter"`
+	// SNMP index. Flow rules match the flows received on it.
+	Interface string `json:"interface"`
+	// in, out or max for utilization; src or dst for the host side of
+	// host_octets
+	Direction string `json:"direction"`
+	// Addresses and networks a host_octets rule is limited to, in the
+	// syntax of the traffic filters; empty checks every host
+	Host string `json:"host"`
+	// IP protocol number of protocol_share rules
+	Protocol int `json:"protocol"`
+	// Percent for utilization and protocol share, bytes for host octets
+	Threshold      float64 `json:"threshold"`
+	ClearThreshold float64 `json:"clear_threshold"`
+	// Evaluation window in minutes
+	Window    int       `json:"window"`
+	For       int       `json:"for"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AlertEvent records a rule starting or stopping to fire. Subject tells the
+// hosts of a host_octets rule apart and is empty for the other kinds.
+type AlertEvent struct {
+	ID        int64     `json:"id"`
+	RuleID    int64     `json:"rule_id"`
+	RuleName  string    `json:"rule_name"`
+	Subject   string    `json:"subject"`
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AlertEventFilter selects alert history; zero fields match everything
+type AlertEventFilter struct {
+	RuleID int64
+	Start  time.Time
+	End    time.Time
+	Limit  int
+}
+
+// normalizeAlertRule validates a rule and fills in the defaults
+func normalizeAlertRule(rule *AlertRule) error {
+	if rule.Name == "" {
+		return errors.New("name is required")
+	}
+	if rule.Threshold <= 0 {
+		return errors.New("threshold must be positive")
+	}
+	if rule.ClearThreshold == 0 {
+		rule.ClearThreshold = rule.Threshold * 0.9
+	}
+	if rule.ClearThreshold < 0 || rule.ClearThreshold > rule.Threshold {
+		return errors.New("clear_threshold must be between 0 and threshold")
+	}
+	if rule.For == 0 {
+		rule.For = 1
+	}
+	if rule.For < 0 {
+		return errors.New("for must be positive")
+	}
+	if rule.Window < 0 {
+		return errors.New("window must be positive")
+	}
+	if rule.Interface != "" {
+		if _, err := strconv.ParseUint(rule.Interface, 10, 32); err != nil {
+			return fmt.Errorf("invalid interface %q", rule.Interface)
+		}
+	}
+
+	switch rule.Kind {
+	case alertInterfaceUtilization:
+		if rule.Exporter == 0 || rule.Interface == "" {
+			return errors.New("exporter and interface are required")
+		}
+		if rule.Direction == "" {
+			rule.Direction = billingMax
+		}
+		if rule.Direction != billingIn && rule.Direction != billingOut && rule.Direction != billingMax {
+			return fmt.Errorf("invalid direction %q, use in, out or max", rule.Direction)
+		}
+		if rule.Window == 0 {
+			rule.Window = 5
+		}
+	case alertHostOctets:
+		if rule.Direction == "" {
+			rule.Direction = "src"
+		}
+		if rule.Direction != "src" && rule.Direction != "dst" {
+			return fmt.Errorf("invalid direction %q, use src or dst", rule.Direction)
+		}
+		if _, err := parseAddrFilter(rule.Host); err != nil {
+			return err
+		}
+	case alertProtocolShare:
+		if rule.Protocol < 0 || rule.Protocol > 255 {
+			return errors.New("protocol must be between 0 and 255")
+		}
+		if rule.Threshold > 100 {
+			return errors.New("threshold must be a percentage")
+		}
+	default:
+		return fmt.Errorf("unsupported kind %q", rule.Kind)
+	}
+	// flows_hourly has one row per hour
+	if rule.Kind != alertInterfaceUtilization && rule.Window < 60 {
+		rule.Window = 60
+	}
+	return nil
+}
+
+type alertKey struct {
+	rule    int64
+	subject string
+}
+
+type alertState struct {
+	firing bool
+	over   int
+	// The rule as last evaluated, to resolve its alerts once it is gone
+	rule AlertRule
+}
+
+// AlertEngine evaluates the enabled rules and records their events
+type AlertEngine struct {
+	mu     sync.Mutex
+	states map[alertKey]*alertState
+}
+
+var alertEngine *AlertEngine
+
+// NewAlertEngine restores the alerts left firing by a previous run
+func NewAlertEngine() (*AlertEngine, error) {
+	engine := &AlertEngine{states: make(map[alertKey]*alertState)}
+	active, err := config.Alerts.ActiveAlerts()
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range active {
+		rule := AlertRule{ID: event.RuleID, Name: event.RuleName, Threshold: event.Threshold}
+		engine.states[alertKey{event.RuleID, event.Subject}] = &alertState{firing: true, rule: rule}
+	}
+	return engine, nil
+}
+
+// Run evaluates the rules every interval, starting immediately
+func (e *AlertEngine) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e.Evaluate(time.Now())
+		<-ticker.C
+	}
+}
+
+// Evaluate checks every enabled rule once
+func (e *AlertEngine) Evaluate(now time.Time) {
+	rules, err := config.Alerts.AlertRules()
+	if err != nil {
+		log.Printf("Alerts: loading rules: %v", err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	active := make(map[int64]bool)
+	disabled := make(map[int64]bool)
+	for _, rule := range rules {
+		if !rule.Enabled {
+			disabled[rule.ID] = true
+			continue
+		}
+		active[rule.ID] = true
+		values, err := evaluateAlertRule(rule, now)
+		if err != nil {
+			log.Printf("Alerts: rule %d (%s): %v", rule.ID, rule.Name, err)
+			continue
+		}
+		// Subjects seen earlier but gone from the values are at zero
+		for key := range e.states {
+			if _, ok := values[key.subject]; key.rule == rule.ID && !ok {
+				values[key.subject] = 0
+			}
+		}
+		for subject, value := range values {
+			e.update(rule, subject, value, now)
+		}
+	}
+	// Resolve the alerts of the rules deleted or disabled since the last
+	// run, so they do not stay firing in the history
+	for key, state := range e.states {
+		if active[key.rule] {
+			continue
+		}
+		if state.firing {
+			reason := "rule deleted"
+			if disabled[key.rule] {
+				reason = "rule disabled"
+			}
+			e.record(state.rule, key.subject, alertResolved, 0,
+				fmt.Sprintf("[%s] %s: %s", alertResolved, state.rule.Name, reason), now)
+		}
+		delete(e.states, key)
+	}
+}
+
+// update applies one value to the state of a rule and subject
+func (e *AlertEngine) update(rule AlertRule, subject string, value float64, now time.Time) {
+	key := alertKey{rule.ID, subject}
+	state, ok := e.states[key]
+	if !ok {
+		state = &alertState{}
+		e.states[key] = state
+	}
+	state.rule = rule
+
+	var event string
+	if state.firing {
+		if value < rule.ClearThreshold {
+			state.firing = false
+			event = alertResolved
+		}
+	} else if value >= rule.Threshold {
+		state.over++
+		if state.over >= rule.For {
+			state.firing = true
+			event = alertFiring
+		}
+	} else {
+		state.over = 0
+	}
+	if !state.firing && state.over == 0 {
+		delete(e.states, key)
+	}
+	if event == "" {
+		return
+	}
+	state.over = 0
+	e.record(rule, subject, event, value, alertMessage(rule, subject, value, event), now)
+}
+
+// record stores an event of a rule and sends its notification
+func (e *AlertEngine) record(rule AlertRule, subject string, event string, value float64, message string, now time.Time) {
+	alert := AlertEvent{
+		RuleID:    rule.ID,
+		RuleName:  rule.Name,
+		Subject:   subject,
+		State:     event,
+		Value:     value,
+		Threshold: rule.Threshold,
+		Message:   message,
+		CreatedAt: now,
+	}
+	if err := config.Alerts.InsertAlertEvent(alert); err != nil {
+		log.Printf("Alerts: recording event: %v", err)
+	}
+	log.Printf("Alerts: %s", alert.Message)
+	notifier.Notify(alertNotifyEvent(alert))
+}
+
+func alertMessage(rule AlertRule, subject string, value float64, event string) string {
+	var what string
+	switch rule.Kind {
+	case alertInterfaceUtilization:
+		what = fmt.Sprintf("interface %d/%s %s utilization %.1f%%", rule.Exporter, rule.Interface, rule.Direction, value)
+	case alertHostOctets:
+		verb := "sent"
+		if rule.Direction == "dst" {
+			verb = "received"
+		}
+		what = fmt.Sprintf("host %s %s %.0f bytes in %d minutes", subject, verb, value, rule.Window)
+	case alertProtocolShare:
+		what = fmt.Sprintf("protocol %d share %.1f%%", rule.Protocol, value)
+	}
+	if event == alertFiring {
+		return fmt.Sprintf("[%s] %s: %s, threshold %g", event, rule.Name, what, rule.Threshold)
+	}
+	return fmt.Sprintf("[%s] %s: %s, cleared below %g", event, rule.Name, what, rule.ClearThreshold)
+}
+
+// evaluateAlertRule returns the current value of a rule for each subject
+func evaluateAlertRule(rule AlertRule, now time.Time) (map[string]float64, error) {
+	start := now.Add(-time.Duration(rule.Window) * time.Minute)
+	exporter := strconv.FormatUint(rule.Exporter, 10)
+
+	switch rule.Kind {
+	case alertInterfaceUtilization:
+		iface, _ := findInterface(exporter, rule.Interface)
+		capacity := iface.Bandwidth
+		if capacity <= 0 {
+			capacity = iface.Speed
+		}
+		if capacity <= 0 {
+			return nil, errors.New("interface has no bandwidth or speed")
+		}
+		rates, err := interfaceRates(exporter, rule.Interface, start, now)
+		if err != nil {
+			return nil, err
+		}
+		if len(rates) == 0 {
+			return map[string]float64{}, nil
+		}
+		var bitsIn, bitsOut, seconds float64
+		for _, rate := range rates {
+			bitsIn += rate.BitsIn * rate.Interval
+			bitsOut += rate.BitsOut * rate.Interval
+			seconds += rate.Interval
+		}
+		in := bitsIn / seconds / float64(capacity) * 100
+		out := bitsOut / seconds / float64(capacity) * 100
+		switch rule.Direction {
+		case billingIn:
+			return map[string]float64{"": in}, nil
+		case billingOut:
+			return map[string]float64{"": out}, nil
+		}
+		return map[string]float64{"": max(in, out)}, nil
+
+	case alertHostOctets, alertProtocolShare:
+		filter, err := alertFlowFilter(rule, start, now)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Kind == alertProtocolShare {
+			stats, err := config.Flows.ProtocolStats(filter)
+			if err != nil {
+				return nil, err
+			}
+			var total, matched int64
+			for _, stat := range stats {
+				total += stat.TotalOctets
+				if stat.Protocol == rule.Protocol {
+					matched += stat.TotalOctets
+				}
+			}
+			if total == 0 {
+				return map[string]float64{"": 0}, nil
+			}
+			return map[string]float64{"": float64(matched) / float64(total) * 100}, nil
+		}
+
+		addressType := "srcaddr"
+		if rule.Direction == "dst" {
+			addressType = "dstaddr"
+		}
+		// Hosts under the clear threshold can neither fire nor stay firing
+		filter.MinOctets = int64(rule.ClearThreshold)
+		records, err := config.Flows.AggregateTraffic(filter, "address", addressType)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]float64)
+		for _, record := range records {
+			values[record.Address] = float64(record.TotalOctets)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported kind %q", rule.Kind)
+}
+
+// alertFlowFilter builds the flows_hourly filter of a flow rule
+func alertFlowFilter(rule AlertRule, start time.Time, end time.Time) (TrafficFilter, error) {
+	filter := TrafficFilter{
+		StartTime:    start.Truncate(time.Hour),
+		EndTime:      end,
+		Limit:        1000,
+		OrderBy:      "total_octets",
+		OrderDir:     "DESC",
+		SamplingRate: 1,
+	}
+	if rule.Exporter != 0 {
+		addr, err := exporterAddress(rule.Exporter)
+		if err != nil {
+			return filter, err
+		}
+		filter.Exporter = addr
+		filter.SamplingRate = getSamplingRate(addr, rule.Interface)
+		if rule.Interface != "" {
+			filter.Interface = rule.Interface
+			filter.Direction = "input"
+		}
+	} else {
+		filter.ExporterRates = exporterSamplingRates()
+	}
+	if rule.Kind == alertHostOctets && rule.Host != "" {
+		hosts, err := parseAddrFilter(rule.Host)
+		if err != nil {
+			return filter, err
+		}
+		if rule.Direction == "dst" {
+			filter.DstAddr = hosts
+		} else {
+			filter.SrcAddr = hosts
+		}
+	}
+	return filter, nil
+}
+
+// exporterAddress returns the address of the exporter with the given ID
+func exporterAddress(id uint64) (string, error) {
+	exporters, err := config.Metrics.ExporterConfigs()
+	if err != nil {
+		return "", err
+	}
+	for _, exporter := range exporters {
+		if exporter.ID == id {
+			return exporter.IPInet, nil
+		}
+	}
+	return "", fmt.Errorf("exporter %d not found", id)
+}
+
+// alertRulesRequest handles GET (list) and POST (create) on /api/v1/alerts/rules
+func alertRulesRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rules, err := config.Alerts.AlertRules()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying alert rules: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if rules == nil {
+			rules = []AlertRule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+
+	case http.MethodPost:
+		rule := AlertRule{Enabled: true}
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := normalizeAlertRule(&rule); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid rule: %v", err), http.StatusBadRequest)
+			return
+		}
+		rule, err := config.Alerts.CreateAlertRule(rule)
+		if err != nil {
+			log.Printf("Error creating alert rule: %v", err)
+			http.Error(w, fmt.Sprintf("Error creating alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// alertRuleRequest handles GET, PUT and DELETE on /api/v1/alerts/rules/{id}
+func alertRuleRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid rule id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rules, err := config.Alerts.AlertRules()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying alert rules: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, rule := range rules {
+			if rule.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(rule)
+				return
+			}
+		}
+		http.Error(w, "Rule not found", http.StatusNotFound)
+
+	case http.MethodPut, http.MethodPost:
+		var rule AlertRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		rule.ID = id
+		if err := normalizeAlertRule(&rule); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid rule: %v", err), http.StatusBadRequest)
+			return
+		}
+		found, err := config.Alerts.UpdateAlertRule(rule)
+		if err != nil {
+			log.Printf("Error updating alert rule: %v", err)
+			http.Error(w, fmt.Sprintf("Error updating alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule)
+
+	case http.MethodDelete:
+		found, err := config.Alerts.DeleteAlertRule(id)
+		if err != nil {
+			log.Printf("Error deleting alert rule: %v", err)
+			http.Error(w, fmt.Sprintf("Error deleting alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getAlertHistoryRequest returns alert events, newest first, optionally
+// limited to a rule and a start/end range
+func getAlertHistoryRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := AlertEventFilter{Limit: 100}
+	var err error
+	if s := query.Get("rule"); s != "" {
+		if filter.RuleID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "Invalid rule id", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("start"); s != "" {
+		if filter.Start, err = parseRequestTime(s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid start: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("end"); s != "" {
+		if filter.End, err = parseRequestTime(s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid end: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > 10000 {
+			http.Error(w, "limit must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := config.Alerts.AlertEvents(filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying alert history: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []AlertEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// getActiveAlertsRequest returns the alerts currently firing
+func getActiveAlertsRequest(w http.ResponseWriter, r *http.Request) {
+	events, err := config.Alerts.ActiveAlerts()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying active alerts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []AlertEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
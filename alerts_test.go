@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// lastAlertEvent returns the newest event of a rule
+func lastAlertEvent(t *testing.T, ruleID int64) AlertEvent {
+	t.Helper()
+	events, err := config.Alerts.AlertEvents(AlertEventFilter{RuleID: ruleID, Limit: 1})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("events of rule %d = %+v, %v", ruleID, events, err)
+	}
+	return events[0]
+}
+
+func TestAlertEngineRemovedRules(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	hosts, _ := store.CreateAlertRule(AlertRule{Name: "heavy sender", Kind: alertHostOctets, Enabled: true, Exporter: 1,
+		Direction: "src", Threshold: 1000, ClearThreshold: 900, Window: 60, For: 1})
+	tcp, _ := store.CreateAlertRule(AlertRule{Name: "tcp share", Kind: alertProtocolShare, Enabled: true, Exporter: 1,
+		Protocol: 6, Threshold: 50, ClearThreshold: 45, Window: 60, For: 1})
+	engine, err := NewAlertEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := testHour.Add(30 * time.Minute)
+	engine.Evaluate(now)
+	active, _ := store.ActiveAlerts()
+	if len(active) != 2 {
+		t.Fatalf("active alerts = %+v", active)
+	}
+	if event := lastAlertEvent(t, hosts.ID); event.State != alertFiring || event.Subject != "10.0.0.1" {
+		t.Errorf("host event = %+v", event)
+	}
+
+	// Disabling a rule resolves its alert, so enabling it again does not
+	// bring back an alert nobody evaluated
+	hosts.Enabled = false
+	store.UpdateAlertRule(hosts)
+	store.DeleteAlertRule(tcp.ID)
+	now = now.Add(time.Minute)
+	engine.Evaluate(now)
+	event := lastAlertEvent(t, hosts.ID)
+	if event.State != alertResolved || event.Subject != "10.0.0.1" || event.RuleName != "heavy sender" ||
+		event.Message != "[resolved] heavy sender: rule disabled" || !event.CreatedAt.Equal(now) {
+		t.Errorf("event of disabled rule = %+v", event)
+	}
+	if event := lastAlertEvent(t, tcp.ID); event.State != alertResolved || event.Message != "[resolved] tcp share: rule deleted" {
+		t.Errorf("event of deleted rule = %+v", event)
+	}
+	hosts.Enabled = true
+	store.UpdateAlertRule(hosts)
+	if active, _ := store.ActiveAlerts(); len(active) != 0 {
+		t.Errorf("active alerts after enabling the rule again = %+v", active)
+	}
+
+	// Resolved once: later runs write nothing more
+	engine.Evaluate(now.Add(time.Minute))
+	events, _ := store.AlertEvents(AlertEventFilter{RuleID: tcp.ID})
+	if len(events) != 2 {
+		t.Errorf("events of deleted rule = %+v", events)
+	}
+}
+
+func TestAlertEngineRestoredState(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	rule, _ := store.CreateAlertRule(AlertRule{Name: "tcp share", Kind: alertProtocolShare, Enabled: true, Exporter: 1,
+		Protocol: 6, Threshold: 50, ClearThreshold: 45, Window: 60, For: 1})
+	store.InsertAlertEvent(AlertEvent{RuleID: rule.ID, RuleName: rule.Name, State: alertFiring, Value: 80, Threshold: 50, CreatedAt: testHour})
+
+	// An alert left firing by the previous run is resolved when its rule
+	// is disabled before the first evaluation
+	engine, err := NewAlertEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule.Enabled = false
+	store.UpdateAlertRule(rule)
+	engine.Evaluate(testHour.Add(time.Hour))
+	if event := lastAlertEvent(t, rule.ID); event.State != alertResolved || event.Threshold != 50 {
+		t.Errorf("event = %+v", event)
+	}
+}
+
+func TestAlertEngineExporterRates(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	store.exporters[0].Data = map[string]interface{}{samplingRateKey: float64(10)}
+	store.exporters[1].Data = map[string]interface{}{samplingRateKey: float64(2)}
+	// Unscaled, neither 4000 bytes of 10.0.0.1 nor 9999 of 10.9.9.9 reach
+	// the threshold
+	rule, _ := store.CreateAlertRule(AlertRule{Name: "heavy sender", Kind: alertHostOctets, Enabled: true,
+		Direction: "src", Threshold: 15000, ClearThreshold: 15000, Window: 60, For: 1})
+	engine, err := NewAlertEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Evaluate(testHour.Add(30 * time.Minute))
+	events, _ := store.AlertEvents(AlertEventFilter{RuleID: rule.ID})
+	values := make(map[string]float64)
+	for _, event := range events {
+		values[event.Subject] = event.Value
+	}
+	if len(events) != 2 || values["10.0.0.1"] != 40000 || values["10.9.9.9"] != 19998 {
+		t.Errorf("events over all exporters = %+v", events)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maskedSecret replaces SNMP secrets in audit entries, and changedSecret
+// those an update changed
+const (
+	maskedSecret  = "********"
+	changedSecret = "(changed)"
+)
+
+// AuditEntry records one change to the exporter or interface configuration.
+// Before and After hold the affected configuration as JSON, with the SNMP
+// secrets masked.
+type AuditEntry struct {
+	ID           int64           `json:"id"`
+	CreatedAt    time.Time       `json:"created_at"`
+	Actor        string          `json:"actor"`
+	AuthMethod   string          `json:"auth_method"`
+	RemoteAddr   string          `json:"remote_addr"`
+	ForwardedFor string          `json:"forwarded_for,omitempty"`
+	Endpoint     string          `json:"endpoint"`
+	Target       string          `json:"target"`
+	Before       json.RawMessage `json:"before"`
+	After        json.RawMessage `json:"after"`
+}
+
+// AuditFilter selects audit entries; zero fields match everything
+type AuditFilter struct {
+	Actor    string
+	Endpoint string
+	Target   string
+	Start    time.Time
+	End      time.Time
+	Limit    int
+}
+
+// AuditExportRow is an AuditEntry with the JSON documents as text columns
+type AuditExportRow struct {
+	ID           int64     `json:"id" parquet:"id"`
+	CreatedAt    time.Time `json:"created_at" parquet:"created_at"`
+	Actor        string    `json:"actor" parquet:"actor"`
+	AuthMethod   string    `json:"auth_method" parquet:"auth_method"`
+	RemoteAddr   string    `json:"remote_addr" parquet:"remote_addr"`
+	ForwardedFor string    `json:"forwarded_for" parquet:"forwarded_for"`
+	Endpoint     string    `json:"endpoint" parquet:"endpoint"`
+	Target       string    `json:"target" parquet:"target"`
+	Before       string    `json:"before" parquet:"before"`
+	After        string    `json:"after" parquet:"after"`
+}
+
+// exporterSecretFields returns the SNMP community and passwords of an
+// exporter, in the order of MetricsStore.ExporterSecrets
+func exporterSecretFields(exporter *ExporterConfig) []*string {
+	return []*string{&exporter.SnmpCommunity, &exporter.Snmpv3AuthPass, &exporter.Snmpv3PrivPass}
+}
+
+// maskExporterSecrets hides the SNMP community and passwords of an exporter,
+// keeping whether they are set
+func maskExporterSecrets(exporter ExporterConfig) ExporterConfig {
+	set := []bool{exporter.SnmpCommunitySet, exporter.Snmpv3AuthPassSet, exporter.Snmpv3PrivPassSet}
+	for i, secret := range exporterSecretFields(&exporter) {
+		if *secret != "" || set[i] {
+			*secret = maskedSecret
+		}
+	}
+	return exporter
+}
+
+// markChangedSecrets shows the secrets of an exporter whose stored values
+// differ between before and after an update as changedSecret. The values
+// are compared as stored, sealed, so they never reach the audit log.
+func markChangedSecrets(exporter *ExporterConfig, before []string, after []string) {
+	for i, secret := range exporterSecretFields(exporter) {
+		if i < len(before) && i < len(after) && before[i] != after[i] {
+			*secret = changedSecret
+		}
+	}
+}
+
+// recordAudit stores a configuration change made by the request. Failures
+// are logged; the change itself has already been applied.
+func recordAudit(r *http.Request, target string, before interface{}, after interface{}) {
+	entry := AuditEntry{
+		CreatedAt:    time.Now(),
+		Actor:        "anonymous",
+		AuthMethod:   "none",
+		RemoteAddr:   r.RemoteAddr,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Endpoint:     r.Method + " " + r.URL.Path,
+		Target:       target,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.RemoteAddr = host
+	}
+	if principal := principalFrom(r.Context()); principal != nil {
+		entry.Actor = principal.Name
+		entry.AuthMethod = principal.Method
+		if principal.Token != "" {
+			entry.AuthMethod += " " + principal.Token
+		}
+	}
+	var err error
+	if entry.Before, err = json.Marshal(before); err != nil {
+		log.Printf("Error recording audit entry for %s: %v", target, err)
+		return
+	}
+	if entry.After, err = json.Marshal(after); err != nil {
+		log.Printf("Error recording audit entry for %s: %v", target, err)
+		return
+	}
+	if err := config.Audit.InsertAuditEntry(entry); err != nil {
+		log.Printf("Error recording audit entry for %s: %v", target, err)
+	}
+}
+
+// findExporterConfig returns the exporter with the given ID, or nil
+func findExporterConfig(id uint64) (*ExporterConfig, error) {
+	exporters, err := config.Metrics.ExporterConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for i := range exporters {
+		if exporters[i].ID == id {
+			return &exporters[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// findInterfaceConfig returns the interface with the given ID, or nil
+func findInterfaceConfig(id uint64) (*InterfaceConfig, error) {
+	interfaces, err := config.Metrics.InterfaceConfigs("")
+	if err != nil {
+		return nil, err
+	}
+	for i := range interfaces {
+		if interfaces[i].ID == id {
+			return &interfaces[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// getAuditRequest returns audit entries, newest first, filtered by actor,
+// endpoint, target and a start/end range. format=csv (or ndjson, parquet)
+// downloads them.
+func getAuditRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := AuditFilter{
+		Actor:    query.Get("actor"),
+		Endpoint: query.Get("endpoint"),
+		Target:   query.Get("target"),
+		Limit:    100,
+	}
+	if s := query.Get("start"); s != "" {
+		if filter.Start, err = parseRequestTime(s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid start: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("end"); s != "" {
+		if filter.End, err = parseRequestTime(s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid end: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > 10000 {
+			http.Error(w, "limit must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := config.Audit.AuditEntries(filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	if format != exportJSON {
+		rows := make([]AuditExportRow, len(entries))
+		for i, entry := range entries {
+			rows[i] = AuditExportRow{
+				ID:           entry.ID,
+				CreatedAt:    entry.CreatedAt,
+				Actor:        entry.Actor,
+				AuthMethod:   entry.AuthMethod,
+				RemoteAddr:   entry.RemoteAddr,
+				ForwardedFor: entry.ForwardedFor,
+				Endpoint:     entry.Endpoint,
+				Target:       entry.Target,
+				Before:       string(entry.Before),
+				After:        string(entry.After),
+			}
+		}
+		if err := writeExport(w, r, format, "audit", rows); err != nil {
+			log.Printf("Error writing audit export: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,783 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles of users and API tokens: read may use every endpoint except the
+// configuration ones, admin may use all of them
+const (
+	roleRead  = "read"
+	roleAdmin = "admin"
+)
+
+// Authentication methods recorded in a Principal
+const (
+	authSession = "session"
+	authToken   = "token"
+	authOIDC    = "oidc"
+)
+
+const (
+	sessionCookie = "cnetflow_session"
+	sessionTTL    = 12 * time.Hour
+	// API tokens start with this prefix so they are easy to spot in scripts
+	tokenPrefix       = "cnf_"
+	minPasswordLength = 8
+	// last_used_at of a token is written at most this often
+	tokenTouchInterval = time.Minute
+)
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// User is a local user. PasswordHash is never sent to clients.
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+	// Name of the Scope limiting the exporters the user sees, empty for all
+	Scope        string    `json:"scope,omitempty"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// APIToken is a bearer token for scripts. Only the SHA-256 of the token is
+// stored; Token is set once, in the response that creates it.
+type APIToken struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	Owner     string     `json:"owner"`
+	Scope     string     `json:"scope,omitempty"`
+	Hash      string     `json:"-"`
+	Token     string     `json:"token,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LastUsed  *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Method string `json:"method"`
+	Scope  string `json:"scope,omitempty"`
+	// Name of the API token for token requests
+	Token string `json:"token,omitempty"`
+}
+
+// IsAdmin reports whether the principal may change the configuration
+func (p *Principal) IsAdmin() bool {
+	return p != nil && p.Role == roleAdmin
+}
+
+type principalKey struct{}
+
+// principalFrom returns the caller stored by the auth middleware, nil when
+// authentication is disabled
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Authenticator identifies the caller of a request. It returns nil without
+// an error when the request carries no credentials of its kind, and
+// errInvalidCredentials when it carries bad ones.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// hashSecret returns the hex SHA-256 under which session IDs and API tokens
+// are kept. They are random, so no salt or stretching is needed.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomSecret returns n random bytes encoded for URLs and cookies
+func randomSecret(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func validRole(role string) bool {
+	return role == roleRead || role == roleAdmin
+}
+
+type session struct {
+	principal Principal
+	expires   time.Time
+}
+
+// SessionStore keeps the UI sessions in memory, so a restart logs everybody
+// out. Sessions are keyed by the hash of their cookie value.
+type SessionStore struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{ttl: ttl, sessions: make(map[string]*session)}
+}
+
+// Create starts a session and returns the cookie value
+func (s *SessionStore) Create(p Principal) string {
+	id := randomSecret(32)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[hashSecret(id)] = &session{principal: p, expires: now.Add(s.ttl)}
+	return id
+}
+
+// Lookup returns the principal of a live session
+func (s *SessionStore) Lookup(id string) *Principal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[hashSecret(id)]
+	if !ok || time.Now().After(sess.expires) {
+		return nil
+	}
+	p := sess.principal
+	return &p
+}
+
+func (s *SessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, hashSecret(id))
+}
+
+// DeleteUser ends the sessions of a local user, after it was changed or
+// removed. Single sign-on users of the same name are not affected.
+func (s *SessionStore) DeleteUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, sess := range s.sessions {
+		if sess.principal.Name == username && sess.principal.Method == authSession {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+var sessions = NewSessionStore(sessionTTL)
+
+// sessionAuthenticator accepts the session cookie set by the login endpoint
+type sessionAuthenticator struct {
+	sessions *SessionStore
+}
+
+func (a sessionAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	// An expired session is not an error: the UI is sent to the login page
+	return a.sessions.Lookup(cookie.Value), nil
+}
+
+// tokenAuthenticator accepts "Authorization: Bearer cnf_..." API tokens
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+	token, err := config.Auth.APITokenByHash(hashSecret(strings.TrimSpace(raw)))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if token == nil || (token.ExpiresAt != nil && now.After(*token.ExpiresAt)) {
+		return nil, errInvalidCredentials
+	}
+	// A token works only while its local owner does, and with no more than
+	// the owner's role. Single sign-on owners have no user to check.
+	if token.Owner != "" && !strings.HasPrefix(token.Owner, authOIDC+":") {
+		owner, err := config.Auth.UserByName(token.Owner)
+		if err != nil {
+			return nil, err
+		}
+		if owner == nil || owner.Disabled {
+			return nil, errInvalidCredentials
+		}
+		if owner.Role != roleAdmin {
+			token.Role = roleRead
+		}
+	}
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) > tokenTouchInterval {
+		if err := config.Auth.TouchAPIToken(token.ID, now); err != nil {
+			log.Printf("Error updating API token %d: %v", token.ID, err)
+		}
+	}
+	return &Principal{Name: token.Owner, Role: token.Role, Method: authToken, Scope: token.Scope, Token: token.Name}, nil
+}
+
+// AuthMiddleware authenticates every request before passing it to next.
+// Unauthenticated API calls get 401, UI pages redirect to the login page.
+type AuthMiddleware struct {
+	next           http.Handler
+	authenticators []Authenticator
+}
+
+func NewAuthMiddleware(next http.Handler, authenticators ...Authenticator) *AuthMiddleware {
+	return &AuthMiddleware{next: next, authenticators: authenticators}
+}
+
+func (m *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if publicPath(r.URL.Path) {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	var principal *Principal
+	for _, authenticator := range m.authenticators {
+		p, err := authenticator.Authenticate(r)
+		if errors.Is(err, errInvalidCredentials) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Error authenticating request: %v", err)
+			http.Error(w, fmt.Sprintf("Error authenticating request: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if p != nil {
+			principal = p
+			break
+		}
+	}
+	if principal == nil {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, "/login.html?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	if requiresAdmin(r) && !principal.IsAdmin() {
+		http.Error(w, "Admin role required", http.StatusForbidden)
+		return
+	}
+	ctx := context.WithValue(r.Context(), principalKey{}, principal)
+	if principal.Scope != "" {
+		if !scopedPath(r.URL.Path) {
+			http.Error(w, "Not available to scoped users", http.StatusForbidden)
+			return
+		}
+		scope, err := resolveScope(principal.Scope)
+		if err != nil {
+			log.Printf("Error resolving scope %q: %v", principal.Scope, err)
+			http.Error(w, fmt.Sprintf("Error resolving scope: %v", err), http.StatusInternalServerError)
+			return
+		}
+		ctx = context.WithValue(ctx, scopeKey{}, scope)
+	}
+	m.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// publicPath reports whether a path is served without authentication: the
+// login page, its assets and the login endpoints themselves
+func publicPath(path string) bool {
+	switch path {
+	case "/login.html", "/favicon.ico", "/api/v1/auth/login", "/api/v1/auth/providers",
+		"/api/v1/auth/oidc/login", "/api/v1/auth/oidc/callback":
+		return true
+	}
+	return strings.HasPrefix(path, "/js/") || strings.HasPrefix(path, "/img/")
+}
+
+// requiresAdmin reports whether a request needs the admin role. The UI
+// renders charts with POSTs, so read-only callers are not limited to GET;
+// instead the endpoints that change state are listed here.
+func requiresAdmin(r *http.Request) bool {
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/api/v1/config/") || path == "/api/v1/audit" ||
+		strings.HasPrefix(path, "/api/v1/auth/users") ||
+		strings.HasPrefix(path, "/api/v1/auth/tokens") ||
+		strings.HasPrefix(path, "/api/v1/auth/scopes") {
+		return true
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return false
+	}
+	return strings.HasPrefix(path, "/api/v1/alerts/rules") || path == "/api/v1/notify/test"
+}
+
+// bootstrapAdmin creates an admin user when there are no users yet, so a new
+// installation can be logged into. Without a password one is generated and
+// logged once.
+func bootstrapAdmin(password string) error {
+	users, err := config.Auth.Users()
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return nil
+	}
+	generated := password == ""
+	if generated {
+		password = randomSecret(12)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("CNETFLOW_ADMIN_PASSWORD: %w", err)
+	}
+	if _, err := config.Auth.CreateUser(User{Username: "admin", Role: roleAdmin, PasswordHash: hash}); err != nil {
+		return err
+	}
+	if generated {
+		log.Printf("Created user admin with password %s, change it after logging in", password)
+	} else {
+		log.Printf("Created user admin")
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// dummyHash is compared against when the user does not exist, so unknown
+// and known usernames take the same time to reject
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("cnetflow-dummy-password"), bcrypt.DefaultCost)
+
+// checkPassword returns the user if the username and password match an
+// enabled user
+func checkPassword(username string, password string) (*User, error) {
+	user, err := config.Auth.UserByName(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil || user.Disabled {
+		return nil, errInvalidCredentials
+	}
+	return user, nil
+}
+
+// safeRedirect returns next if it is a local path, "/" otherwise
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// secureRequest reports whether the client reached us over HTTPS, directly
+// or through a proxy
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// setSessionCookie starts a session for the principal
+func setSessionCookie(w http.ResponseWriter, r *http.Request, principal Principal) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sessions.Create(principal),
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginRequest handles POST /api/v1/auth/login with a JSON body or the form
+// of login.html. It sets the session cookie; forms are redirected to next.
+func loginRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	form := !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if form {
+		req.Username = r.PostFormValue("username")
+		req.Password = r.PostFormValue("password")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	user, err := checkPassword(req.Username, req.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		log.Printf("Failed login for %q from %s", req.Username, r.RemoteAddr)
+		if form {
+			http.Redirect(w, r, "/login.html?error=1&next="+url.QueryEscape(r.PostFormValue("next")), http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		http.Error(w, fmt.Sprintf("Error checking password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	principal := Principal{Name: user.Username, Role: user.Role, Method: authSession, Scope: user.Scope}
+	setSessionCookie(w, r, principal)
+	if form {
+		http.Redirect(w, r, safeRedirect(r.PostFormValue("next")), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(principal)
+}
+
+// logoutRequest handles POST /api/v1/auth/logout, ending the session
+func logoutRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		sessions.Delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Redirect(w, r, "/login.html", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAuthMeRequest returns the caller of /api/v1/auth/me
+func getAuthMeRequest(w http.ResponseWriter, r *http.Request) {
+	principal := principalFrom(r.Context())
+	if principal == nil {
+		// Authentication is disabled: everybody is admin
+		principal = &Principal{Name: "anonymous", Role: roleAdmin}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(principal)
+}
+
+// userRequest is the body of the user endpoints. Password is only changed
+// when set; Disabled and Scope only when present.
+type userRequest struct {
+	Username string  `json:"username"`
+	Password string  `json:"password"`
+	Role     string  `json:"role"`
+	Disabled *bool   `json:"disabled"`
+	Scope    *string `json:"scope"`
+}
+
+// lastAdmin reports whether the user with id is the only enabled admin
+func lastAdmin(users []User, id int64) bool {
+	for _, user := range users {
+		if user.ID != id && user.Role == roleAdmin && !user.Disabled {
+			return false
+		}
+	}
+	return true
+}
+
+// authUsersRequest handles GET (list) and POST (create) on /api/v1/auth/users
+func authUsersRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		users, err := config.Auth.Users()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying users: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if users == nil {
+			users = []User{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+
+	case http.MethodPost:
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		req.Username = strings.TrimSpace(req.Username)
+		if req.Username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = roleRead
+		}
+		if !validRole(req.Role) {
+			http.Error(w, fmt.Sprintf("unsupported role %q, use read or admin", req.Role), http.StatusBadRequest)
+			return
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid password: %v", err), http.StatusBadRequest)
+			return
+		}
+		existing, err := config.Auth.UserByName(req.Username)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying users: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			http.Error(w, fmt.Sprintf("user %q already exists", req.Username), http.StatusConflict)
+			return
+		}
+		user := User{Username: req.Username, Role: req.Role, PasswordHash: hash}
+		if req.Disabled != nil {
+			user.Disabled = *req.Disabled
+		}
+		if req.Scope != nil {
+			user.Scope = *req.Scope
+		}
+		if err := validateScopeName(user.Scope, user.Role); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid scope: %v", err), http.StatusBadRequest)
+			return
+		}
+		user, err = config.Auth.CreateUser(user)
+		if err != nil {
+			log.Printf("Error creating user: %v", err)
+			http.Error(w, fmt.Sprintf("Error creating user: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authUserRequest handles PUT and DELETE on /api/v1/auth/users/{id}. The
+// last enabled admin can be neither demoted, disabled nor deleted.
+func authUserRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+	users, err := config.Auth.Users()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying users: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var user *User
+	for i := range users {
+		if users[i].ID == id {
+			user = &users[i]
+		}
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		updated := *user
+		updated.PasswordHash = ""
+		if req.Role != "" {
+			if !validRole(req.Role) {
+				http.Error(w, fmt.Sprintf("unsupported role %q, use read or admin", req.Role), http.StatusBadRequest)
+				return
+			}
+			updated.Role = req.Role
+		}
+		if req.Disabled != nil {
+			updated.Disabled = *req.Disabled
+		}
+		if req.Scope != nil {
+			updated.Scope = *req.Scope
+		}
+		if err := validateScopeName(updated.Scope, updated.Role); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid scope: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Password != "" {
+			if updated.PasswordHash, err = hashPassword(req.Password); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid password: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if (updated.Role != roleAdmin || updated.Disabled) && user.Role == roleAdmin && !user.Disabled && lastAdmin(users, id) {
+			http.Error(w, "Cannot demote or disable the last admin", http.StatusConflict)
+			return
+		}
+		found, err := config.Auth.UpdateUser(updated)
+		if err != nil {
+			log.Printf("Error updating user: %v", err)
+			http.Error(w, fmt.Sprintf("Error updating user: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		sessions.DeleteUser(user.Username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated)
+
+	case http.MethodDelete:
+		if user.Role == roleAdmin && !user.Disabled && lastAdmin(users, id) {
+			http.Error(w, "Cannot delete the last admin", http.StatusConflict)
+			return
+		}
+		found, err := config.Auth.DeleteUser(id)
+		if err != nil {
+			log.Printf("Error deleting user: %v", err)
+			http.Error(w, fmt.Sprintf("Error deleting user: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		sessions.DeleteUser(user.Username)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authTokensRequest handles GET (list) and POST (create) on
+// /api/v1/auth/tokens. The created token is only returned by the POST.
+func authTokensRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := config.Auth.APITokens()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying API tokens: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if tokens == nil {
+			tokens = []APIToken{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+
+	case http.MethodPost:
+		var req struct {
+			Name  string `json:"name"`
+			Role  string `json:"role"`
+			Scope string `json:"scope"`
+			// Lifetime in days, 0 for a token that does not expire
+			ExpiresDays int `json:"expires_days"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = roleRead
+		}
+		if !validRole(req.Role) {
+			http.Error(w, fmt.Sprintf("unsupported role %q, use read or admin", req.Role), http.StatusBadRequest)
+			return
+		}
+		if err := validateScopeName(req.Scope, req.Role); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid scope: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresDays < 0 {
+			http.Error(w, "expires_days must not be negative", http.StatusBadRequest)
+			return
+		}
+		raw := tokenPrefix + randomSecret(32)
+		token := APIToken{Name: req.Name, Role: req.Role, Scope: req.Scope, Hash: hashSecret(raw)}
+		if principal := principalFrom(r.Context()); principal != nil {
+			token.Owner = principal.Name
+		}
+		if req.ExpiresDays > 0 {
+			expires := time.Now().AddDate(0, 0, req.ExpiresDays)
+			token.ExpiresAt = &expires
+		}
+		token, err := config.Auth.CreateAPIToken(token)
+		if err != nil {
+			log.Printf("Error creating API token: %v", err)
+			http.Error(w, fmt.Sprintf("Error creating API token: %v", err), http.StatusInternalServerError)
+			return
+		}
+		token.Token = raw
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(token)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authTokenRequest handles DELETE on /api/v1/auth/tokens/{id}
+func authTokenRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid token id", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	found, err := config.Auth.DeleteAPIToken(id)
+	if err != nil {
+		log.Printf("Error deleting API token: %v", err)
+		http.Error(w, fmt.Sprintf("Error deleting API token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// authTestHandler is the auth middleware in front of a handler answering
+// with the caller's name and role
+func authTestHandler() http.Handler {
+	return NewAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := principalFrom(r.Context()); p != nil {
+			fmt.Fprintf(w, "%s %s", p.Name, p.Role)
+		}
+	}), sessionAuthenticator{sessions}, tokenAuthenticator{})
+}
+
+// addTestToken stores a token of the owner and returns its bearer value
+func addTestToken(store *memoryStore, owner string, role string, expires *time.Time) string {
+	raw := tokenPrefix + owner + "-" + role + "-" + strconv.Itoa(len(store.tokens))
+	store.CreateAPIToken(APIToken{Name: raw, Role: role, Owner: owner, Hash: hashSecret(raw), ExpiresAt: expires})
+	return raw
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	store := useMemoryStore(t)
+	saved := sessions
+	sessions = NewSessionStore(sessionTTL)
+	t.Cleanup(func() { sessions = saved })
+	store.CreateUser(User{Username: "admin", Role: roleAdmin})
+	store.CreateUser(User{Username: "viewer", Role: roleRead})
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	adminToken := addTestToken(store, "admin", roleAdmin, nil)
+	readToken := addTestToken(store, "viewer", roleRead, &future)
+	expiredToken := addTestToken(store, "admin", roleAdmin, &past)
+	ssoToken := addTestToken(store, "oidc:carol", roleRead, nil)
+	viewerSession := sessions.Create(Principal{Name: "viewer", Role: roleRead, Method: authSession})
+	handler := authTestHandler()
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		session  string
+		code     int
+		body     string
+		location string
+	}{
+		{"API without credentials", "GET", "/api/v1/traffic", "", "", http.StatusUnauthorized, "", ""},
+		{"page without credentials", "GET", "/flows.html?exporter=1", "", "", http.StatusSeeOther, "", "/login.html?next=%2Fflows.html%3Fexporter%3D1"},
+		{"login page", "GET", "/login.html", "", "", http.StatusOK, "", ""},
+		{"login endpoint", "POST", "/api/v1/auth/login", "", "", http.StatusOK, "", ""},
+		{"login assets", "GET", "/js/login.js", "", "", http.StatusOK, "", ""},
+		{"unknown token", "GET", "/api/v1/traffic", "cnf_unknown", "", http.StatusUnauthorized, "", ""},
+		{"expired token", "GET", "/api/v1/traffic", expiredToken, "", http.StatusUnauthorized, "", ""},
+		{"expired session", "GET", "/api/v1/traffic", "", "gone", http.StatusUnauthorized, "", ""},
+		{"read token", "GET", "/api/v1/traffic", readToken, "", http.StatusOK, "viewer read", ""},
+		{"session", "GET", "/api/v1/traffic", "", viewerSession, http.StatusOK, "viewer read", ""},
+		{"single sign-on owner", "GET", "/api/v1/traffic", ssoToken, "", http.StatusOK, "oidc:carol read", ""},
+		{"read token on config", "GET", "/api/v1/config/exporters", readToken, "", http.StatusForbidden, "", ""},
+		{"read session on users", "GET", "/api/v1/auth/users", "", viewerSession, http.StatusForbidden, "", ""},
+		{"read token on audit", "GET", "/api/v1/audit", readToken, "", http.StatusForbidden, "", ""},
+		{"read token lists rules", "GET", "/api/v1/alerts/rules", readToken, "", http.StatusOK, "viewer read", ""},
+		{"read token changes rules", "POST", "/api/v1/alerts/rules", readToken, "", http.StatusForbidden, "", ""},
+		{"read token renders charts", "POST", "/api/v1/metrics/1/3", readToken, "", http.StatusOK, "viewer read", ""},
+		{"admin token on config", "PUT", "/api/v1/config/exporters/update", adminToken, "", http.StatusOK, "admin admin", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.session != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.session})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.code, w.Body)
+			continue
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s: principal %q, want %q", tt.name, w.Body, tt.body)
+		}
+		if location := w.Header().Get("Location"); location != tt.location {
+			t.Errorf("%s: location %q, want %q", tt.name, location, tt.location)
+		}
+		if tt.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tt.name)
+		}
+	}
+}
+
+func TestAuthTokenOwner(t *testing.T) {
+	store := useMemoryStore(t)
+	admin, _ := store.CreateUser(User{Username: "admin", Role: roleAdmin})
+	other, _ := store.CreateUser(User{Username: "other", Role: roleAdmin})
+	token := addTestToken(store, "other", roleAdmin, nil)
+	kept := addTestToken(store, "admin", roleAdmin, nil)
+	handler := authTestHandler()
+	get := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/config/exporters", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// A demoted owner's admin token is limited to reading
+	other.Role = roleRead
+	store.UpdateUser(other)
+	if w := get(token); w.Code != http.StatusForbidden {
+		t.Errorf("token of demoted owner on config: status %d, want 403", w.Code)
+	}
+
+	// Disabling the owner stops the token, enabling it again restores it
+	other.Role, other.Disabled = roleAdmin, true
+	store.UpdateUser(other)
+	if w := get(token); w.Code != http.StatusUnauthorized {
+		t.Errorf("token of disabled owner: status %d, want 401", w.Code)
+	}
+	other.Disabled = false
+	store.UpdateUser(other)
+	if w := get(token); w.Code != http.StatusOK {
+		t.Errorf("token of enabled owner: status %d, want 200", w.Code)
+	}
+
+	// Deleting the owner through the API deletes its tokens
+	w := serve(authUserRequest, httptest.NewRequest(http.MethodDelete, "/api/v1/auth/users/2", nil), "id", strconv.FormatInt(other.ID, 10))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete user: status %d: %s", w.Code, w.Body)
+	}
+	if w := get(token); w.Code != http.StatusUnauthorized {
+		t.Errorf("token of deleted owner: status %d, want 401", w.Code)
+	}
+	tokens, _ := store.APITokens()
+	if len(tokens) != 1 || tokens[0].Owner != admin.Username {
+		t.Errorf("tokens after deleting their owner = %+v", tokens)
+	}
+	if w := get(kept); w.Code != http.StatusOK {
+		t.Errorf("token of another user: status %d, want 200", w.Code)
+	}
+}
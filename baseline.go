@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	hoursPerWeek = 7 * 24
+	// Slots with fewer samples have no band yet
+	baselineMinSamples   = 3
+	defaultBaselineWeeks = 4
+	defaultBaselineSigma = 3
+	// The current rate is the average over this period before the newest
+	// rate of the last hour
+	baselineCurrentWindow = 5 * time.Minute
+)
+
+// baselineSlot accumulates the mean and variance of one hour-of-week with
+// Welford's algorithm
+type baselineSlot struct {
+	samples int64
+	mean    float64
+	m2      float64
+}
+
+func (s *baselineSlot) add(v float64) {
+	s.samples++
+	delta := v - s.mean
+	s.mean += delta / float64(s.samples)
+	s.m2 += delta * (v - s.mean)
+}
+
+// band returns the expected range at sigma standard deviations, or nil when
+// the slot has too few samples
+func (s baselineSlot) band(sigma float64) *BaselineBand {
+	if s.samples < baselineMinSamples {
+		return nil
+	}
+	stddev := math.Sqrt(s.m2 / float64(s.samples-1))
+	return &BaselineBand{
+		Expected: s.mean,
+		Lower:    max(s.mean-sigma*stddev, 0),
+		Upper:    s.mean + sigma*stddev,
+		StdDev:   stddev,
+		Samples:  s.samples,
+	}
+}
+
+// interfaceProfile holds the hour-of-week profiles of one interface: bits/s
+// in and out from the interface counters, and bytes per hour of each IP
+// protocol received (input) and sent (output) from flows_hourly
+type interfaceProfile struct {
+	in           [hoursPerWeek]baselineSlot
+	out          [hoursPerWeek]baselineSlot
+	protocolsIn  map[int]*[hoursPerWeek]baselineSlot
+	protocolsOut map[int]*[hoursPerWeek]baselineSlot
+	updated      time.Time
+}
+
+// BaselineBand is the expected range of a value
+type BaselineBand struct {
+	Expected float64 `json:"expected"`
+	Lower    float64 `json:"lower"`
+	Upper    float64 `json:"upper"`
+	StdDev   float64 `json:"stddev"`
+	Samples  int64   `json:"samples"`
+}
+
+// BaselineScore is a value with its band and z-score. The z-score is 0 when
+// the profile shows no variance.
+type BaselineScore struct {
+	Value  float64 `json:"value"`
+	ZScore float64 `json:"zscore"`
+	BaselineBand
+}
+
+// ProtocolBaselineScore scores the bytes of one protocol in the last
+// complete hour
+type ProtocolBaselineScore struct {
+	Protocol  int       `json:"protocol"`
+	Name      string    `json:"name"`
+	Direction string    `json:"direction"`
+	Timestamp time.Time `json:"timestamp"`
+	BaselineScore
+}
+
+// BaselineBandPoint is the band of one hour, for drawing on charts
+type BaselineBandPoint struct {
+	Timestamp time.Time     `json:"timestamp"`
+	In        *BaselineBand `json:"in,omitempty"`
+	Out       *BaselineBand `json:"out,omitempty"`
+}
+
+// BaselineResponse is the response of /api/v1/baseline/{exporter}/{interface}
+type BaselineResponse struct {
+	Exporter   string                  `json:"exporter"`
+	Interface  string                  `json:"interface"`
+	Updated    time.Time               `json:"updated"`
+	Weeks      int                     `json:"weeks"`
+	Sigma      float64                 `json:"sigma"`
+	HourOfWeek int                     `json:"hour_of_week"`
+	In         *BaselineScore          `json:"in,omitempty"`
+	Out        *BaselineScore          `json:"out,omitempty"`
+	Protocols  []ProtocolBaselineScore `json:"protocols"`
+	Bands      []BaselineBandPoint     `json:"bands,omitempty"`
+}
+
+// BaselineEngine relearns the profiles of every enabled interface from the
+// last weeks of data once per interval
+type BaselineEngine struct {
+	interval time.Duration
+	weeks    int
+
+	mu       sync.RWMutex
+	profiles map[string]*interfaceProfile
+}
+
+var baselineEngine *BaselineEngine
+
+// NewBaselineEngine parses the number of weeks learned, empty selecting the
+// default
+func NewBaselineEngine(interval time.Duration, weeks string) (*BaselineEngine, error) {
+	e := &BaselineEngine{
+		interval: interval,
+		weeks:    defaultBaselineWeeks,
+		profiles: make(map[string]*interfaceProfile),
+	}
+	if weeks != "" {
+		n, err := strconv.Atoi(weeks)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid CNETFLOW_BASELINE_WEEKS %q", weeks)
+		}
+		e.weeks = n
+	}
+	return e, nil
+}
+
+// hourOfWeek numbers the hours of the week from Sunday 00:00 in the
+// database time zone
+func hourOfWeek(t time.Time) int {
+	t = t.In(dbLocation)
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// Run learns the profiles now and then every interval
+func (e *BaselineEngine) Run() {
+	e.Update(time.Now())
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		e.Update(now)
+	}
+}
+
+// Update relearns the profiles from the data before now
+func (e *BaselineEngine) Update(now time.Time) {
+	exporters, err := config.Metrics.ExporterConfigs()
+	if err != nil {
+		log.Printf("Baseline: %v", err)
+		return
+	}
+	byID := make(map[int64]ExporterConfig)
+	for _, exporter := range exporters {
+		byID[int64(exporter.ID)] = exporter
+	}
+	interfaces, err := config.Metrics.InterfaceConfigs("")
+	if err != nil {
+		log.Printf("Baseline: %v", err)
+		return
+	}
+
+	start := now.AddDate(0, 0, -7*e.weeks)
+	profiles := make(map[string]*interfaceProfile)
+	for _, iface := range interfaces {
+		if !iface.Enabled {
+			continue
+		}
+		exporterID := strconv.FormatInt(iface.Exporter, 10)
+		index := strconv.FormatInt(iface.SnmpIndex, 10)
+		profile, err := learnInterfaceProfile(byID[iface.Exporter], exporterID, index, start, now)
+		if err != nil {
+			log.Printf("Baseline of %s/%s: %v", exporterID, index, err)
+			continue
+		}
+		profiles[exporterID+"/"+index] = profile
+	}
+
+	e.mu.Lock()
+	e.profiles = profiles
+	e.mu.Unlock()
+	log.Printf("Baseline: learned %d interfaces", len(profiles))
+}
+
+// learnInterfaceProfile builds the profile of one interface. Only complete
+// hours of flows are used.
+func learnInterfaceProfile(exporter ExporterConfig, exporterID string, index string, start time.Time, now time.Time) (*interfaceProfile, error) {
+	profile := &interfaceProfile{
+		protocolsIn:  make(map[int]*[hoursPerWeek]baselineSlot),
+		protocolsOut: make(map[int]*[hoursPerWeek]baselineSlot),
+		updated:      now,
+	}
+	rates, err := interfaceRates(exporterID, index, start, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, rate := range rates {
+		slot := hourOfWeek(rate.Timestamp)
+		profile.in[slot].add(rate.BitsIn)
+		profile.out[slot].add(rate.BitsOut)
+	}
+
+	if exporter.IPInet == "" {
+		return profile, nil
+	}
+	for _, direction := range []string{"input", "output"} {
+		protocols := profile.protocolsIn
+		if direction == "output" {
+			protocols = profile.protocolsOut
+		}
+		series, err := config.Flows.ProtocolTimeSeries(TrafficFilter{
+			Exporter:     exporter.IPInet,
+			Interface:    index,
+			Direction:    direction,
+			StartTime:    start.Truncate(time.Hour),
+			EndTime:      now.Truncate(time.Hour).Add(-time.Hour),
+			SamplingRate: samplingRateFromData(exporter.Data, index),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, point := range series {
+			for protocol := range point.ProtocolData {
+				if protocols[protocol] == nil {
+					protocols[protocol] = new([hoursPerWeek]baselineSlot)
+				}
+			}
+		}
+		// An hour with traffic but none of a protocol counts as zero for it
+		for _, point := range series {
+			slot := hourOfWeek(point.Timestamp)
+			for protocol, slots := range protocols {
+				slots[slot].add(float64(point.ProtocolData[protocol]))
+			}
+		}
+	}
+	return profile, nil
+}
+
+// profile returns the learned profile of an interface
+func (e *BaselineEngine) profile(exporter string, iface string) (*interfaceProfile, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	profile, ok := e.profiles[exporter+"/"+iface]
+	return profile, ok
+}
+
+// score rates a value against a band
+func score(value float64, band *BaselineBand) *BaselineScore {
+	if band == nil {
+		return nil
+	}
+	s := &BaselineScore{Value: value, BaselineBand: *band}
+	if band.StdDev > 0 {
+		s.ZScore = (value - band.Expected) / band.StdDev
+	}
+	return s
+}
+
+// getBaselineRequest handles /api/v1/baseline/{exporter}/{interface}. It
+// scores the current bits/s and the protocols of the last complete hour;
+// sigma= sets the band width (default 3). With start and end (RFC3339 or
+// epoch seconds) the hourly bands of that period are included for charts.
+func getBaselineRequest(w http.ResponseWriter, r *http.Request) {
+	exporterStr := r.PathValue("exporter")
+	interfaceStr := r.PathValue("interface")
+	if !authorizeExporter(w, r, exporterStr, interfaceStr) {
+		return
+	}
+	query := r.URL.Query()
+	if baselineEngine == nil {
+		http.Error(w, "Baselining is disabled", http.StatusServiceUnavailable)
+		return
+	}
+	profile, ok := baselineEngine.profile(exporterStr, interfaceStr)
+	if !ok {
+		http.Error(w, "No baseline for this interface", http.StatusNotFound)
+		return
+	}
+	sigma := float64(defaultBaselineSigma)
+	if s := query.Get("sigma"); s != "" {
+		var err error
+		if sigma, err = strconv.ParseFloat(s, 64); err != nil || sigma <= 0 {
+			http.Error(w, "invalid sigma", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	response := BaselineResponse{
+		Exporter:   exporterStr,
+		Interface:  interfaceStr,
+		Updated:    profile.updated,
+		Weeks:      baselineEngine.weeks,
+		Sigma:      sigma,
+		HourOfWeek: hourOfWeek(now),
+		Protocols:  []ProtocolBaselineScore{},
+	}
+
+	rates, err := interfaceRates(exporterStr, interfaceStr, now.Add(-time.Hour), now)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(rates) > 0 {
+		newest := rates[len(rates)-1].Timestamp
+		var bitsIn, bitsOut, seconds float64
+		for _, rate := range rates {
+			if newest.Sub(rate.Timestamp) >= baselineCurrentWindow {
+				continue
+			}
+			bitsIn += rate.BitsIn * rate.Interval
+			bitsOut += rate.BitsOut * rate.Interval
+			seconds += rate.Interval
+		}
+		slot := hourOfWeek(rates[len(rates)-1].Timestamp)
+		response.In = score(bitsIn/seconds, profile.in[slot].band(sigma))
+		response.Out = score(bitsOut/seconds, profile.out[slot].band(sigma))
+	}
+
+	id, _ := strconv.ParseUint(exporterStr, 10, 64)
+	if addr, err := exporterAddress(id); err == nil {
+		hour := now.Truncate(time.Hour).Add(-time.Hour)
+		slot := hourOfWeek(hour)
+		for _, direction := range []string{"input", "output"} {
+			protocols := profile.protocolsIn
+			name := billingIn
+			if direction == "output" {
+				protocols = profile.protocolsOut
+				name = billingOut
+			}
+			series, err := config.Flows.ProtocolTimeSeries(TrafficFilter{
+				Exporter:     addr,
+				Interface:    interfaceStr,
+				Direction:    direction,
+				StartTime:    hour,
+				EndTime:      hour,
+				SamplingRate: getSamplingRate(addr, interfaceStr),
+			})
+			if err != nil {
+				log.Println(err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			values := make(map[int]int64)
+			for _, point := range series {
+				for protocol, octets := range point.ProtocolData {
+					values[protocol] += octets
+				}
+			}
+			for protocol, slots := range protocols {
+				s := score(float64(values[protocol]), slots[slot].band(sigma))
+				if s == nil {
+					continue
+				}
+				response.Protocols = append(response.Protocols, ProtocolBaselineScore{
+					Protocol:      protocol,
+					Name:          getProtocolName(protocol),
+					Direction:     name,
+					Timestamp:     hour,
+					BaselineScore: *s,
+				})
+			}
+		}
+		sort.Slice(response.Protocols, func(i, j int) bool {
+			a, b := response.Protocols[i], response.Protocols[j]
+			if a.Direction != b.Direction {
+				return a.Direction < b.Direction
+			}
+			return a.Protocol < b.Protocol
+		})
+	}
+
+	start, _ := parseRequestTime(query.Get("start"))
+	end, _ := parseRequestTime(query.Get("end"))
+	if !start.IsZero() && !end.IsZero() && end.After(start) {
+		for t := start.Truncate(time.Hour); !t.After(end); t = t.Add(time.Hour) {
+			slot := hourOfWeek(t)
+			response.Bands = append(response.Bands, BaselineBandPoint{
+				Timestamp: t,
+				In:        profile.in[slot].band(sigma),
+				Out:       profile.out[slot].band(sigma),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding baseline: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// approxEqual compares floats computed in different orders
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*max(1, math.Abs(a), math.Abs(b))
+}
+
+func TestBaselineSlot(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		sigma   float64
+		want    *BaselineBand
+	}{
+		{"too few samples", []float64{10, 20}, 3, nil},
+		{"sample standard deviation", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 1,
+			&BaselineBand{Expected: 5, Lower: 5 - math.Sqrt(32.0/7), Upper: 5 + math.Sqrt(32.0/7), StdDev: math.Sqrt(32.0 / 7), Samples: 8}},
+		{"lower bound at zero", []float64{0, 0, 30}, 3,
+			&BaselineBand{Expected: 10, Lower: 0, Upper: 10 + 3*math.Sqrt(300), StdDev: math.Sqrt(300), Samples: 3}},
+		{"no variance", []float64{500, 500, 500}, 3,
+			&BaselineBand{Expected: 500, Lower: 500, Upper: 500, Samples: 3}},
+		// Rates of a busy link: summing squares would lose the variance
+		{"large values", []float64{1e12 + 4, 1e12 + 7, 1e12 + 13, 1e12 + 16}, 2,
+			&BaselineBand{Expected: 1e12 + 10, Lower: 1e12 + 10 - 2*math.Sqrt(30), Upper: 1e12 + 10 + 2*math.Sqrt(30), StdDev: math.Sqrt(30), Samples: 4}},
+	}
+	for _, tt := range tests {
+		var slot baselineSlot
+		for _, v := range tt.samples {
+			slot.add(v)
+		}
+		got := slot.band(tt.sigma)
+		if tt.want == nil || got == nil {
+			if got != tt.want {
+				t.Errorf("%s: band = %+v, want %+v", tt.name, got, tt.want)
+			}
+			continue
+		}
+		if !approxEqual(got.Expected, tt.want.Expected) || !approxEqual(got.Lower, tt.want.Lower) ||
+			!approxEqual(got.Upper, tt.want.Upper) || !approxEqual(got.StdDev, tt.want.StdDev) || got.Samples != tt.want.Samples {
+			t.Errorf("%s: band = %+v, want %+v", tt.name, *got, *tt.want)
+		}
+	}
+}
+
+func TestBaselineScore(t *testing.T) {
+	if s := score(100, nil); s != nil {
+		t.Errorf("score without a band = %+v", s)
+	}
+	band := &BaselineBand{Expected: 1000, Lower: 400, Upper: 1600, StdDev: 200, Samples: 4}
+	if s := score(1500, band); s.ZScore != 2.5 || s.Value != 1500 || s.BaselineBand != *band {
+		t.Errorf("score above the expected value = %+v", s)
+	}
+	if s := score(700, band); s.ZScore != -1.5 {
+		t.Errorf("score below the expected value = %+v", s)
+	}
+	if s := score(900, &BaselineBand{Expected: 500, Lower: 500, Upper: 500, Samples: 3}); s.ZScore != 0 {
+		t.Errorf("score without variance = %+v", s)
+	}
+}
+
+func TestHourOfWeek(t *testing.T) {
+	useDBTimezone(t, "UTC")
+	// 2025-06-01 is a Sunday
+	if got := hourOfWeek(testHour); got != 10 {
+		t.Errorf("UTC: hourOfWeek(%v) = %d, want 10", testHour, got)
+	}
+	useDBTimezone(t, "Europe/Berlin")
+	tests := []struct {
+		at   time.Time
+		want int
+	}{
+		// Sunday 00:00 CEST
+		{time.Date(2025, 5, 31, 22, 0, 0, 0, time.UTC), 0},
+		// Saturday 23:59 CEST
+		{time.Date(2025, 5, 31, 21, 59, 0, 0, time.UTC), hoursPerWeek - 1},
+		{testHour, 12},
+		// Sunday 12:00 CET, an hour later in UTC than in summer
+		{time.Date(2025, 12, 7, 11, 0, 0, 0, time.UTC), 12},
+	}
+	for _, tt := range tests {
+		if got := hourOfWeek(tt.at); got != tt.want {
+			t.Errorf("Europe/Berlin: hourOfWeek(%v) = %d, want %d", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestBaselineLearn(t *testing.T) {
+	useDBTimezone(t, "UTC")
+	store := useMemoryStore(t)
+	store.AddExporter(ExporterConfig{ID: 1, IPInet: "192.0.2.1", Name: "edge1"})
+	store.AddInterface(InterfaceConfig{ID: 1, Exporter: 1, SnmpIndex: 3, Enabled: true})
+	store.AddInterface(InterfaceConfig{ID: 2, Exporter: 1, SnmpIndex: 4})
+	engine, err := NewBaselineEngine(time.Hour, "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hourly counters over the three weeks learned: 1000, 2000 and 3000
+	// bits/s in during the first, second and third week, 800 out throughout
+	start := testHour.AddDate(0, 0, -21)
+	var in, out int64
+	for k := 0; k <= 3*hoursPerWeek; k++ {
+		if k > 0 {
+			in += int64((k-1)/hoursPerWeek+1) * 1000 * 3600 / 8
+			out += 800 * 3600 / 8
+		}
+		store.AddMetrics("1", "3", Metric{Timestamp: start.Add(time.Duration(k) * time.Hour), OctetsIn: in, OctetsOut: out})
+	}
+	// TCP received in the last complete hour and the same hour of the two
+	// weeks before; UDP only in the last one
+	hour := testHour.Add(-time.Hour)
+	for week, octets := range []int64{3000, 2000, 1000} {
+		last := hour.AddDate(0, 0, -7*week).Add(30 * time.Minute)
+		store.AddFlows(TrafficRecord{Exporter: "192.0.2.1", Input: 3, Protocol: "6", DOctets: octets, DPkts: 1, First: last, Last: last})
+	}
+	store.AddFlows(TrafficRecord{Exporter: "192.0.2.1", Input: 3, Protocol: "17", DOctets: 600, DPkts: 1, First: hour, Last: hour.Add(time.Minute)})
+
+	engine.Update(testHour)
+	if _, ok := engine.profile("1", "4"); ok {
+		t.Error("disabled interface learned")
+	}
+	profile, ok := engine.profile("1", "3")
+	if !ok {
+		t.Fatal("no profile of interface 3")
+	}
+	for slot := 0; slot < hoursPerWeek; slot++ {
+		in, out := profile.in[slot].band(1), profile.out[slot].band(1)
+		if in == nil || out == nil {
+			t.Fatalf("slot %d: no band", slot)
+		}
+		if in.Samples != 3 || !approxEqual(in.Expected, 2000) || !approxEqual(in.StdDev, 1000) ||
+			!approxEqual(in.Lower, 1000) || !approxEqual(in.Upper, 3000) {
+			t.Errorf("slot %d: band in = %+v", slot, *in)
+		}
+		if out.Samples != 3 || !approxEqual(out.Expected, 800) || !approxEqual(out.StdDev, 0) {
+			t.Errorf("slot %d: band out = %+v", slot, *out)
+		}
+	}
+
+	slot := hourOfWeek(hour)
+	if len(profile.protocolsIn) != 2 || len(profile.protocolsOut) != 0 {
+		t.Fatalf("protocols in %v, out %v", profile.protocolsIn, profile.protocolsOut)
+	}
+	tcp := profile.protocolsIn[6][slot].band(3)
+	if tcp == nil || tcp.Samples != 3 || !approxEqual(tcp.Expected, 2000) || !approxEqual(tcp.StdDev, 1000) {
+		t.Errorf("TCP band = %+v", tcp)
+	}
+	// The hours without UDP count as zero
+	udp := profile.protocolsIn[17][slot].band(1)
+	if udp == nil || udp.Samples != 3 || !approxEqual(udp.Expected, 200) || !approxEqual(udp.StdDev, math.Sqrt(120000)) || udp.Lower != 0 {
+		t.Errorf("UDP band = %+v", udp)
+	}
+	if band := profile.protocolsIn[6][(slot+1)%hoursPerWeek].band(3); band != nil {
+		t.Errorf("band of an hour without flows = %+v", band)
+	}
+}
+
+func TestNewBaselineEngine(t *testing.T) {
+	engine, err := NewBaselineEngine(time.Hour, "")
+	if err != nil || engine.weeks != defaultBaselineWeeks {
+		t.Errorf("default engine = %+v, %v", engine, err)
+	}
+	for _, weeks := range []string{"0", "-1", "four"} {
+		if _, err := NewBaselineEngine(time.Hour, weeks); err == nil {
+			t.Errorf("NewBaselineEngine(%q) accepted", weeks)
+		}
+	}
+}
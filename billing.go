@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// billingStep is the sampling period of 95th percentile billing
+const billingStep = 5 * time.Minute
+
+// Billing modes: bill on the inbound, the outbound or the greater of both
+// directions' percentiles
+const (
+	billingIn  = "in"
+	billingOut = "out"
+	billingMax = "max"
+)
+
+// BillingSample is the average rate and the volume of one 5-minute period
+type BillingSample struct {
+	Timestamp time.Time
+	BitsIn    float64
+	BitsOut   float64
+	BytesIn   float64
+	BytesOut  float64
+}
+
+// BillingReport is the monthly billing summary of an interface. Rates are in
+// bits per second, volumes in bytes. The billed values follow the mode and
+// the overage is the part of the billed 95th percentile above the commit.
+type BillingReport struct {
+	Exporter        string    `json:"exporter" parquet:"exporter"`
+	Interface       string    `json:"interface" parquet:"interface"`
+	Month           string    `json:"month" parquet:"month"`
+	Mode            string    `json:"mode" parquet:"mode"`
+	Start           time.Time `json:"start" parquet:"start"`
+	End             time.Time `json:"end" parquet:"end"`
+	Samples         int       `json:"samples" parquet:"samples"`
+	ExpectedSamples int       `json:"expected_samples" parquet:"expected_samples"`
+	In95            float64   `json:"in_95th" parquet:"in_95th"`
+	In99            float64   `json:"in_99th" parquet:"in_99th"`
+	InAverage       float64   `json:"in_average" parquet:"in_average"`
+	InPeak          float64   `json:"in_peak" parquet:"in_peak"`
+	InBytes         int64     `json:"in_bytes" parquet:"in_bytes"`
+	Out95           float64   `json:"out_95th" parquet:"out_95th"`
+	Out99           float64   `json:"out_99th" parquet:"out_99th"`
+	OutAverage      float64   `json:"out_average" parquet:"out_average"`
+	OutPeak         float64   `json:"out_peak" parquet:"out_peak"`
+	OutBytes        int64     `json:"out_bytes" parquet:"out_bytes"`
+	Billed95        float64   `json:"billed_95th" parquet:"billed_95th"`
+	Billed99        float64   `json:"billed_99th" parquet:"billed_99th"`
+	BilledAverage   float64   `json:"billed_average" parquet:"billed_average"`
+	BilledPeak      float64   `json:"billed_peak" parquet:"billed_peak"`
+	BilledBytes     int64     `json:"billed_bytes" parquet:"billed_bytes"`
+	Commit          int64     `json:"commit" parquet:"commit"`
+	Overage         float64   `json:"overage" parquet:"overage"`
+	OveragePercent  float64   `json:"overage_percent" parquet:"overage_percent"`
+}
+
+// billingSamples spreads the traffic of each rate evenly over the interval
+// it covers and averages it per 5-minute period between start and end.
+// Periods without data are left out, so polling gaps do not count as idle.
+func billingSamples(rates []Rate, start time.Time, end time.Time) []BillingSample {
+	n := int(end.Sub(start) / billingStep)
+	bytesIn := make([]float64, n)
+	bytesOut := make([]float64, n)
+	covered := make([]float64, n)
+
+	for _, rate := range rates {
+		to := rate.Timestamp
+		from := to.Add(-time.Duration(rate.Interval * float64(time.Second)))
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		for from.Before(to) {
+			i := int(from.Sub(start) / billingStep)
+			if i >= n {
+				break
+			}
+			next := start.Add(time.Duration(i+1) * billingStep)
+			if next.After(to) {
+				next = to
+			}
+			seconds := next.Sub(from).Seconds()
+			bytesIn[i] += rate.BitsIn / 8 * seconds
+			bytesOut[i] += rate.BitsOut / 8 * seconds
+			covered[i] += seconds
+			from = next
+		}
+	}
+
+	samples := make([]BillingSample, 0, n)
+	for i := range covered {
+		if covered[i] == 0 {
+			continue
+		}
+		samples = append(samples, BillingSample{
+			Timestamp: start.Add(time.Duration(i) * billingStep),
+			BitsIn:    bytesIn[i] * 8 / covered[i],
+			BitsOut:   bytesOut[i] * 8 / covered[i],
+			BytesIn:   bytesIn[i],
+			BytesOut:  bytesOut[i],
+		})
+	}
+	return samples
+}
+
+// percentile returns the nearest-rank p-th percentile of values, sorting
+// them in place
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p/100*float64(len(values)))) - 1
+	return values[max(rank, 0)]
+}
+
+// billingStats returns the 95th and 99th percentiles, average, peak and
+// volume of one direction of the samples
+func billingStats(samples []BillingSample, inbound bool) (p95, p99, avg, peak float64, bytes int64) {
+	if len(samples) == 0 {
+		return 0, 0, 0, 0, 0
+	}
+	values := make([]float64, len(samples))
+	var sum, volume float64
+	for i, sample := range samples {
+		if inbound {
+			values[i] = sample.BitsIn
+			volume += sample.BytesIn
+		} else {
+			values[i] = sample.BitsOut
+			volume += sample.BytesOut
+		}
+		sum += values[i]
+		peak = max(peak, values[i])
+	}
+	avg = sum / float64(len(values))
+	bytes = int64(math.Round(volume))
+	p95 = percentile(values, 95)
+	p99 = percentile(values, 99)
+	return p95, p99, avg, peak, bytes
+}
+
+// buildBillingReport summarizes the samples of a month. commit is the
+// committed rate in bits per second, 0 when there is none.
+func buildBillingReport(samples []BillingSample, mode string, commit int64) BillingReport {
+	var report BillingReport
+	report.Samples = len(samples)
+	report.In95, report.In99, report.InAverage, report.InPeak, report.InBytes =
+		billingStats(samples, true)
+	report.Out95, report.Out99, report.OutAverage, report.OutPeak, report.OutBytes =
+		billingStats(samples, false)
+
+	report.Mode = mode
+	switch mode {
+	case billingIn:
+		report.Billed95, report.Billed99 = report.In95, report.In99
+		report.BilledAverage, report.BilledPeak, report.BilledBytes = report.InAverage, report.InPeak, report.InBytes
+	case billingOut:
+		report.Billed95, report.Billed99 = report.Out95, report.Out99
+		report.BilledAverage, report.BilledPeak, report.BilledBytes = report.OutAverage, report.OutPeak, report.OutBytes
+	default:
+		// The direction with the higher 95th percentile is billed
+		if report.In95 >= report.Out95 {
+			report.Billed95, report.Billed99 = report.In95, report.In99
+			report.BilledAverage, report.BilledPeak, report.BilledBytes = report.InAverage, report.InPeak, report.InBytes
+		} else {
+			report.Billed95, report.Billed99 = report.Out95, report.Out99
+			report.BilledAverage, report.BilledPeak, report.BilledBytes = report.OutAverage, report.OutPeak, report.OutBytes
+		}
+	}
+
+	report.Commit = commit
+	if commit > 0 && report.Billed95 > float64(commit) {
+		report.Overage = report.Billed95 - float64(commit)
+		report.OveragePercent = report.Overage / float64(commit) * 100
+	}
+	return report
+}
+
+// parseBillingMonth returns the bounds of a YYYY-MM month in the database
+// time zone, defaulting to the current month
+func parseBillingMonth(s string) (time.Time, time.Time, error) {
+	var start time.Time
+	if s == "" {
+		now := time.Now().In(dbLocation)
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, dbLocation)
+	} else {
+		t, err := time.ParseInLocation("2006-01", s, dbLocation)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid month %q, use YYYY-MM", s)
+		}
+		start = t
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// getBillingRequest handles /api/v1/billing/{exporter}/{interface}?month=YYYY-MM
+// with mode=in|out|max (default max) and format=json|csv. The commit is the
+// interface bandwidth set on the config page, unless given as commit=bps.
+func getBillingRequest(w http.ResponseWriter, r *http.Request) {
+	exporterStr := r.PathValue("exporter")
+	interfaceStr := r.PathValue("interface")
+	if !authorizeExporter(w, r, exporterStr, interfaceStr) {
+		return
+	}
+	query := r.URL.Query()
+
+	start, end, err := parseBillingMonth(query.Get("month"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode := query.Get("mode")
+	switch mode {
+	case "":
+		mode = billingMax
+	case billingIn, billingOut, billingMax:
+	default:
+		http.Error(w, fmt.Sprintf("unsupported mode %q, use in, out or max", mode), http.StatusBadRequest)
+		return
+	}
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	iface, _ := findInterface(exporterStr, interfaceStr)
+	commit := iface.Bandwidth
+	if s := query.Get("commit"); s != "" {
+		commit, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || commit < 0 {
+			http.Error(w, "invalid commit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rates, err := interfaceRates(exporterStr, interfaceStr, start, end)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report := buildBillingReport(billingSamples(rates, start, end), mode, commit)
+	report.Exporter = exporterStr
+	report.Interface = interfaceStr
+	report.Month = start.Format("2006-01")
+	report.Start = start
+	report.End = end
+	report.ExpectedSamples = int(end.Sub(start) / billingStep)
+
+	if format != exportJSON {
+		kind := fmt.Sprintf("billing_%s_if%s_%s", exporterStr, interfaceStr, report.Month)
+		if err := writeExport(w, r, format, kind, []BillingReport{report}); err != nil {
+			log.Printf("Error writing billing export: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error encoding billing report: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	series := func(n int) []float64 {
+		values := make([]float64, n)
+		for i := range values {
+			// Descending, so percentile has to sort
+			values[i] = float64(n - i)
+		}
+		return values
+	}
+	tests := []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 95, 0},
+		{[]float64{42}, 95, 42},
+		// Nearest rank: ceil(0.95 * 20) = 19th of 20
+		{series(20), 95, 19},
+		{series(20), 99, 20},
+		// ceil(0.95 * 21) = 20th of 21
+		{series(21), 95, 20},
+		{series(100), 95, 95},
+		{series(100), 99, 99},
+		// 8640 samples of a 30-day month: the 432 highest are discarded
+		{series(8640), 95, 8208},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.values, tt.p); got != tt.want {
+			t.Errorf("percentile of %d values, p%v = %v, want %v", len(tt.values), tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestBillingSamples(t *testing.T) {
+	start := testHour
+	end := start.Add(30 * time.Minute)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	rate := func(minutes int, interval float64, bitsIn float64, bitsOut float64) Rate {
+		return Rate{Timestamp: at(minutes), BitsIn: bitsIn, BitsOut: bitsOut, Interval: interval}
+	}
+	sample := func(minutes int, bitsIn float64, bitsOut float64, bytesIn float64, bytesOut float64) BillingSample {
+		return BillingSample{Timestamp: at(minutes), BitsIn: bitsIn, BitsOut: bitsOut, BytesIn: bytesIn, BytesOut: bytesOut}
+	}
+
+	tests := []struct {
+		name  string
+		rates []Rate
+		want  []BillingSample
+	}{
+		{
+			name:  "aligned polls",
+			rates: []Rate{rate(5, 300, 800, 80), rate(10, 300, 1600, 160)},
+			want:  []BillingSample{sample(0, 800, 80, 30000, 3000), sample(5, 1600, 160, 60000, 6000)},
+		},
+		{
+			// No rate covers 10-15, e.g. a counter reset; the period is left
+			// out rather than billed as idle
+			name:  "polling gap",
+			rates: []Rate{rate(5, 300, 800, 0), rate(10, 300, 1600, 0), rate(20, 300, 2400, 0)},
+			want:  []BillingSample{sample(0, 800, 0, 30000, 0), sample(5, 1600, 0, 60000, 0), sample(15, 2400, 0, 90000, 0)},
+		},
+		{
+			// One 10-minute poll spreads over both periods it covers
+			name:  "long interval",
+			rates: []Rate{rate(30, 600, 400, 0)},
+			want:  []BillingSample{sample(20, 400, 0, 15000, 0), sample(25, 400, 0, 15000, 0)},
+		},
+		{
+			// 2-7 covers 3 minutes of the first period and 2 of the second
+			name:  "unaligned poll",
+			rates: []Rate{rate(7, 300, 1200, 0)},
+			want:  []BillingSample{sample(0, 1200, 0, 27000, 0), sample(5, 1200, 0, 18000, 0)},
+		},
+		{
+			// Only the parts inside the billing period count
+			name: "period boundaries",
+			rates: []Rate{
+				rate(-1, 300, 9999, 0),
+				rate(2, 300, 800, 0),
+				rate(31, 300, 800, 0),
+				rate(40, 300, 9999, 0),
+			},
+			want: []BillingSample{sample(0, 800, 0, 12000, 0), sample(25, 800, 0, 24000, 0)},
+		},
+	}
+	for _, tt := range tests {
+		if got := billingSamples(tt.rates, start, end); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: samples = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildBillingReport(t *testing.T) {
+	// Inbound has the higher peak, outbound the higher 95th percentile:
+	// ceil(0.95 * 20) = 19, so the single inbound burst is discarded
+	samples := make([]BillingSample, 20)
+	for i := range samples {
+		samples[i] = BillingSample{BitsIn: 100, BitsOut: 500, BytesIn: 3750, BytesOut: 18750}
+	}
+	samples[7].BitsIn, samples[7].BytesIn = 10000, 375000
+
+	tests := []struct {
+		mode        string
+		commit      int64
+		billed95    float64
+		billedPeak  float64
+		billedBytes int64
+		overage     float64
+		percent     float64
+	}{
+		{billingMax, 400, 500, 500, 375000, 100, 25},
+		{billingIn, 400, 100, 10000, 446250, 0, 0},
+		{billingOut, 0, 500, 500, 375000, 0, 0},
+	}
+	for _, tt := range tests {
+		report := buildBillingReport(samples, tt.mode, tt.commit)
+		if report.In95 != 100 || report.InPeak != 10000 || report.Out95 != 500 || report.Samples != 20 {
+			t.Errorf("%s: directions = %+v", tt.mode, report)
+		}
+		if report.Billed95 != tt.billed95 || report.BilledPeak != tt.billedPeak || report.BilledBytes != tt.billedBytes ||
+			report.Overage != tt.overage || report.OveragePercent != tt.percent {
+			t.Errorf("%s: billed %v, peak %v, bytes %d, overage %v (%v%%)", tt.mode,
+				report.Billed95, report.BilledPeak, report.BilledBytes, report.Overage, report.OveragePercent)
+		}
+	}
+
+	// Equal percentiles bill the inbound direction
+	for i := range samples {
+		samples[i].BitsOut = samples[i].BitsIn
+	}
+	samples[7].BytesOut = 0
+	if report := buildBillingReport(samples, billingMax, 0); report.BilledBytes != report.InBytes {
+		t.Errorf("tie billed %d bytes, want the inbound %d", report.BilledBytes, report.InBytes)
+	}
+}
+
+func TestParseBillingMonth(t *testing.T) {
+	useDBTimezone(t, "Europe/Berlin")
+	tests := []struct {
+		month    string
+		start    time.Time
+		duration time.Duration
+	}{
+		{"2025-02", time.Date(2025, 1, 31, 23, 0, 0, 0, time.UTC), 28 * 24 * time.Hour},
+		// Clocks go forward on March 30 and back on October 26
+		{"2025-03", time.Date(2025, 2, 28, 23, 0, 0, 0, time.UTC), 31*24*time.Hour - time.Hour},
+		{"2025-10", time.Date(2025, 9, 30, 22, 0, 0, 0, time.UTC), 31*24*time.Hour + time.Hour},
+		{"2025-12", time.Date(2025, 11, 30, 23, 0, 0, 0, time.UTC), 31 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		start, end, err := parseBillingMonth(tt.month)
+		if err != nil || !start.Equal(tt.start) || end.Sub(start) != tt.duration {
+			t.Errorf("%s: %v to %v (%v), %v, want %v for %v", tt.month, start, end, end.Sub(start), err, tt.start, tt.duration)
+		}
+	}
+	if _, _, err := parseBillingMonth("2025-13"); err == nil {
+		t.Error("month 13 accepted")
+	}
+}
+
+func TestBillingHandlerDST(t *testing.T) {
+	store := useMemoryStore(t)
+	useDBTimezone(t, "Europe/Berlin")
+	// October 2025 in Berlin has 745 hours, 8940 periods. The first 447
+	// run at 8000 b/s, the other 8493 at 1000 b/s: the 95th percentile is
+	// the 8493rd lowest, the last at 1000 b/s.
+	start, _, _ := parseBillingMonth("2025-10")
+	var in int64
+	metrics := []Metric{{Timestamp: start}}
+	for period := range 8940 {
+		if period < 447 {
+			in += 300000
+		} else {
+			in += 37500
+		}
+		metrics = append(metrics, Metric{Timestamp: start.Add(time.Duration(period+1) * billingStep), OctetsIn: in})
+	}
+	store.AddMetrics("1", "3", metrics...)
+
+	w := serve(getBillingRequest, httptest.NewRequest(http.MethodGet, "/api/v1/billing/1/3?month=2025-10&mode=in", nil),
+		"exporter", "1", "interface", "3")
+	var report BillingReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if report.ExpectedSamples != 8940 || report.Samples != 8940 {
+		t.Errorf("samples = %d of %d, want 8940", report.Samples, report.ExpectedSamples)
+	}
+	if report.In95 != 1000 || report.In99 != 8000 || report.InPeak != 8000 || report.InBytes != 447*300000+8493*37500 {
+		t.Errorf("report = %+v", report)
+	}
+}
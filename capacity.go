@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCapacityDays    = 90
+	defaultCapacityHorizon = 365
+	maxCapacityHorizon     = 5 * 365
+	// Fewer days cannot be fitted; seasonality needs two weeks
+	capacityMinDays         = 7
+	capacitySeasonalityDays = 14
+	// Days with less than half of their 5-minute samples are left out
+	capacityMinCoverage = 0.5
+	capacityCacheTTL    = time.Hour
+)
+
+// Utilization levels, in percent of the capacity, whose crossing is projected
+var capacityThresholds = []float64{70, 80, 100}
+
+// DailyPercentile is the 95th percentile of one day in bits per second
+type DailyPercentile struct {
+	Date  string  `json:"date"`
+	In95  float64 `json:"in_95th"`
+	Out95 float64 `json:"out_95th"`
+}
+
+// ForecastPoint is the projected daily 95th percentile of a future day
+type ForecastPoint struct {
+	Date  string  `json:"date"`
+	Value float64 `json:"value"`
+}
+
+// CapacityThreshold is the first day the projection reaches a utilization
+// level. Days is 0 when the level is already reached and -1 when it is not
+// reached within the horizon.
+type CapacityThreshold struct {
+	Percent float64 `json:"percent"`
+	Level   float64 `json:"level"`
+	Date    string  `json:"date,omitempty"`
+	Days    int     `json:"days"`
+}
+
+// CapacityForecast is the response of /api/v1/capacity/{exporter}/{interface}.
+// The daily value is the greater of the in and out 95th percentiles; it is
+// fitted as a linear trend plus a day-of-week offset.
+type CapacityForecast struct {
+	Exporter    string              `json:"exporter"`
+	Interface   string              `json:"interface"`
+	Name        string              `json:"name"`
+	Capacity    int64               `json:"capacity"`
+	CapacityOf  string              `json:"capacity_of,omitempty"`
+	Days        int                 `json:"days"`
+	Horizon     int                 `json:"horizon"`
+	Slope       float64             `json:"slope_per_day"`
+	Current     float64             `json:"current"`
+	Utilization float64             `json:"utilization"`
+	R2          float64             `json:"r2"`
+	Seasonality []float64           `json:"seasonality"`
+	Thresholds  []CapacityThreshold `json:"thresholds"`
+	History     []DailyPercentile   `json:"history"`
+	Forecast    []ForecastPoint     `json:"forecast"`
+}
+
+// CapacityRank is one row of the fleet ranking
+type CapacityRank struct {
+	Exporter    string  `json:"exporter" parquet:"exporter"`
+	Interface   string  `json:"interface" parquet:"interface"`
+	Name        string  `json:"name" parquet:"name"`
+	Capacity    int64   `json:"capacity" parquet:"capacity"`
+	Current     float64 `json:"current" parquet:"current"`
+	Utilization float64 `json:"utilization" parquet:"utilization"`
+	Slope       float64 `json:"slope_per_day" parquet:"slope_per_day"`
+	Days70      int     `json:"days_to_70" parquet:"days_to_70"`
+	Days80      int     `json:"days_to_80" parquet:"days_to_80"`
+	Days100     int     `json:"days_to_100" parquet:"days_to_100"`
+	Date100     string  `json:"date_100" parquet:"date_100"`
+}
+
+// capacityFit is a linear trend over days since the first day plus an
+// offset per weekday
+type capacityFit struct {
+	first     time.Time
+	intercept float64
+	slope     float64
+	weekday   [7]float64
+	r2        float64
+}
+
+func (f capacityFit) at(day time.Time) float64 {
+	x := float64(daysBetween(f.first, day))
+	return max(f.intercept+f.slope*x+f.weekday[day.Weekday()], 0)
+}
+
+// daysBetween counts calendar days, unaffected by DST changes
+func daysBetween(from time.Time, to time.Time) int {
+	a := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	b := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(b.Sub(a).Hours() / 24)
+}
+
+// linearFit returns the least squares intercept and slope of y over x
+func linearFit(x []float64, y []float64) (float64, float64) {
+	n := float64(len(x))
+	var sx, sy, sxx, sxy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		sxy += x[i] * y[i]
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return sy / n, 0
+	}
+	slope := (n*sxy - sx*sy) / d
+	return (sy - slope*sx) / n, slope
+}
+
+// fitCapacity fits the daily values. The weekday offsets are the mean
+// residuals of a first trend, and the trend is then refitted on the values
+// without them.
+func fitCapacity(days []time.Time, values []float64) capacityFit {
+	fit := capacityFit{first: days[0]}
+	x := make([]float64, len(days))
+	for i, day := range days {
+		x[i] = float64(daysBetween(fit.first, day))
+	}
+	fit.intercept, fit.slope = linearFit(x, values)
+
+	if len(days) >= capacitySeasonalityDays {
+		var sums [7]float64
+		var counts [7]int
+		for i, day := range days {
+			sums[day.Weekday()] += values[i] - (fit.intercept + fit.slope*x[i])
+			counts[day.Weekday()]++
+		}
+		var mean float64
+		for d := range sums {
+			if counts[d] > 0 {
+				fit.weekday[d] = sums[d] / float64(counts[d])
+			}
+			mean += fit.weekday[d] / 7
+		}
+		adjusted := make([]float64, len(values))
+		for d := range fit.weekday {
+			fit.weekday[d] -= mean
+		}
+		for i, day := range days {
+			adjusted[i] = values[i] - fit.weekday[day.Weekday()]
+		}
+		fit.intercept, fit.slope = linearFit(x, adjusted)
+	}
+
+	var mean, total, residual float64
+	for _, v := range values {
+		mean += v / float64(len(values))
+	}
+	for i, day := range days {
+		total += (values[i] - mean) * (values[i] - mean)
+		e := values[i] - (fit.intercept + fit.slope*x[i] + fit.weekday[day.Weekday()])
+		residual += e * e
+	}
+	if total > 0 {
+		fit.r2 = 1 - residual/total
+	}
+	return fit
+}
+
+// dailyPercentiles returns the 95th percentiles of the complete days before
+// today, in the database time zone
+func dailyPercentiles(exporter string, iface string, days int, now time.Time) ([]DailyPercentile, []time.Time, error) {
+	local := now.In(dbLocation)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, dbLocation)
+	start := today.AddDate(0, 0, -days)
+	rates, err := interfaceRates(exporter, iface, start, today)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	history := []DailyPercentile{}
+	var dates []time.Time
+	for day := start; day.Before(today); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		samples := billingSamples(rates, day, next)
+		if float64(len(samples)) < float64(next.Sub(day)/billingStep)*capacityMinCoverage {
+			continue
+		}
+		in95, _, _, _, _ := billingStats(samples, true)
+		out95, _, _, _, _ := billingStats(samples, false)
+		history = append(history, DailyPercentile{Date: day.Format("2006-01-02"), In95: in95, Out95: out95})
+		dates = append(dates, day)
+	}
+	return history, dates, nil
+}
+
+// interfaceCapacity returns the bandwidth set on the config page, or else
+// the interface speed
+func interfaceCapacity(iface InterfaceConfig) (int64, string) {
+	if iface.Bandwidth > 0 {
+		return iface.Bandwidth, "bandwidth"
+	}
+	if iface.Speed > 0 {
+		return iface.Speed, "speed"
+	}
+	return 0, ""
+}
+
+var errCapacityData = errors.New("not enough daily samples to forecast")
+
+// forecastCapacity builds the forecast of an interface
+func forecastCapacity(exporter string, index string, days int, horizon int, now time.Time) (CapacityForecast, error) {
+	iface, _ := findInterface(exporter, index)
+	forecast := CapacityForecast{
+		Exporter:   exporter,
+		Interface:  index,
+		Name:       iface.Name,
+		Days:       days,
+		Horizon:    horizon,
+		Thresholds: []CapacityThreshold{},
+		Forecast:   []ForecastPoint{},
+	}
+	forecast.Capacity, forecast.CapacityOf = interfaceCapacity(iface)
+
+	history, dates, err := dailyPercentiles(exporter, index, days, now)
+	if err != nil {
+		return forecast, err
+	}
+	forecast.History = history
+	if len(history) < capacityMinDays {
+		return forecast, errCapacityData
+	}
+	values := make([]float64, len(history))
+	for i, day := range history {
+		values[i] = max(day.In95, day.Out95)
+	}
+	fit := fitCapacity(dates, values)
+	forecast.Slope = fit.slope
+	forecast.R2 = fit.r2
+	forecast.Seasonality = fit.weekday[:]
+
+	local := now.In(dbLocation)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, dbLocation)
+	forecast.Current = fit.at(today)
+	if forecast.Capacity > 0 {
+		forecast.Utilization = forecast.Current / float64(forecast.Capacity) * 100
+	}
+	for _, percent := range capacityThresholds {
+		if forecast.Capacity <= 0 {
+			break
+		}
+		threshold := CapacityThreshold{
+			Percent: percent,
+			Level:   float64(forecast.Capacity) * percent / 100,
+			Days:    -1,
+		}
+		for d := 0; d <= horizon; d++ {
+			day := today.AddDate(0, 0, d)
+			if fit.at(day) >= threshold.Level {
+				threshold.Days = d
+				threshold.Date = day.Format("2006-01-02")
+				break
+			}
+		}
+		forecast.Thresholds = append(forecast.Thresholds, threshold)
+	}
+	for d := 1; d <= horizon; d++ {
+		day := today.AddDate(0, 0, d)
+		forecast.Forecast = append(forecast.Forecast, ForecastPoint{Date: day.Format("2006-01-02"), Value: fit.at(day)})
+	}
+	return forecast, nil
+}
+
+// parseCapacityParams reads days= (history) and horizon= (projection), both
+// in days
+func parseCapacityParams(r *http.Request) (int, int, error) {
+	days, horizon := defaultCapacityDays, defaultCapacityHorizon
+	if s := r.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < capacityMinDays || n > 3*365 {
+			return 0, 0, fmt.Errorf("invalid days, use %d to %d", capacityMinDays, 3*365)
+		}
+		days = n
+	}
+	if s := r.URL.Query().Get("horizon"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxCapacityHorizon {
+			return 0, 0, fmt.Errorf("invalid horizon, use 1 to %d", maxCapacityHorizon)
+		}
+		horizon = n
+	}
+	return days, horizon, nil
+}
+
+// getCapacityRequest handles /api/v1/capacity/{exporter}/{interface}
+func getCapacityRequest(w http.ResponseWriter, r *http.Request) {
+	exporterStr := r.PathValue("exporter")
+	interfaceStr := r.PathValue("interface")
+	if !authorizeExporter(w, r, exporterStr, interfaceStr) {
+		return
+	}
+	days, horizon, err := parseCapacityParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	forecast, err := forecastCapacity(exporterStr, interfaceStr, days, horizon, time.Now())
+	if errors.Is(err, errCapacityData) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(forecast); err != nil {
+		log.Printf("Error encoding capacity forecast: %v", err)
+	}
+}
+
+// capacityCache keeps fleet forecasts for capacityCacheTTL, as each one
+// reads months of counters
+var capacityCache = struct {
+	sync.Mutex
+	entries map[string]capacityCacheEntry
+}{entries: make(map[string]capacityCacheEntry)}
+
+type capacityCacheEntry struct {
+	at   time.Time
+	rank CapacityRank
+	ok   bool
+}
+
+// capacityRank returns the ranking row of an interface, false when it has
+// no capacity or not enough data
+func capacityRank(iface InterfaceConfig, days int, horizon int, now time.Time) (CapacityRank, bool) {
+	exporter := strconv.FormatInt(iface.Exporter, 10)
+	index := strconv.FormatInt(iface.SnmpIndex, 10)
+	key := fmt.Sprintf("%s/%s/%d/%d", exporter, index, days, horizon)
+	capacityCache.Lock()
+	entry, cached := capacityCache.entries[key]
+	capacityCache.Unlock()
+	if cached && now.Sub(entry.at) < capacityCacheTTL {
+		return entry.rank, entry.ok
+	}
+
+	entry = capacityCacheEntry{at: now}
+	if capacity, _ := interfaceCapacity(iface); capacity > 0 {
+		forecast, err := forecastCapacity(exporter, index, days, horizon, now)
+		if err != nil && !errors.Is(err, errCapacityData) {
+			log.Printf("Capacity forecast of %s/%s: %v", exporter, index, err)
+		}
+		if err == nil {
+			entry.ok = true
+			entry.rank = CapacityRank{
+				Exporter:    exporter,
+				Interface:   index,
+				Name:        iface.Name,
+				Capacity:    forecast.Capacity,
+				Current:     forecast.Current,
+				Utilization: forecast.Utilization,
+				Slope:       forecast.Slope,
+			}
+			for _, threshold := range forecast.Thresholds {
+				switch threshold.Percent {
+				case 70:
+					entry.rank.Days70 = threshold.Days
+				case 80:
+					entry.rank.Days80 = threshold.Days
+				case 100:
+					entry.rank.Days100 = threshold.Days
+					entry.rank.Date100 = threshold.Date
+				}
+			}
+		}
+	}
+	capacityCache.Lock()
+	capacityCache.entries[key] = entry
+	capacityCache.Unlock()
+	return entry.rank, entry.ok
+}
+
+// getCapacityRankingRequest handles /api/v1/capacity, ranking the enabled
+// interfaces by the days left until saturation, then by utilization.
+// limit= (default 20, 0 for all) and format=json|csv|ndjson|parquet.
+func getCapacityRankingRequest(w http.ResponseWriter, r *http.Request) {
+	days, horizon, err := parseCapacityParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 20
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	interfaces, err := config.Metrics.InterfaceConfigs("")
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	ranking := []CapacityRank{}
+	for _, iface := range interfaces {
+		if !iface.Enabled {
+			continue
+		}
+		if rank, ok := capacityRank(iface, days, horizon, now); ok {
+			ranking = append(ranking, rank)
+		}
+	}
+	sort.SliceStable(ranking, func(i, j int) bool {
+		a, b := ranking[i], ranking[j]
+		if (a.Days100 >= 0) != (b.Days100 >= 0) {
+			return a.Days100 >= 0
+		}
+		if a.Days100 != b.Days100 {
+			return a.Days100 < b.Days100
+		}
+		return a.Utilization > b.Utilization
+	})
+	if limit > 0 && len(ranking) > limit {
+		ranking = ranking[:limit]
+	}
+
+	if format != exportJSON {
+		if err := writeExport(w, r, format, "capacity", ranking); err != nil {
+			log.Printf("Error writing capacity export: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ranking); err != nil {
+		log.Printf("Error encoding capacity ranking: %v", err)
+	}
+}
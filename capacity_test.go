@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLinearFit(t *testing.T) {
+	tests := []struct {
+		x, y      []float64
+		intercept float64
+		slope     float64
+	}{
+		{[]float64{0, 1, 2, 3}, []float64{5, 7, 9, 11}, 5, 2},
+		{[]float64{0, 1, 2, 3}, []float64{1, 3, 2, 4}, 1.3, 0.8},
+		// All on one day: the mean, flat
+		{[]float64{3, 3, 3}, []float64{1, 2, 6}, 3, 0},
+	}
+	for _, tt := range tests {
+		intercept, slope := linearFit(tt.x, tt.y)
+		if !approxEqual(intercept, tt.intercept) || !approxEqual(slope, tt.slope) {
+			t.Errorf("linearFit(%v, %v) = %v, %v, want %v, %v", tt.x, tt.y, intercept, slope, tt.intercept, tt.slope)
+		}
+	}
+}
+
+func TestDaysBetween(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from, to time.Time
+		want     int
+	}{
+		// 47 and 49 hours across the DST changes
+		{time.Date(2025, 3, 29, 0, 0, 0, 0, berlin), time.Date(2025, 3, 31, 0, 0, 0, 0, berlin), 2},
+		{time.Date(2025, 10, 25, 0, 0, 0, 0, berlin), time.Date(2025, 10, 27, 0, 0, 0, 0, berlin), 2},
+		{time.Date(2025, 12, 31, 23, 0, 0, 0, berlin), time.Date(2026, 1, 1, 1, 0, 0, 0, berlin), 1},
+		{testHour, testHour.Add(-48 * time.Hour), -2},
+	}
+	for _, tt := range tests {
+		if got := daysBetween(tt.from, tt.to); got != tt.want {
+			t.Errorf("daysBetween(%v, %v) = %d, want %d", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// capacityDays returns n consecutive days from first
+func capacityDays(first time.Time, n int) []time.Time {
+	days := make([]time.Time, n)
+	for i := range days {
+		days[i] = first.AddDate(0, 0, i)
+	}
+	return days
+}
+
+func TestFitCapacity(t *testing.T) {
+	// A falling trend is projected down to zero, not below
+	days := capacityDays(time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC), 10)
+	values := make([]float64, len(days))
+	for i := range values {
+		values[i] = 500 - 50*float64(i)
+	}
+	fit := fitCapacity(days, values)
+	if !approxEqual(fit.intercept, 500) || !approxEqual(fit.slope, -50) || !approxEqual(fit.r2, 1) || fit.weekday != [7]float64{} {
+		t.Errorf("falling trend: fit = %+v", fit)
+	}
+	if v := fit.at(days[0].AddDate(0, 0, 8)); !approxEqual(v, 100) {
+		t.Errorf("falling trend: value of day 8 = %v, want 100", v)
+	}
+	if v := fit.at(days[0].AddDate(0, 0, 12)); v != 0 {
+		t.Errorf("falling trend: value of day 12 = %v, want 0", v)
+	}
+
+	// Four weeks from a Monday, busier on Mondays and Sundays, quieter on
+	// Tuesdays and Saturdays
+	days = capacityDays(time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC), 28)
+	offsets := [7]float64{time.Sunday: 100, time.Monday: 100, time.Tuesday: -100, time.Saturday: -100}
+	values = make([]float64, len(days))
+	for i, day := range days {
+		values[i] = 1000 + 10*float64(i) + offsets[day.Weekday()]
+	}
+	fit = fitCapacity(days, values)
+	if !approxEqual(fit.intercept, 1000) || !approxEqual(fit.slope, 10) || !approxEqual(fit.r2, 1) {
+		t.Errorf("weekly pattern: fit = %+v", fit)
+	}
+	for d := range offsets {
+		if !approxEqual(fit.weekday[d], offsets[d]) {
+			t.Errorf("weekly pattern: offset of %v = %v, want %v", time.Weekday(d), fit.weekday[d], offsets[d])
+		}
+	}
+	// Monday, four weeks on
+	if v := fit.at(days[0].AddDate(0, 0, 28)); !approxEqual(v, 1380) {
+		t.Errorf("weekly pattern: value of day 28 = %v, want 1380", v)
+	}
+
+	// The same pattern over less than two weeks is left to the trend
+	fit = fitCapacity(days[:13], values[:13])
+	if fit.weekday != [7]float64{} || fit.r2 >= 1 || fit.r2 <= 0 {
+		t.Errorf("weekly pattern of 13 days: fit = %+v", fit)
+	}
+
+	fit = fitCapacity(days[:4], []float64{1, 3, 2, 4})
+	if !approxEqual(fit.r2, 0.64) {
+		t.Errorf("noisy values: r2 = %v, want 0.64", fit.r2)
+	}
+}
+
+func TestForecastCapacity(t *testing.T) {
+	useDBTimezone(t, "UTC")
+	store := useMemoryStore(t)
+	store.AddInterface(InterfaceConfig{ID: 1, Exporter: 1, SnmpIndex: 3, Name: "ge-0/0/3", Speed: 2050000, Enabled: true})
+	store.AddInterface(InterfaceConfig{ID: 2, Exporter: 1, SnmpIndex: 4, Name: "ge-0/0/4", Bandwidth: 1000000, Speed: 1e9})
+
+	// Four weeks of 5-minute counters, day d at 1 Mbit/s + 10 kbit/s per
+	// day in and half of it out. On day 10 the agent stops after six hours
+	// and restarts the next day.
+	first := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	today := first.AddDate(0, 0, 28)
+	var in, out, uptime int64
+	for at := first; !at.After(today); at = at.Add(billingStep) {
+		if at.After(first.AddDate(0, 0, 10).Add(6*time.Hour)) && at.Before(first.AddDate(0, 0, 11)) {
+			uptime = 0
+			continue
+		}
+		if at.After(first) {
+			day := daysBetween(first, at.Add(-billingStep))
+			octets := int64(1000000+10000*day) * 300 / 8
+			in += octets
+			out += octets / 2
+		}
+		uptime += 30000
+		store.AddMetrics("1", "3", Metric{Timestamp: at, OctetsIn: in, OctetsOut: out, Uptime: uptime})
+	}
+
+	forecast, err := forecastCapacity("1", "3", 28, 60, today.Add(12*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forecast.Name != "ge-0/0/3" || forecast.Capacity != 2050000 || forecast.CapacityOf != "speed" {
+		t.Errorf("interface = %q, capacity %d of %q", forecast.Name, forecast.Capacity, forecast.CapacityOf)
+	}
+	if len(forecast.History) != 27 || forecast.History[0] != (DailyPercentile{Date: "2025-06-01", In95: 1e6, Out95: 5e5}) ||
+		forecast.History[10].Date != "2025-06-12" || forecast.History[26].Date != "2025-06-28" {
+		t.Errorf("history without the short day = %+v", forecast.History)
+	}
+	if !approxEqual(forecast.Slope, 10000) || !approxEqual(forecast.R2, 1) || !approxEqual(forecast.Current, 1280000) ||
+		!approxEqual(forecast.Utilization, 1280000.0/2050000*100) {
+		t.Errorf("forecast = slope %v, r2 %v, current %v, utilization %v", forecast.Slope, forecast.R2, forecast.Current, forecast.Utilization)
+	}
+	want := []CapacityThreshold{
+		{Percent: 70, Level: 1435000, Date: "2025-07-15", Days: 16},
+		{Percent: 80, Level: 1640000, Date: "2025-08-04", Days: 36},
+		// Reached after the horizon
+		{Percent: 100, Level: 2050000, Days: -1},
+	}
+	if len(forecast.Thresholds) != len(want) {
+		t.Fatalf("thresholds = %+v", forecast.Thresholds)
+	}
+	for i := range want {
+		if forecast.Thresholds[i] != want[i] {
+			t.Errorf("threshold %v%% = %+v, want %+v", want[i].Percent, forecast.Thresholds[i], want[i])
+		}
+	}
+	if len(forecast.Forecast) != 60 || forecast.Forecast[0].Date != "2025-06-30" || !approxEqual(forecast.Forecast[0].Value, 1290000) {
+		t.Errorf("forecast = %+v", forecast.Forecast)
+	}
+
+	// The bandwidth set on the config page wins over the speed; without
+	// counters there is no trend
+	forecast, err = forecastCapacity("1", "4", 28, 60, today.Add(12*time.Hour))
+	if !errors.Is(err, errCapacityData) || forecast.Capacity != 1000000 || forecast.CapacityOf != "bandwidth" || len(forecast.History) != 0 {
+		t.Errorf("interface without counters = %+v, %v", forecast, err)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 
@@ -23,6 +22,9 @@ func renderChartTag(w http.ResponseWriter, r *http.Request) {
 	log.Println(exporterStr)
 	interfaceStr := r.PathValue("interface")
 	log.Println(interfaceStr)
+	if !authorizeExporter(w, r, exporterStr, interfaceStr) {
+		return
+	}
 	start := time.Now().Add(-1 * time.Hour)
 	end := time.Now()
 	startStr := fmt.Sprintf("%d", start.Unix())
@@ -183,7 +185,7 @@ func ParseIEC(s string) (int64, error) {
 	return int64(math.Round(val)), nil
 }
 
-func getSNMPMetricsForChart(r *http.Request) (metrics []Metric, err error) {
+func getSNMPRatesForChart(r *http.Request) (rates []Rate, err error) {
 
 	exporterStr := r.PathValue("exporter")
 	log.Println(exporterStr)
@@ -211,14 +213,17 @@ func getSNMPMetricsForChart(r *http.Request) (metrics []Metric, err error) {
 	}
 	log.Println("start: ", start)
 	log.Println("end : ", end)
-	metrics, err = getInterfacesMetrics(exporterStr, interfaceStr, start, end)
-	return metrics, err
+	rates, err = interfaceRates(exporterStr, interfaceStr, start, end)
+	return rates, err
 }
 
 func renderTimeseriesChartPNG(w http.ResponseWriter, r *http.Request) {
+	if !authorizeExporter(w, r, r.PathValue("exporter"), r.PathValue("interface")) {
+		return
+	}
 	w.Header().Set("Content-Type", "image/png")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	metrics, err := getSNMPMetricsForChart(r)
+	rates, err := getSNMPRatesForChart(r)
 	if err != nil {
 		log.Println(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -227,47 +232,10 @@ func renderTimeseriesChartPNG(w http.ResponseWriter, r *http.Request) {
 	var x_values []time.Time
 	var y_values_in []float64
 	var y_values_out []float64
-	var old_in float64 = 0
-	var new_in float64 = 0
-	var old_out float64 = 0
-	var new_out float64 = 0
-	var delta_in float64 = 0
-	var delta_out float64 = 0
-	var new_ts time.Time
-	var old_ts time.Time
-	var delta_ts time.Duration
-	for _, metric := range metrics {
-		old_ts = new_ts
-		new_ts = metric.Timestamp
-		delta_ts = new_ts.Sub(old_ts)
-
-		old_in = new_in
-		new_in = float64(metric.OctetsIn)
-		delta_in = new_in - old_in
-		if delta_in == new_in {
-			delta_in = 0
-		}
-		old_out = new_out
-		new_out = float64(metric.OctetsOut)
-		delta_out = new_out - old_out
-		if delta_out == new_out {
-			delta_out = 0
-		}
-		if delta_out < 0 {
-			delta_out = 0
-		}
-		if delta_in < 0 {
-			delta_in = 0
-		}
-
-		log.Println("Seconds: ", delta_ts.Seconds())
-		delta_in = (delta_in / delta_ts.Seconds()) * 8
-		delta_out = (delta_out / delta_ts.Seconds()) * 8
-		x_values = append(x_values, metric.Timestamp)
-		y_values_in = append(y_values_in, delta_in)
-		y_values_out = append(y_values_out, delta_out)
-		log.Println(delta_in)
-		log.Println(delta_out)
+	for _, rate := range rates {
+		x_values = append(x_values, rate.Timestamp)
+		y_values_in = append(y_values_in, rate.BitsIn)
+		y_values_out = append(y_values_out, rate.BitsOut)
 	}
 	graph := chart.Chart{
 		Title:  "Traffic",
@@ -355,9 +323,9 @@ type FlowData struct {
 }
 
 func getFlowMetricsForChart(r *http.Request) ([]FlowData, error) {
-	var input_or_output string = r.PathValue("direction")
-	if input_or_output == "" {
-		input_or_output = "input"
+	input_or_output, err := parseDirection(r.PathValue("direction"))
+	if err != nil {
+		return nil, err
 	}
 	exporterStr := r.PathValue("exporter")
 	log.Println(exporterStr)
@@ -385,79 +353,35 @@ func getFlowMetricsForChart(r *http.Request) ([]FlowData, error) {
 	}
 	log.Println("start: ", start)
 	log.Println("end : ", end)
-	var flows []FlowData
-	exporters, err := getExporterList()
+	exporters, err := config.Metrics.ExporterConfigs()
 	if err != nil {
 		return nil, err
 	}
 	var exporterInet string
 	for _, exporter := range exporters {
-		log.Println(exporter.ID)
-		log.Println(exporterStr)
-		log.Println(exporter.IP_Inet)
 		if fmt.Sprintf("%d", exporter.ID) == exporterStr {
 			log.Println("Found")
-			exporterInet = exporter.IP_Inet
+			exporterInet = exporter.IPInet
 		}
 	}
 	if exporterInet == "" {
 		return nil, errors.New("Exporter not found")
 	}
 	log.Println(exporterInet)
-	/*
-		q := fmt.Sprintf("select bucket_5min,exporter,srcaddr,dstaddr,srcport,dstport,src_as,dst_as,total_packets,total_octets,input,output from flows_v5_agg_5min where exporter=$1 and "+
-			input_or_output+
-			" = $2 and bucket_5min >= $3 and bucket_5min <= $4 "+
-			" UNION "+
-			"select bucket_5min,exporter,srcaddr,dstaddr,srcport,dstport,src_as,dst_as,total_packets,total_octets,input,output from flows_v9_agg_5min where exporter=$1 and "+
-			input_or_output+" = $2 and bucket_5min >= $3 and bucket_5min <= $4",
-			exporterInet, interfaceStr, start, end)
-
-	*/
-	rows, err := config.Db.Query("select bucket as bucket, exporter, srcaddr, dstaddr, srcport, dstport, src_as, dst_as, total_packets, total_bytes as total_octets, input, output from flows_hourly where exporter=$1 and "+
-		input_or_output+
-		" = $2 and bucket AT TIME ZONE 'UTC' >= $3 and bucket AT TIME ZONE 'UTC' <= $4 ",
-		exporterInet, interfaceStr, start, end)
-	if err != nil {
-		return nil, err
-	}
-	var sqltimestamp sql.NullTime
-	var sqlexporter sql.NullString
-	var sqlsrcaddr sql.NullString
-	var sqldstaddr sql.NullString
-	var sqlsrcport sql.NullInt64
-	var sqldstport sql.NullInt64
-	var sqlsrcas sql.NullInt64
-	var sqldstas sql.NullInt64
-	var sqlinput sql.NullInt64
-	var sqloutput sql.NullInt64
-	var sqloctets sql.NullInt64
-	var sqlpackets sql.NullInt64
-	for rows.Next() {
-		var flow FlowData
-		err := rows.Scan(&sqltimestamp, &sqlexporter, &sqlsrcaddr, &sqldstaddr, &sqlsrcport, &sqldstport, &sqlsrcas, &sqldstas, &sqlpackets, &sqloctets, &sqlinput, &sqloutput)
-		if err != nil {
-			return nil, err
-		}
-		flow.Timestamp = sqltimestamp.Time
-		flow.SrcAddr = sqlsrcaddr.String
-		flow.DstAddr = sqldstaddr.String
-		flow.SrcPort = sqlsrcport.Int64
-		flow.DstPort = sqldstport.Int64
-		flow.SrcAs = sqlsrcas.Int64
-		flow.DstAs = sqldstas.Int64
-		flow.Input = sqlinput.Int64
-		flow.Output = sqloutput.Int64
-		flow.TotalPackets = sqlpackets.Int64
-		flow.TotalOctets = sqloctets.Int64
-		log.Println(flow)
-		flows = append(flows, flow)
-
-	}
-	return flows, nil
+	return config.Flows.HourlyFlows(TrafficFilter{
+		Exporter:     exporterInet,
+		Interface:    interfaceStr,
+		Direction:    input_or_output,
+		StartTime:    start,
+		EndTime:      end,
+		SamplingRate: getSamplingRate(exporterInet, interfaceStr),
+	})
 }
 
 func renderPieChartPNG(w http.ResponseWriter, r *http.Request) {
+	if !authorizeExporter(w, r, r.PathValue("exporter"), r.PathValue("interface")) {
+		return
+	}
 	w.Header().Set("Content-Type", "image/png")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	metrics, err := getFlowMetricsForChart(r)
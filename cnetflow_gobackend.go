@@ -5,12 +5,15 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"html"
 	"log"
+	"maps"
 	"math"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -64,66 +67,42 @@ func int64ToIPv4(intIP int64) net.IP {
 
 // TIP <p>To run your code, right-click the code and select <b>Run</b>.</p> <p>Alternatively, click
 // the <icon src="AllIcons.Actions.Execute"/> icon in the gutter and select the <b>Run</b> menu item from here.</p>
-func getFlowsDB(exporter string, last string) ([]FlowGEO, string) {
+// flowsLastLayout is the database wall clock format of the last parameter of
+// the flows endpoint
+const flowsLastLayout = "2006-01-02 15:04:05.999999"
+
+// getFlowsDB returns the flows of the exporter since last, skipping those
+// whose interfaces are both outside the scope
+func getFlowsDB(exporter string, last string, scope *ExporterScope) ([]FlowGEO, string) {
 	var flowsGeo map[string]map[string]*FlowGEO
 	flowsGeo = make(map[string]map[string]*FlowGEO)
 	var max_last time.Time
-	max_last_str := last
-	var rows *sql.Rows
-	var err error
 	if last == "0" {
 		last = "2000-01-01 00:00:00"
 	}
-	last = strings.Split(last, "+")[0]
-	query := fmt.Sprintf("select * from flows where exporter = $1::inet and last  >= $2::timestamp ;  ")
-	log.Println(query)
+	last = strings.TrimSpace(strings.Split(last, "+")[0])
+	since, err := time.Parse(flowsLastLayout, last)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, "0"
+	}
 	exporter = strings.Split(exporter, "/")[0]
-	rows, err = config.Db.Query(query, exporter, last)
+	var flows []TrafficRecord
+	err = config.Flows.RawFlows(TrafficFilter{Exporter: exporter, StartTime: fromDBTime(since)}, nil, 0, func(flow TrafficRecord) bool {
+		flows = append(flows, flow)
+		return true
+	})
 	if err != nil {
 		log.Println(err.Error())
 		return nil, "0"
 	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			log.Println(err.Error())
-		}
-	}(rows)
-	for rows.Next() {
-		//var row Row
-		var flow FlowDB
-		var flow_hash sql.NullString
-		err := rows.Scan(
-			&flow.ID,
-			&flow.InsertedAt,
-			&flow.Exporter,
-			&flow.SrcAddr,
-			&flow.DstAddr,
-			&flow.Input,
-			&flow.Output,
-			&flow.DPkts,
-			&flow.DOctets,
-			&flow.SrcPort,
-			&flow.DstPort,
-			&flow.TCPFlags,
-			&flow.Protocol,
-			&flow.TOS,
-			&flow.SrcAS,
-			&flow.DstAS,
-			&flow.SrcMask,
-			&flow.DstMask,
-			&flow.IPVersion,
-			&flow.First,
-			&flow.Last,
-			&flow_hash,
-		)
-		if flow_hash.Valid {
-			flow.FlowHash = flow_hash.String
+	for _, flow := range flows {
+		if !scope.InterfaceIndex(exporter, flow.Input) && !scope.InterfaceIndex(exporter, flow.Output) {
+			continue
 		}
 		flowGeo := FlowGEO{}
-		if flow.Last.Unix() > max_last.Unix() {
+		if flow.Last.After(max_last) {
 			max_last = flow.Last
-			max_last_str = flow.Last.String()
 		}
 		if flow.SrcAddr > flow.DstAddr {
 			tmp := flow.SrcAddr
@@ -180,11 +159,6 @@ func getFlowsDB(exporter string, last string) ([]FlowGEO, string) {
 		}
 		flowsGeo[flow.SrcAddr][flow.DstAddr].Distance = flowsGeo[flow.SrcAddr][flow.DstAddr].SrcCoord.HaversineMeters(flowsGeo[flow.SrcAddr][flow.DstAddr].DstCoord)
 		//fmt.Println(flowsGeo[flow.SrcAddr][flow.DstAddr].Distance)
-
-		if err != nil {
-			log.Println(err.Error())
-		}
-
 	}
 	var flowsGEOPruned map[Coordinates]map[Coordinates]*FlowGEO
 	flowsGEOPruned = make(map[Coordinates]map[Coordinates]*FlowGEO)
@@ -216,11 +190,9 @@ func getFlowsDB(exporter string, last string) ([]FlowGEO, string) {
 			FlowsGEOArray = append(FlowsGEOArray, *f2)
 		}
 	}
-	if strings.Split(max_last.String(), "+")[0] != "0001-01-01 00:00:00 " {
-		max_last_str = max_last.String()
-		max_last_str = strings.Split(max_last_str, "+")[0]
-	} else {
-		max_last_str = last
+	max_last_str := last
+	if !max_last.IsZero() {
+		max_last_str = toDBTime(max_last).Format(flowsLastLayout)
 	}
 
 	return FlowsGEOArray, max_last_str
@@ -232,6 +204,9 @@ func getInterfacesMetricsRequest(w http.ResponseWriter, r *http.Request) {
 	log.Println(exporterStr)
 	interfaceStr := r.PathValue("interface")
 	log.Println(interfaceStr)
+	if !authorizeExporter(w, r, exporterStr, interfaceStr) {
+		return
+	}
 	var start time.Time
 	var end time.Time
 	startStr := r.PathValue("start")
@@ -245,16 +220,8 @@ func getInterfacesMetricsRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	// Parse start/end as RFC3339 or epoch seconds
 	parseTime := func(s string) time.Time {
-		if s == "" {
-			return time.Time{}
-		}
-		if t, err := time.Parse(time.RFC3339, s); err == nil {
-			return t
-		}
-		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
-			return time.Unix(sec, 0)
-		}
-		return time.Time{}
+		t, _ := parseRequestTime(s)
+		return t
 	}
 	start = parseTime(startStr)
 	end = parseTime(endStr)
@@ -264,7 +231,7 @@ func getInterfacesMetricsRequest(w http.ResponseWriter, r *http.Request) {
 	if end.IsZero() {
 		end = time.Now()
 	}
-	metrics, err := getInterfacesMetrics(exporterStr, interfaceStr, start, end)
+	metrics, err := config.Metrics.InterfaceMetrics(exporterStr, interfaceStr, start, end)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -284,131 +251,25 @@ func getInterfacesMetricsRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func getPorts() []Service {
-	var rows *sql.Rows
-	var err error
-	services := []Service{}
-	rows, err = config.Db.Query("select number,protocol,name,description from ports; ")
+	services, err := config.Flows.Ports()
 	if err != nil {
-		return services
-	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			log.Println(err.Error())
-		}
-	}(rows)
-	for rows.Next() {
-		//var row Row
-		var service Service
-
-		var portsql sql.NullInt64
-		var protocolsql sql.NullInt64
-		var namesql sql.NullString
-		var descriptionsql sql.NullString
-		err := rows.Scan(
-			&portsql,
-			&protocolsql,
-			&namesql,
-			&descriptionsql,
-		)
-		if err != nil {
-			log.Println(err.Error())
-			continue
-		}
-		service.Port = int(portsql.Int64)
-		service.Protocol = int(protocolsql.Int64)
-		service.Name = namesql.String
-		service.Description = descriptionsql.String
-		services = append(services, service)
-
+		log.Println(err.Error())
+		return []Service{}
 	}
 	return services
-
 }
 
 // getServiceNetworks returns list of CIDR/name pairs from the services table
 // Minimal helper as requested by issue description
 func getServiceNetworks() []ServiceNetwork {
-	var rows *sql.Rows
-	var err error
-	entries := []ServiceNetwork{}
-	rows, err = config.Db.Query("select addr, name from services; ")
+	entries, err := config.Flows.ServiceNetworks()
 	if err != nil {
-		return entries
-	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			log.Println(err.Error())
-		}
-	}(rows)
-	for rows.Next() {
-		var cidr sql.NullString
-		var name sql.NullString
-		err := rows.Scan(&cidr, &name)
-		if err != nil {
-			log.Println(err.Error())
-			continue
-		}
-		entries = append(entries, ServiceNetwork{CIDR: cidr.String, Name: name.String})
+		log.Println(err.Error())
+		return []ServiceNetwork{}
 	}
 	return entries
 }
 
-func getInterfacesMetrics(exporter string, interfac string, start time.Time, end time.Time) ([]Metric, error) {
-	var rows *sql.Rows
-	var err error
-	var metrics []Metric
-	log.Println("start: ", start)
-	log.Println("end : ", end)
-	log.Println("start: ", start.Format("2006-01-02T15:04"))
-	log.Println("end : ", start.Format("2006-01-02T15:04"))
-
-	rows, err = config.Db.Query("select inserted_at,octets_in,octets_out from interface_metrics where exporter = $1 and snmp_index = $2 and (inserted_at AT TIME ZONE 'UTC' >= $3 and inserted_at AT TIME ZONE 'UTC' <= $4 )", exporter, interfac, start.Format("2006-01-02T15:04"), end.Format("2006-01-02T15:04"))
-	if err != nil {
-		return nil, err
-	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			log.Println(err.Error())
-		}
-	}(rows)
-	for rows.Next() {
-		//var row Row
-		var metric Metric
-		var ts sql.NullTime
-		var octets_in sql.NullInt64
-		var octets_out sql.NullInt64
-		err := rows.Scan(
-			&ts,
-			&octets_in,
-			&octets_out)
-		if err != nil {
-			log.Println(err.Error())
-			continue
-		}
-		if ts.Valid {
-			metric.Timestamp = ts.Time
-		}
-		if octets_out.Valid {
-			metric.OctetsOut = octets_out.Int64
-		}
-		if octets_in.Valid {
-			metric.OctetsIn = octets_in.Int64
-		}
-		metrics = append(metrics, metric)
-
-	}
-	//log.Println(metrics)
-	sort.Slice(metrics, func(i, j int) bool {
-		//return times[i].Before(times[j]) // ascending
-		return metrics[i].Timestamp.Before(metrics[j].Timestamp)
-	})
-
-	return metrics, nil
-}
-
 func getServicesRequest(w http.ResponseWriter, r *http.Request) {
 	format := r.PathValue("format")
 
@@ -469,6 +330,11 @@ func getInterfacesRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if scope := scopeFrom(r.Context()); scope != nil {
+		interfaces = slices.DeleteFunc(interfaces, func(interfac Interface) bool {
+			return !scope.InterfaceIndex(interfac.Exporter, int64(interfac.Snmp_if))
+		})
+	}
 	if format == "list" || format == "" {
 		var line = ""
 		for _, interfac := range interfaces {
@@ -498,138 +364,38 @@ func getInterfacesRequest(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func handleQueryRequest(w http.ResponseWriter, r *http.Request) {
-	value := r.PathValue("path")
-	log.Println(value)
-	body := fmt.Sprintf("Not implemented\nPath: %s", value)
-	http.Error(w, body, http.StatusNotImplemented)
-}
-
 func getInterfacesList(exporter string) ([]Interface, error) {
-	var interfaces []Interface
-
-	var rows *sql.Rows
-	var err error
-	if exporter == "" {
-		log.Println("No exporter")
-		rows, err = config.Db.Query("select id,exporter,snmp_index,description,alias,speed,enabled from interfaces ;")
-	} else {
-		log.Println("Exporter: " + exporter)
-		rows, err = config.Db.Query("select id,exporter,snmp_index,description,alias,speed,enabled from interfaces where exporter = $1 ;", exporter)
-	}
-
+	configs, err := config.Metrics.InterfaceConfigs(exporter)
 	if err != nil {
 		return nil, err
 	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			log.Println(err.Error())
-
-		}
-	}(rows)
-
-	for rows.Next() {
-		interfac := Interface{}
-		//var row Row
-		var id sql.NullInt64
-		var exporter sql.NullString
-		var snmp_index sql.NullInt64
-		var description sql.NullString
-		var alias sql.NullString
-		var speed sql.NullInt64
-		var enabled sql.NullBool
-		err := rows.Scan(
-			&id,
-			&exporter,
-			&snmp_index,
-			&description,
-			&alias,
-			&speed,
-			&enabled,
-		)
-		if err != nil {
-			log.Println(err.Error())
-			return nil, err
-		}
-		if !id.Valid {
-			log.Println("No ID")
-			continue
-		}
-		if !exporter.Valid {
-			log.Println("No exporter")
-			continue
-		}
-		if !snmp_index.Valid {
-			log.Println("No snmp_index")
-			continue
-		}
-		if !description.Valid {
-			log.Println("No description")
-			//continue
+	interfaces := make([]Interface, len(configs))
+	for i, iface := range configs {
+		interfaces[i] = Interface{
+			ID:       iface.ID,
+			Exporter: strconv.FormatInt(iface.Exporter, 10),
+			Snmp_if:  uint64(iface.SnmpIndex),
+			Descr:    iface.Description,
+			Alias:    iface.Alias,
+			Speed:    iface.Speed,
+			Enabled:  iface.Enabled,
 		}
-		if !alias.Valid {
-			log.Println("No alias")
-			//continue
-		}
-		if !speed.Valid {
-			log.Println("No speed")
-			//continue
-		}
-		if !enabled.Valid {
-			log.Println("No enabled")
-			//continue
-		}
-		interfac.ID = uint64(id.Int64)
-		interfac.Exporter = exporter.String
-		interfac.Snmp_if = uint64(snmp_index.Int64)
-		interfac.Descr = description.String
-		interfac.Alias = alias.String
-		interfac.Speed = speed.Int64
-		interfac.Enabled = enabled.Bool
-
-		interfaces = append(interfaces, interfac)
-		log.Println(interfac)
-		log.Println(interfaces)
 	}
 	return interfaces, nil
 }
 
 func getExporterList() (map[int]Exporter, error) {
-	var exporters = make(map[int]Exporter)
-
-	var rows *sql.Rows
-	var err error
-
-	rows, err = config.Db.Query("select id,ip_bin,ip_inet,name from exporters ;")
+	configs, err := config.Metrics.ExporterConfigs()
 	if err != nil {
 		return nil, err
 	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			log.Println(err.Error())
-
-		}
-	}(rows)
-
-	for rows.Next() {
-		exporter := Exporter{}
-		//var row Row
-
-		err := rows.Scan(
-			&exporter.ID,
-			&exporter.IP_Bin,
-			&exporter.IP_Inet,
-			&exporter.Name,
-		)
-		if err != nil {
-			log.Println(err.Error())
-			return nil, err
+	var exporters = make(map[int]Exporter)
+	for _, exp := range configs {
+		exporter := Exporter{ID: exp.ID, IP_Inet: exp.IPInet, Name: exp.Name}
+		if ip4 := net.ParseIP(exp.IPInet).To4(); ip4 != nil {
+			exporter.IP_Bin = int64(binary.BigEndian.Uint32(ip4))
 		}
 		exporters[int(exporter.ID)] = exporter
-		log.Println(exporter)
-		log.Println(exporters)
 	}
 	return exporters, nil
 }
@@ -646,6 +412,10 @@ func getExportersRequest(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Println(err.Error())
 	}
+	scope := scopeFrom(r.Context())
+	maps.DeleteFunc(exporters, func(_ int, exporter Exporter) bool {
+		return !scope.Exporter(strconv.FormatUint(exporter.ID, 10))
+	})
 	log.Println(exporters)
 	if format == "list" || format == "" {
 		var line = ""
@@ -656,38 +426,24 @@ func getExportersRequest(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, line)
 	} else if format == "json" {
 		// Return an array of objects with ip_inet and name from the exporters table
-		rows, qerr := config.Db.Query("SELECT id,ip_inet, name FROM exporters ORDER BY ip_inet")
-		if qerr != nil {
-			http.Error(w, qerr.Error(), http.StatusInternalServerError)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
 		type exporterItem struct {
 			Id     int64  `json:"id"`
 			IPInet string `json:"ip_inet"`
 			Name   string `json:"name"`
 		}
-		list := make([]exporterItem, 0)
-		for rows.Next() {
-			var id sql.NullInt64
-			var ip sql.NullString
-			var name sql.NullString
-			if err := rows.Scan(&id, &ip, &name); err != nil {
-				log.Println("scan exporters json:", err)
-				continue
-			}
-			item := exporterItem{Id: 0, IPInet: "", Name: ""}
-			if ip.Valid {
-				item.IPInet = ip.String
-			}
-			if name.Valid {
-				item.Name = name.String
-			}
-			if id.Valid {
-				item.Id = id.Int64
-			}
-			list = append(list, item)
+		list := make([]exporterItem, 0, len(exporters))
+		for _, exporter := range exporters {
+			list = append(list, exporterItem{Id: int64(exporter.ID), IPInet: exporter.IP_Inet, Name: exporter.Name})
 		}
+		slices.SortFunc(list, func(a, b exporterItem) int {
+			addrA, _ := netip.ParseAddr(a.IPInet)
+			addrB, _ := netip.ParseAddr(b.IPInet)
+			return addrA.Compare(addrB)
+		})
 		bytes, err := json.Marshal(list)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -728,22 +484,17 @@ func getFlowExportersRequest(w http.ResponseWriter, r *http.Request) {
 		format = r.FormValue("format")
 	}
 
-	rows, err := config.Db.Query("SELECT DISTINCT exporter::text FROM flows_hourly ORDER BY exporter::text")
+	flowExporters, err := config.Flows.FlowExporters()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
+	scope := scopeFrom(r.Context())
 	exporters := []string{}
-	for rows.Next() {
-		var exp sql.NullString
-		if err := rows.Scan(&exp); err != nil {
-			log.Println(err)
-			continue
-		}
-		if exp.Valid {
-			exporters = append(exporters, exp.String)
+	for _, exp := range flowExporters {
+		if scope.Exporter(exp) {
+			exporters = append(exporters, exp)
 		}
 	}
 
@@ -792,33 +543,22 @@ func getFlowInterfacesRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "exporter is required", http.StatusBadRequest)
 		return
 	}
+	scope := scopeFrom(r.Context())
+	if !scope.Exporter(exporter) {
+		http.Error(w, fmt.Sprintf("Access to exporter %q denied", exporter), http.StatusForbidden)
+		return
+	}
 
-	query := `
-		SELECT DISTINCT input as ifindex
-		FROM flows_hourly
-		WHERE exporter = $1::inet AND input IS NOT NULL
-		UNION
-		SELECT DISTINCT output as ifindex
-		FROM flows_hourly
-		WHERE exporter = $1::inet AND output IS NOT NULL
-		ORDER BY ifindex`
-
-	rows, err := config.Db.Query(query, exporter)
+	flowInterfaces, err := config.Flows.FlowInterfaces(exporter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
 	indices := []int64{}
-	for rows.Next() {
-		var idx sql.NullInt64
-		if err := rows.Scan(&idx); err != nil {
-			log.Println(err)
-			continue
-		}
-		if idx.Valid {
-			indices = append(indices, idx.Int64)
+	for _, idx := range flowInterfaces {
+		if scope.InterfaceIndex(exporter, idx) {
+			indices = append(indices, idx)
 		}
 	}
 
@@ -833,11 +573,12 @@ func getFlowInterfacesRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	names := interfaceNames(exporter)
 	if format == "combo" {
 		line := "<select name=\"interface\" id=\"interface\">"
 		line = fmt.Sprintf("%s\n<option value=\"\">%s</option>", line, "select interface")
 		for _, idx := range indices {
-			line = fmt.Sprintf("%s\n<option value=\"%d\">[%d]</option>", line, idx, idx)
+			line = fmt.Sprintf("%s\n<option value=\"%d\">[%d]%s</option>", line, idx, idx, names[idx])
 		}
 		line = fmt.Sprintf("%s\n</select>\n", line)
 		fmt.Fprintf(w, line)
@@ -847,18 +588,51 @@ func getFlowInterfacesRequest(w http.ResponseWriter, r *http.Request) {
 	// default htmx list
 	line := ""
 	for _, idx := range indices {
-		line = fmt.Sprintf("%s<li hx-post=\"/api/v1/body/%s/%d\" hx-target=\"#body\">[%d]</li>\n", line, exporter, idx, idx)
+		line = fmt.Sprintf("%s<li hx-post=\"/api/v1/body/%s/%d\" hx-target=\"#body\">[%d]%s</li>\n", line, exporter, idx, idx, names[idx])
 	}
 	fmt.Fprintf(w, line)
 }
+
+// interfaceNames maps the ifIndexes of the exporter with the given address to
+// " name" labels from the interfaces table, as filled by SNMP discovery
+func interfaceNames(exporter string) map[int64]string {
+	names := make(map[int64]string)
+	exporters, err := config.Metrics.ExporterConfigs()
+	if err != nil {
+		log.Println(err)
+		return names
+	}
+	for _, exp := range exporters {
+		if exp.IPInet != exporter {
+			continue
+		}
+		interfaces, err := config.Metrics.InterfaceConfigs(strconv.FormatUint(exp.ID, 10))
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		for _, iface := range interfaces {
+			if iface.Name != "" {
+				names[iface.SnmpIndex] = " " + html.EscapeString(iface.Name)
+			}
+		}
+		break
+	}
+	return names
+}
 func getFlowsRequest(w http.ResponseWriter, r *http.Request) {
 	rs := ReturnStruct{}
 	w.Header().Set("Content-Type", "application/json")
 	lastStr := r.PathValue("last")
 
 	exporterStr := r.PathValue("exporter")
+	scope := scopeFrom(r.Context())
+	if !scope.Exporter(exporterStr) {
+		http.Error(w, fmt.Sprintf("Access to exporter %q denied", exporterStr), http.StatusForbidden)
+		return
+	}
 
-	rs.Fdb, lastStr = getFlowsDB(exporterStr, lastStr)
+	rs.Fdb, lastStr = getFlowsDB(exporterStr, lastStr, scope)
 
 	//rs.Last = time.Now().Unix()
 	rs.Last = lastStr
@@ -875,6 +649,16 @@ func getFlowsRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// PortTimeSeriesPoint holds the bytes of one protocol and port pair in an
+// hourly bucket; missing columns are nil
+type PortTimeSeriesPoint struct {
+	Bucket     time.Time
+	Prot       *int64
+	SrcPort    *int64
+	DstPort    *int64
+	TotalBytes int64
+}
+
 // getPortsProtocolsTimeseriesJSON serves aggregated flow bytes per bucket grouped by protocol and port.
 // Path: /api/v1/flows/ports-timeseries/{exporter}/{interface}/{start}/{end}/{direction}/{portrole}/json
 // exporter: exporter ID as used elsewhere (resolved to inet)
@@ -891,6 +675,9 @@ func getPortsProtocolsTimeseriesJSON(w http.ResponseWriter, r *http.Request) {
 	}
 	exporterStr := r.PathValue("exporter")
 	ifaceStr := r.PathValue("interface")
+	if !authorizeExporter(w, r, exporterStr, ifaceStr) {
+		return
+	}
 	startStr := r.PathValue("start")
 	endStr := r.PathValue("end")
 	// Resolve exporter to inet string. Accept either inet (contains '.' or ':') or numeric ID.
@@ -932,32 +719,21 @@ func getPortsProtocolsTimeseriesJSON(w http.ResponseWriter, r *http.Request) {
 	if end.IsZero() {
 		end = time.Now()
 	}
-	// Build and execute query
-	col := "input"
-	if direction == "output" {
-		col = "output"
-	}
-	q := fmt.Sprintf(`
-		select bucket, prot, srcport, dstport, sum(total_bytes) as total_bytes
-		from flows_hourly
-		where exporter = $1 and %s = $2 and bucket AT TIME ZONE 'UTC' >= $3 and bucket AT TIME ZONE 'UTC' <= $4
-		group by bucket, prot, srcport, dstport
-		order by bucket asc
-	`, col)
-	rows, err := config.Db.Query(q, exporterInet, ifaceStr, start, end)
+	// Query the store
+	samplingRate := getSamplingRate(exporterInet, ifaceStr)
+	w.Header().Set("X-Sampling-Rate", strconv.FormatInt(samplingRate, 10))
+	points, err := config.Flows.PortTimeSeries(TrafficFilter{
+		Exporter:     exporterInet,
+		Interface:    ifaceStr,
+		Direction:    direction,
+		StartTime:    start,
+		EndTime:      end,
+		SamplingRate: samplingRate,
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-	// Prepare scanning vars
-	var (
-		bucket     sql.NullTime
-		prot       sql.NullInt64
-		srcport    sql.NullInt64
-		dstport    sql.NullInt64
-		totalBytes sql.NullInt64
-	)
 	type Row struct {
 		Bucket     string `json:"bucket"`
 		Prot       *int64 `json:"prot"`
@@ -966,40 +742,19 @@ func getPortsProtocolsTimeseriesJSON(w http.ResponseWriter, r *http.Request) {
 		TotalBytes int64  `json:"total_bytes"`
 	}
 	var out []Row
-	for rows.Next() {
-		if err := rows.Scan(&bucket, &prot, &srcport, &dstport, &totalBytes); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		var pPtr, spPtr, dpPtr *int64
-		if prot.Valid {
-			v := prot.Int64
-			pPtr = &v
-		}
-		if srcport.Valid {
-			v := srcport.Int64
-			spPtr = &v
-		}
-		if dstport.Valid {
-			v := dstport.Int64
-			dpPtr = &v
-		}
-		bkt := time.Now().UTC().Format(time.RFC3339)
-		if bucket.Valid {
-			bkt = bucket.Time.UTC().Format(time.RFC3339)
+	for _, point := range points {
+		bkt := time.Now().Format(time.RFC3339)
+		if !point.Bucket.IsZero() {
+			bkt = point.Bucket.Format(time.RFC3339)
 		}
 		out = append(out, Row{
 			Bucket:     bkt,
-			Prot:       pPtr,
-			SrcPort:    spPtr,
-			DstPort:    dpPtr,
-			TotalBytes: totalBytes.Int64,
+			Prot:       point.Prot,
+			SrcPort:    point.SrcPort,
+			DstPort:    point.DstPort,
+			TotalBytes: point.TotalBytes,
 		})
 	}
-	if err := rows.Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(out); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1014,8 +769,55 @@ func main() {
 	//TIP <p>Press <shortcut actionId="ShowIntentionActions"/> when your caret is at the underlined text
 	// to see how GoLand suggests fixing the warning.</p><p>Alternatively, if available, click the lightbulb to view possible fixes.</p>
 	config.Bind_address = os.Getenv("CNETFLOW_GOBACKEND_BIND")
+	config.Collector_bind = os.Getenv("CNETFLOW_COLLECTOR_BIND")
+	config.Sflow_bind = os.Getenv("CNETFLOW_SFLOW_BIND")
+	config.Snmp_poll = os.Getenv("CNETFLOW_SNMP_POLL_INTERVAL")
+	config.Snmp_discovery = os.Getenv("CNETFLOW_SNMP_DISCOVERY_INTERVAL")
+	config.Alert_interval = os.Getenv("CNETFLOW_ALERT_INTERVAL")
+	if config.Alert_interval == "" {
+		config.Alert_interval = "60s"
+	}
+	config.Ddos_interval = os.Getenv("CNETFLOW_DDOS_INTERVAL")
+	if config.Ddos_interval == "" {
+		config.Ddos_interval = "60s"
+	}
+	config.Ddos_min_pps = os.Getenv("CNETFLOW_DDOS_MIN_PPS")
+	config.Ddos_factor = os.Getenv("CNETFLOW_DDOS_FACTOR")
+	config.Scan_interval = os.Getenv("CNETFLOW_SCAN_INTERVAL")
+	if config.Scan_interval == "" {
+		config.Scan_interval = "60s"
+	}
+	config.Scan_window = os.Getenv("CNETFLOW_SCAN_WINDOW")
+	config.Scan_min_hosts = os.Getenv("CNETFLOW_SCAN_MIN_HOSTS")
+	config.Scan_min_ports = os.Getenv("CNETFLOW_SCAN_MIN_PORTS")
+	config.Scan_suppress = os.Getenv("CNETFLOW_SCAN_SUPPRESS")
+	config.Baseline_interval = os.Getenv("CNETFLOW_BASELINE_INTERVAL")
+	if config.Baseline_interval == "" {
+		config.Baseline_interval = "1h"
+	}
+	config.Baseline_weeks = os.Getenv("CNETFLOW_BASELINE_WEEKS")
+	config.Notify_config = os.Getenv("CNETFLOW_NOTIFY_CONFIG")
+	config.Auth_mode = os.Getenv("CNETFLOW_AUTH")
+	config.Admin_password = os.Getenv("CNETFLOW_ADMIN_PASSWORD")
+	config.Oidc_issuer = os.Getenv("CNETFLOW_OIDC_ISSUER")
+	config.Oidc_client_id = os.Getenv("CNETFLOW_OIDC_CLIENT_ID")
+	config.Oidc_secret = os.Getenv("CNETFLOW_OIDC_CLIENT_SECRET")
+	config.Oidc_redirect_url = os.Getenv("CNETFLOW_OIDC_REDIRECT_URL")
+	config.Oidc_scopes = os.Getenv("CNETFLOW_OIDC_SCOPES")
+	config.Oidc_groups_claim = os.Getenv("CNETFLOW_OIDC_GROUPS_CLAIM")
+	config.Oidc_user_claim = os.Getenv("CNETFLOW_OIDC_USERNAME_CLAIM")
+	config.Oidc_role_map = os.Getenv("CNETFLOW_OIDC_ROLE_MAP")
+	config.Secret_keys = os.Getenv("CNETFLOW_SECRET_KEYS")
+	config.Secret_keys_file = os.Getenv("CNETFLOW_SECRET_KEYS_FILE")
 	config.Conn_string = os.Getenv("PG_CONN_STRING")
 	config.TZ = os.Getenv("TZ")
+	config.DB_TZ = os.Getenv("DB_TZ")
+	if config.DB_TZ == "" {
+		config.DB_TZ = config.TZ
+	}
+	if err := setDBTimezone(config.DB_TZ); err != nil {
+		log.Fatal(err)
+	}
 	config.Maxmind_database = os.Getenv("MAXMIND_DATABASE")
 	config.Dbrest = os.Getenv("PGREST_URL")
 	if config.Maxmind_database == "" {
@@ -1042,9 +844,158 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	store := newPGStore(config.Db)
+	if err := store.migrate(); err != nil {
+		log.Fatal(err)
+	}
+	timezoneSource := "DB_TZ"
+	if os.Getenv("DB_TZ") == "" {
+		timezoneSource = "TZ"
+	}
+	if config.DB_TZ == "" {
+		// Neither DB_TZ nor TZ is set: follow the server, whose zone now()
+		// writes in, rather than the zone of the host running the backend
+		timezoneSource = "database server"
+		name, err := store.serverTimezone()
+		if err == nil {
+			err = setDBTimezone(name)
+		}
+		if err != nil {
+			timezoneSource = "default"
+			log.Printf("Error reading the database server time zone, using UTC: %v", err)
+		}
+	}
+	log.Printf("Database time zone: %s (%s)", dbLocation, timezoneSource)
+	secretKeys, err = loadKeyring(config.Secret_keys, config.Secret_keys_file)
+	if err != nil {
+		log.Fatalf("Error loading secret keys: %v", err)
+	}
+	if secretKeys == nil {
+		log.Println("CNETFLOW_SECRET_KEYS is not set, SNMP credentials are stored unencrypted")
+	} else {
+		n, err := store.resealSecrets()
+		if n > 0 {
+			log.Printf("Encrypted the SNMP credentials of %d exporters with key %s", n, secretKeys.primary)
+		}
+		if err != nil {
+			log.Printf("Error encrypting SNMP credentials: %v", err)
+		}
+	}
+	config.Flows = store
+	config.Metrics = store
+	config.Alerts = store
+	config.Auth = store
+	config.Audit = store
 	if config.Bind_address == "" {
 		config.Bind_address = ":3002"
 	}
+	var collectorBinds []string
+	if config.Collector_bind != "" {
+		collectorBinds = append(collectorBinds, config.Collector_bind)
+	}
+	if config.Sflow_bind != "" {
+		collectorBinds = append(collectorBinds, config.Sflow_bind)
+	}
+	if len(collectorBinds) > 0 {
+		flowCollector, err = NewFlowCollector(collectorBinds...)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		go flowCollector.Run()
+	}
+	pollInterval, err := parseInterval("CNETFLOW_SNMP_POLL_INTERVAL", config.Snmp_poll)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pollInterval > 0 {
+		log.Printf("SNMP poller enabled every %s", pollInterval)
+		snmpPoller = NewSNMPPoller(pollInterval)
+		go snmpPoller.Run()
+	}
+	discoveryInterval, err := parseInterval("CNETFLOW_SNMP_DISCOVERY_INTERVAL", config.Snmp_discovery)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if discoveryInterval > 0 {
+		log.Printf("SNMP interface discovery enabled every %s", discoveryInterval)
+		go runInterfaceDiscovery(discoveryInterval)
+	}
+	if config.Notify_config != "" {
+		channels, err := loadNotifyConfig(config.Notify_config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifier, err = NewNotifyDispatcher(channels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Notifications enabled on %d channels", len(channels))
+	}
+	alertInterval, err := parseInterval("CNETFLOW_ALERT_INTERVAL", config.Alert_interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alertEngine, err = NewAlertEngine()
+	if err != nil {
+		log.Fatal(err)
+	}
+	go alertEngine.Run(alertInterval)
+	ddosInterval, err := parseInterval("CNETFLOW_DDOS_INTERVAL", config.Ddos_interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ddosDetector, err = NewDDoSDetector(ddosInterval, config.Ddos_min_pps, config.Ddos_factor)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go ddosDetector.Run()
+	scanInterval, err := parseInterval("CNETFLOW_SCAN_INTERVAL", config.Scan_interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scanDetector, err = NewScanDetector(scanInterval, config.Scan_window, config.Scan_min_hosts, config.Scan_min_ports, config.Scan_suppress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go scanDetector.Run()
+	baselineInterval, err := parseInterval("CNETFLOW_BASELINE_INTERVAL", config.Baseline_interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	baselineEngine, err = NewBaselineEngine(baselineInterval, config.Baseline_weeks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go baselineEngine.Run()
+	mux := newRouter()
+	var handler http.Handler = mux
+	switch config.Auth_mode {
+	case "off":
+		log.Println("CNETFLOW_AUTH=off, the API and UI are open to anyone")
+	case "", "on":
+		if err := bootstrapAdmin(config.Admin_password); err != nil {
+			log.Fatal(err)
+		}
+		if config.Oidc_issuer != "" {
+			oidcLogin, err = NewOIDCLogin(config.Oidc_issuer, config.Oidc_client_id, config.Oidc_secret, config.Oidc_redirect_url,
+				config.Oidc_scopes, config.Oidc_groups_claim, config.Oidc_user_claim, config.Oidc_role_map)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Single sign-on with %s enabled", config.Oidc_issuer)
+		}
+		handler = NewAuthMiddleware(mux, sessionAuthenticator{sessions}, tokenAuthenticator{})
+	default:
+		log.Fatalf("invalid CNETFLOW_AUTH %q, use on or off", config.Auth_mode)
+	}
+	err = http.ListenAndServe(config.Bind_address, handler)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// newRouter registers the API endpoints and the static UI files
+func newRouter() *http.ServeMux {
 	mux := http.NewServeMux()
 	fileServer := http.FileServer(http.Dir("./static"))
 	//mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
@@ -1055,6 +1006,11 @@ func main() {
 	mux.HandleFunc("/api/v1/interfaces/{format}", getInterfacesRequest)
 	mux.HandleFunc("/api/v1/metrics/{exporter}/{interface}", getInterfacesMetricsRequest)
 	mux.HandleFunc("/api/v1/metrics/{exporter}/{interface}/tag", renderChartTag)
+	mux.HandleFunc("/api/v1/metrics/{exporter}/{interface}/rate", getInterfaceRatesRequest)
+	mux.HandleFunc("/api/v1/billing/{exporter}/{interface}", getBillingRequest)
+	mux.HandleFunc("/api/v1/baseline/{exporter}/{interface}", getBaselineRequest)
+	mux.HandleFunc("/api/v1/capacity", getCapacityRankingRequest)
+	mux.HandleFunc("/api/v1/capacity/{exporter}/{interface}", getCapacityRequest)
 	mux.HandleFunc("/api/v1/metrics/{exporter}/{interface}/{start}/{end}/png", renderTimeseriesChartPNG)
 	mux.HandleFunc("/api/v1/metrics/{exporter}/{interface}/png", renderTimeseriesChartPNG)
 	mux.HandleFunc("/api/v1/metrics/{exporter}/{interface}/js", highcharts)
@@ -1098,19 +1054,43 @@ func main() {
 	mux.HandleFunc("/api/v1/enrichment", getEnrichmentRequest)
 	mux.HandleFunc("/api/v1/enrichment/bulk", getBulkEnrichmentRequest)
 
+	// Built-in flow collector counters
+	mux.HandleFunc("/api/v1/collector/stats", getCollectorStatsRequest)
+	mux.HandleFunc("/api/v1/poller/stats", getPollerStatsRequest)
+	mux.HandleFunc("/api/v1/alerts/rules", alertRulesRequest)
+	mux.HandleFunc("/api/v1/alerts/rules/{id}", alertRuleRequest)
+	mux.HandleFunc("/api/v1/alerts/history", getAlertHistoryRequest)
+	mux.HandleFunc("/api/v1/alerts/active", getActiveAlertsRequest)
+	mux.HandleFunc("/api/v1/notify/test", notifyTestRequest)
+	mux.HandleFunc("/api/v1/security/ddos", getDDoSRequest)
+	mux.HandleFunc("/api/v1/security/scans", getScansRequest)
+
 	// PostgreSQL metrics endpoint
 	mux.HandleFunc("/api/v1/postgres/metrics", getPostgresMetricsRequest)
 
 	// Configuration endpoints
 	mux.HandleFunc("/api/v1/config/exporters", getExportersConfigRequest)
 	mux.HandleFunc("/api/v1/config/exporters/update", updateExporterRequest)
+	mux.HandleFunc("/api/v1/config/exporters/{id}/discover", discoverExporterRequest)
 	mux.HandleFunc("/api/v1/config/interfaces", getInterfacesConfigRequest)
 	mux.HandleFunc("/api/v1/config/interfaces/update", updateInterfaceRequest)
 	mux.HandleFunc("/api/v1/config/interfaces/bulk-update", bulkUpdateInterfacesRequest)
+	mux.HandleFunc("/api/v1/audit", getAuditRequest)
+
+	// Authentication endpoints
+	mux.HandleFunc("/api/v1/auth/login", loginRequest)
+	mux.HandleFunc("/api/v1/auth/logout", logoutRequest)
+	mux.HandleFunc("/api/v1/auth/me", getAuthMeRequest)
+	mux.HandleFunc("/api/v1/auth/providers", getAuthProvidersRequest)
+	mux.HandleFunc("/api/v1/auth/oidc/login", oidcLoginRequest)
+	mux.HandleFunc("/api/v1/auth/oidc/callback", oidcCallbackRequest)
+	mux.HandleFunc("/api/v1/auth/users", authUsersRequest)
+	mux.HandleFunc("/api/v1/auth/users/{id}", authUserRequest)
+	mux.HandleFunc("/api/v1/auth/tokens", authTokensRequest)
+	mux.HandleFunc("/api/v1/auth/tokens/{id}", authTokenRequest)
+	mux.HandleFunc("/api/v1/auth/scopes", authScopesRequest)
+	mux.HandleFunc("/api/v1/auth/scopes/{id}", authScopeRequest)
 
 	mux.Handle("/", http.StripPrefix("", fileServer))
-	err = http.ListenAndServe(config.Bind_address, mux)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
+	return mux
 }
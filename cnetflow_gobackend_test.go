@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporterListHandlers(t *testing.T) {
+	store := useMemoryStore(t)
+	store.AddExporter(ExporterConfig{ID: 1, IPInet: "192.0.2.10", Name: "b"})
+	store.AddExporter(ExporterConfig{ID: 2, IPInet: "2001:db8::1", Name: "c"})
+	store.AddExporter(ExporterConfig{ID: 3, IPInet: "192.0.2.9", Name: "a"})
+
+	w := serve(getExportersRequest, httptest.NewRequest(http.MethodGet, "/api/v1/exporters/json", nil), "format", "json")
+	if got := strings.TrimSpace(w.Body.String()); got != `[{"id":3,"ip_inet":"192.0.2.9","name":"a"},{"id":1,"ip_inet":"192.0.2.10","name":"b"},{"id":2,"ip_inet":"2001:db8::1","name":"c"}]` {
+		t.Errorf("exporters = %s", got)
+	}
+
+	exporters, err := getExporterList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exporters[1].IP_Bin != 0xc000020a || exporters[2].IP_Bin != 0 {
+		t.Errorf("ip_bin = %d, %d", exporters[1].IP_Bin, exporters[2].IP_Bin)
+	}
+
+	w = serve(getExportersRequest, httptest.NewRequest(http.MethodGet, "/api/v1/exporters/combo", nil), "format", "combo")
+	if !strings.Contains(w.Body.String(), `<option value="2001:db8::1">[2] c 2001:db8::1</option>`) {
+		t.Errorf("combo = %s", w.Body)
+	}
+}
+
+func TestFlowListHandlers(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+
+	w := serve(getFlowExportersRequest, httptest.NewRequest(http.MethodGet, "/api/v1/flows/exporters/json", nil), "format", "json")
+	if got := strings.TrimSpace(w.Body.String()); got != `["192.0.2.1/32","192.0.2.2/32"]` {
+		t.Errorf("flow exporters = %s", got)
+	}
+
+	w = serve(getFlowInterfacesRequest, httptest.NewRequest(http.MethodGet, "/api/v1/flows/interfaces/192.0.2.1/json", nil),
+		"exporter", "192.0.2.1", "format", "json")
+	if got := strings.TrimSpace(w.Body.String()); got != "[3,4,5,7]" {
+		t.Errorf("flow interfaces = %s", got)
+	}
+
+	w = serve(getFlowInterfacesRequest, httptest.NewRequest(http.MethodGet, "/api/v1/flows/interfaces", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("without exporter: status %d, want 400", w.Code)
+	}
+}
+
+func TestInterfacesHandler(t *testing.T) {
+	store := useMemoryStore(t)
+	store.AddInterface(InterfaceConfig{ID: 7, Exporter: 1, SnmpIndex: 12, Description: "xe-0/0/1", Alias: "transit", Speed: 10000000000})
+	store.AddInterface(InterfaceConfig{ID: 8, Exporter: 1, SnmpIndex: 2, Description: "ge-0/0/0"})
+	store.AddInterface(InterfaceConfig{ID: 9, Exporter: 2, SnmpIndex: 1, Description: "eth0"})
+
+	w := serve(getInterfacesRequest, httptest.NewRequest(http.MethodGet, "/api/v1/interfaces/1/json", nil),
+		"exporter", "1", "format", "json")
+	var interfaces []Interface
+	if err := json.Unmarshal(w.Body.Bytes(), &interfaces); err != nil {
+		t.Fatal(err)
+	}
+	if len(interfaces) != 2 || interfaces[0].Snmp_if != 2 || interfaces[1].Alias != "transit" || interfaces[1].Exporter != "1" {
+		t.Errorf("interfaces = %+v", interfaces)
+	}
+}
+
+func TestPortsTimeseriesHandler(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	store.exporters[0].Data = map[string]interface{}{samplingRateKey: float64(2)}
+
+	start, end := testHour.Add(-time.Hour).Unix(), testHour.Add(time.Hour).Unix()
+	w := serve(getPortsProtocolsTimeseriesJSON, httptest.NewRequest(http.MethodGet, "/api/v1/flows/ports-timeseries", nil),
+		"exporter", "1", "interface", "3", "direction", "input",
+		"start", strconv.FormatInt(start, 10), "end", strconv.FormatInt(end, 10))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if rate := w.Header().Get("X-Sampling-Rate"); rate != "2" {
+		t.Errorf("X-Sampling-Rate = %s", rate)
+	}
+	var rows []struct {
+		Bucket     string `json:"bucket"`
+		Prot       *int64 `json:"prot"`
+		DstPort    *int64 `json:"dstport"`
+		TotalBytes int64  `json:"total_bytes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, row := range rows {
+		if row.Bucket != "2025-06-01T10:00:00Z" || row.Prot == nil || row.DstPort == nil {
+			t.Errorf("row = %+v", row)
+		}
+		total += row.TotalBytes
+	}
+	if len(rows) != 3 || total != 9000 {
+		t.Errorf("%d rows, %d bytes", len(rows), total)
+	}
+
+	w = serve(getPortsProtocolsTimeseriesJSON, httptest.NewRequest(http.MethodGet, "/api/v1/flows/ports-timeseries", nil),
+		"exporter", "42", "interface", "3")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown exporter: status %d, want 400", w.Code)
+	}
+}
+
+func TestServiceNetworksHandler(t *testing.T) {
+	store := useMemoryStore(t)
+	store.AddServiceNetworks(ServiceNetwork{CIDR: "10.0.0.0/24", Name: "office"})
+
+	w := serve(getServiceNetworksRequest, httptest.NewRequest(http.MethodGet, "/api/v1/service-networks", nil))
+	if got := strings.TrimSpace(w.Body.String()); got != `[{"cidr":"10.0.0.0/24","name":"office"}]` {
+		t.Errorf("service networks = %s", got)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Maximum size of a single UDP datagram we are willing to read
+	collectorMaxDatagram = 65535
+	// Number of decoded records buffered between the decoders and the DB writer
+	collectorQueueSize = 100000
+	// Flush the pending batch when it reaches this many rows...
+	collectorBatchSize = 1000
+	// ...or when this much time has passed since the last flush
+	collectorFlushInterval = 2 * time.Second
+
+	netflowV5HeaderLen = 24
+	netflowV5RecordLen = 48
+)
+
+// CollectorStats holds the counters exposed by /api/v1/collector/stats
+type CollectorStats struct {
+	Enabled       bool     `json:"enabled"`
+	BindAddresses []string `json:"bind_addresses,omitempty"`
+	Datagrams     uint64   `json:"datagrams"`
+	Records       uint64   `json:"records"`
+	DecodeErrors  uint64   `json:"decode_errors"`
+	QueueDrops    uint64   `json:"queue_drops"`
+	SequenceGaps  uint64   `json:"sequence_gaps"`
+	LostFlows     uint64   `json:"lost_flows"`
+	LostDatagrams uint64   `json:"lost_datagrams"`
+	Inserted      uint64   `json:"inserted"`
+	InsertErrors  uint64   `json:"insert_errors"`
+
+	Templates        int               `json:"templates"`
+	MissingTemplates uint64            `json:"missing_templates"`
+	SamplingRates    map[string]uint32 `json:"sampling_rates,omitempty"`
+}
+
+// FlowCollector receives flow export datagrams over UDP, decodes them into
+// FlowDB records and batch-inserts them into the flows table.
+type FlowCollector struct {
+	binds     []string
+	conns     []*net.UDPConn
+	queue     chan FlowDB
+	sequences *sequenceTracker
+	templates *TemplateCache
+	exporters sync.Map
+
+	datagrams     atomic.Uint64
+	records       atomic.Uint64
+	decodeErrors  atomic.Uint64
+	queueDrops    atomic.Uint64
+	sequenceGaps  atomic.Uint64
+	lostFlows     atomic.Uint64
+	lostDatagrams atomic.Uint64
+	inserted      atomic.Uint64
+	insertErrors  atomic.Uint64
+
+	missingTemplates atomic.Uint64
+}
+
+var flowCollector *FlowCollector
+
+// netflowV5Header is the fixed 24 byte header of a NetFlow v5 export packet
+type netflowV5Header struct {
+	Version          uint16
+	Count            uint16
+	SysUptime        uint32
+	UnixSecs         uint32
+	UnixNsecs        uint32
+	FlowSequence     uint32
+	EngineType       uint8
+	EngineID         uint8
+	SamplingInterval uint16
+}
+
+// sequenceTracker remembers the next expected sequence number per exporter
+// stream so gaps (lost datagrams) can be detected.
+type sequenceTracker struct {
+	mu   sync.Mutex
+	next map[string]uint32
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{next: make(map[string]uint32)}
+}
+
+// check records that a packet with sequence number seq was received and that
+// the following packet should carry seq+increment. It returns the number of
+// sequence units missing between the previous packet and this one.
+// Sequence numbers going backwards are treated as an exporter restart or
+// reordering and never counted as loss.
+func (s *sequenceTracker) check(key string, seq uint32, increment uint32) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expected, seen := s.next[key]
+	s.next[key] = seq + increment
+	if !seen {
+		return 0
+	}
+	gap := seq - expected
+	if gap == 0 || gap >= 1<<31 {
+		return 0
+	}
+	return gap
+}
+
+// forget drops the expected sequence number of key, so the next packet is
+// taken as the start of the sequence
+func (s *sequenceTracker) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.next, key)
+}
+
+// NewFlowCollector creates a collector listening on every given UDP address.
+// All sockets share the same decoders and DB writer.
+func NewFlowCollector(binds ...string) (*FlowCollector, error) {
+	c := &FlowCollector{
+		binds:     binds,
+		queue:     make(chan FlowDB, collectorQueueSize),
+		sequences: newSequenceTracker(),
+		templates: NewTemplateCache(templateExpiry),
+	}
+	for _, bind := range binds {
+		addr, err := net.ResolveUDPAddr("udp", bind)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("invalid collector address %q: %w", bind, err)
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("listen %s: %w", bind, err)
+		}
+		if err := conn.SetReadBuffer(4 * 1024 * 1024); err != nil {
+			log.Printf("Collector: unable to enlarge socket buffer: %v", err)
+		}
+		c.conns = append(c.conns, conn)
+	}
+	return c, nil
+}
+
+// Run starts the DB writer and blocks reading datagrams until every socket is closed
+func (c *FlowCollector) Run() {
+	go c.writer()
+	go c.expireTemplates()
+
+	var wg sync.WaitGroup
+	for i, conn := range c.conns {
+		wg.Add(1)
+		go func(bind string, conn *net.UDPConn) {
+			defer wg.Done()
+			c.listen(bind, conn)
+		}(c.binds[i], conn)
+	}
+	wg.Wait()
+	close(c.queue)
+}
+
+// listen reads datagrams from one socket until it is closed
+func (c *FlowCollector) listen(bind string, conn *net.UDPConn) {
+	log.Printf("Flow collector listening on %s", bind)
+	buf := make([]byte, collectorMaxDatagram)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Collector read error on %s: %v", bind, err)
+			continue
+		}
+		c.datagrams.Add(1)
+		c.handleDatagram(buf[:n], remote.IP)
+	}
+}
+
+// Close stops the collector; pending records are flushed by the writer
+func (c *FlowCollector) Close() error {
+	var firstErr error
+	for _, conn := range c.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// handleDatagram dispatches a datagram to the decoder for its export version
+func (c *FlowCollector) handleDatagram(data []byte, exporter net.IP) {
+	if len(data) < 4 {
+		c.decodeErrors.Add(1)
+		return
+	}
+	var flows []FlowDB
+	var err error
+	version := binary.BigEndian.Uint16(data[0:2])
+	switch {
+	case version == 5:
+		flows, err = c.decodeNetflowV5(data, exporter)
+	case version == 9:
+		flows, err = c.decodeNetflowV9(data, exporter)
+	case version == 10:
+		flows, err = c.decodeIPFIX(data, exporter)
+	case binary.BigEndian.Uint32(data[0:4]) == 5:
+		// sFlow carries a 32 bit version, so its first 16 bits are zero
+		flows, err = c.decodeSflow(data, exporter)
+	default:
+		err = fmt.Errorf("unsupported export version %d", version)
+	}
+	if err != nil {
+		c.decodeErrors.Add(1)
+		log.Printf("Collector: datagram from %s: %v", exporter, err)
+		return
+	}
+	c.enqueue(flows)
+}
+
+// enqueue hands decoded records to the writer without blocking the reader
+func (c *FlowCollector) enqueue(flows []FlowDB) {
+	for _, flow := range flows {
+		c.registerExporter(flow.Exporter)
+		select {
+		case c.queue <- flow:
+			c.records.Add(1)
+		default:
+			c.queueDrops.Add(1)
+		}
+	}
+}
+
+// registerExporter adds exporters seen for the first time to the exporters
+// table so they show up in the UI without manual configuration
+func (c *FlowCollector) registerExporter(exporter string) {
+	if _, known := c.exporters.LoadOrStore(exporter, true); known {
+		return
+	}
+	go func() {
+		added, err := config.Metrics.RegisterExporter(exporter)
+		if err != nil {
+			log.Printf("Collector: unable to register exporter %s: %v", exporter, err)
+			c.exporters.Delete(exporter)
+			return
+		}
+		if added {
+			log.Printf("Collector: registered new exporter %s", exporter)
+		}
+	}()
+}
+
+// decodeNetflowV5 parses a NetFlow v5 export packet into FlowDB records
+func (c *FlowCollector) decodeNetflowV5(data []byte, exporter net.IP) ([]FlowDB, error) {
+	header, err := parseNetflowV5Header(data)
+	if err != nil {
+		return nil, err
+	}
+	expected := netflowV5HeaderLen + int(header.Count)*netflowV5RecordLen
+	if len(data) < expected {
+		return nil, fmt.Errorf("netflow v5 packet truncated: %d bytes, header announces %d records", len(data), header.Count)
+	}
+
+	key := fmt.Sprintf("v5|%s|%d|%d", exporter, header.EngineType, header.EngineID)
+	if lost := c.sequences.check(key, header.FlowSequence, uint32(header.Count)); lost > 0 {
+		c.sequenceGaps.Add(1)
+		c.lostFlows.Add(uint64(lost))
+		log.Printf("Collector: netflow v5 sequence gap from %s: %d flows lost before sequence %d", exporter, lost, header.FlowSequence)
+	}
+
+	flows := make([]FlowDB, 0, header.Count)
+	for i := 0; i < int(header.Count); i++ {
+		offset := netflowV5HeaderLen + i*netflowV5RecordLen
+		flows = append(flows, parseNetflowV5Record(header, data[offset:offset+netflowV5RecordLen], exporter))
+	}
+	return flows, nil
+}
+
+// parseNetflowV5Header decodes the v5 header fields
+func parseNetflowV5Header(data []byte) (netflowV5Header, error) {
+	var h netflowV5Header
+	if len(data) < netflowV5HeaderLen {
+		return h, fmt.Errorf("netflow v5 header truncated: %d bytes", len(data))
+	}
+	h.Version = binary.BigEndian.Uint16(data[0:2])
+	h.Count = binary.BigEndian.Uint16(data[2:4])
+	h.SysUptime = binary.BigEndian.Uint32(data[4:8])
+	h.UnixSecs = binary.BigEndian.Uint32(data[8:12])
+	h.UnixNsecs = binary.BigEndian.Uint32(data[12:16])
+	h.FlowSequence = binary.BigEndian.Uint32(data[16:20])
+	h.EngineType = data[20]
+	h.EngineID = data[21]
+	h.SamplingInterval = binary.BigEndian.Uint16(data[22:24])
+	if h.Version != 5 {
+		return h, fmt.Errorf("not a netflow v5 packet (version %d)", h.Version)
+	}
+	if h.Count == 0 || h.Count > 30 {
+		return h, fmt.Errorf("invalid netflow v5 record count %d", h.Count)
+	}
+	return h, nil
+}
+
+// parseNetflowV5Record decodes one 48 byte v5 flow record
+func parseNetflowV5Record(h netflowV5Header, rec []byte, exporter net.IP) FlowDB {
+	return FlowDB{
+		Exporter:  exporter.String(),
+		SrcAddr:   net.IP(rec[0:4]).String(),
+		DstAddr:   net.IP(rec[4:8]).String(),
+		Input:     int64(binary.BigEndian.Uint16(rec[12:14])),
+		Output:    int64(binary.BigEndian.Uint16(rec[14:16])),
+		DPkts:     int64(binary.BigEndian.Uint32(rec[16:20])),
+		DOctets:   int64(binary.BigEndian.Uint32(rec[20:24])),
+		First:     uptimeToTime(h.UnixSecs, h.UnixNsecs, h.SysUptime, binary.BigEndian.Uint32(rec[24:28])),
+		Last:      uptimeToTime(h.UnixSecs, h.UnixNsecs, h.SysUptime, binary.BigEndian.Uint32(rec[28:32])),
+		SrcPort:   int64(binary.BigEndian.Uint16(rec[32:34])),
+		DstPort:   int64(binary.BigEndian.Uint16(rec[34:36])),
+		TCPFlags:  strconv.Itoa(int(rec[37])),
+		Protocol:  strconv.Itoa(int(rec[38])),
+		TOS:       strconv.Itoa(int(rec[39])),
+		SrcAS:     int64(binary.BigEndian.Uint16(rec[40:42])),
+		DstAS:     int64(binary.BigEndian.Uint16(rec[42:44])),
+		SrcMask:   strconv.Itoa(int(rec[44])),
+		DstMask:   strconv.Itoa(int(rec[45])),
+		IPVersion: "4",
+	}
+}
+
+// uptimeToTime converts a router uptime in milliseconds into wall clock time
+// using the export timestamp and uptime carried in the packet header.
+// The unsigned subtraction keeps working across a 32 bit uptime wrap.
+func uptimeToTime(unixSecs uint32, unixNsecs uint32, sysUptime uint32, uptime uint32) time.Time {
+	export := time.Unix(int64(unixSecs), int64(unixNsecs))
+	return export.Add(-time.Duration(sysUptime-uptime) * time.Millisecond)
+}
+
+// writer drains the queue and inserts records in batches
+func (c *FlowCollector) writer() {
+	batch := make([]FlowDB, 0, collectorBatchSize)
+	ticker := time.NewTicker(collectorFlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := config.Flows.InsertFlows(batch); err != nil {
+			c.insertErrors.Add(uint64(len(batch)))
+			log.Printf("Collector: error inserting %d flows: %v", len(batch), err)
+		} else {
+			c.inserted.Add(uint64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case flow, ok := <-c.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, flow)
+			if len(batch) >= collectorBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Stats returns a snapshot of the collector counters
+func (c *FlowCollector) Stats() CollectorStats {
+	return CollectorStats{
+		Enabled:       true,
+		BindAddresses: c.binds,
+		Datagrams:     c.datagrams.Load(),
+		Records:       c.records.Load(),
+		DecodeErrors:  c.decodeErrors.Load(),
+		QueueDrops:    c.queueDrops.Load(),
+		SequenceGaps:  c.sequenceGaps.Load(),
+		LostFlows:     c.lostFlows.Load(),
+		LostDatagrams: c.lostDatagrams.Load(),
+		Inserted:      c.inserted.Load(),
+		InsertErrors:  c.insertErrors.Load(),
+
+		Templates:        c.templates.Len(),
+		MissingTemplates: c.missingTemplates.Load(),
+		SamplingRates:    c.templates.SamplingRates(),
+	}
+}
+
+// getCollectorStatsRequest reports the built-in collector counters
+func getCollectorStatsRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	stats := CollectorStats{}
+	if flowCollector != nil {
+		stats = flowCollector.Stats()
+	}
+
+	jsonBytes, err := json.Marshal(stats)
+	if err != nil {
+		log.Printf("Error marshaling collector stats: %v", err)
+		http.Error(w, `{"error": "failed to encode response"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// netflowV5Packet builds a v5 packet of an engine with count records of
+// 10.0.0.1 to 10.0.0.2
+func netflowV5Packet(sequence uint32, engineID uint8, count int) []byte {
+	packet := make([]byte, netflowV5HeaderLen+count*netflowV5RecordLen)
+	binary.BigEndian.PutUint16(packet[0:2], 5)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(count))
+	binary.BigEndian.PutUint32(packet[4:8], 60000)
+	binary.BigEndian.PutUint32(packet[8:12], 1748772000)
+	binary.BigEndian.PutUint32(packet[16:20], sequence)
+	packet[21] = engineID
+	for i := 0; i < count; i++ {
+		rec := packet[netflowV5HeaderLen+i*netflowV5RecordLen:]
+		copy(rec[0:4], net.IPv4(10, 0, 0, 1).To4())
+		copy(rec[4:8], net.IPv4(10, 0, 0, 2).To4())
+		binary.BigEndian.PutUint32(rec[20:24], 1500)
+		rec[38] = 6
+	}
+	return packet
+}
+
+func TestNetflowV5Sequence(t *testing.T) {
+	c := &FlowCollector{sequences: newSequenceTracker()}
+	exporter := net.ParseIP("192.0.2.1")
+	tests := []struct {
+		name     string
+		sequence uint32
+		engineID uint8
+		count    int
+		// Totals after the packet
+		gaps uint64
+		lost uint64
+	}{
+		{"first packet", 100, 0, 2, 0, 0},
+		{"in order", 102, 0, 3, 0, 0},
+		{"in order", 105, 0, 1, 0, 0},
+		{"gap", 110, 0, 2, 1, 4},
+		// Each engine of an exporter has its own sequence
+		{"other engine", 7, 1, 1, 1, 4},
+		{"near the wrap", 0xfffffffe, 0, 3, 1, 4},
+		{"after the wrap", 1, 0, 2, 1, 4},
+		{"gap after the wrap", 5, 0, 1, 2, 6},
+		// Going back is a restart, not 4 billion lost flows
+		{"restart", 0, 0, 2, 2, 6},
+		{"after the restart", 2, 0, 2, 2, 6},
+		{"other engine in order", 8, 1, 1, 2, 6},
+	}
+	for _, tt := range tests {
+		flows, err := c.decodeNetflowV5(netflowV5Packet(tt.sequence, tt.engineID, tt.count), exporter)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(flows) != tt.count || flows[0].SrcAddr != "10.0.0.1" || flows[0].DOctets != 1500 || flows[0].Exporter != "192.0.2.1" {
+			t.Errorf("%s: flows = %+v", tt.name, flows)
+		}
+		if gaps, lost := c.sequenceGaps.Load(), c.lostFlows.Load(); gaps != tt.gaps || lost != tt.lost {
+			t.Errorf("%s (sequence %d): %d gaps, %d lost flows, want %d and %d", tt.name, tt.sequence, gaps, lost, tt.gaps, tt.lost)
+		}
+	}
+
+	// A truncated packet is refused before it touches the sequence
+	if _, err := c.decodeNetflowV5(netflowV5Packet(100, 0, 2)[:100], exporter); err == nil {
+		t.Error("truncated packet decoded")
+	}
+	if _, err := c.decodeNetflowV5(netflowV5Packet(4, 0, 1), exporter); err != nil || c.sequenceGaps.Load() != 2 {
+		t.Errorf("sequence after a truncated packet: %v, %d gaps", err, c.sequenceGaps.Load())
+	}
+}
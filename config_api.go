@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -23,47 +22,46 @@ func updateExporterRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Marshal data to JSON
-	dataJSON, err := json.Marshal(exporter.Data)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error marshaling data: %v", err), http.StatusBadRequest)
+	if err := normalizeSamplingConfig(exporter.Data); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sampling configuration: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	query := `
-		UPDATE exporters
-		SET name = $1,
-		    snmp_version = $2,
-		    snmp_community = $3,
-		    snmpv3_username = $4,
-		    snmpv3_level = $5,
-		    snmpv3_auth_proto = $6,
-		    snmpv3_auth_pass = $7,
-		    snmpv3_priv_proto = $8,
-		    snmpv3_priv_pass = $9,
-		    data = $10
-		WHERE id = $11
-	`
-
-	_, err = config.Db.Exec(query,
-		exporter.Name,
-		exporter.SnmpVersion,
-		exporter.SnmpCommunity,
-		exporter.Snmpv3Username,
-		exporter.Snmpv3Level,
-		exporter.Snmpv3AuthProto,
-		exporter.Snmpv3AuthPass,
-		exporter.Snmpv3PrivProto,
-		exporter.Snmpv3PrivPass,
-		dataJSON,
-		exporter.ID,
-	)
+	before, err := findExporterConfig(exporter.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying exporters: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if before == nil {
+		http.Error(w, "Exporter not found", http.StatusNotFound)
+		return
+	}
+	secrets, err := config.Metrics.ExporterSecrets(exporter.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying exporters: %v", err), http.StatusInternalServerError)
+		return
+	}
 
+	err = config.Metrics.UpdateExporter(exporter)
 	if err != nil {
 		log.Printf("Error updating exporter: %v", err)
 		http.Error(w, fmt.Sprintf("Error updating exporter: %v", err), http.StatusInternalServerError)
 		return
 	}
+	// Blank secrets are kept, so log the stored row rather than the request
+	var after interface{}
+	if stored, err := findExporterConfig(exporter.ID); err != nil {
+		log.Printf("Error querying updated exporter: %v", err)
+	} else if stored != nil {
+		masked := maskExporterSecrets(*stored)
+		if changed, err := config.Metrics.ExporterSecrets(exporter.ID); err != nil {
+			log.Printf("Error querying updated exporter: %v", err)
+		} else {
+			markChangedSecrets(&masked, secrets, changed)
+		}
+		after = masked
+	}
+	recordAudit(r, fmt.Sprintf("exporter %d", exporter.ID), maskExporterSecrets(*before), after)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -74,52 +72,17 @@ func updateExporterRequest(w http.ResponseWriter, r *http.Request) {
 
 // getExportersConfigRequest returns detailed exporter configuration
 func getExportersConfigRequest(w http.ResponseWriter, r *http.Request) {
-	query := `
-		SELECT
-			id, ip_inet, name, snmp_version, snmp_community,
-			snmpv3_username, snmpv3_level, snmpv3_auth_proto,
-			snmpv3_priv_proto, data
-		FROM exporters
-		ORDER BY id
-	`
-
-	rows, err := config.Db.Query(query)
+	exporters, err := config.Metrics.ExporterConfigs()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error querying exporters: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var exporters []ExporterConfig
-	for rows.Next() {
-		var exp ExporterConfig
-		var dataJSON []byte
-		err := rows.Scan(
-			&exp.ID,
-			&exp.IPInet,
-			&exp.Name,
-			&exp.SnmpVersion,
-			&exp.SnmpCommunity,
-			&exp.Snmpv3Username,
-			&exp.Snmpv3Level,
-			&exp.Snmpv3AuthProto,
-			&exp.Snmpv3PrivProto,
-			&dataJSON,
-		)
-		if err != nil {
-			log.Printf("Error scanning exporter: %v", err)
-			continue
-		}
-
-		// Parse JSON data
-		if len(dataJSON) > 0 {
-			json.Unmarshal(dataJSON, &exp.Data)
-		}
 
-		// Don't send passwords to frontend
-		exp.Snmpv3AuthPass = ""
-		exp.Snmpv3PrivPass = ""
-		exporters = append(exporters, exp)
+	// The SNMP secrets are write-only, never send them back
+	for i := range exporters {
+		exporters[i].SnmpCommunity = ""
+		exporters[i].Snmpv3AuthPass = ""
+		exporters[i].Snmpv3PrivPass = ""
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -130,53 +93,11 @@ func getExportersConfigRequest(w http.ResponseWriter, r *http.Request) {
 func getInterfacesConfigRequest(w http.ResponseWriter, r *http.Request) {
 	exporterID := r.URL.Query().Get("exporter")
 
-	var query string
-	var rows *sql.Rows
-	var err error
-
-	if exporterID != "" {
-		query = `
-			SELECT id, exporter, snmp_index, name, description, alias, speed, enabled, bandwidth
-			FROM interfaces
-			WHERE exporter = $1
-			ORDER BY snmp_index
-		`
-		rows, err = config.Db.Query(query, exporterID)
-	} else {
-		query = `
-			SELECT id, exporter, snmp_index, name, description, alias, speed, enabled, bandwidth
-			FROM interfaces
-			ORDER BY exporter, snmp_index
-		`
-		rows, err = config.Db.Query(query)
-	}
-
+	interfaces, err := config.Metrics.InterfaceConfigs(exporterID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error querying interfaces: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var interfaces []InterfaceConfig
-	for rows.Next() {
-		var iface InterfaceConfig
-		err := rows.Scan(
-			&iface.ID,
-			&iface.Exporter,
-			&iface.SnmpIndex,
-			&iface.Name,
-			&iface.Description,
-			&iface.Alias,
-			&iface.Speed,
-			&iface.Enabled,
-			&iface.Bandwidth,
-		)
-		if err != nil {
-			log.Printf("Error scanning interface: %v", err)
-			continue
-		}
-		interfaces = append(interfaces, iface)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(interfaces)
@@ -196,20 +117,27 @@ func updateInterfaceRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `
-		UPDATE interfaces
-		SET enabled = $1,
-		    alias = $2,
-		    bandwidth = $3
-		WHERE id = $4
-	`
+	before, err := findInterfaceConfig(iface.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying interfaces: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if before == nil {
+		http.Error(w, "Interface not found", http.StatusNotFound)
+		return
+	}
 
-	_, err = config.Db.Exec(query, iface.Enabled, iface.Alias, iface.Bandwidth, iface.ID)
+	err = config.Metrics.UpdateInterface(iface)
 	if err != nil {
 		log.Printf("Error updating interface: %v", err)
 		http.Error(w, fmt.Sprintf("Error updating interface: %v", err), http.StatusInternalServerError)
 		return
 	}
+	after, err := findInterfaceConfig(iface.ID)
+	if err != nil {
+		log.Printf("Error querying updated interface: %v", err)
+	}
+	recordAudit(r, fmt.Sprintf("exporter %d interface %d", before.Exporter, before.SnmpIndex), before, after)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -242,15 +170,23 @@ func bulkUpdateInterfacesRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `UPDATE interfaces SET enabled = $1 WHERE exporter = $2`
-	result, err := config.Db.Exec(query, req.Enabled, exporterIDInt)
+	before, err := config.Metrics.InterfaceConfigs(strconv.FormatInt(exporterIDInt, 10))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying interfaces: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := config.Metrics.SetInterfacesEnabled(exporterIDInt, req.Enabled)
 	if err != nil {
 		log.Printf("Error bulk updating interfaces: %v", err)
 		http.Error(w, fmt.Sprintf("Error updating interfaces: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	rowsAffected, _ := result.RowsAffected()
+	after, err := config.Metrics.InterfaceConfigs(strconv.FormatInt(exporterIDInt, 10))
+	if err != nil {
+		log.Printf("Error querying updated interfaces: %v", err)
+	}
+	recordAudit(r, fmt.Sprintf("exporter %d interfaces", exporterIDInt), before, after)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
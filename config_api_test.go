@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExportersConfigHandler(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+
+	w := serve(getExportersConfigRequest, httptest.NewRequest(http.MethodGet, "/api/v1/config/exporters", nil))
+	var exporters []ExporterConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &exporters); err != nil {
+		t.Fatal(err)
+	}
+	if len(exporters) != 2 {
+		t.Fatalf("exporters = %+v", exporters)
+	}
+	// Secrets are write-only
+	if exporters[0].SnmpCommunity != "" || !exporters[0].SnmpCommunitySet || exporters[1].SnmpCommunitySet {
+		t.Errorf("exporters = %+v", exporters)
+	}
+}
+
+func TestUpdateExporterHandler(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+
+	body := `{"id": 1, "name": "core", "snmp_version": 2, "snmp_community": "", "data": {"sampling_rate": "100"}}`
+	w := serve(updateExporterRequest, httptest.NewRequest(http.MethodPost, "/api/v1/config/exporters/update", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	targets, _ := store.PollTargets()
+	if len(targets) != 1 || targets[0].Name != "core" || targets[0].SnmpCommunity != "public" {
+		t.Errorf("a blank community must keep the stored one: %+v", targets)
+	}
+	if rate := getSamplingRate("192.0.2.1", "3"); rate != 100 {
+		t.Errorf("sampling rate = %d, want 100", rate)
+	}
+
+	entries, _ := store.AuditEntries(AuditFilter{})
+	if len(entries) != 1 {
+		t.Fatalf("audit entries = %+v", entries)
+	}
+	entry := entries[0]
+	if entry.Target != "exporter 1" || entry.Actor != "anonymous" || entry.Endpoint != "POST /api/v1/config/exporters/update" {
+		t.Errorf("audit entry = %+v", entry)
+	}
+	if strings.Contains(string(entry.Before), "public") || !strings.Contains(string(entry.Before), `"name":"edge1"`) {
+		t.Errorf("audit before = %s", entry.Before)
+	}
+	// The blank community was kept, not cleared
+	if strings.Contains(string(entry.After), "public") || !strings.Contains(string(entry.After), `"snmp_community":"********"`) ||
+		!strings.Contains(string(entry.After), `"name":"core"`) {
+		t.Errorf("audit after = %s", entry.After)
+	}
+
+	// New secrets show as changed, without their values
+	body = `{"id": 1, "name": "core", "snmp_version": 3, "snmp_community": "private", "snmpv3_priv_pass": "s3cret"}`
+	if w := serve(updateExporterRequest, httptest.NewRequest(http.MethodPost, "/api/v1/config/exporters/update", strings.NewReader(body))); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	entries, _ = store.AuditEntries(AuditFilter{Limit: 1})
+	var before, after ExporterConfig
+	json.Unmarshal(entries[0].Before, &before)
+	json.Unmarshal(entries[0].After, &after)
+	if before.SnmpCommunity != maskedSecret || before.Snmpv3PrivPass != "" {
+		t.Errorf("audit before = %s", entries[0].Before)
+	}
+	if after.SnmpCommunity != changedSecret || after.Snmpv3AuthPass != "" || after.Snmpv3PrivPass != changedSecret ||
+		strings.Contains(string(entries[0].After), "s3cret") {
+		t.Errorf("audit after = %s", entries[0].After)
+	}
+
+	for _, tt := range []struct {
+		method string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "{", http.StatusBadRequest},
+		{http.MethodPost, `{"id": 99}`, http.StatusNotFound},
+		{http.MethodPost, `{"id": 1, "data": {"sampling_rate": -1}}`, http.StatusBadRequest},
+	} {
+		w := serve(updateExporterRequest, httptest.NewRequest(tt.method, "/api/v1/config/exporters/update", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.body, w.Code, tt.status)
+		}
+	}
+}
+
+func TestUpdateInterfaceHandlers(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	store.AddInterface(InterfaceConfig{ID: 1, Exporter: 1, SnmpIndex: 3, Name: "ge-0/0/3", Enabled: true})
+	store.AddInterface(InterfaceConfig{ID: 2, Exporter: 1, SnmpIndex: 4, Name: "ge-0/0/4", Enabled: true})
+	store.AddInterface(InterfaceConfig{ID: 3, Exporter: 2, SnmpIndex: 1, Name: "eth0", Enabled: true})
+
+	body := `{"id": 2, "enabled": false, "alias": "uplink", "bandwidth": 1000000000}`
+	w := serve(updateInterfaceRequest, httptest.NewRequest(http.MethodPost, "/api/v1/config/interfaces/update", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	w = serve(getInterfacesConfigRequest, httptest.NewRequest(http.MethodGet, "/api/v1/config/interfaces?exporter=1", nil))
+	var interfaces []InterfaceConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &interfaces); err != nil {
+		t.Fatal(err)
+	}
+	if len(interfaces) != 2 || interfaces[1].Enabled || interfaces[1].Alias != "uplink" || interfaces[1].Bandwidth != 1000000000 {
+		t.Errorf("interfaces = %+v", interfaces)
+	}
+
+	w = serve(bulkUpdateInterfacesRequest, httptest.NewRequest(http.MethodPost, "/api/v1/config/interfaces/bulk-update",
+		strings.NewReader(`{"exporter_id": "1", "enabled": false}`)))
+	var result struct {
+		RowsAffected int64 `json:"rows_affected"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.RowsAffected != 2 {
+		t.Errorf("rows affected = %d, want 2", result.RowsAffected)
+	}
+	if iface, _ := findInterfaceConfig(3); iface == nil || !iface.Enabled {
+		t.Errorf("interface of another exporter changed: %+v", iface)
+	}
+
+	entries, _ := store.AuditEntries(AuditFilter{})
+	if len(entries) != 2 || entries[0].Target != "exporter 1 interfaces" || entries[1].Target != "exporter 1 interface 4" {
+		t.Errorf("audit entries = %+v", entries)
+	}
+
+	if w := serve(updateInterfaceRequest, httptest.NewRequest(http.MethodPost, "/api/v1/config/interfaces/update",
+		strings.NewReader(`{"id": 42}`))); w.Code != http.StatusNotFound {
+		t.Errorf("unknown interface: status %d, want 404", w.Code)
+	}
+	if w := serve(bulkUpdateInterfacesRequest, httptest.NewRequest(http.MethodPost, "/api/v1/config/interfaces/bulk-update",
+		strings.NewReader(`{"exporter_id": "one"}`))); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid exporter ID: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Attack vectors reported by the DDoS detector. Amplification vectors are
+// named after the service, e.g. dns_amplification.
+const (
+	ddosPacketFlood = "packet_flood"
+	ddosSourceFlood = "source_flood"
+	ddosSynFlood    = "syn_flood"
+)
+
+// amplificationPorts are the UDP source ports of services abused for
+// reflection and amplification attacks
+var amplificationPorts = []struct {
+	Port    int64
+	Service string
+}{
+	{19, "chargen"},
+	{53, "dns"},
+	{123, "ntp"},
+	{161, "snmp"},
+	{389, "cldap"},
+	{1900, "ssdp"},
+	{11211, "memcached"},
+}
+
+const (
+	defaultDDoSMinPPS = 10000
+	defaultDDoSFactor = 5
+	// Distinct sources per window a destination needs to be a source flood
+	ddosMinSources = 1000
+	// Weight of the last window in the baselines
+	ddosBaselineWeight = 0.1
+	// Runs during which first-seen destinations start from their current
+	// traffic instead of zero
+	ddosWarmup     = 5
+	ddosTopSources = 10
+	// Ended attacks kept for the report
+	ddosHistory = 100
+)
+
+// DestinationStats sums the raw flows of one destination address. Packet
+// and byte counts are scaled by the sampling rate.
+type DestinationStats struct {
+	Address string
+	Packets int64
+	Octets  int64
+	Flows   int64
+	// Distinct source addresses
+	Sources int64
+	// Packets of TCP flows with SYN but no ACK
+	SynPackets int64
+	// UDP packets per amplification source port
+	Amplification map[int64]int64
+}
+
+// DDoSAttack is an attack on one destination seen by one exporter. Rates are
+// per second over the detector interval; Value, Baseline and Threshold are
+// in the unit of the vector (packets per second, or sources for a source
+// flood).
+type DDoSAttack struct {
+	Exporter   string              `json:"exporter"`
+	Target     string              `json:"target"`
+	Vector     string              `json:"vector"`
+	Active     bool                `json:"active"`
+	Start      time.Time           `json:"start"`
+	LastSeen   time.Time           `json:"last_seen"`
+	End        *time.Time          `json:"end,omitempty"`
+	Value      float64             `json:"value"`
+	PeakValue  float64             `json:"peak_value"`
+	Baseline   float64             `json:"baseline"`
+	Threshold  float64             `json:"threshold"`
+	PeakPPS    float64             `json:"peak_pps"`
+	PeakBPS    float64             `json:"peak_bps"`
+	Sources    int64               `json:"sources"`
+	TopSources []TrafficAggregated `json:"top_sources"`
+}
+
+// DDoSReport is the response of /api/v1/security/ddos
+type DDoSReport struct {
+	Enabled  bool         `json:"enabled"`
+	Interval string       `json:"interval,omitempty"`
+	MinPPS   float64      `json:"min_pps,omitempty"`
+	Factor   float64      `json:"factor,omitempty"`
+	Attacks  []DDoSAttack `json:"attacks"`
+}
+
+// DDoSDetector looks at the raw flows of every exporter once per interval.
+// Each destination keeps a moving baseline per vector; a vector is an attack
+// when it exceeds both its floor and factor times the baseline. The attack
+// lasts until the vector falls under half of the threshold it crossed.
+type DDoSDetector struct {
+	interval time.Duration
+	minPPS   float64
+	factor   float64
+
+	mu        sync.Mutex
+	runs      int
+	baselines map[string]map[string]float64
+	active    map[string]*DDoSAttack
+	ended     []DDoSAttack
+}
+
+var ddosDetector *DDoSDetector
+
+// NewDDoSDetector parses the thresholds, empty strings selecting the
+// defaults
+func NewDDoSDetector(interval time.Duration, minPPS string, factor string) (*DDoSDetector, error) {
+	d := &DDoSDetector{
+		interval:  interval,
+		minPPS:    defaultDDoSMinPPS,
+		factor:    defaultDDoSFactor,
+		baselines: make(map[string]map[string]float64),
+		active:    make(map[string]*DDoSAttack),
+	}
+	var err error
+	if minPPS != "" {
+		if d.minPPS, err = strconv.ParseFloat(minPPS, 64); err != nil || d.minPPS <= 0 {
+			return nil, fmt.Errorf("invalid CNETFLOW_DDOS_MIN_PPS %q", minPPS)
+		}
+	}
+	if factor != "" {
+		if d.factor, err = strconv.ParseFloat(factor, 64); err != nil || d.factor <= 1 {
+			return nil, fmt.Errorf("invalid CNETFLOW_DDOS_FACTOR %q, must be greater than 1", factor)
+		}
+	}
+	return d, nil
+}
+
+// Run checks the flows every interval
+func (d *DDoSDetector) Run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		d.Detect(now)
+	}
+}
+
+// Detect checks the flows of the interval ending at now
+func (d *DDoSDetector) Detect(now time.Time) {
+	exporters, err := config.Metrics.ExporterConfigs()
+	if err != nil {
+		log.Printf("DDoS detection: %v", err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.runs++
+	seen := make(map[string]bool)
+	for _, exporter := range exporters {
+		filter := TrafficFilter{
+			Exporter:     exporter.IPInet,
+			StartTime:    now.Add(-d.interval),
+			EndTime:      now,
+			SamplingRate: samplingRateFromData(exporter.Data, ""),
+			// Destinations this quiet have no baseline worth keeping
+			MinPackets: int64(d.minPPS / d.factor * d.interval.Seconds()),
+		}
+		stats, err := config.Flows.DestinationStats(filter)
+		if err != nil {
+			log.Printf("DDoS detection on %s: %v", exporter.IPInet, err)
+			continue
+		}
+		for _, stat := range stats {
+			key := exporter.IPInet + "|" + stat.Address
+			seen[key] = true
+			d.check(filter, stat, now)
+		}
+	}
+
+	// Destinations without traffic decay towards zero and are forgotten,
+	// and their attacks are over
+	for key, baseline := range d.baselines {
+		if seen[key] {
+			continue
+		}
+		idle := true
+		for vector, value := range baseline {
+			baseline[vector] = value * (1 - ddosBaselineWeight)
+			if baseline[vector] >= 1 {
+				idle = false
+			}
+		}
+		if idle {
+			delete(d.baselines, key)
+		}
+	}
+	for key, attack := range d.active {
+		if !seen[attack.Exporter+"|"+attack.Target] {
+			d.finish(key, now)
+		}
+	}
+}
+
+// ddosVectors returns the value and floor of every vector of a destination
+func (d *DDoSDetector) ddosVectors(stat DestinationStats) map[string][2]float64 {
+	seconds := d.interval.Seconds()
+	vectors := map[string][2]float64{
+		ddosPacketFlood: {float64(stat.Packets) / seconds, d.minPPS},
+		ddosSourceFlood: {float64(stat.Sources), ddosMinSources},
+		ddosSynFlood:    {float64(stat.SynPackets) / seconds, d.minPPS / d.factor},
+	}
+	for _, amp := range amplificationPorts {
+		vectors[amp.Service+"_amplification"] = [2]float64{
+			float64(stat.Amplification[amp.Port]) / seconds, d.minPPS / d.factor,
+		}
+	}
+	return vectors
+}
+
+// check compares the vectors of a destination with its baselines
+func (d *DDoSDetector) check(filter TrafficFilter, stat DestinationStats, now time.Time) {
+	key := filter.Exporter + "|" + stat.Address
+	baseline, known := d.baselines[key]
+	if !known {
+		baseline = make(map[string]float64)
+		d.baselines[key] = baseline
+	}
+	pps := float64(stat.Packets) / d.interval.Seconds()
+	bps := float64(stat.Octets) * 8 / d.interval.Seconds()
+
+	for vector, v := range d.ddosVectors(stat) {
+		value, floor := v[0], v[1]
+		attackKey := key + "|" + vector
+		if attack, ok := d.active[attackKey]; ok {
+			if value < attack.Threshold/2 {
+				d.finish(attackKey, now)
+				baseline[vector] = updateBaseline(baseline[vector], value)
+				continue
+			}
+			attack.LastSeen = now
+			attack.Value = value
+			attack.Sources = max(attack.Sources, stat.Sources)
+			attack.PeakBPS = max(attack.PeakBPS, bps)
+			if value > attack.PeakValue {
+				attack.PeakValue = value
+				attack.PeakPPS = max(attack.PeakPPS, pps)
+				attack.TopSources = attackSources(filter, stat.Address, vector)
+			}
+			continue
+		}
+
+		if !known && d.runs <= ddosWarmup {
+			baseline[vector] = value
+			continue
+		}
+		threshold := max(floor, baseline[vector]*d.factor)
+		if value < threshold {
+			baseline[vector] = updateBaseline(baseline[vector], value)
+			continue
+		}
+		attack := &DDoSAttack{
+			Exporter:   filter.Exporter,
+			Target:     stat.Address,
+			Vector:     vector,
+			Active:     true,
+			Start:      now,
+			LastSeen:   now,
+			Value:      value,
+			PeakValue:  value,
+			Baseline:   baseline[vector],
+			Threshold:  threshold,
+			PeakPPS:    pps,
+			PeakBPS:    bps,
+			Sources:    stat.Sources,
+			TopSources: attackSources(filter, stat.Address, vector),
+		}
+		d.active[attackKey] = attack
+		log.Printf("DDoS %s on %s seen by %s: %.0f over threshold %.0f",
+			vector, stat.Address, filter.Exporter, value, threshold)
+		notifier.Notify(ddosNotifyEvent(*attack))
+	}
+}
+
+// finish moves an active attack to the history
+func (d *DDoSDetector) finish(key string, now time.Time) {
+	attack := d.active[key]
+	delete(d.active, key)
+	attack.Active = false
+	attack.End = &now
+	d.ended = append(d.ended, *attack)
+	if len(d.ended) > ddosHistory {
+		d.ended = d.ended[len(d.ended)-ddosHistory:]
+	}
+	log.Printf("DDoS %s on %s seen by %s ended", attack.Vector, attack.Target, attack.Exporter)
+	notifier.Notify(ddosNotifyEvent(*attack))
+}
+
+// updateBaseline adds one window to an exponentially weighted baseline
+func updateBaseline(baseline float64, value float64) float64 {
+	return baseline + (value-baseline)*ddosBaselineWeight
+}
+
+// attackSources returns the top sources of the flows of a vector towards
+// target
+func attackSources(filter TrafficFilter, target string, vector string) []TrafficAggregated {
+	filter.DstAddr = AddrFilter{Hosts: []string{target}}
+	filter.MinPackets = 0
+	filter.Limit = ddosTopSources
+	switch vector {
+	case ddosSynFlood:
+		filter.Protocol = RangeFilter{Ranges: [][2]int64{{6, 6}}}
+	case ddosPacketFlood, ddosSourceFlood:
+	default:
+		for _, amp := range amplificationPorts {
+			if vector == amp.Service+"_amplification" {
+				filter.Protocol = RangeFilter{Ranges: [][2]int64{{17, 17}}}
+				filter.SrcPort = RangeFilter{Ranges: [][2]int64{{amp.Port, amp.Port}}}
+			}
+		}
+	}
+	sources, err := config.Flows.TopSources(filter)
+	if err != nil {
+		log.Printf("DDoS top sources of %s: %v", target, err)
+		return []TrafficAggregated{}
+	}
+	return sources
+}
+
+// Attacks returns the active attacks and the history, newest first
+func (d *DDoSDetector) Attacks() []DDoSAttack {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	attacks := make([]DDoSAttack, 0, len(d.active)+len(d.ended))
+	for _, attack := range d.active {
+		attacks = append(attacks, *attack)
+	}
+	attacks = append(attacks, d.ended...)
+	sort.SliceStable(attacks, func(i, j int) bool {
+		if !attacks[i].Start.Equal(attacks[j].Start) {
+			return attacks[i].Start.After(attacks[j].Start)
+		}
+		return attacks[i].Target+attacks[i].Vector < attacks[j].Target+attacks[j].Vector
+	})
+	return attacks
+}
+
+// ddosNotifyEvent turns the start or the end of an attack into a notification
+func ddosNotifyEvent(attack DDoSAttack) NotifyEvent {
+	event := NotifyEvent{
+		Source:   "ddos",
+		Severity: severityCritical,
+		Title:    fmt.Sprintf("DDoS %s on %s", attack.Vector, attack.Target),
+		Message: fmt.Sprintf("%s towards %s seen by %s: %.0f (baseline %.0f), %.0f packets/s, %.0f bits/s from %d sources",
+			attack.Vector, attack.Target, attack.Exporter, attack.Value, attack.Baseline,
+			attack.PeakPPS, attack.PeakBPS, attack.Sources),
+		Time: attack.Start,
+		Fields: map[string]interface{}{
+			"exporter": attack.Exporter,
+			"target":   attack.Target,
+			"vector":   attack.Vector,
+			"peak_pps": attack.PeakPPS,
+			"peak_bps": attack.PeakBPS,
+			"sources":  attack.Sources,
+		},
+	}
+	if !attack.Active {
+		event.Severity = severityInfo
+		event.Title += " ended"
+		event.Message = fmt.Sprintf("%s towards %s seen by %s ended after %s, peak %.0f packets/s, %.0f bits/s",
+			attack.Vector, attack.Target, attack.Exporter, attack.End.Sub(attack.Start).Round(time.Second),
+			attack.PeakPPS, attack.PeakBPS)
+		event.Time = *attack.End
+	}
+	return event
+}
+
+// getDDoSRequest handles /api/v1/security/ddos. active=true leaves out the
+// attacks that are over and target= selects one destination. Top sources
+// are enriched like the traffic endpoints.
+func getDDoSRequest(w http.ResponseWriter, r *http.Request) {
+	report := DDoSReport{Attacks: []DDoSAttack{}}
+	if ddosDetector != nil {
+		report.Enabled = true
+		report.Interval = ddosDetector.interval.String()
+		report.MinPPS = ddosDetector.minPPS
+		report.Factor = ddosDetector.factor
+		activeOnly := r.URL.Query().Get("active") == "true"
+		target := r.URL.Query().Get("target")
+		for _, attack := range ddosDetector.Attacks() {
+			if (activeOnly && !attack.Active) || (target != "" && attack.Target != target) {
+				continue
+			}
+			report.Attacks = append(report.Attacks, attack)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var ips []string
+	for _, attack := range report.Attacks {
+		for _, source := range attack.TopSources {
+			if !seen[source.Address] {
+				seen[source.Address] = true
+				ips = append(ips, source.Address)
+			}
+		}
+	}
+	if len(ips) > 0 {
+		enrichments := EnrichIPs(ips)
+		for i := range report.Attacks {
+			// The detector's copies are shared, enrich new slices
+			sources := make([]TrafficAggregated, len(report.Attacks[i].TopSources))
+			for j, source := range report.Attacks[i].TopSources {
+				source.Enrichment = enrichments[source.Address]
+				sources[j] = source
+			}
+			report.Attacks[i].TopSources = sources
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error encoding DDoS report: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestDDoSDetector returns a detector with a one minute interval, the
+// default floor of 10000 pps and factor 5, past its warmup
+func newTestDDoSDetector(t *testing.T) *DDoSDetector {
+	t.Helper()
+	d, err := NewDDoSDetector(time.Minute, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.runs = ddosWarmup + 1
+	return d
+}
+
+func TestDDoSThresholds(t *testing.T) {
+	useMemoryStore(t)
+	filter := TrafficFilter{Exporter: "192.0.2.1"}
+	// Per-second values are the counts of the one minute window over 60
+	perMinute := func(perSecond int64) int64 { return perSecond * 60 }
+
+	tests := []struct {
+		name      string
+		baseline  map[string]float64
+		stat      DestinationStats
+		vector    string
+		threshold float64
+	}{
+		{"under the floor", nil, DestinationStats{Packets: perMinute(9999)}, "", 0},
+		{"at the floor", nil, DestinationStats{Packets: perMinute(10000)}, ddosPacketFlood, 10000},
+		// Five times the baseline is above the floor
+		{"under five times the baseline", map[string]float64{ddosPacketFlood: 4000},
+			DestinationStats{Packets: perMinute(19999)}, "", 0},
+		{"at five times the baseline", map[string]float64{ddosPacketFlood: 4000},
+			DestinationStats{Packets: perMinute(20000)}, ddosPacketFlood, 20000},
+		{"sources under the floor", nil, DestinationStats{Sources: 999}, "", 0},
+		{"source flood", nil, DestinationStats{Sources: 1000}, ddosSourceFlood, 1000},
+		// SYN and amplification floors are the packet floor over the factor
+		{"syn flood", nil, DestinationStats{Packets: perMinute(2000), SynPackets: perMinute(2000)}, ddosSynFlood, 2000},
+		{"syn packets under the floor", nil, DestinationStats{Packets: perMinute(1999), SynPackets: perMinute(1999)}, "", 0},
+		{"dns amplification", nil, DestinationStats{Packets: perMinute(2500), Amplification: map[int64]int64{53: perMinute(2500)}},
+			"dns_amplification", 2000},
+		{"amplification on another port", nil, DestinationStats{Packets: perMinute(2500), Amplification: map[int64]int64{54: perMinute(2500)}},
+			"", 0},
+	}
+	for _, tt := range tests {
+		d := newTestDDoSDetector(t)
+		if tt.baseline != nil {
+			d.baselines["192.0.2.1|10.0.1.1"] = tt.baseline
+		}
+		tt.stat.Address = "10.0.1.1"
+		d.check(filter, tt.stat, testHour)
+		if tt.vector == "" {
+			if len(d.active) != 0 {
+				t.Errorf("%s: attacks %v", tt.name, d.active)
+			}
+			continue
+		}
+		attack, ok := d.active["192.0.2.1|10.0.1.1|"+tt.vector]
+		if !ok || len(d.active) != 1 {
+			t.Errorf("%s: attacks %v, want %s", tt.name, d.active, tt.vector)
+			continue
+		}
+		if attack.Threshold != tt.threshold || attack.Target != "10.0.1.1" || !attack.Start.Equal(testHour) {
+			t.Errorf("%s: attack = %+v, want threshold %v", tt.name, attack, tt.threshold)
+		}
+	}
+}
+
+func TestDDoSWarmupAndHysteresis(t *testing.T) {
+	useMemoryStore(t)
+	filter := TrafficFilter{Exporter: "192.0.2.1"}
+	d := newTestDDoSDetector(t)
+
+	// During the warmup a new destination starts from its traffic
+	d.runs = ddosWarmup
+	d.check(filter, DestinationStats{Address: "10.0.1.1", Packets: 60 * 50000}, testHour)
+	if len(d.active) != 0 || d.baselines["192.0.2.1|10.0.1.1"][ddosPacketFlood] != 50000 {
+		t.Fatalf("warmup: attacks %v, baselines %v", d.active, d.baselines)
+	}
+
+	// 250000 pps crosses 5 * 50000; the attack lasts down to half of that
+	d.runs = ddosWarmup + 1
+	key := "192.0.2.1|10.0.1.1|" + ddosPacketFlood
+	for i, tt := range []struct {
+		pps    int64
+		active bool
+	}{
+		{250000, true},
+		{125000, true},
+		{124999, false},
+	} {
+		d.check(filter, DestinationStats{Address: "10.0.1.1", Packets: 60 * tt.pps}, testHour.Add(time.Duration(i)*time.Minute))
+		if _, ok := d.active[key]; ok != tt.active {
+			t.Errorf("%d pps: active %v, want %v", tt.pps, ok, tt.active)
+		}
+	}
+	if len(d.ended) != 1 || d.ended[0].PeakValue != 250000 || d.ended[0].End == nil || !d.ended[0].End.Equal(testHour.Add(2*time.Minute)) {
+		t.Errorf("ended = %+v", d.ended)
+	}
+	// The attack windows stay out of the baseline, the last one is added
+	if got := d.baselines["192.0.2.1|10.0.1.1"][ddosPacketFlood]; got != 50000+(124999-50000)*ddosBaselineWeight {
+		t.Errorf("baseline = %v", got)
+	}
+}
+
+func TestDDoSIdleDestinations(t *testing.T) {
+	store := useMemoryStore(t)
+	store.AddExporter(ExporterConfig{ID: 1, IPInet: "192.0.2.1", Name: "edge1"})
+	d := newTestDDoSDetector(t)
+	d.baselines["192.0.2.1|10.0.1.1"] = map[string]float64{ddosPacketFlood: 10}
+	d.baselines["192.0.2.1|10.0.1.2"] = map[string]float64{ddosPacketFlood: 1.05}
+	d.active["192.0.2.1|10.0.1.1|"+ddosPacketFlood] = &DDoSAttack{Exporter: "192.0.2.1", Target: "10.0.1.1", Vector: ddosPacketFlood}
+
+	// Without flows baselines decay by the baseline weight, and are dropped
+	// under 1
+	d.Detect(testHour)
+	if got := d.baselines["192.0.2.1|10.0.1.1"][ddosPacketFlood]; got != 9 {
+		t.Errorf("decayed baseline = %v, want 9", got)
+	}
+	if _, ok := d.baselines["192.0.2.1|10.0.1.2"]; ok {
+		t.Error("idle baseline kept")
+	}
+	if len(d.active) != 0 || len(d.ended) != 1 {
+		t.Errorf("attack on an idle destination: active %v, ended %+v", d.active, d.ended)
+	}
+}
+
+func TestNewDDoSDetector(t *testing.T) {
+	for _, tt := range []struct {
+		minPPS string
+		factor string
+		ok     bool
+	}{
+		{"", "", true},
+		{"500", "2.5", true},
+		{"0", "", false},
+		{"-1", "", false},
+		{"many", "", false},
+		{"", "1", false},
+		{"", "0.5", false},
+	} {
+		if _, err := NewDDoSDetector(time.Minute, tt.minPPS, tt.factor); (err == nil) != tt.ok {
+			t.Errorf("NewDDoSDetector(%q, %q) error %v", tt.minPPS, tt.factor, err)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	// ifTable columns
+	oidIfDescr = ".1.3.6.1.2.1.2.2.1.2"
+	oidIfSpeed = ".1.3.6.1.2.1.2.2.1.5"
+	// ifXTable columns, missing on SNMPv1-only agents
+	oidIfName      = ".1.3.6.1.2.1.31.1.1.1.1"
+	oidIfHighSpeed = ".1.3.6.1.2.1.31.1.1.1.15"
+	oidIfAlias     = ".1.3.6.1.2.1.31.1.1.1.18"
+)
+
+// InterfaceChange is an interface row before and after a discovery, with the
+// names of the fields that differ
+type InterfaceChange struct {
+	Before InterfaceConfig `json:"before"`
+	After  InterfaceConfig `json:"after"`
+	Fields []string        `json:"fields"`
+}
+
+// InterfaceDiscovery is the result of discovering the interfaces of one
+// exporter. Missing interfaces are reported but kept, since their flows and
+// metrics still reference them.
+type InterfaceDiscovery struct {
+	Exporter   uint64            `json:"exporter"`
+	Address    string            `json:"address"`
+	DryRun     bool              `json:"dry_run"`
+	Discovered int               `json:"discovered"`
+	Added      []InterfaceConfig `json:"added"`
+	Updated    []InterfaceChange `json:"updated"`
+	Renumbered []InterfaceChange `json:"renumbered"`
+	Missing    []InterfaceConfig `json:"missing"`
+	Unchanged  int               `json:"unchanged"`
+}
+
+// changes returns the interface rows a discovery changed, before and after.
+// Added interfaces only appear after.
+func (d *InterfaceDiscovery) changes() (before []InterfaceConfig, after []InterfaceConfig) {
+	before = []InterfaceConfig{}
+	after = append([]InterfaceConfig{}, d.Added...)
+	for _, changes := range [][]InterfaceChange{d.Renumbered, d.Updated} {
+		for _, change := range changes {
+			before = append(before, change.Before)
+			after = append(after, change.After)
+		}
+	}
+	return before, after
+}
+
+// discoverInterfaces walks ifTable and ifXTable on an exporter and syncs the
+// interfaces table with the result. With dryRun the diff is computed but not
+// applied.
+func discoverInterfaces(target ExporterConfig, dryRun bool) (*InterfaceDiscovery, error) {
+	client, err := newSNMPClient(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(); err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer client.Conn.Close()
+
+	found, err := walkInterfaceTable(client, int64(target.ID))
+	if err != nil {
+		return nil, err
+	}
+	existing, err := config.Metrics.InterfaceConfigs(strconv.FormatUint(target.ID, 10))
+	if err != nil {
+		return nil, err
+	}
+
+	result := diffInterfaces(existing, found)
+	result.Exporter = target.ID
+	result.Address = target.IPInet
+	result.DryRun = dryRun
+	if dryRun {
+		return result, nil
+	}
+
+	var changed []InterfaceConfig
+	for _, change := range result.Renumbered {
+		changed = append(changed, change.After)
+	}
+	for _, change := range result.Updated {
+		changed = append(changed, change.After)
+	}
+	if err := config.Metrics.SyncInterfaces(int64(target.ID), result.Added, changed); err != nil {
+		return nil, fmt.Errorf("sync: %w", err)
+	}
+	return result, nil
+}
+
+// walkInterfaceTable reads the name, description, alias and speed of every
+// interface, in ifIndex order. Speed is in bits per second.
+func walkInterfaceTable(client *gosnmp.GoSNMP, exporterID int64) ([]InterfaceConfig, error) {
+	walk := client.BulkWalkAll
+	if client.Version == gosnmp.Version1 {
+		walk = client.WalkAll
+	}
+
+	byIndex := make(map[int64]*InterfaceConfig)
+	var order []int64
+	highSpeed := make(map[int64]uint64)
+	for _, column := range []string{oidIfDescr, oidIfSpeed, oidIfName, oidIfHighSpeed, oidIfAlias} {
+		pdus, err := walk(column)
+		if err != nil {
+			if column == oidIfDescr {
+				return nil, fmt.Errorf("walk %s: %w", column, err)
+			}
+			// ifXTable is optional
+			log.Printf("SNMP discovery: %s: walk %s: %v", client.Target, column, err)
+			continue
+		}
+		for _, pdu := range pdus {
+			index, err := strconv.ParseInt(strings.TrimPrefix(pdu.Name, column+"."), 10, 64)
+			if err != nil {
+				continue
+			}
+			iface, ok := byIndex[index]
+			if !ok {
+				if column != oidIfDescr {
+					// Rows are created from ifTable only
+					continue
+				}
+				iface = &InterfaceConfig{Exporter: exporterID, SnmpIndex: index, Enabled: true}
+				byIndex[index] = iface
+				order = append(order, index)
+			}
+			switch column {
+			case oidIfDescr:
+				iface.Description = snmpString(pdu)
+			case oidIfSpeed:
+				iface.Speed = gosnmp.ToBigInt(pdu.Value).Int64()
+			case oidIfName:
+				iface.Name = snmpString(pdu)
+			case oidIfHighSpeed:
+				highSpeed[index] = gosnmp.ToBigInt(pdu.Value).Uint64()
+			case oidIfAlias:
+				iface.Alias = snmpString(pdu)
+			}
+		}
+	}
+
+	interfaces := make([]InterfaceConfig, 0, len(order))
+	for _, index := range order {
+		iface := byIndex[index]
+		// ifSpeed saturates at 4294967295, ifHighSpeed is in Mbps
+		if mbps := highSpeed[index]; mbps > 0 && iface.Speed >= math.MaxUint32 {
+			iface.Speed = int64(mbps) * 1000000
+		}
+		if iface.Name == "" {
+			iface.Name = iface.Description
+		}
+		interfaces = append(interfaces, *iface)
+	}
+	return interfaces, nil
+}
+
+func snmpString(pdu gosnmp.SnmpPDU) string {
+	if b, ok := pdu.Value.([]byte); ok {
+		return strings.TrimRight(string(b), "\x00")
+	}
+	return fmt.Sprint(pdu.Value)
+}
+
+// diffInterfaces compares the stored interfaces of an exporter with the ones
+// found on the device. Interfaces are matched by name first, so an interface
+// that moved to another ifIndex after a reboot keeps its row, enabled flag
+// and bandwidth; the remaining ones are matched by ifIndex. An alias set on
+// the config page is not overwritten by the device alias.
+func diffInterfaces(existing []InterfaceConfig, found []InterfaceConfig) *InterfaceDiscovery {
+	result := &InterfaceDiscovery{
+		Discovered: len(found),
+		Added:      []InterfaceConfig{},
+		Updated:    []InterfaceChange{},
+		Renumbered: []InterfaceChange{},
+		Missing:    []InterfaceConfig{},
+	}
+
+	// Names shared by several interfaces cannot identify one
+	countNames := func(interfaces []InterfaceConfig) map[string]int {
+		counts := make(map[string]int)
+		for _, iface := range interfaces {
+			if iface.Name != "" {
+				counts[iface.Name]++
+			}
+		}
+		return counts
+	}
+	existingNames := countNames(existing)
+	foundNames := countNames(found)
+
+	byName := make(map[string]int)
+	byIndex := make(map[int64]int)
+	for i, iface := range existing {
+		if existingNames[iface.Name] == 1 {
+			byName[iface.Name] = i
+		}
+		byIndex[iface.SnmpIndex] = i
+	}
+
+	matched := make([]bool, len(existing))
+	match := make([]int, len(found))
+	for i, iface := range found {
+		match[i] = -1
+		if foundNames[iface.Name] != 1 {
+			continue
+		}
+		if j, ok := byName[iface.Name]; ok {
+			match[i] = j
+			matched[j] = true
+		}
+	}
+	for i, iface := range found {
+		if match[i] >= 0 {
+			continue
+		}
+		if j, ok := byIndex[iface.SnmpIndex]; ok && !matched[j] {
+			match[i] = j
+			matched[j] = true
+		}
+	}
+
+	for i, iface := range found {
+		if match[i] < 0 {
+			result.Added = append(result.Added, iface)
+			continue
+		}
+		before := existing[match[i]]
+		after := before
+		var fields []string
+		if after.SnmpIndex != iface.SnmpIndex {
+			after.SnmpIndex = iface.SnmpIndex
+			fields = append(fields, "snmp_index")
+		}
+		if after.Name != iface.Name {
+			after.Name = iface.Name
+			fields = append(fields, "name")
+		}
+		if after.Description != iface.Description {
+			after.Description = iface.Description
+			fields = append(fields, "description")
+		}
+		if after.Alias == "" && iface.Alias != "" {
+			after.Alias = iface.Alias
+			fields = append(fields, "alias")
+		}
+		if after.Speed != iface.Speed {
+			after.Speed = iface.Speed
+			fields = append(fields, "speed")
+		}
+
+		switch {
+		case len(fields) == 0:
+			result.Unchanged++
+		case fields[0] == "snmp_index":
+			result.Renumbered = append(result.Renumbered, InterfaceChange{Before: before, After: after, Fields: fields})
+		default:
+			result.Updated = append(result.Updated, InterfaceChange{Before: before, After: after, Fields: fields})
+		}
+	}
+	for j, iface := range existing {
+		if !matched[j] {
+			result.Missing = append(result.Missing, iface)
+		}
+	}
+	return result
+}
+
+// discoveryTarget returns the SNMP settings of the exporter with the given ID
+func discoveryTarget(id uint64) (ExporterConfig, error) {
+	targets, err := config.Metrics.PollTargets()
+	if err != nil {
+		return ExporterConfig{}, err
+	}
+	for _, target := range targets {
+		if target.ID == id {
+			return target, nil
+		}
+	}
+	return ExporterConfig{}, errors.New("exporter not found or SNMP not configured")
+}
+
+// discoverExporterRequest handles POST /api/v1/config/exporters/{id}/discover.
+// With ?dry_run=true the diff is returned without changing the interfaces.
+func discoverExporterRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid exporter id", http.StatusBadRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	target, err := discoveryTarget(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	result, err := discoverInterfaces(target, dryRun)
+	if err != nil {
+		log.Printf("SNMP discovery: %s: %v", target.IPInet, err)
+		http.Error(w, fmt.Sprintf("Discovery failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	if !dryRun {
+		if before, after := result.changes(); len(after) > 0 {
+			recordAudit(r, fmt.Sprintf("exporter %d interfaces", id), before, after)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runInterfaceDiscovery discovers the interfaces of every SNMP exporter each
+// interval, starting immediately
+func runInterfaceDiscovery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		targets, err := config.Metrics.PollTargets()
+		if err != nil {
+			log.Printf("SNMP discovery: loading exporters: %v", err)
+		}
+		for _, target := range targets {
+			result, err := discoverInterfaces(target, false)
+			if err != nil {
+				log.Printf("SNMP discovery: %s: %v", target.IPInet, err)
+				continue
+			}
+			log.Printf("SNMP discovery: %s: %d interfaces, %d added, %d updated, %d renumbered, %d missing",
+				target.IPInet, result.Discovered, len(result.Added), len(result.Updated), len(result.Renumbered), len(result.Missing))
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestInterfaceDiscoveryChanges(t *testing.T) {
+	existing := []InterfaceConfig{
+		{ID: 1, Exporter: 1, SnmpIndex: 1, Name: "ge-0/0/0", Description: "ge-0/0/0", Enabled: true},
+		{ID: 2, Exporter: 1, SnmpIndex: 2, Name: "ge-0/0/1", Description: "ge-0/0/1", Enabled: false},
+		{ID: 3, Exporter: 1, SnmpIndex: 3, Name: "ge-0/0/2", Description: "old", Enabled: true},
+	}
+	found := []InterfaceConfig{
+		{Exporter: 1, SnmpIndex: 1, Name: "ge-0/0/0", Description: "ge-0/0/0"},
+		{Exporter: 1, SnmpIndex: 5, Name: "ge-0/0/1", Description: "ge-0/0/1"},
+		{Exporter: 1, SnmpIndex: 3, Name: "ge-0/0/2", Description: "new"},
+		{Exporter: 1, SnmpIndex: 4, Name: "ge-0/0/3", Description: "ge-0/0/3"},
+	}
+	result := diffInterfaces(existing, found)
+	if result.Unchanged != 1 || len(result.Added) != 1 || len(result.Updated) != 1 || len(result.Renumbered) != 1 {
+		t.Fatalf("diff = %+v", result)
+	}
+
+	before, after := result.changes()
+	if len(before) != 2 || len(after) != 3 {
+		t.Fatalf("before = %+v, after = %+v", before, after)
+	}
+	if after[0].SnmpIndex != 4 || after[1].SnmpIndex != 5 || after[1].Enabled || after[2].Description != "new" {
+		t.Errorf("after = %+v", after)
+	}
+	if before[0].SnmpIndex != 2 || before[1].Description != "old" {
+		t.Errorf("before = %+v", before)
+	}
+
+	if before, after := diffInterfaces(existing, existing).changes(); len(before) != 0 || len(after) != 0 {
+		t.Errorf("no changes: before = %+v, after = %+v", before, after)
+	}
+}
+
+// discoveryTable returns the ifTable and ifXTable rows of the named
+// interfaces, keyed by ifIndex
+func discoveryTable(names map[int]string) []gosnmp.SnmpPDU {
+	var pdus []gosnmp.SnmpPDU
+	for index, name := range names {
+		suffix := "." + strconv.Itoa(index)
+		pdus = append(pdus,
+			gosnmp.SnmpPDU{Name: oidIfDescr + suffix, Type: gosnmp.OctetString, Value: []byte(name)},
+			gosnmp.SnmpPDU{Name: oidIfSpeed + suffix, Type: gosnmp.Gauge32, Value: uint(1000000000)},
+			gosnmp.SnmpPDU{Name: oidIfName + suffix, Type: gosnmp.OctetString, Value: []byte(name)},
+		)
+	}
+	return pdus
+}
+
+func TestSyncInterfaces(t *testing.T) {
+	store := useMemoryStore(t)
+	store.AddInterface(InterfaceConfig{ID: 1, Exporter: 1, SnmpIndex: 1, Name: "ge-0/0/0", Description: "ge-0/0/0", Speed: 1e9, Enabled: true, Bandwidth: 5e8})
+	store.AddInterface(InterfaceConfig{ID: 2, Exporter: 1, SnmpIndex: 2, Name: "ge-0/0/1", Description: "ge-0/0/1", Alias: "uplink", Speed: 1e9})
+	store.AddInterface(InterfaceConfig{ID: 3, Exporter: 1, SnmpIndex: 3, Name: "ge-0/0/2", Description: "ge-0/0/2", Speed: 1e9, Enabled: true})
+	store.AddInterface(InterfaceConfig{ID: 4, Exporter: 2, SnmpIndex: 2, Name: "eth0", Description: "eth0", Enabled: true})
+
+	// After a reboot the first two interfaces swapped ifIndexes, the third
+	// one is gone and a new one appeared
+	agent := newSNMPAgent(t, discoveryTable(map[int]string{1: "ge-0/0/1", 2: "ge-0/0/0", 5: "ge-0/0/3"})).v2c("public")
+	target := agent.target()
+	target.SnmpVersion = 2
+	target.SnmpCommunity = "public"
+	stored, _ := store.InterfaceConfigs("")
+
+	result, err := discoverInterfaces(target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Renumbered) != 2 || len(result.Added) != 1 || len(result.Missing) != 1 || len(result.Updated) != 0 {
+		t.Fatalf("dry run = %+v", result)
+	}
+	if interfaces, _ := store.InterfaceConfigs(""); !slices.Equal(interfaces, stored) {
+		t.Errorf("dry run changed the interfaces: %+v", interfaces)
+	}
+
+	result, err = discoverInterfaces(target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Missing) != 1 || result.Missing[0].ID != 3 {
+		t.Errorf("missing = %+v", result.Missing)
+	}
+	interfaces, _ := store.InterfaceConfigs("")
+	byID := make(map[uint64]InterfaceConfig)
+	for _, iface := range interfaces {
+		byID[iface.ID] = iface
+	}
+	want := map[uint64]InterfaceConfig{
+		// Renumbered rows keep their settings
+		1: {ID: 1, Exporter: 1, SnmpIndex: 2, Name: "ge-0/0/0", Description: "ge-0/0/0", Speed: 1e9, Enabled: true, Bandwidth: 5e8},
+		2: {ID: 2, Exporter: 1, SnmpIndex: 1, Name: "ge-0/0/1", Description: "ge-0/0/1", Alias: "uplink", Speed: 1e9},
+		// Removed from the device, kept for its history
+		3: {ID: 3, Exporter: 1, SnmpIndex: 3, Name: "ge-0/0/2", Description: "ge-0/0/2", Speed: 1e9, Enabled: true},
+		// Another exporter's interface on a renumbered ifIndex
+		4: {ID: 4, Exporter: 2, SnmpIndex: 2, Name: "eth0", Description: "eth0", Enabled: true},
+		5: {ID: 5, Exporter: 1, SnmpIndex: 5, Name: "ge-0/0/3", Description: "ge-0/0/3", Speed: 1e9, Enabled: true},
+	}
+	if len(byID) != len(want) {
+		t.Fatalf("interfaces = %+v", interfaces)
+	}
+	for id, iface := range want {
+		if byID[id] != iface {
+			t.Errorf("interface %d = %+v, want %+v", id, byID[id], iface)
+		}
+	}
+
+	// Discovering again changes nothing; the removed interface stays missing
+	result, err = discoverInterfaces(target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Unchanged != 3 || len(result.Missing) != 1 || len(result.Added)+len(result.Renumbered)+len(result.Updated) != 0 {
+		t.Errorf("second discovery = %+v", result)
+	}
+	if again, _ := store.InterfaceConfigs(""); !slices.Equal(again, interfaces) {
+		t.Errorf("second discovery changed the interfaces: %+v", again)
+	}
+}
@@ -73,6 +73,9 @@ func (ec *EnrichmentCache) Set(ip string, data *IPEnrichment) {
 
 // enrichIPWithGeoIP adds country and city information from MaxMind database
 func enrichIPWithGeoIP(ip string, enrichment *IPEnrichment) error {
+	if config.Mmdb == nil {
+		return nil
+	}
 	addr, err := netip.ParseAddr(ip)
 	if err != nil {
 		return fmt.Errorf("invalid IP address: %w", err)
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Export formats accepted by the format parameter of the traffic, top-talker
+// and protocol endpoints. Rows are written from flat structs; the json tag
+// names the CSV column and the parquet tag the Parquet column.
+const (
+	exportJSON    = "json"
+	exportCSV     = "csv"
+	exportNDJSON  = "ndjson"
+	exportParquet = "parquet"
+)
+
+// parseExportFormat validates the format parameter, defaulting to JSON
+func parseExportFormat(r *http.Request) (string, error) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	switch format {
+	case "":
+		return exportJSON, nil
+	case exportJSON, exportCSV, exportNDJSON, exportParquet:
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported format %q, use json, csv, ndjson or parquet", format)
+}
+
+// exportFilename builds a download name from the exporter, interface and
+// time range of the request, e.g. traffic_10.0.0.1_if3_20250101T000000Z-20250101T010000Z.csv
+func exportFilename(r *http.Request, kind string, format string) string {
+	query := r.URL.Query()
+	parts := []string{kind}
+	if exporter := query.Get("exporter"); exporter != "" {
+		parts = append(parts, exporter)
+	}
+	if iface := query.Get("interface"); iface != "" {
+		parts = append(parts, "if"+iface)
+	}
+	var times []string
+	for _, key := range []string{"start", "end"} {
+		if t, err := time.Parse(time.RFC3339, query.Get(key)); err == nil {
+			times = append(times, t.UTC().Format("20060102T150405Z"))
+		}
+	}
+	if len(times) > 0 {
+		parts = append(parts, strings.Join(times, "-"))
+	}
+
+	name := strings.Join(parts, "_") + "." + format
+	// Keep the name safe for headers and file systems (IPv6 colons etc.)
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+			return c
+		}
+		return '-'
+	}, name)
+}
+
+// writeExport writes rows in a non-JSON export format with a download name
+func writeExport[T any](w http.ResponseWriter, r *http.Request, format string, kind string, rows []T) error {
+	switch format {
+	case exportCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case exportNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case exportParquet:
+		w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(r, kind, format)))
+
+	switch format {
+	case exportCSV:
+		return writeCSV(w, rows)
+	case exportNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, row := range rows {
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	writer := parquet.NewGenericWriter[T](w)
+	if _, err := writer.Write(rows); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// writeCSV writes a header from the json tags of T followed by one line per row
+func writeCSV[T any](w http.ResponseWriter, rows []T) error {
+	writer := csv.NewWriter(w)
+	fields := csvFields(reflect.TypeFor[T]())
+
+	header := make([]string, len(fields))
+	for i, field := range fields {
+		header[i] = field.name
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(fields))
+	for _, row := range rows {
+		value := reflect.ValueOf(row)
+		for i, field := range fields {
+			record[i] = csvValue(value.Field(field.index))
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type csvField struct {
+	name  string
+	index int
+}
+
+// csvFields lists the exported scalar fields of a struct with their json names
+func csvFields(t reflect.Type) []csvField {
+	var fields []csvField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, csvField{name: name, index: i})
+	}
+	return fields
+}
+
+func csvValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// TrafficExportRow is a TrafficAggregated record with its enrichment
+// flattened into columns
+type TrafficExportRow struct {
+	Address      string  `json:"address" parquet:"address"`
+	SrcAddr      string  `json:"srcaddr" parquet:"srcaddr"`
+	DstAddr      string  `json:"dstaddr" parquet:"dstaddr"`
+	SrcPort      int64   `json:"srcport" parquet:"srcport"`
+	DstPort      int64   `json:"dstport" parquet:"dstport"`
+	Protocol     string  `json:"protocol" parquet:"protocol"`
+	ProtocolName string  `json:"protocol_name" parquet:"protocol_name"`
+	TotalOctets  int64   `json:"total_octets" parquet:"total_octets"`
+	TotalPackets int64   `json:"total_packets" parquet:"total_packets"`
+	FlowCount    int64   `json:"flow_count" parquet:"flow_count"`
+	Percentage   float64 `json:"percentage" parquet:"percentage"`
+	Country      string  `json:"country" parquet:"country"`
+	CountryCode  string  `json:"country_code" parquet:"country_code"`
+	City         string  `json:"city" parquet:"city"`
+	ASN          int64   `json:"asn" parquet:"asn"`
+	ASOrg        string  `json:"as_org" parquet:"as_org"`
+	Hostname     string  `json:"hostname" parquet:"hostname"`
+	ServiceName  string  `json:"service_name" parquet:"service_name"`
+	IsPrivate    bool    `json:"is_private" parquet:"is_private"`
+}
+
+// trafficExportRows flattens aggregated traffic records for export
+func trafficExportRows(records []TrafficAggregated) []TrafficExportRow {
+	rows := make([]TrafficExportRow, len(records))
+	for i, record := range records {
+		row := TrafficExportRow{
+			Address:      record.Address,
+			SrcAddr:      record.SrcAddr,
+			DstAddr:      record.DstAddr,
+			SrcPort:      record.SrcPort,
+			DstPort:      record.DstPort,
+			Protocol:     record.Protocol,
+			ProtocolName: record.ProtocolName,
+			TotalOctets:  record.TotalOctets,
+			TotalPackets: record.TotalPackets,
+			FlowCount:    record.FlowCount,
+			Percentage:   record.Percentage,
+		}
+		if e := record.Enrichment; e != nil {
+			row.Country = e.Country
+			row.CountryCode = e.CountryCode
+			row.City = e.City
+			row.ASN = int64(e.ASN)
+			row.ASOrg = e.ASOrg
+			row.Hostname = e.Hostname
+			row.ServiceName = e.ServiceName
+			row.IsPrivate = e.IsPrivate
+		}
+		rows[i] = row
+	}
+	return rows
+}
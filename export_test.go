@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// exportTestRow covers the column kinds of the export structs
+type exportTestRow struct {
+	Name     string    `json:"name"`
+	Octets   int64     `json:"octets,omitempty"`
+	Share    float64   `json:"share"`
+	Private  bool      `json:"private"`
+	Seen     time.Time `json:"seen"`
+	Skipped  string    `json:"-"`
+	Untagged uint32
+	hidden   string
+}
+
+func TestWriteExportCSV(t *testing.T) {
+	seen := time.Date(2025, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	rows := []exportTestRow{
+		{Name: "plain", Octets: 1500, Share: 12.5, Private: true, Seen: seen, Skipped: "x", Untagged: 7, hidden: "y"},
+		{Name: `AS "Example", Inc`, Octets: -1, Share: 0.1},
+		{Name: "two\nlines"},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/traffic?exporter=2001:db8::1&interface=3&start=2025-06-01T10:00:00Z&format=csv", nil)
+	w := httptest.NewRecorder()
+	if err := writeExport(w, r, exportCSV, "traffic", rows); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("content type %q", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="traffic_2001-db8--1_if3_20250601T100000Z.csv"` {
+		t.Errorf("content disposition %q", got)
+	}
+
+	want := "name,octets,share,private,seen,Untagged\n" +
+		"plain,1500,12.5,true,2025-06-01T10:00:00Z,7\n" +
+		`"AS ""Example"", Inc",-1,0.1,false,0001-01-01T00:00:00Z,0` + "\n" +
+		"\"two\nlines\",0,0,false,0001-01-01T00:00:00Z,0\n"
+	if w.Body.String() != want {
+		t.Errorf("csv =\n%s\nwant\n%s", w.Body, want)
+	}
+	records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[2][0] != rows[1].Name || records[3][0] != rows[2].Name {
+		t.Errorf("records read back = %q", records)
+	}
+}
+
+func TestWriteExportColumns(t *testing.T) {
+	// The CSV header follows the field order of the export struct
+	w := httptest.NewRecorder()
+	if err := writeExport(w, httptest.NewRequest(http.MethodGet, "/", nil), exportCSV, "traffic", []TrafficExportRow{}); err != nil {
+		t.Fatal(err)
+	}
+	header := "address,srcaddr,dstaddr,srcport,dstport,protocol,protocol_name,total_octets,total_packets,flow_count," +
+		"percentage,country,country_code,city,asn,as_org,hostname,service_name,is_private\n"
+	if w.Body.String() != header {
+		t.Errorf("header = %s", w.Body)
+	}
+
+	// NDJSON writes one object per row
+	w = httptest.NewRecorder()
+	rows := []TrafficExportRow{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}}
+	if err := writeExport(w, httptest.NewRequest(http.MethodGet, "/", nil), exportNDJSON, "traffic", rows); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], `{"address":"10.0.0.2",`) {
+		t.Errorf("ndjson = %s", w.Body)
+	}
+
+	if err := writeExport(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), "xml", "traffic", rows); err == nil {
+		t.Error("xml export accepted")
+	}
+}
+
+func TestWriteExportParquet(t *testing.T) {
+	rows := []TrafficExportRow{
+		{Address: "10.0.0.1", Protocol: "6", ProtocolName: "TCP", TotalOctets: 4000, TotalPackets: 30, FlowCount: 2,
+			Percentage: 27.5, CountryCode: "DE", ASN: 64500, ASOrg: `AS "Example", Inc`, IsPrivate: true},
+		{Address: "2001:db8::1", TotalOctets: 1 << 40, Percentage: 72.5},
+	}
+	w := httptest.NewRecorder()
+	if err := writeExport(w, httptest.NewRequest(http.MethodGet, "/", nil), exportParquet, "traffic", rows); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/vnd.apache.parquet" {
+		t.Errorf("content type %q", got)
+	}
+
+	data := w.Body.Bytes()
+	got, err := parquet.Read[TrafficExportRow](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rows) {
+		t.Errorf("rows read back = %+v, want %+v", got, rows)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var columns []string
+	for _, path := range file.Schema().Columns() {
+		columns = append(columns, strings.Join(path, "."))
+	}
+	if !slices.Equal(columns[:4], []string{"address", "srcaddr", "dstaddr", "srcport"}) || len(columns) != 19 {
+		t.Errorf("parquet columns = %v", columns)
+	}
+	if file.NumRows() != 2 {
+		t.Errorf("parquet rows = %d", file.NumRows())
+	}
+}
@@ -5,13 +5,26 @@ go 1.23.0
 toolchain go1.23.4
 
 require (
+	github.com/coreos/go-oidc/v3 v3.14.1
+	github.com/gosnmp/gosnmp v1.38.0
 	github.com/lib/pq v1.10.9
 	github.com/oschwald/maxminddb-golang/v2 v2.0.0-beta.7
+	github.com/parquet-go/parquet-go v0.24.0
 	github.com/wcharczuk/go-chart/v2 v2.1.2
+	golang.org/x/crypto v0.38.0
+	golang.org/x/oauth2 v0.28.0
 )
 
 require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/go-jose/go-jose/v4 v4.0.5 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/image v0.18.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
 )
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	netflowV9HeaderLen = 20
+	ipfixHeaderLen     = 16
+
+	// Templates not refreshed by the exporter within this window are dropped
+	templateExpiry = 30 * time.Minute
+
+	// Variable length marker used by IPFIX information elements
+	ipfixVariableLength = 65535
+)
+
+// Field type identifiers shared by NetFlow v9 and IPFIX (IANA IPFIX registry)
+const (
+	fieldInBytes                = 1
+	fieldInPkts                 = 2
+	fieldProtocol               = 4
+	fieldSrcTos                 = 5
+	fieldTCPFlags               = 6
+	fieldL4SrcPort              = 7
+	fieldIPv4SrcAddr            = 8
+	fieldSrcMask                = 9
+	fieldInputSnmp              = 10
+	fieldL4DstPort              = 11
+	fieldIPv4DstAddr            = 12
+	fieldDstMask                = 13
+	fieldOutputSnmp             = 14
+	fieldSrcAS                  = 16
+	fieldDstAS                  = 17
+	fieldLastSwitched           = 21
+	fieldFirstSwitched          = 22
+	fieldOutBytes               = 23
+	fieldOutPkts                = 24
+	fieldIPv6SrcAddr            = 27
+	fieldIPv6DstAddr            = 28
+	fieldIPv6SrcMask            = 29
+	fieldIPv6DstMask            = 30
+	fieldSamplingInterval       = 34
+	fieldSamplerRandomInterval  = 50
+	fieldIPVersion              = 60
+	fieldOctetTotalCount        = 85
+	fieldPacketTotalCount       = 86
+	fieldFlowStartSeconds       = 150
+	fieldFlowEndSeconds         = 151
+	fieldFlowStartMilliseconds  = 152
+	fieldFlowEndMilliseconds    = 153
+	fieldSystemInitTimeMillis   = 160
+	fieldSamplingPacketInterval = 305
+	fieldSamplingPacketSpace    = 306
+)
+
+// templateField is a single (type, length) pair of a template definition
+type templateField struct {
+	Type       uint16
+	Length     uint16
+	Enterprise uint32
+}
+
+// flowTemplate is a data or options template announced by an exporter
+type flowTemplate struct {
+	ID         uint16
+	Fields     []templateField
+	ScopeCount int
+	Options    bool
+	Updated    time.Time
+}
+
+// templateKey identifies a template within an exporter's observation domain
+// (the v9 source ID or the IPFIX observation domain ID)
+type templateKey struct {
+	Version    uint16
+	Exporter   string
+	Domain     uint32
+	TemplateID uint16
+}
+
+// samplingKey identifies the exporter stream a sampling interval applies to
+type samplingKey struct {
+	Exporter string
+	Domain   uint32
+}
+
+// TemplateCache stores v9/IPFIX templates and the sampling intervals learnt
+// from options data, keyed by exporter and observation domain.
+type TemplateCache struct {
+	mu        sync.RWMutex
+	templates map[templateKey]*flowTemplate
+	sampling  map[samplingKey]uint32
+	ttl       time.Duration
+}
+
+// NewTemplateCache creates an empty cache expiring templates after ttl
+func NewTemplateCache(ttl time.Duration) *TemplateCache {
+	return &TemplateCache{
+		templates: make(map[templateKey]*flowTemplate),
+		sampling:  make(map[samplingKey]uint32),
+		ttl:       ttl,
+	}
+}
+
+// Set stores or refreshes a template
+func (tc *TemplateCache) Set(key templateKey, tmpl *flowTemplate) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tmpl.Updated = time.Now()
+	tc.templates[key] = tmpl
+}
+
+// Delete withdraws a template
+func (tc *TemplateCache) Delete(key templateKey) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.templates, key)
+}
+
+// Get returns a template if it is known and has not expired
+func (tc *TemplateCache) Get(key templateKey) (*flowTemplate, bool) {
+	tc.mu.RLock()
+	tmpl, exists := tc.templates[key]
+	tc.mu.RUnlock()
+	if !exists {
+		return nil, false
+	}
+	if tc.ttl > 0 && time.Since(tmpl.Updated) > tc.ttl {
+		tc.Delete(key)
+		return nil, false
+	}
+	return tmpl, true
+}
+
+// Expire removes every template older than the cache TTL
+func (tc *TemplateCache) Expire() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	removed := 0
+	for key, tmpl := range tc.templates {
+		if time.Since(tmpl.Updated) > tc.ttl {
+			delete(tc.templates, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of cached templates
+func (tc *TemplateCache) Len() int {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return len(tc.templates)
+}
+
+// SetSampling records the sampling interval announced for an exporter stream
+func (tc *TemplateCache) SetSampling(key samplingKey, interval uint32) {
+	if interval == 0 {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.sampling[key] = interval
+}
+
+// Sampling returns the known sampling interval for an exporter stream
+func (tc *TemplateCache) Sampling(key samplingKey) (uint32, bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	interval, ok := tc.sampling[key]
+	return interval, ok
+}
+
+// SamplingRates returns a copy of all known sampling intervals keyed by "exporter/domain"
+func (tc *TemplateCache) SamplingRates() map[string]uint32 {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	rates := make(map[string]uint32, len(tc.sampling))
+	for key, interval := range tc.sampling {
+		rates[fmt.Sprintf("%s/%d", key.Exporter, key.Domain)] = interval
+	}
+	return rates
+}
+
+// expireTemplates periodically purges stale templates
+func (c *FlowCollector) expireTemplates() {
+	ticker := time.NewTicker(templateExpiry / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if removed := c.templates.Expire(); removed > 0 {
+			log.Printf("Collector: expired %d templates", removed)
+		}
+	}
+}
+
+// exportContext carries the header values needed to turn relative
+// timestamps into absolute ones while decoding a message
+type exportContext struct {
+	Version    uint16
+	Exporter   net.IP
+	Domain     uint32
+	ExportTime time.Time
+	UnixSecs   uint32
+	SysUptime  uint32
+}
+
+// decodeNetflowV9 parses a NetFlow v9 export packet
+func (c *FlowCollector) decodeNetflowV9(data []byte, exporter net.IP) ([]FlowDB, error) {
+	if len(data) < netflowV9HeaderLen {
+		return nil, fmt.Errorf("netflow v9 header truncated: %d bytes", len(data))
+	}
+	ctx := exportContext{
+		Version:   9,
+		Exporter:  exporter,
+		SysUptime: binary.BigEndian.Uint32(data[4:8]),
+		UnixSecs:  binary.BigEndian.Uint32(data[8:12]),
+		Domain:    binary.BigEndian.Uint32(data[16:20]),
+	}
+	ctx.ExportTime = time.Unix(int64(ctx.UnixSecs), 0)
+	sequence := binary.BigEndian.Uint32(data[12:16])
+
+	// v9 sequence numbers count export packets
+	key := fmt.Sprintf("v9|%s|%d", exporter, ctx.Domain)
+	if lost := c.sequences.check(key, sequence, 1); lost > 0 {
+		c.sequenceGaps.Add(1)
+		c.lostDatagrams.Add(uint64(lost))
+		log.Printf("Collector: netflow v9 sequence gap from %s/%d: %d datagrams lost before sequence %d", exporter, ctx.Domain, lost, sequence)
+	}
+
+	flows, _, _, err := c.decodeSets(ctx, data[netflowV9HeaderLen:], 0, 1)
+	return flows, err
+}
+
+// decodeIPFIX parses an IPFIX message
+func (c *FlowCollector) decodeIPFIX(data []byte, exporter net.IP) ([]FlowDB, error) {
+	if len(data) < ipfixHeaderLen {
+		return nil, fmt.Errorf("ipfix header truncated: %d bytes", len(data))
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < ipfixHeaderLen || length > len(data) {
+		return nil, fmt.Errorf("ipfix message length %d does not match datagram size %d", length, len(data))
+	}
+	ctx := exportContext{
+		Version:  10,
+		Exporter: exporter,
+		UnixSecs: binary.BigEndian.Uint32(data[4:8]),
+		Domain:   binary.BigEndian.Uint32(data[12:16]),
+	}
+	ctx.ExportTime = time.Unix(int64(ctx.UnixSecs), 0)
+	sequence := binary.BigEndian.Uint32(data[8:12])
+
+	flows, records, skipped, err := c.decodeSets(ctx, data[ipfixHeaderLen:length], 2, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	// IPFIX sequence numbers count data records, options records included,
+	// so the increment is only known once the message has been decoded.
+	// Without the template of a set its records cannot be counted, and the
+	// next message starts the sequence over.
+	key := fmt.Sprintf("ipfix|%s|%d", exporter, ctx.Domain)
+	if skipped {
+		c.sequences.forget(key)
+	} else if lost := c.sequences.check(key, sequence, uint32(records)); lost > 0 {
+		c.sequenceGaps.Add(1)
+		c.lostFlows.Add(uint64(lost))
+		log.Printf("Collector: ipfix sequence gap from %s/%d: %d records lost before sequence %d", exporter, ctx.Domain, lost, sequence)
+	}
+
+	return flows, nil
+}
+
+// decodeSets walks the flowsets (v9) or sets (IPFIX) of a message. Template
+// and options template set IDs differ between versions and are passed in.
+// Besides the flows it returns the number of data records seen, options
+// records included, and whether data sets were skipped for lack of a
+// template.
+func (c *FlowCollector) decodeSets(ctx exportContext, data []byte, templateSetID uint16, optionsSetID uint16) ([]FlowDB, int, bool, error) {
+	var flows []FlowDB
+	records := 0
+	skipped := false
+	for len(data) >= 4 {
+		setID := binary.BigEndian.Uint16(data[0:2])
+		setLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if setLen < 4 || setLen > len(data) {
+			return flows, records, skipped, fmt.Errorf("invalid set length %d (set %d, %d bytes left)", setLen, setID, len(data))
+		}
+		body := data[4:setLen]
+		data = data[setLen:]
+
+		switch {
+		case setID == templateSetID:
+			if err := c.parseTemplates(ctx, body, false); err != nil {
+				return flows, records, skipped, err
+			}
+		case setID == optionsSetID:
+			if err := c.parseTemplates(ctx, body, true); err != nil {
+				return flows, records, skipped, err
+			}
+		case setID >= 256:
+			key := templateKey{Version: ctx.Version, Exporter: ctx.Exporter.String(), Domain: ctx.Domain, TemplateID: setID}
+			tmpl, ok := c.templates.Get(key)
+			if !ok {
+				c.missingTemplates.Add(1)
+				skipped = true
+				continue
+			}
+			setFlows, setRecords := c.decodeDataSet(ctx, tmpl, body)
+			flows = append(flows, setFlows...)
+			records += setRecords
+		}
+	}
+	return flows, records, skipped, nil
+}
+
+// parseTemplates reads every template record of a template or options template set
+func (c *FlowCollector) parseTemplates(ctx exportContext, body []byte, options bool) error {
+	for len(body) >= 4 {
+		tmpl := &flowTemplate{
+			ID:      binary.BigEndian.Uint16(body[0:2]),
+			Options: options,
+		}
+		var fieldCount, scopeCount int
+		var offset int
+
+		switch {
+		case options && ctx.Version == 9:
+			// v9 options templates carry scope and option lengths in bytes
+			if len(body) < 6 {
+				return fmt.Errorf("netflow v9 options template truncated")
+			}
+			scopeCount = int(binary.BigEndian.Uint16(body[2:4])) / 4
+			fieldCount = scopeCount + int(binary.BigEndian.Uint16(body[4:6]))/4
+			offset = 6
+		case options:
+			if len(body) < 6 {
+				return fmt.Errorf("ipfix options template truncated")
+			}
+			fieldCount = int(binary.BigEndian.Uint16(body[2:4]))
+			scopeCount = int(binary.BigEndian.Uint16(body[4:6]))
+			offset = 6
+		default:
+			fieldCount = int(binary.BigEndian.Uint16(body[2:4]))
+			offset = 4
+		}
+
+		// Templates below 256 can only be set padding
+		if tmpl.ID < 256 {
+			return nil
+		}
+		key := templateKey{Version: ctx.Version, Exporter: ctx.Exporter.String(), Domain: ctx.Domain, TemplateID: tmpl.ID}
+		if fieldCount == 0 {
+			// IPFIX template withdrawal
+			c.templates.Delete(key)
+			body = body[offset:]
+			continue
+		}
+
+		for i := 0; i < fieldCount; i++ {
+			if len(body) < offset+4 {
+				return fmt.Errorf("template %d truncated", tmpl.ID)
+			}
+			field := templateField{
+				Type:   binary.BigEndian.Uint16(body[offset : offset+2]),
+				Length: binary.BigEndian.Uint16(body[offset+2 : offset+4]),
+			}
+			offset += 4
+			if ctx.Version == 10 && field.Type&0x8000 != 0 {
+				if len(body) < offset+4 {
+					return fmt.Errorf("template %d truncated", tmpl.ID)
+				}
+				field.Type &= 0x7fff
+				field.Enterprise = binary.BigEndian.Uint32(body[offset : offset+4])
+				offset += 4
+			}
+			tmpl.Fields = append(tmpl.Fields, field)
+		}
+		tmpl.ScopeCount = scopeCount
+		c.templates.Set(key, tmpl)
+		body = body[offset:]
+	}
+	return nil
+}
+
+// decodeDataSet decodes the records of a data set using its template. Records
+// of options templates only update the sampling interval and produce no flows.
+func (c *FlowCollector) decodeDataSet(ctx exportContext, tmpl *flowTemplate, body []byte) ([]FlowDB, int) {
+	var flows []FlowDB
+	records := 0
+	for len(body) > 0 {
+		values, consumed, ok := splitRecord(tmpl, body)
+		if !ok {
+			// Whatever is left is set padding
+			break
+		}
+		body = body[consumed:]
+		records++
+
+		if tmpl.Options {
+			c.applyOptionsRecord(ctx, tmpl, values)
+			continue
+		}
+		if interval := samplingFromRecord(tmpl.Fields, values); interval > 0 {
+			c.templates.SetSampling(samplingKey{Exporter: ctx.Exporter.String(), Domain: ctx.Domain}, interval)
+		}
+		flow := buildTemplateFlow(ctx, tmpl, values)
+		if flow.SrcAddr == "" || flow.DstAddr == "" {
+			// Non-IP records (e.g. layer 2 templates) have no place in flows
+			continue
+		}
+		flows = append(flows, flow)
+	}
+	return flows, records
+}
+
+// splitRecord slices one record into per-field values. It returns false when
+// the remaining bytes are too short to hold a record.
+func splitRecord(tmpl *flowTemplate, body []byte) ([][]byte, int, bool) {
+	values := make([][]byte, len(tmpl.Fields))
+	offset := 0
+	for i, field := range tmpl.Fields {
+		length := int(field.Length)
+		if field.Length == ipfixVariableLength {
+			if offset >= len(body) {
+				return nil, 0, false
+			}
+			length = int(body[offset])
+			offset++
+			if length == 255 {
+				if offset+2 > len(body) {
+					return nil, 0, false
+				}
+				length = int(binary.BigEndian.Uint16(body[offset : offset+2]))
+				offset += 2
+			}
+		}
+		if offset+length > len(body) {
+			return nil, 0, false
+		}
+		values[i] = body[offset : offset+length]
+		offset += length
+	}
+	if offset == 0 {
+		return nil, 0, false
+	}
+	return values, offset, true
+}
+
+// applyOptionsRecord extracts the sampling interval from an options data record
+func (c *FlowCollector) applyOptionsRecord(ctx exportContext, tmpl *flowTemplate, values [][]byte) {
+	interval := samplingFromRecord(tmpl.Fields, values)
+	if interval == 0 {
+		return
+	}
+	key := samplingKey{Exporter: ctx.Exporter.String(), Domain: ctx.Domain}
+	if previous, ok := c.templates.Sampling(key); !ok || previous != interval {
+		log.Printf("Collector: sampling interval for %s/%d is 1:%d", ctx.Exporter, ctx.Domain, interval)
+	}
+	c.templates.SetSampling(key, interval)
+}
+
+// samplingFromRecord returns the sampling interval carried by a record, if any
+func samplingFromRecord(fields []templateField, values [][]byte) uint32 {
+	var interval, packetInterval, packetSpace uint64
+	for i, field := range fields {
+		if field.Enterprise != 0 {
+			continue
+		}
+		switch field.Type {
+		case fieldSamplingInterval, fieldSamplerRandomInterval:
+			interval = beUint(values[i])
+		case fieldSamplingPacketInterval:
+			packetInterval = beUint(values[i])
+		case fieldSamplingPacketSpace:
+			packetSpace = beUint(values[i])
+		}
+	}
+	if interval == 0 && packetInterval > 0 {
+		// 1 packet selected out of every (interval + space) packets
+		interval = (packetInterval + packetSpace) / packetInterval
+	}
+	return uint32(interval)
+}
+
+// buildTemplateFlow maps the decoded values of a data record onto FlowDB
+func buildTemplateFlow(ctx exportContext, tmpl *flowTemplate, values [][]byte) FlowDB {
+	flow := FlowDB{
+		Exporter:  ctx.Exporter.String(),
+		IPVersion: "4",
+		TCPFlags:  "0",
+		Protocol:  "0",
+		TOS:       "0",
+		SrcMask:   "0",
+		DstMask:   "0",
+	}
+	var inBytes, totalBytes, outBytes, inPkts, totalPkts, outPkts uint64
+	var first, last time.Time
+	var firstUptime, lastUptime uint32
+	var hasFirstUptime, hasLastUptime bool
+	var systemInit time.Time
+
+	for i, field := range tmpl.Fields {
+		if field.Enterprise != 0 {
+			continue
+		}
+		value := values[i]
+		switch field.Type {
+		case fieldInBytes:
+			inBytes = beUint(value)
+		case fieldOctetTotalCount:
+			totalBytes = beUint(value)
+		case fieldOutBytes:
+			outBytes = beUint(value)
+		case fieldInPkts:
+			inPkts = beUint(value)
+		case fieldPacketTotalCount:
+			totalPkts = beUint(value)
+		case fieldOutPkts:
+			outPkts = beUint(value)
+		case fieldProtocol:
+			flow.Protocol = strconv.FormatUint(beUint(value), 10)
+		case fieldSrcTos:
+			flow.TOS = strconv.FormatUint(beUint(value), 10)
+		case fieldTCPFlags:
+			// IPFIX exports 16 bit tcpControlBits; keep the classic 8 flags
+			flow.TCPFlags = strconv.FormatUint(beUint(value)&0xff, 10)
+		case fieldL4SrcPort:
+			flow.SrcPort = int64(beUint(value))
+		case fieldL4DstPort:
+			flow.DstPort = int64(beUint(value))
+		case fieldIPv4SrcAddr:
+			if len(value) == net.IPv4len {
+				flow.SrcAddr = net.IP(value).String()
+			}
+		case fieldIPv4DstAddr:
+			if len(value) == net.IPv4len {
+				flow.DstAddr = net.IP(value).String()
+			}
+		case fieldIPv6SrcAddr:
+			if len(value) == net.IPv6len {
+				flow.SrcAddr = net.IP(value).String()
+				flow.IPVersion = "6"
+			}
+		case fieldIPv6DstAddr:
+			if len(value) == net.IPv6len {
+				flow.DstAddr = net.IP(value).String()
+				flow.IPVersion = "6"
+			}
+		case fieldSrcMask, fieldIPv6SrcMask:
+			flow.SrcMask = strconv.FormatUint(beUint(value), 10)
+		case fieldDstMask, fieldIPv6DstMask:
+			flow.DstMask = strconv.FormatUint(beUint(value), 10)
+		case fieldInputSnmp:
+			flow.Input = int64(beUint(value))
+		case fieldOutputSnmp:
+			flow.Output = int64(beUint(value))
+		case fieldSrcAS:
+			flow.SrcAS = int64(beUint(value))
+		case fieldDstAS:
+			flow.DstAS = int64(beUint(value))
+		case fieldIPVersion:
+			flow.IPVersion = strconv.FormatUint(beUint(value), 10)
+		case fieldFirstSwitched:
+			firstUptime = uint32(beUint(value))
+			hasFirstUptime = true
+		case fieldLastSwitched:
+			lastUptime = uint32(beUint(value))
+			hasLastUptime = true
+		case fieldFlowStartSeconds:
+			first = time.Unix(int64(beUint(value)), 0)
+		case fieldFlowEndSeconds:
+			last = time.Unix(int64(beUint(value)), 0)
+		case fieldFlowStartMilliseconds:
+			first = time.UnixMilli(int64(beUint(value)))
+		case fieldFlowEndMilliseconds:
+			last = time.UnixMilli(int64(beUint(value)))
+		case fieldSystemInitTimeMillis:
+			systemInit = time.UnixMilli(int64(beUint(value)))
+		}
+	}
+
+	flow.DOctets = int64(firstNonZero(inBytes, totalBytes, outBytes))
+	flow.DPkts = int64(firstNonZero(inPkts, totalPkts, outPkts))
+
+	// Relative uptime timestamps: v9 uses the header uptime, IPFIX the
+	// exporter's systemInitTimeMilliseconds when present
+	if ctx.Version == 9 {
+		if hasFirstUptime {
+			first = uptimeToTime(ctx.UnixSecs, 0, ctx.SysUptime, firstUptime)
+		}
+		if hasLastUptime {
+			last = uptimeToTime(ctx.UnixSecs, 0, ctx.SysUptime, lastUptime)
+		}
+	} else if !systemInit.IsZero() {
+		if hasFirstUptime && first.IsZero() {
+			first = systemInit.Add(time.Duration(firstUptime) * time.Millisecond)
+		}
+		if hasLastUptime && last.IsZero() {
+			last = systemInit.Add(time.Duration(lastUptime) * time.Millisecond)
+		}
+	}
+	if last.IsZero() {
+		last = first
+	}
+	if last.IsZero() {
+		last = ctx.ExportTime
+	}
+	if first.IsZero() {
+		first = last
+	}
+	flow.First = first
+	flow.Last = last
+	return flow
+}
+
+// beUint decodes a big-endian unsigned integer of up to 8 bytes
+// (IPFIX allows reduced-size encoding of counters)
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, octet := range b {
+		v = v<<8 | uint64(octet)
+	}
+	return v
+}
+
+// firstNonZero returns the first non-zero value
+func firstNonZero(values ...uint64) uint64 {
+	for _, v := range values {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
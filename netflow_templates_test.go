@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// ipfixMessage builds an IPFIX message of observation domain 0 from encoded sets
+func ipfixMessage(sequence uint32, sets ...[]byte) []byte {
+	msg := make([]byte, ipfixHeaderLen)
+	for _, set := range sets {
+		msg = append(msg, set...)
+	}
+	binary.BigEndian.PutUint16(msg[0:2], 10)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:8], 1748772000)
+	binary.BigEndian.PutUint32(msg[8:12], sequence)
+	return msg
+}
+
+// ipfixSet encodes a set with a body of 16-bit words
+func ipfixSet(id uint16, words ...uint16) []byte {
+	set := binary.BigEndian.AppendUint16(nil, id)
+	set = binary.BigEndian.AppendUint16(set, uint16(4+2*len(words)))
+	for _, word := range words {
+		set = binary.BigEndian.AppendUint16(set, word)
+	}
+	return set
+}
+
+func TestIPFIXSequenceWithoutTemplate(t *testing.T) {
+	c := &FlowCollector{sequences: newSequenceTracker(), templates: NewTemplateCache(templateExpiry)}
+	exporter := net.ParseIP("192.0.2.1")
+	// Template 256: sourceIPv4Address, destinationIPv4Address, octetDeltaCount
+	template := ipfixSet(2, 256, 3, 8, 4, 12, 4, 1, 4)
+	record := func(n int) []byte {
+		var words []uint16
+		for i := 0; i < n; i++ {
+			words = append(words, 0x0a00, 0x0001, 0x0a00, 0x0002, 0, 1000)
+		}
+		return ipfixSet(256, words...)
+	}
+
+	// After a restart the data arrives before the template: two records
+	// that cannot be counted
+	for _, msg := range []struct {
+		data  []byte
+		flows int
+	}{
+		{ipfixMessage(100, record(2)), 0},
+		{ipfixMessage(102, template, record(1)), 1},
+		{ipfixMessage(103, record(2)), 2},
+	} {
+		flows, err := c.decodeIPFIX(msg.data, exporter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(flows) != msg.flows {
+			t.Errorf("%d flows, want %d", len(flows), msg.flows)
+		}
+	}
+	if gaps, lost := c.sequenceGaps.Load(), c.lostFlows.Load(); gaps != 0 || lost != 0 {
+		t.Errorf("%d gaps, %d lost flows, want none", gaps, lost)
+	}
+	if missing := c.missingTemplates.Load(); missing != 1 {
+		t.Errorf("%d missing templates, want 1", missing)
+	}
+
+	if _, err := c.decodeIPFIX(ipfixMessage(110, record(1)), exporter); err != nil {
+		t.Fatal(err)
+	}
+	if gaps, lost := c.sequenceGaps.Load(), c.lostFlows.Load(); gaps != 1 || lost != 5 {
+		t.Errorf("%d gaps, %d lost flows, want 1 and 5", gaps, lost)
+	}
+}
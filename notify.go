@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notification severities, from most to least urgent
+const (
+	severityCritical = "critical"
+	severityWarning  = "warning"
+	severityInfo     = "info"
+)
+
+// syslogSeverities maps severities to RFC 5424 severity codes
+var syslogSeverities = map[string]int{
+	severityCritical: 2,
+	severityWarning:  4,
+	severityInfo:     6,
+}
+
+const (
+	notifyQueueSize   = 100
+	notifyTimeout     = 10 * time.Second
+	notifyMaxBackoff  = 5 * time.Minute
+	defaultNotifyBody = `{{.Title}}
+
+{{.Message}}
+
+Source: {{.Source}}
+Severity: {{.Severity}}
+Time: {{.Time.Format "2006-01-02T15:04:05Z07:00"}}
+`
+	defaultNotifySubject = `[cnetflow] {{.Title}}`
+)
+
+// NotifyEvent is anything worth pushing to operators. Alerts are one source;
+// other checks can build events the same way and pass them to
+// notifier.Notify.
+type NotifyEvent struct {
+	Source   string                 `json:"source"`
+	Severity string                 `json:"severity"`
+	Title    string                 `json:"title"`
+	Message  string                 `json:"message"`
+	Time     time.Time              `json:"time"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Notifier delivers one event to one destination
+type Notifier interface {
+	Send(ctx context.Context, event NotifyEvent) error
+}
+
+// NotifyChannelConfig is one entry of the CNETFLOW_NOTIFY_CONFIG JSON file.
+// Body and Subject are text/template templates over NotifyEvent.
+type NotifyChannelConfig struct {
+	Name string `json:"name"`
+	// webhook, smtp or syslog
+	Type        string `json:"type"`
+	MinSeverity string `json:"min_severity"`
+	Body        string `json:"body"`
+	Subject     string `json:"subject"`
+	// Attempts after the first one, with doubling delays from RetryDelay
+	Retries    int    `json:"retries"`
+	RetryDelay string `json:"retry_delay"`
+	// Maximum events per minute; further events are dropped
+	RateLimit int `json:"rate_limit"`
+
+	// webhook
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers"`
+	ContentType string            `json:"content_type"`
+
+	// smtp
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	// syslog: Address is host:port, Network udp or tcp
+	Network  string `json:"network"`
+	Address  string `json:"address"`
+	Facility int    `json:"facility"`
+	AppName  string `json:"app_name"`
+}
+
+// notifyChannel queues events for a notifier and delivers them with retries
+// and rate limiting
+type notifyChannel struct {
+	name        string
+	notifier    Notifier
+	minSeverity int
+	retries     int
+	retryDelay  time.Duration
+	rateLimit   int
+	queue       chan NotifyEvent
+
+	mu       sync.Mutex
+	tokens   float64
+	refilled time.Time
+}
+
+// NotifyDispatcher fans events out to every configured channel
+type NotifyDispatcher struct {
+	channels []*notifyChannel
+}
+
+var notifier *NotifyDispatcher
+
+// loadNotifyConfig reads the channel list from a JSON file
+func loadNotifyConfig(path string) ([]NotifyChannelConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []NotifyChannelConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return configs, nil
+}
+
+// NewNotifyDispatcher builds the channels and starts their workers
+func NewNotifyDispatcher(configs []NotifyChannelConfig) (*NotifyDispatcher, error) {
+	d := &NotifyDispatcher{}
+	names := make(map[string]bool)
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, errors.New("notify channel without name")
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("duplicate notify channel %q", cfg.Name)
+		}
+		names[cfg.Name] = true
+		ch, err := newNotifyChannel(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("notify channel %q: %w", cfg.Name, err)
+		}
+		d.channels = append(d.channels, ch)
+		go ch.run()
+	}
+	return d, nil
+}
+
+func newNotifyChannel(cfg NotifyChannelConfig) (*notifyChannel, error) {
+	body, err := template.New("body").Parse(cmp.Or(cfg.Body, defaultNotifyBody))
+	if err != nil {
+		return nil, fmt.Errorf("body: %w", err)
+	}
+	subject, err := template.New("subject").Parse(cmp.Or(cfg.Subject, defaultNotifySubject))
+	if err != nil {
+		return nil, fmt.Errorf("subject: %w", err)
+	}
+
+	var n Notifier
+	switch cfg.Type {
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, errors.New("url is required")
+		}
+		n = &webhookNotifier{url: cfg.URL, headers: cfg.Headers, contentType: cfg.ContentType, body: body, custom: cfg.Body != ""}
+	case "smtp":
+		if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+			return nil, errors.New("host, from and to are required")
+		}
+		port := cfg.Port
+		if port == 0 {
+			port = 25
+		}
+		n = &smtpNotifier{
+			addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(port)),
+			host:     cfg.Host,
+			username: cfg.Username,
+			password: cfg.Password,
+			from:     cfg.From,
+			to:       cfg.To,
+			subject:  subject,
+			body:     body,
+		}
+	case "syslog":
+		network := cmp.Or(cfg.Network, "udp")
+		if network != "udp" && network != "tcp" {
+			return nil, fmt.Errorf("unsupported network %q, use udp or tcp", network)
+		}
+		if cfg.Address == "" {
+			return nil, errors.New("address is required")
+		}
+		if cfg.Facility < 0 || cfg.Facility > 23 {
+			return nil, errors.New("facility must be between 0 and 23")
+		}
+		hostname, _ := os.Hostname()
+		n = &syslogNotifier{
+			network:  network,
+			address:  cfg.Address,
+			facility: cmp.Or(cfg.Facility, 1),
+			hostname: cmp.Or(hostname, "-"),
+			appName:  cmp.Or(cfg.AppName, "cnetflow"),
+			body:     body,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %q", cfg.Type)
+	}
+
+	minSeverity := syslogSeverities[severityInfo]
+	if cfg.MinSeverity != "" {
+		code, ok := syslogSeverities[cfg.MinSeverity]
+		if !ok {
+			return nil, fmt.Errorf("unsupported min_severity %q", cfg.MinSeverity)
+		}
+		minSeverity = code
+	}
+	retryDelay := time.Second
+	if cfg.RetryDelay != "" {
+		if retryDelay, err = time.ParseDuration(cfg.RetryDelay); err != nil {
+			return nil, fmt.Errorf("retry_delay: %w", err)
+		}
+	}
+	if cfg.Retries < 0 || cfg.RateLimit < 0 {
+		return nil, errors.New("retries and rate_limit must not be negative")
+	}
+
+	return &notifyChannel{
+		name:        cfg.Name,
+		notifier:    n,
+		minSeverity: minSeverity,
+		retries:     cfg.Retries,
+		retryDelay:  retryDelay,
+		rateLimit:   cfg.RateLimit,
+		queue:       make(chan NotifyEvent, notifyQueueSize),
+		tokens:      float64(cfg.RateLimit),
+		refilled:    time.Now(),
+	}, nil
+}
+
+// Notify queues an event on every channel accepting its severity. It never
+// blocks; events are dropped when a channel is rate limited or backed up.
+func (d *NotifyDispatcher) Notify(event NotifyEvent) {
+	if d == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	severity, ok := syslogSeverities[event.Severity]
+	if !ok {
+		severity = syslogSeverities[severityInfo]
+	}
+	for _, ch := range d.channels {
+		if severity > ch.minSeverity {
+			continue
+		}
+		if !ch.allow(time.Now()) {
+			log.Printf("Notify %s: rate limited, dropping %q", ch.name, event.Title)
+			continue
+		}
+		select {
+		case ch.queue <- event:
+		default:
+			log.Printf("Notify %s: queue full, dropping %q", ch.name, event.Title)
+		}
+	}
+}
+
+// NotifyResult is the outcome of a test notification on one channel
+type NotifyResult struct {
+	Channel string `json:"channel"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Test sends an event synchronously to the named channel, or to all of them
+// when name is empty, without retries or rate limiting
+func (d *NotifyDispatcher) Test(name string, event NotifyEvent) []NotifyResult {
+	results := []NotifyResult{}
+	if d == nil {
+		return results
+	}
+	for _, ch := range d.channels {
+		if name != "" && ch.name != name {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		err := ch.notifier.Send(ctx, event)
+		cancel()
+		result := NotifyResult{Channel: ch.name, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// allow takes a token from the per-minute bucket of the channel
+func (ch *notifyChannel) allow(now time.Time) bool {
+	if ch.rateLimit == 0 {
+		return true
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.tokens += now.Sub(ch.refilled).Minutes() * float64(ch.rateLimit)
+	ch.tokens = min(ch.tokens, float64(ch.rateLimit))
+	ch.refilled = now
+	if ch.tokens < 1 {
+		return false
+	}
+	ch.tokens--
+	return true
+}
+
+// run delivers queued events one at a time
+func (ch *notifyChannel) run() {
+	for event := range ch.queue {
+		delay := ch.retryDelay
+		for attempt := 0; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			err := ch.notifier.Send(ctx, event)
+			cancel()
+			if err == nil {
+				break
+			}
+			if attempt >= ch.retries {
+				log.Printf("Notify %s: giving up on %q: %v", ch.name, event.Title, err)
+				break
+			}
+			log.Printf("Notify %s: %v, retrying in %s", ch.name, err, delay)
+			time.Sleep(delay)
+			delay = min(delay*2, notifyMaxBackoff)
+		}
+	}
+}
+
+func renderNotifyTemplate(tmpl *template.Template, event NotifyEvent) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// webhookNotifier POSTs the event as JSON, or the rendered body template
+// when one is configured
+type webhookNotifier struct {
+	url         string
+	headers     map[string]string
+	contentType string
+	body        *template.Template
+	custom      bool
+}
+
+func (n *webhookNotifier) Send(ctx context.Context, event NotifyEvent) error {
+	var payload []byte
+	contentType := "application/json"
+	if n.custom {
+		body, err := renderNotifyTemplate(n.body, event)
+		if err != nil {
+			return err
+		}
+		payload = []byte(body)
+		contentType = cmp.Or(n.contentType, contentType)
+	} else {
+		var err error
+		if payload, err = json.Marshal(event); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range n.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier mails the rendered templates. STARTTLS is used when the
+// server offers it; authentication is only attempted with a username.
+type smtpNotifier struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+	subject  *template.Template
+	body     *template.Template
+}
+
+func (n *smtpNotifier) Send(ctx context.Context, event NotifyEvent) error {
+	msg, err := n.message(event)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	// net/smtp has no context support; run it so the caller's deadline holds
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(n.addr, auth, n.from, n.to, msg)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// message renders the mail of an event. The subject is folded onto one
+// line, so a CR or LF from a rule name cannot start another header.
+func (n *smtpNotifier) message(event NotifyEvent) ([]byte, error) {
+	subject, err := renderNotifyTemplate(n.subject, event)
+	if err != nil {
+		return nil, err
+	}
+	body, err := renderNotifyTemplate(n.body, event)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.Join(strings.Fields(subject), " "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
+
+// syslogNotifier sends RFC 5424 messages, over TCP with octet-counting
+// framing (RFC 6587)
+type syslogNotifier struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+	appName  string
+	body     *template.Template
+}
+
+func (n *syslogNotifier) Send(ctx context.Context, event NotifyEvent) error {
+	body, err := renderNotifyTemplate(n.body, event)
+	if err != nil {
+		return err
+	}
+	msg := formatSyslog(n.facility, event, n.hostname, n.appName, body)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, n.network, n.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if n.network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	_, err = conn.Write([]byte(msg))
+	return err
+}
+
+// formatSyslog builds an RFC 5424 message; the event source is the MSGID
+func formatSyslog(facility int, event NotifyEvent, hostname string, appName string, body string) string {
+	severity, ok := syslogSeverities[event.Severity]
+	if !ok {
+		severity = syslogSeverities[severityInfo]
+	}
+	msgID := cmp.Or(strings.ReplaceAll(event.Source, " ", "_"), "-")
+	body = strings.Join(strings.Fields(body), " ")
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		facility*8+severity,
+		event.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		hostname, appName, os.Getpid(), msgID, body)
+}
+
+// alertNotifyEvent turns an alert event into a notification
+func alertNotifyEvent(alert AlertEvent) NotifyEvent {
+	severity := severityWarning
+	if alert.State == alertResolved {
+		severity = severityInfo
+	}
+	title := fmt.Sprintf("%s %s", alert.RuleName, alert.State)
+	if alert.Subject != "" {
+		title = fmt.Sprintf("%s %s (%s)", alert.RuleName, alert.State, alert.Subject)
+	}
+	return NotifyEvent{
+		Source:   "alert",
+		Severity: severity,
+		Title:    title,
+		Message:  alert.Message,
+		Time:     alert.CreatedAt,
+		Fields: map[string]interface{}{
+			"rule_id":   alert.RuleID,
+			"rule_name": alert.RuleName,
+			"subject":   alert.Subject,
+			"state":     alert.State,
+			"value":     alert.Value,
+			"threshold": alert.Threshold,
+		},
+	}
+}
+
+// notifyTestRequest handles POST /api/v1/notify/test. The optional JSON body
+// selects a channel and overrides the test event, e.g.
+// {"channel": "ops-mail", "severity": "critical"}.
+func notifyTestRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Channel string `json:"channel"`
+		NotifyEvent
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	event := req.NotifyEvent
+	event.Source = cmp.Or(event.Source, "test")
+	event.Severity = cmp.Or(event.Severity, severityInfo)
+	event.Title = cmp.Or(event.Title, "Test notification")
+	event.Message = cmp.Or(event.Message, "This is a test notification from cnetflow.")
+	event.Time = time.Now()
+
+	results := notifier.Test(req.Channel, event)
+	if len(results) == 0 {
+		http.Error(w, "No matching notify channel configured", http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	for _, result := range results {
+		if !result.OK {
+			status = http.StatusBadGateway
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
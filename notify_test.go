@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEvent is an alert event with the given title
+func testEvent(title string) NotifyEvent {
+	return NotifyEvent{
+		Source:   "alert",
+		Severity: severityWarning,
+		Title:    title,
+		Message:  "Traffic above threshold",
+		Time:     time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestSMTPMessageSubject(t *testing.T) {
+	ch, err := newNotifyChannel(NotifyChannelConfig{Name: "mail", Type: "smtp", Host: "localhost", From: "cnetflow@example.com", To: []string{"noc@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"rule\r\nBcc: victim@example.com", "rule\rBcc: victim@example.com", "rule\nBcc: victim@example.com"} {
+		msg, err := ch.notifier.(*smtpNotifier).message(testEvent(title))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _, _ := strings.Cut(string(msg), "\r\n\r\n")
+		if strings.Count(header, "\r") != 5 || strings.Count(header, "\n") != 5 {
+			t.Errorf("%q: header lines = %q", title, header)
+		}
+		if !strings.Contains(header, "\r\nSubject: [cnetflow] rule Bcc: victim@example.com\r\n") {
+			t.Errorf("%q: header = %q", title, header)
+		}
+	}
+}
+
+// deliver sends one event through the retries of a channel and returns once
+// it was delivered or given up on
+func deliver(ch *notifyChannel, event NotifyEvent) {
+	ch.queue <- event
+	close(ch.queue)
+	ch.run()
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	type request struct {
+		contentType   string
+		authorization string
+		body          string
+	}
+	var requests []request
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, request{r.Header.Get("Content-Type"), r.Header.Get("Authorization"), string(body)})
+		if len(requests) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	ch, err := newNotifyChannel(NotifyChannelConfig{
+		Name:        "chat",
+		Type:        "webhook",
+		URL:         server.URL,
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		Body:        `{"text": "{{.Title}}: {{.Message}}", "severity": "{{.Severity}}"}`,
+		ContentType: "application/vnd.chat+json",
+		Retries:     2,
+		RetryDelay:  "1ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Retried on 5xx until the third attempt succeeds
+	deliver(ch, testEvent("rule fired"))
+	if len(requests) != 3 {
+		t.Fatalf("%d requests, want 3", len(requests))
+	}
+	want := request{"application/vnd.chat+json", "Bearer token", `{"text": "rule fired: Traffic above threshold", "severity": "warning"}`}
+	for i, r := range requests {
+		if r != want {
+			t.Errorf("request %d = %+v", i, r)
+		}
+	}
+
+	// Without a body template the event is posted as JSON; one retry is
+	// not enough this time
+	requests, failures = nil, 5
+	ch, err = newNotifyChannel(NotifyChannelConfig{Name: "hook", Type: "webhook", URL: server.URL, Retries: 1, RetryDelay: "1ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(ch, testEvent("rule fired"))
+	if len(requests) != 2 {
+		t.Fatalf("%d requests, want 2", len(requests))
+	}
+	var event NotifyEvent
+	if err := json.Unmarshal([]byte(requests[0].body), &event); err != nil || requests[0].contentType != "application/json" {
+		t.Fatalf("body %s (%s): %v", requests[0].body, requests[0].contentType, err)
+	}
+	if event.Title != "rule fired" || event.Severity != severityWarning || !event.Time.Equal(testEvent("").Time) {
+		t.Errorf("event = %+v", event)
+	}
+}
+
+func TestSyslogNotifier(t *testing.T) {
+	body := "{{.Title}}\n{{.Message}}"
+	frame := func(ch *notifyChannel, priority int) string {
+		return fmt.Sprintf("<%d>1 2025-06-01T10:00:00.000000Z %s cnetflow %d alert - rule fired Traffic above threshold",
+			priority, ch.notifier.(*syslogNotifier).hostname, os.Getpid())
+	}
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ch, err := newNotifyChannel(NotifyChannelConfig{Name: "syslog", Type: "syslog", Address: conn.LocalAddr().String(), Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.notifier.Send(context.Background(), testEvent("rule fired")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// user.warning
+		if got, want := string(buf[:n]), frame(ch, 12); got != want {
+			t.Errorf("message = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		received := make(chan string, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				received <- err.Error()
+				return
+			}
+			defer conn.Close()
+			data, _ := io.ReadAll(conn)
+			received <- string(data)
+		}()
+		ch, err := newNotifyChannel(NotifyChannelConfig{Name: "syslog", Type: "syslog", Network: "tcp", Address: ln.Addr().String(), Facility: 16, Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.notifier.Send(context.Background(), testEvent("rule fired")); err != nil {
+			t.Fatal(err)
+		}
+		var data string
+		select {
+		case data = <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message received")
+		}
+		// Octet counting: the length of the message, a space, the message
+		length, msg, _ := strings.Cut(data, " ")
+		if n, err := strconv.Atoi(length); err != nil || n != len(msg) {
+			t.Errorf("frame length %q for %d bytes", length, len(msg))
+		}
+		// local0.warning
+		if want := frame(ch, 132); msg != want {
+			t.Errorf("message = %q, want %q", msg, want)
+		}
+	})
+}
+
+func TestNotifyRateLimit(t *testing.T) {
+	ch, err := newNotifyChannel(NotifyChannelConfig{Name: "hook", Type: "webhook", URL: "http://127.0.0.1:9", RateLimit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := ch.refilled
+	steps := []struct {
+		after time.Duration
+		allow bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		// One token per 30 seconds at 2 per minute
+		{20 * time.Second, false},
+		{30 * time.Second, true},
+		{30 * time.Second, false},
+		// The bucket holds at most a minute's worth
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+	for i, step := range steps {
+		if got := ch.allow(start.Add(step.after)); got != step.allow {
+			t.Errorf("step %d, after %s: allow = %v, want %v", i, step.after, got, step.allow)
+		}
+	}
+
+	ch.rateLimit = 0
+	for i := 0; i < 100; i++ {
+		if !ch.allow(start) {
+			t.Fatal("a channel without rate limit dropped an event")
+		}
+	}
+}
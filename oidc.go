@@ -0,0 +1,347 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie = "cnetflow_oidc_state"
+	// How long a user has to complete the login at the identity provider
+	oidcLoginTimeout     = 10 * time.Minute
+	defaultOIDCScopes    = "openid,profile,email"
+	defaultGroupsClaim   = "groups"
+	defaultUsernameClaim = "preferred_username"
+)
+
+// oidcRoleMapping gives the members of a group a role and, for read, an
+// optional scope
+type oidcRoleMapping struct {
+	Group string
+	Role  string
+	Scope string
+}
+
+// parseOIDCRoleMap parses CNETFLOW_OIDC_ROLE_MAP, a comma-separated list of
+// group=role or group=read:scope entries
+func parseOIDCRoleMap(s string) ([]oidcRoleMapping, error) {
+	var mappings []oidcRoleMapping
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(entry, "=")
+		if !ok || group == "" {
+			return nil, fmt.Errorf("invalid CNETFLOW_OIDC_ROLE_MAP entry %q, use group=role", entry)
+		}
+		role, scope, _ := strings.Cut(role, ":")
+		if !validRole(role) {
+			return nil, fmt.Errorf("invalid CNETFLOW_OIDC_ROLE_MAP entry %q, role must be read or admin", entry)
+		}
+		if scope != "" && role == roleAdmin {
+			return nil, fmt.Errorf("invalid CNETFLOW_OIDC_ROLE_MAP entry %q, admin cannot be scoped", entry)
+		}
+		mappings = append(mappings, oidcRoleMapping{Group: group, Role: role, Scope: scope})
+	}
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("CNETFLOW_OIDC_ROLE_MAP is required with CNETFLOW_OIDC_ISSUER")
+	}
+	return mappings, nil
+}
+
+type oidcPending struct {
+	nonce    string
+	verifier string
+	next     string
+	expires  time.Time
+}
+
+// OIDCLogin signs UI users in with the authorization code flow (with PKCE)
+// of an OpenID Connect provider. Signed in users get the same session cookie
+// as local users; their role comes from the groups claim of the ID token.
+type OIDCLogin struct {
+	issuer        string
+	clientID      string
+	clientSecret  string
+	redirectURL   string
+	scopes        []string
+	groupsClaim   string
+	usernameClaim string
+	roleMap       []oidcRoleMapping
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	// Logins waiting for the provider's redirect, by state
+	pending map[string]oidcPending
+}
+
+var oidcLogin *OIDCLogin
+
+// NewOIDCLogin parses the settings; empty scopes and claims select the
+// defaults. The provider is discovered on the first login, so the backend
+// starts while the provider is unreachable.
+func NewOIDCLogin(issuer string, clientID string, clientSecret string, redirectURL string, scopes string, groupsClaim string, usernameClaim string, roleMap string) (*OIDCLogin, error) {
+	if clientID == "" || redirectURL == "" {
+		return nil, fmt.Errorf("CNETFLOW_OIDC_CLIENT_ID and CNETFLOW_OIDC_REDIRECT_URL are required with CNETFLOW_OIDC_ISSUER")
+	}
+	if _, err := url.Parse(redirectURL); err != nil {
+		return nil, fmt.Errorf("invalid CNETFLOW_OIDC_REDIRECT_URL: %w", err)
+	}
+	mappings, err := parseOIDCRoleMap(roleMap)
+	if err != nil {
+		return nil, err
+	}
+	o := &OIDCLogin{
+		issuer:        issuer,
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		redirectURL:   redirectURL,
+		groupsClaim:   cmp.Or(groupsClaim, defaultGroupsClaim),
+		usernameClaim: cmp.Or(usernameClaim, defaultUsernameClaim),
+		roleMap:       mappings,
+		pending:       make(map[string]oidcPending),
+	}
+	for _, scope := range strings.Split(cmp.Or(scopes, defaultOIDCScopes), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			o.scopes = append(o.scopes, scope)
+		}
+	}
+	return o, nil
+}
+
+// discover fetches the provider metadata once
+func (o *OIDCLogin) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.oauth != nil {
+		return o.oauth, o.verifier, nil
+	}
+	provider, err := oidc.NewProvider(ctx, o.issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovering %s: %w", o.issuer, err)
+	}
+	o.oauth = &oauth2.Config{
+		ClientID:     o.clientID,
+		ClientSecret: o.clientSecret,
+		RedirectURL:  o.redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       o.scopes,
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.clientID})
+	return o.oauth, o.verifier, nil
+}
+
+// begin records a login and returns its state
+func (o *OIDCLogin) begin(next string) (string, oidcPending) {
+	state := randomSecret(24)
+	login := oidcPending{
+		nonce:    randomSecret(24),
+		verifier: oauth2.GenerateVerifier(),
+		next:     safeRedirect(next),
+		expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for key, p := range o.pending {
+		if time.Now().After(p.expires) {
+			delete(o.pending, key)
+		}
+	}
+	o.pending[state] = login
+	return state, login
+}
+
+// finish returns and forgets the login with the given state
+func (o *OIDCLogin) finish(state string) (oidcPending, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	login, ok := o.pending[state]
+	delete(o.pending, state)
+	if !ok || time.Now().After(login.expires) {
+		return login, false
+	}
+	return login, true
+}
+
+// mapGroups picks the role of a user from its groups: admin wins, then read
+// without a scope, then the first scoped mapping in configuration order
+func (o *OIDCLogin) mapGroups(groups []string) (role string, scope string, ok bool) {
+	member := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		member[group] = true
+	}
+	var scoped *oidcRoleMapping
+	for i, mapping := range o.roleMap {
+		if !member[mapping.Group] {
+			continue
+		}
+		switch {
+		case mapping.Role == roleAdmin:
+			return roleAdmin, "", true
+		case mapping.Scope == "":
+			role, ok = roleRead, true
+		case scoped == nil:
+			scoped = &o.roleMap[i]
+		}
+	}
+	if ok {
+		return role, "", true
+	}
+	if scoped != nil {
+		return scoped.Role, scoped.Scope, true
+	}
+	return "", "", false
+}
+
+// claimStrings reads a claim holding a string or a list of strings
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// oidcUsername names a provider user after the username or email claim,
+// falling back to the subject. The "oidc:" prefix keeps them apart from local
+// users, whose sessions and audit entries would otherwise share the name.
+func oidcUsername(subject string, claims map[string]interface{}) string {
+	username := subject
+	for _, name := range []string{oidcLogin.usernameClaim, "email"} {
+		if values := claimStrings(claims, name); len(values) > 0 && values[0] != "" {
+			username = values[0]
+			break
+		}
+	}
+	return authOIDC + ":" + username
+}
+
+// oidcLoginRequest handles /api/v1/auth/oidc/login?next=, redirecting the
+// browser to the provider
+func oidcLoginRequest(w http.ResponseWriter, r *http.Request) {
+	if oidcLogin == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	oauth, _, err := oidcLogin.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDC: %v", err)
+		http.Error(w, fmt.Sprintf("Error contacting the identity provider: %v", err), http.StatusBadGateway)
+		return
+	}
+	state, login := oidcLogin.begin(r.URL.Query().Get("next"))
+	// The cookie ties the state to this browser, so a callback URL sent to
+	// someone else does not sign them in
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/v1/auth/oidc/",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, oauth.AuthCodeURL(state, oidc.Nonce(login.nonce), oauth2.S256ChallengeOption(login.verifier)), http.StatusFound)
+}
+
+// oidcCallbackRequest handles /api/v1/auth/oidc/callback, where the provider
+// sends the browser back with an authorization code
+func oidcCallbackRequest(w http.ResponseWriter, r *http.Request) {
+	if oidcLogin == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		http.Error(w, fmt.Sprintf("Sign-in failed: %s %s", e, query.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "Invalid sign-in state, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/api/v1/auth/oidc/", MaxAge: -1, HttpOnly: true})
+	login, ok := oidcLogin.finish(state)
+	if !ok {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	oauth, verifier, err := oidcLogin.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDC: %v", err)
+		http.Error(w, fmt.Sprintf("Error contacting the identity provider: %v", err), http.StatusBadGateway)
+		return
+	}
+	token, err := oauth.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		log.Printf("OIDC: exchanging code: %v", err)
+		http.Error(w, "Error exchanging the authorization code", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "The identity provider returned no ID token", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		log.Printf("OIDC: verifying ID token: %v", err)
+		http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+	if idToken.Nonce != login.nonce {
+		http.Error(w, "Invalid ID token nonce", http.StatusUnauthorized)
+		return
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, fmt.Sprintf("Error reading ID token claims: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	username := oidcUsername(idToken.Subject, claims)
+	groups := claimStrings(claims, oidcLogin.groupsClaim)
+	role, scope, ok := oidcLogin.mapGroups(groups)
+	if !ok {
+		log.Printf("OIDC: %s has no mapped group in %v", username, groups)
+		http.Error(w, "Your account is not allowed to use this application", http.StatusForbidden)
+		return
+	}
+	log.Printf("OIDC: %s signed in as %s", username, role)
+	setSessionCookie(w, r, Principal{Name: username, Role: role, Method: authOIDC, Scope: scope})
+	http.Redirect(w, r, login.next, http.StatusSeeOther)
+}
+
+// getAuthProvidersRequest tells the login page which sign-in methods exist
+func getAuthProvidersRequest(w http.ResponseWriter, r *http.Request) {
+	providers := []string{"local"}
+	if oidcLogin != nil {
+		providers = append(providers, "oidc")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"providers": providers})
+}
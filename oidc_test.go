@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc/oidctest"
+)
+
+// mockIssuer is a local OpenID provider. Discovery and keys are served by
+// oidctest; the token endpoint redeems the codes issued with authorize.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: make(map[string]mockGrant)}
+	provider := &oidctest.Server{PublicKeys: []oidctest.PublicKey{{PublicKey: key.Public(), KeyID: "test", Algorithm: "RS256"}}}
+	mux := http.NewServeMux()
+	mux.Handle("/", provider)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	provider.SetIssuer(m.URL)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize plays the provider's login page: it returns a code for the
+// authorization request the browser was redirected with. The ID token gets
+// the given claims, and the nonce of the request unless claims has one.
+func (m *mockIssuer) authorize(t *testing.T, location string, claims map[string]interface{}) string {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "cnetflow" {
+		t.Fatalf("authorization request = %s", location)
+	}
+	all := map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   "cnetflow",
+		"sub":   "0001",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		all[name] = value
+	}
+	code := randomSecret(16)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[code] = mockGrant{challenge: query.Get("code_challenge"), claims: all}
+	return code
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	grant, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+	// PKCE: the verifier must hash to the challenge of the authorization request
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant"}`)
+		return
+	}
+	claims, _ := json.Marshal(grant.claims)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     oidctest.SignIDToken(m.key, "test", "RS256", string(claims)),
+	})
+}
+
+// useOIDCLogin configures single sign-on against the issuer for the duration
+// of a test, with fresh sessions
+func useOIDCLogin(t *testing.T, issuer string, roleMap string) {
+	t.Helper()
+	login, err := NewOIDCLogin(issuer, "cnetflow", "secret", "http://cnetflow.test/api/v1/auth/oidc/callback", "", "", "", roleMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedLogin, savedSessions := oidcLogin, sessions
+	oidcLogin, sessions = login, NewSessionStore(sessionTTL)
+	t.Cleanup(func() { oidcLogin, sessions = savedLogin, savedSessions })
+}
+
+// startOIDCLogin opens the login endpoint and returns the redirect to the
+// provider and the state cookie
+func startOIDCLogin(t *testing.T) (string, *http.Cookie) {
+	t.Helper()
+	w := serve(oidcLoginRequest, httptest.NewRequest(http.MethodGet, "/api/v1/auth/oidc/login?next=/traffic", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			return w.Header().Get("Location"), cookie
+		}
+	}
+	t.Fatal("login: no state cookie")
+	return "", nil
+}
+
+func oidcCallback(code string, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/auth/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return serve(oidcCallbackRequest, r)
+}
+
+func stateOf(t *testing.T, location string) string {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("state")
+}
+
+func TestOIDCCallback(t *testing.T) {
+	issuer := newMockIssuer(t)
+	useOIDCLogin(t, issuer.URL, "netops=admin,noc=read")
+
+	location, cookie := startOIDCLogin(t)
+	code := issuer.authorize(t, location, map[string]interface{}{"preferred_username": "admin", "groups": []string{"noc"}})
+	w := oidcCallback(code, stateOf(t, location), cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/traffic" {
+		t.Fatalf("callback: status %d, location %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("callback: no session cookie")
+	}
+	principal := sessions.Lookup(session.Value)
+	if principal == nil || principal.Name != "oidc:admin" || principal.Role != roleRead || principal.Method != authOIDC {
+		t.Fatalf("principal = %+v", principal)
+	}
+	// Changing the local admin does not end the provider user's session
+	sessions.DeleteUser("admin")
+	if sessions.Lookup(session.Value) == nil {
+		t.Error("session of oidc:admin ended with the local admin's")
+	}
+
+	// The state is single use
+	if w := oidcCallback(code, stateOf(t, location), cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed state: status %d, want 400", w.Code)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	issuer := newMockIssuer(t)
+	useOIDCLogin(t, issuer.URL, "netops=admin")
+	member := map[string]interface{}{"groups": []string{"netops"}}
+
+	t.Run("state cookie mismatch", func(t *testing.T) {
+		location, cookie := startOIDCLogin(t)
+		code := issuer.authorize(t, location, member)
+		if w := oidcCallback(code, stateOf(t, location), nil); w.Code != http.StatusBadRequest {
+			t.Errorf("without cookie: status %d, want 400", w.Code)
+		}
+		other := *cookie
+		other.Value = "other"
+		if w := oidcCallback(code, stateOf(t, location), &other); w.Code != http.StatusBadRequest {
+			t.Errorf("cookie of another login: status %d, want 400", w.Code)
+		}
+		if w := oidcCallback(code, "unknown", &http.Cookie{Name: oidcStateCookie, Value: "unknown"}); w.Code != http.StatusBadRequest {
+			t.Errorf("unknown state: status %d, want 400", w.Code)
+		}
+	})
+
+	t.Run("nonce mismatch", func(t *testing.T) {
+		location, cookie := startOIDCLogin(t)
+		code := issuer.authorize(t, location, map[string]interface{}{"groups": []string{"netops"}, "nonce": "replayed"})
+		if w := oidcCallback(code, stateOf(t, location), cookie); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "nonce") {
+			t.Errorf("status %d, want 401: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("PKCE verifier", func(t *testing.T) {
+		// The code was issued for the challenge of another login, so the
+		// verifier sent with this one does not match it
+		first, _ := startOIDCLogin(t)
+		location, cookie := startOIDCLogin(t)
+		code := issuer.authorize(t, first, member)
+		if w := oidcCallback(code, stateOf(t, location), cookie); w.Code != http.StatusUnauthorized {
+			t.Errorf("status %d, want 401", w.Code)
+		}
+	})
+
+	t.Run("no mapped group", func(t *testing.T) {
+		location, cookie := startOIDCLogin(t)
+		code := issuer.authorize(t, location, map[string]interface{}{"groups": "guests"})
+		if w := oidcCallback(code, stateOf(t, location), cookie); w.Code != http.StatusForbidden {
+			t.Errorf("status %d, want 403", w.Code)
+		}
+	})
+
+	t.Run("provider error", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/auth/oidc/callback?error=access_denied", nil)
+		if w := serve(oidcCallbackRequest, r); w.Code != http.StatusUnauthorized {
+			t.Errorf("status %d, want 401", w.Code)
+		}
+	})
+}
+
+func TestOIDCMapGroups(t *testing.T) {
+	login, err := NewOIDCLogin("http://issuer.test", "cnetflow", "", "http://cnetflow.test/callback", "", "", "",
+		"tenant-a=read:customer-a,tenant-b=read:customer-b,noc=read,netops=admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		groups []string
+		role   string
+		scope  string
+		ok     bool
+	}{
+		{[]string{"noc", "netops"}, roleAdmin, "", true},
+		{[]string{"tenant-a", "netops"}, roleAdmin, "", true},
+		{[]string{"tenant-a", "noc"}, roleRead, "", true},
+		// Scoped mappings apply in configuration order
+		{[]string{"tenant-b", "tenant-a"}, roleRead, "customer-a", true},
+		{[]string{"tenant-b"}, roleRead, "customer-b", true},
+		{[]string{"guests"}, "", "", false},
+		{nil, "", "", false},
+	}
+	for _, tt := range tests {
+		role, scope, ok := login.mapGroups(tt.groups)
+		if role != tt.role || scope != tt.scope || ok != tt.ok {
+			t.Errorf("mapGroups(%v) = %q, %q, %v, want %q, %q, %v", tt.groups, role, scope, ok, tt.role, tt.scope, tt.ok)
+		}
+	}
+}
@@ -49,6 +49,9 @@ type highchartsData struct {
 }
 
 func renderTimeseriesChartJS(w http.ResponseWriter, r *http.Request) {
+	if !authorizeExporter(w, r, r.PathValue("exporter"), r.PathValue("interface")) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/javascript")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	var data = FillDataFromPath(r)
@@ -73,6 +76,9 @@ func highcharts(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	exporterStr := r.PathValue("exporter")
 	interfaceStr := r.PathValue("interface")
+	if !authorizeExporter(w, r, exporterStr, interfaceStr) {
+		return
+	}
 	startStr := r.PathValue("start")
 	endStr := r.PathValue("end")
 	startEpoch, _ := strconv.ParseInt(startStr, 10, 64)
@@ -147,7 +153,7 @@ func FillDataFromPath(r *http.Request) MainPageData {
 	exporters, _ := getExporterList()
 	exporterId, _ := strconv.ParseInt(exporterStr, 10, 64)
 	exporterIp := exporters[int(exporterId)].IP_Inet
-	metrics, err := getInterfacesMetrics(fmt.Sprint(exporterId), interfaceStr, start, end)
+	metrics, err := config.Metrics.InterfaceMetrics(fmt.Sprint(exporterId), interfaceStr, start, end)
 	if err != nil {
 		log.Println(err.Error())
 	}
@@ -182,6 +188,9 @@ func FillDataFromPath(r *http.Request) MainPageData {
 	return data
 }
 func renderPieChartJS(w http.ResponseWriter, r *http.Request) {
+	if !authorizeExporter(w, r, r.PathValue("exporter"), r.PathValue("interface")) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/javascript")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	data := FillDataFromPath(r)
@@ -194,6 +203,9 @@ func renderPieChartJS(w http.ResponseWriter, r *http.Request) {
 	err = tmpl.Execute(w, data)
 }
 func mainPageHighcharts(w http.ResponseWriter, r *http.Request) {
+	if !authorizeExporter(w, r, r.PathValue("exporter"), r.PathValue("interface")) {
+		return
+	}
 	var data = FillDataFromPath(r)
 	tmpl, err := t.ParseFiles("./static/templates/body.js.gotmpl.html")
 	if err != nil {
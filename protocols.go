@@ -1,25 +1,23 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
 // ProtocolStats represents aggregated statistics for a protocol
 type ProtocolStats struct {
-	Protocol      int     `json:"protocol"`
-	ProtocolName  string  `json:"protocol_name"`
-	TotalOctets   int64   `json:"total_octets"`
-	TotalPackets  int64   `json:"total_packets"`
-	FlowCount     int64   `json:"flow_count"`
-	Percentage    float64 `json:"percentage"`
-	AvgPacketSize float64 `json:"avg_packet_size"`
+	Protocol      int     `json:"protocol" parquet:"protocol"`
+	ProtocolName  string  `json:"protocol_name" parquet:"protocol_name"`
+	TotalOctets   int64   `json:"total_octets" parquet:"total_octets"`
+	TotalPackets  int64   `json:"total_packets" parquet:"total_packets"`
+	FlowCount     int64   `json:"flow_count" parquet:"flow_count"`
+	Percentage    float64 `json:"percentage" parquet:"percentage"`
+	AvgPacketSize float64 `json:"avg_packet_size" parquet:"avg_packet_size"`
 }
 
 // ProtocolPortStats represents statistics for protocol+port combinations
@@ -49,6 +47,8 @@ type ProtocolAnalysisResponse struct {
 	TotalOctets   int64                     `json:"total_octets"`
 	TotalPackets  int64                     `json:"total_packets"`
 	TotalFlows    int64                     `json:"total_flows"`
+	SamplingRate  int64                     `json:"sampling_rate"`
+	Scaled        bool                      `json:"scaled"`
 }
 
 // getProtocolName returns the name of a protocol number
@@ -72,7 +72,7 @@ func getProtocolName(protocol int) string {
 }
 
 // parseProtocolFilter extracts filter parameters from request
-func parseProtocolFilter(r *http.Request) TrafficFilter {
+func parseProtocolFilter(r *http.Request) (TrafficFilter, error) {
 	filter := TrafficFilter{
 		Direction: "input",
 		Limit:     100,
@@ -84,126 +84,40 @@ func parseProtocolFilter(r *http.Request) TrafficFilter {
 
 	filter.Exporter = query.Get("exporter")
 	filter.Interface = query.Get("interface")
-	filter.Direction = query.Get("direction")
-	filter.Protocol = query.Get("protocol")
-
-	// Time filters
-	// Note: Database stores timestamps without timezone in GMT-3
-	// Apply -3 hour offset to incoming UTC times
-	if startStr := query.Get("start"); startStr != "" {
-		if t, err := time.Parse(time.RFC3339, startStr); err == nil {
-			filter.StartTime = t.Add(-3 * time.Hour)
-		}
+	var err error
+	if filter.Direction, err = parseDirection(query.Get("direction")); err != nil {
+		return filter, err
 	}
-	if endStr := query.Get("end"); endStr != "" {
-		if t, err := time.Parse(time.RFC3339, endStr); err == nil {
-			filter.EndTime = t.Add(-3 * time.Hour)
-		}
+	if err := parseMatchFilters(query, &filter); err != nil {
+		return filter, err
 	}
-
-	// Default to last hour if not specified
-	if filter.StartTime.IsZero() {
-		filter.StartTime = time.Now().Add(-1 * time.Hour)
+	if err := parseOrder(query, &filter); err != nil {
+		return filter, err
 	}
-	if filter.EndTime.IsZero() {
-		filter.EndTime = time.Now()
+
+	// Time filters (instants; converted to the database time zone in SQL args)
+	filter.StartTime, filter.EndTime, err = parseTimeRange(query, time.Hour)
+	if err != nil {
+		return filter, err
 	}
 
-	return filter
+	return filter, nil
 }
 
 // getProtocolStats retrieves aggregated protocol statistics
 func getProtocolStats(filter TrafficFilter) ([]ProtocolStats, error) {
-	var conditions []string
-	var args []interface{}
-	argIndex := 1
-
-	// Build WHERE clause
-	if filter.Exporter != "" {
-		conditions = append(conditions, fmt.Sprintf("exporter = $%d::inet", argIndex))
-		args = append(args, filter.Exporter)
-		argIndex++
-	}
-
-	if filter.Interface != "" {
-		conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.Direction, argIndex))
-		args = append(args, filter.Interface)
-		argIndex++
-	}
-
-	if !filter.StartTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("bucket AT TIME ZONE 'UTC' >= $%d", argIndex))
-		args = append(args, filter.StartTime)
-		argIndex++
-	}
-
-	if !filter.EndTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("bucket AT TIME ZONE 'UTC' <= $%d", argIndex))
-		args = append(args, filter.EndTime)
-		argIndex++
-	}
-
-	if filter.Protocol != "" {
-		conditions = append(conditions, fmt.Sprintf("prot = $%d", argIndex))
-		args = append(args, filter.Protocol)
-		argIndex++
-	}
-
-	whereClause := ""
-	if len(conditions) > 0 {
-		whereClause = "WHERE " + strings.Join(conditions, " AND ")
-	}
-
-	query := fmt.Sprintf(`
-		SELECT
-			prot as protocol,
-			SUM(total_bytes) as total_octets,
-			SUM(total_packets) as total_packets,
-			COUNT(*) as flow_count
-		FROM flows_hourly
-		%s
-		GROUP BY prot
-		ORDER BY total_octets DESC
-	`, whereClause)
-
-	log.Println("Protocol stats query:", query)
-	log.Println("Args:", args)
-
-	rows, err := config.Db.Query(query, args...)
+	stats, err := config.Flows.ProtocolStats(filter)
 	if err != nil {
-		return nil, fmt.Errorf("query error: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
 
-	var stats []ProtocolStats
 	var totalOctets int64
-
-	for rows.Next() {
-		var stat ProtocolStats
-		var protocol sql.NullInt64
-
-		err := rows.Scan(
-			&protocol,
-			&stat.TotalOctets,
-			&stat.TotalPackets,
-			&stat.FlowCount,
-		)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			continue
-		}
-
-		if protocol.Valid {
-			stat.Protocol = int(protocol.Int64)
-			stat.ProtocolName = getProtocolName(stat.Protocol)
-		}
-
-		if stat.TotalPackets > 0 {
-			stat.AvgPacketSize = float64(stat.TotalOctets) / float64(stat.TotalPackets)
+	for i := range stats {
+		stats[i].ProtocolName = getProtocolName(stats[i].Protocol)
+		if stats[i].TotalPackets > 0 {
+			stats[i].AvgPacketSize = float64(stats[i].TotalOctets) / float64(stats[i].TotalPackets)
 		}
-
-		totalOctets += stat.TotalOctets
-		stats = append(stats, stat)
+		totalOctets += stats[i].TotalOctets
 	}
 
 	// Calculate percentages
@@ -218,71 +132,10 @@ func getProtocolStats(filter TrafficFilter) ([]ProtocolStats, error) {
 
 // getProtocolPortStats retrieves protocol+port statistics
 func getProtocolPortStats(filter TrafficFilter, limit int) ([]ProtocolPortStats, error) {
-	var conditions []string
-	var args []interface{}
-	argIndex := 1
-
-	// Build WHERE clause
-	if filter.Exporter != "" {
-		conditions = append(conditions, fmt.Sprintf("exporter = $%d::inet", argIndex))
-		args = append(args, filter.Exporter)
-		argIndex++
-	}
-
-	if filter.Interface != "" {
-		conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.Direction, argIndex))
-		args = append(args, filter.Interface)
-		argIndex++
-	}
-
-	if !filter.StartTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("bucket AT TIME ZONE 'UTC' >= $%d", argIndex))
-		args = append(args, filter.StartTime)
-		argIndex++
-	}
-
-	if !filter.EndTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("bucket AT TIME ZONE 'UTC' <= $%d", argIndex))
-		args = append(args, filter.EndTime)
-		argIndex++
-	}
-
-	if filter.Protocol != "" {
-		conditions = append(conditions, fmt.Sprintf("prot = $%d", argIndex))
-		args = append(args, filter.Protocol)
-		argIndex++
-	}
-
-	whereClause := ""
-	if len(conditions) > 0 {
-		whereClause = "WHERE " + strings.Join(conditions, " AND ")
-	}
-
-	query := fmt.Sprintf(`
-		SELECT
-			prot as protocol,
-			srcport,
-			dstport,
-			SUM(total_bytes) as total_octets,
-			SUM(total_packets) as total_packets,
-			COUNT(*) as flow_count
-		FROM flows_hourly
-		%s
-		GROUP BY prot, srcport, dstport
-		ORDER BY total_octets DESC
-		LIMIT %d
-	`, whereClause, limit)
-
-	log.Println("Protocol port stats query:", query)
-
-	rows, err := config.Db.Query(query, args...)
+	stats, err := config.Flows.ProtocolPortStats(filter, limit)
 	if err != nil {
-		return nil, fmt.Errorf("query error: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
-
-	var stats []ProtocolPortStats
-	var totalOctets int64
 
 	// Get service names map
 	services := getPorts()
@@ -292,52 +145,20 @@ func getProtocolPortStats(filter TrafficFilter, limit int) ([]ProtocolPortStats,
 		serviceMap[key] = svc.Name
 	}
 
-	for rows.Next() {
-		var stat ProtocolPortStats
-		var protocol, srcPort, dstPort sql.NullInt64
-
-		err := rows.Scan(
-			&protocol,
-			&srcPort,
-			&dstPort,
-			&stat.TotalOctets,
-			&stat.TotalPackets,
-			&stat.FlowCount,
-		)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			continue
-		}
-
-		if protocol.Valid {
-			stat.Protocol = int(protocol.Int64)
-			stat.ProtocolName = getProtocolName(stat.Protocol)
-		}
-
-		if srcPort.Valid {
-			stat.SrcPort = int(srcPort.Int64)
-		}
-		if dstPort.Valid {
-			stat.DstPort = int(dstPort.Int64)
-		}
+	var totalOctets int64
+	for i := range stats {
+		stat := &stats[i]
+		stat.ProtocolName = getProtocolName(stat.Protocol)
 
 		// Try to find service name from destination port first
-		if dstPort.Valid {
-			key := fmt.Sprintf("%d:%d", stat.Protocol, stat.DstPort)
-			if name, ok := serviceMap[key]; ok {
-				stat.ServiceName = name
-			}
-		}
-		// If not found, try source port
-		if stat.ServiceName == "" && srcPort.Valid {
-			key := fmt.Sprintf("%d:%d", stat.Protocol, stat.SrcPort)
-			if name, ok := serviceMap[key]; ok {
-				stat.ServiceName = name + " (src)"
-			}
+		if name, ok := serviceMap[fmt.Sprintf("%d:%d", stat.Protocol, stat.DstPort)]; ok {
+			stat.ServiceName = name
+		} else if name, ok := serviceMap[fmt.Sprintf("%d:%d", stat.Protocol, stat.SrcPort)]; ok {
+			// If not found, try source port
+			stat.ServiceName = name + " (src)"
 		}
 
 		totalOctets += stat.TotalOctets
-		stats = append(stats, stat)
 	}
 
 	// Calculate percentages
@@ -350,113 +171,20 @@ func getProtocolPortStats(filter TrafficFilter, limit int) ([]ProtocolPortStats,
 	return stats, nil
 }
 
-// getProtocolTimeSeries retrieves time series data for protocols
-func getProtocolTimeSeries(filter TrafficFilter) ([]ProtocolTimeSeriesPoint, error) {
-	var conditions []string
-	var args []interface{}
-	argIndex := 1
-
-	// Build WHERE clause
-	if filter.Exporter != "" {
-		conditions = append(conditions, fmt.Sprintf("exporter = $%d::inet", argIndex))
-		args = append(args, filter.Exporter)
-		argIndex++
-	}
-
-	if filter.Interface != "" {
-		conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.Direction, argIndex))
-		args = append(args, filter.Interface)
-		argIndex++
-	}
-
-	if !filter.StartTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("bucket AT TIME ZONE 'UTC' >= $%d", argIndex))
-		args = append(args, filter.StartTime)
-		argIndex++
-	}
-
-	if !filter.EndTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("bucket AT TIME ZONE 'UTC' <= $%d", argIndex))
-		args = append(args, filter.EndTime)
-		argIndex++
-	}
-
-	whereClause := ""
-	if len(conditions) > 0 {
-		whereClause = "WHERE " + strings.Join(conditions, " AND ")
-	}
-
-	query := fmt.Sprintf(`
-		SELECT
-			bucket,
-			prot,
-			SUM(total_bytes) as total_octets
-		FROM flows_hourly
-		%s
-		GROUP BY bucket, prot
-		ORDER BY bucket ASC, prot ASC
-	`, whereClause)
-
-	log.Println("Protocol time series query:", query)
-
-	rows, err := config.Db.Query(query, args...)
-	if err != nil {
-		return nil, fmt.Errorf("query error: %w", err)
-	}
-	defer rows.Close()
-
-	// Build time series data
-	timeSeriesMap := make(map[time.Time]map[int]int64)
-
-	for rows.Next() {
-		var timestamp time.Time
-		var protocol sql.NullInt64
-		var octets int64
-
-		err := rows.Scan(&timestamp, &protocol, &octets)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			continue
-		}
-
-		if !protocol.Valid {
-			continue
-		}
-
-		if _, exists := timeSeriesMap[timestamp]; !exists {
-			timeSeriesMap[timestamp] = make(map[int]int64)
-		}
-
-		timeSeriesMap[timestamp][int(protocol.Int64)] = octets
-	}
-
-	// Convert map to slice
-	var timeSeries []ProtocolTimeSeriesPoint
-	for ts, data := range timeSeriesMap {
-		timeSeries = append(timeSeries, ProtocolTimeSeriesPoint{
-			Timestamp:    ts,
-			ProtocolData: data,
-		})
-	}
-
-	// Sort by timestamp
-	// Note: Using a simple bubble sort for small datasets
-	for i := 0; i < len(timeSeries)-1; i++ {
-		for j := 0; j < len(timeSeries)-i-1; j++ {
-			if timeSeries[j].Timestamp.After(timeSeries[j+1].Timestamp) {
-				timeSeries[j], timeSeries[j+1] = timeSeries[j+1], timeSeries[j]
-			}
-		}
-	}
-
-	return timeSeries, nil
-}
-
 // getProtocolAnalysisRequest handles HTTP request for protocol analysis
 func getProtocolAnalysisRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	filter := parseProtocolFilter(r)
+	filter, err := parseProtocolFilter(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
 	includeTimeSeries := r.URL.Query().Get("include_timeseries") == "true"
 	includeTopPorts := r.URL.Query().Get("include_ports") == "true"
 	portLimit := 20
@@ -480,6 +208,10 @@ func getProtocolAnalysisRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "interface parameter is required"}`, http.StatusBadRequest)
 		return
 	}
+	if !authorizeExporter(w, r, filter.Exporter, filter.Interface) {
+		return
+	}
+	filter.SamplingRate = getSamplingRate(filter.Exporter, filter.Interface)
 
 	// Get protocol statistics
 	protocolStats, err := getProtocolStats(filter)
@@ -489,8 +221,17 @@ func getProtocolAnalysisRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if format != exportJSON {
+		if err := writeExport(w, r, format, "protocols", protocolStats); err != nil {
+			log.Printf("Error exporting protocol stats: %v", err)
+		}
+		return
+	}
+
 	response := &ProtocolAnalysisResponse{
 		ProtocolStats: protocolStats,
+		SamplingRate:  max(filter.SamplingRate, 1),
+		Scaled:        filter.SamplingRate > 1,
 	}
 
 	// Calculate totals
@@ -512,7 +253,7 @@ func getProtocolAnalysisRequest(w http.ResponseWriter, r *http.Request) {
 
 	// Get time series if requested
 	if includeTimeSeries {
-		timeSeries, err := getProtocolTimeSeries(filter)
+		timeSeries, err := config.Flows.ProtocolTimeSeries(filter)
 		if err != nil {
 			log.Printf("Error getting protocol time series: %v", err)
 		} else {
@@ -558,15 +299,23 @@ type IPProtocolPortStats struct {
 func getIPProtocolStatsRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	filter := parseProtocolFilter(r)
+	filter, err := parseProtocolFilter(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
 
 	if filter.Exporter == "" || filter.Interface == "" {
 		http.Error(w, `{"error": "exporter and interface are required"}`, http.StatusBadRequest)
 		return
 	}
+	if !authorizeExporter(w, r, filter.Exporter, filter.Interface) {
+		return
+	}
+	filter.SamplingRate = max(getSamplingRate(filter.Exporter, filter.Interface), 1)
 
 	// Query for IP + Protocol aggregation
-	ipProtocolStats, totalOctets, totalPackets, err := getIPProtocolStats(filter)
+	ipProtocolStats, totalOctets, totalPackets, err := config.Flows.IPProtocolStats(filter)
 	if err != nil {
 		log.Printf("Error getting IP protocol stats: %v", err)
 		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusInternalServerError)
@@ -581,7 +330,7 @@ func getIPProtocolStatsRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query for IP + Protocol + Port with service names
-	ipProtocolPortStats, err := getIPProtocolPortStats(filter)
+	ipProtocolPortStats, err := config.Flows.IPProtocolPortStats(filter)
 	if err != nil {
 		log.Printf("Error getting IP protocol port stats: %v", err)
 		http.Error(w, fmt.Sprintf(`{"error": "%v"}`, err), http.StatusInternalServerError)
@@ -600,6 +349,8 @@ func getIPProtocolStatsRequest(w http.ResponseWriter, r *http.Request) {
 		"ip_protocol_port_stats": ipProtocolPortStats,
 		"total_octets":           totalOctets,
 		"total_packets":          totalPackets,
+		"sampling_rate":          filter.SamplingRate,
+		"scaled":                 filter.SamplingRate > 1,
 	}
 
 	jsonBytes, err := json.Marshal(response)
@@ -611,170 +362,3 @@ func getIPProtocolStatsRequest(w http.ResponseWriter, r *http.Request) {
 
 	w.Write(jsonBytes)
 }
-
-func getIPProtocolStats(filter TrafficFilter) ([]IPProtocolStats, int64, int64, error) {
-	// Build query to aggregate by IP address and protocol
-	// Use CASE to map known protocols from ports table, aggregate others as "Other"
-	query := `
-		WITH protocol_mapping AS (
-			SELECT DISTINCT protocol, name FROM ports
-		),
-		flow_data AS (
-			SELECT 
-				CASE 
-					WHEN $4 = 'input' THEN dstaddr
-					ELSE srcaddr
-				END as ip_address,
-				prot as protocol,
-				total_bytes as total_octets,
-				total_packets
-			FROM flows_hourly
-			WHERE exporter = $1::inet
-			  AND (input = $2::int OR output = $2::int)
-			  AND bucket AT TIME ZONE 'UTC' >= $3::timestamp
-			  AND bucket AT TIME ZONE 'UTC' <= $5::timestamp
-		)
-		SELECT 
-			fd.ip_address,
-			fd.protocol,
-			COALESCE(pm.name, 'Protocol-' || fd.protocol::text) as protocol_name,
-			SUM(fd.total_octets) as total_octets,
-			SUM(fd.total_packets) as total_packets,
-			COUNT(*) as flow_count,
-			SUM(SUM(fd.total_octets)) OVER () as grand_total_octets,
-			SUM(SUM(fd.total_packets)) OVER () as grand_total_packets
-		FROM flow_data fd
-		LEFT JOIN protocol_mapping pm ON fd.protocol = pm.protocol
-		GROUP BY fd.ip_address, fd.protocol, pm.name
-		ORDER BY total_octets DESC
-		LIMIT 100
-	`
-
-	rows, err := config.Db.Query(query,
-		filter.Exporter,
-		filter.Interface,
-		filter.StartTime,
-		filter.Direction,
-		filter.EndTime,
-	)
-	if err != nil {
-		return nil, 0, 0, err
-	}
-	defer rows.Close()
-
-	var stats []IPProtocolStats
-	var grandTotalOctets, grandTotalPackets int64
-
-	for rows.Next() {
-		var stat IPProtocolStats
-		var totalOctets, totalPackets sql.NullInt64
-
-		err := rows.Scan(
-			&stat.IPAddress,
-			&stat.Protocol,
-			&stat.ProtocolName,
-			&totalOctets,
-			&totalPackets,
-			&stat.FlowCount,
-			&grandTotalOctets,
-			&grandTotalPackets,
-		)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			continue
-		}
-
-		if totalOctets.Valid {
-			stat.TotalOctets = totalOctets.Int64
-		}
-		if totalPackets.Valid {
-			stat.TotalPackets = totalPackets.Int64
-		}
-
-		stats = append(stats, stat)
-	}
-
-	return stats, grandTotalOctets, grandTotalPackets, nil
-}
-
-func getIPProtocolPortStats(filter TrafficFilter) ([]IPProtocolPortStats, error) {
-	// Query to get IP + Protocol + Port with service names from services table
-	query := `
-		WITH flow_data AS (
-			SELECT 
-				CASE 
-					WHEN $4 = 'input' THEN dstaddr
-					ELSE srcaddr
-				END as ip_address,
-				prot as protocol,
-				COALESCE(dstport, srcport, 0) as port,
-				total_octets,
-				total_packets
-			FROM flows_agg_5min
-			WHERE exporter = $1::inet
-			  AND (input = $2::int OR output = $2::int)
-			  AND bucket_5min >= $3::timestamp
-			  AND bucket_5min <= $5::timestamp
-		)
-		SELECT 
-			fd.ip_address,
-			fd.protocol,
-			COALESCE(p.name, 'Protocol-' || fd.protocol::text) as protocol_name,
-			fd.port,
-			COALESCE(p2.name, 'Port-' || fd.port::text) as service_name,
-			SUM(fd.total_octets) as total_octets,
-			SUM(fd.total_packets) as total_packets,
-			COUNT(*) as flow_count
-		FROM flow_data fd
-		LEFT JOIN ports p ON fd.protocol = p.protocol AND p.number IS NULL
-		LEFT JOIN ports p2 ON fd.port = p2.number AND fd.protocol = p2.protocol
-		GROUP BY fd.ip_address, fd.protocol, p.name, fd.port, p2.name
-		ORDER BY total_octets DESC
-		LIMIT 100
-	`
-
-	rows, err := config.Db.Query(query,
-		filter.Exporter,
-		filter.Interface,
-		filter.StartTime,
-		filter.Direction,
-		filter.EndTime,
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var stats []IPProtocolPortStats
-
-	for rows.Next() {
-		var stat IPProtocolPortStats
-		var totalOctets, totalPackets sql.NullInt64
-
-		err := rows.Scan(
-			&stat.IPAddress,
-			&stat.Protocol,
-			&stat.ProtocolName,
-			&stat.Port,
-			&stat.ServiceName,
-			&totalOctets,
-			&totalPackets,
-			&stat.FlowCount,
-		)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			continue
-		}
-
-		if totalOctets.Valid {
-			stat.TotalOctets = totalOctets.Int64
-		}
-		if totalPackets.Valid {
-			stat.TotalPackets = totalPackets.Int64
-		}
-
-		stats = append(stats, stat)
-	}
-
-	return stats, nil
-}
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flow query language
+//
+// Filters use an nfdump/pcap like syntax, e.g.
+//
+//	src net 10.0.0.0/8 and dst port 443 and not proto udp
+//	(host 192.0.2.1 or host 2001:db8::1) and bytes > 1000000
+//	in if 3 and port 1024-2048
+//
+// Primitives (src/dst qualifiers are optional, without them either side matches):
+//
+//	[src|dst] host <ip>
+//	[src|dst] net <cidr>
+//	[src|dst] port [op] <n> | <n>-<m>
+//	[src|dst] as [op] <n>
+//	[in|out] if <n>
+//	proto <name|n>
+//	exporter <ip>
+//	bytes|packets <op> <n>
+//	ipv4 | ipv6 | any
+//
+// Operators are =, ==, !=, <, <=, >, >=. Expressions combine with and/&&,
+// or/||, not/! and parentheses. The parser produces a queryExpr tree that is
+// turned into a parameterized WHERE clause by querySQLBuilder; no value from
+// the filter is ever interpolated into the SQL text.
+
+const (
+	queryDefaultLimit = 100
+	queryMaxLimit     = 10000
+)
+
+// queryError reports a parse or validation error at a position of the filter
+type queryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+// queryToken is a lexical token of a filter expression
+type queryToken struct {
+	Kind  string // "word", "op", "(", ")", "eof"
+	Value string
+	Pos   int
+}
+
+// lexQuery splits a filter expression into tokens
+func lexQuery(input string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, queryToken{Kind: string(c), Value: string(c), Pos: i})
+			i++
+		case c == '&' || c == '|':
+			if i+1 >= len(input) || input[i+1] != c {
+				return nil, &queryError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			value := "and"
+			if c == '|' {
+				value = "or"
+			}
+			tokens = append(tokens, queryToken{Kind: "word", Value: value, Pos: i})
+			i += 2
+		case c == '!' || c == '=' || c == '<' || c == '>':
+			start := i
+			i++
+			if i < len(input) && input[i] == '=' {
+				i++
+			}
+			op := input[start:i]
+			if op == "!" {
+				tokens = append(tokens, queryToken{Kind: "word", Value: "not", Pos: start})
+				continue
+			}
+			if op == "==" {
+				op = "="
+			}
+			tokens = append(tokens, queryToken{Kind: "op", Value: op, Pos: start})
+		default:
+			start := i
+			for i < len(input) && !strings.ContainsRune(" \t\n\r()&|!=<>", rune(input[i])) {
+				i++
+			}
+			tokens = append(tokens, queryToken{Kind: "word", Value: strings.ToLower(input[start:i]), Pos: start})
+		}
+	}
+	tokens = append(tokens, queryToken{Kind: "eof", Pos: len(input)})
+	return tokens, nil
+}
+
+// queryExpr is a node of a parsed filter expression
+type queryExpr interface {
+	queryNode()
+}
+
+// queryBinary combines two expressions with "and" or "or"
+type queryBinary struct {
+	Op    string
+	Left  queryExpr
+	Right queryExpr
+}
+
+// queryNot negates an expression
+type queryNot struct {
+	Expr queryExpr
+}
+
+// queryPrimitive is a single match such as "src port 443"
+type queryPrimitive struct {
+	Dir   string // "src", "dst", "in", "out" or ""
+	Field string // host, net, port, as, if, proto, exporter, bytes, packets, ipv4, ipv6, any
+	Op    string
+	Value string
+	High  string // upper bound of a port/as range
+	Pos   int
+}
+
+func (queryBinary) queryNode()    {}
+func (queryNot) queryNode()       {}
+func (queryPrimitive) queryNode() {}
+
+// queryParser is a recursive descent parser over lexQuery tokens
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// parseQuery parses a filter expression. An empty filter matches everything.
+func parseQuery(input string) (queryExpr, error) {
+	tokens, err := lexQuery(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	if p.peek().Kind == "eof" {
+		return queryPrimitive{Field: "any"}, nil
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Kind != "eof" {
+		return nil, &queryError{Pos: tok.Pos, Msg: fmt.Sprintf("unexpected %q", tok.Value)}
+	}
+	return expr, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.Kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) isWord(value string) bool {
+	tok := p.peek()
+	return tok.Kind == "word" && tok.Value == value
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isWord("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = queryBinary{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isWord("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = queryBinary{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (queryExpr, error) {
+	tok := p.peek()
+	switch {
+	case tok.Kind == "word" && tok.Value == "not":
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{Expr: expr}, nil
+	case tok.Kind == "(":
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.Kind != ")" {
+			return nil, &queryError{Pos: closing.Pos, Msg: "missing closing parenthesis"}
+		}
+		return expr, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *queryParser) parsePrimitive() (queryExpr, error) {
+	tok := p.next()
+	if tok.Kind != "word" {
+		if tok.Kind == "eof" {
+			return nil, &queryError{Pos: tok.Pos, Msg: "unexpected end of filter"}
+		}
+		return nil, &queryError{Pos: tok.Pos, Msg: fmt.Sprintf("unexpected %q", tok.Value)}
+	}
+	prim := queryPrimitive{Pos: tok.Pos, Op: "="}
+
+	switch tok.Value {
+	case "src", "dst":
+		prim.Dir = tok.Value
+		tok = p.next()
+		switch tok.Value {
+		case "host", "ip", "net", "port", "as":
+		default:
+			return nil, &queryError{Pos: tok.Pos, Msg: fmt.Sprintf("expected host, net, port or as after %q", prim.Dir)}
+		}
+	case "in", "out":
+		prim.Dir = tok.Value
+		tok = p.next()
+		if tok.Value != "if" {
+			return nil, &queryError{Pos: tok.Pos, Msg: fmt.Sprintf("expected if after %q", prim.Dir)}
+		}
+	}
+
+	prim.Field = tok.Value
+	switch prim.Field {
+	case "ip":
+		prim.Field = "host"
+	case "packet", "pkts":
+		prim.Field = "packets"
+	case "octets":
+		prim.Field = "bytes"
+	case "inet":
+		prim.Field = "ipv4"
+	case "inet6":
+		prim.Field = "ipv6"
+	case "all":
+		prim.Field = "any"
+	}
+
+	switch prim.Field {
+	case "ipv4", "ipv6", "any":
+		return prim, nil
+	case "host", "net", "proto", "exporter":
+		if op := p.peek(); op.Kind == "op" {
+			p.next()
+			if op.Value != "=" && op.Value != "!=" {
+				return nil, &queryError{Pos: op.Pos, Msg: fmt.Sprintf("operator %s not supported for %s", op.Value, prim.Field)}
+			}
+			prim.Op = op.Value
+		}
+	case "port", "as", "if", "bytes", "packets":
+		if op := p.peek(); op.Kind == "op" {
+			p.next()
+			prim.Op = op.Value
+		} else if prim.Field == "bytes" || prim.Field == "packets" {
+			return nil, &queryError{Pos: op.Pos, Msg: fmt.Sprintf("expected comparison operator after %s", prim.Field)}
+		}
+	default:
+		return nil, &queryError{Pos: tok.Pos, Msg: fmt.Sprintf("unknown keyword %q", tok.Value)}
+	}
+
+	value := p.next()
+	if value.Kind != "word" {
+		return nil, &queryError{Pos: value.Pos, Msg: fmt.Sprintf("expected value for %s", prim.Field)}
+	}
+	prim.Value = value.Value
+	if err := validatePrimitive(&prim, value.Pos); err != nil {
+		return nil, err
+	}
+	return prim, nil
+}
+
+// queryProtocols maps protocol names accepted by "proto" to numbers
+var queryProtocols = map[string]int{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"ipv6":   41,
+	"gre":    47,
+	"esp":    50,
+	"ah":     51,
+	"icmp6":  58,
+	"icmpv6": 58,
+	"ospf":   89,
+	"sctp":   132,
+}
+
+// validatePrimitive checks and normalizes the value of a primitive
+func validatePrimitive(prim *queryPrimitive, pos int) error {
+	fail := func(format string, args ...interface{}) error {
+		return &queryError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	switch prim.Field {
+	case "host", "exporter":
+		ip := net.ParseIP(prim.Value)
+		if ip == nil {
+			return fail("invalid IP address %q", prim.Value)
+		}
+		prim.Value = ip.String()
+	case "net":
+		if !strings.Contains(prim.Value, "/") {
+			ip := net.ParseIP(prim.Value)
+			if ip == nil {
+				return fail("invalid network %q", prim.Value)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			prim.Value = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, network, err := net.ParseCIDR(prim.Value)
+		if err != nil {
+			return fail("invalid network %q", prim.Value)
+		}
+		prim.Value = network.String()
+	case "proto":
+		if number, ok := queryProtocols[prim.Value]; ok {
+			prim.Value = strconv.Itoa(number)
+		} else if n, err := strconv.Atoi(prim.Value); err != nil || n < 0 || n > 255 {
+			return fail("invalid protocol %q", prim.Value)
+		}
+	case "port", "as", "if", "bytes", "packets":
+		maximum := map[string]uint64{
+			"port":    65535,
+			"as":      4294967295,
+			"if":      4294967295,
+			"bytes":   1<<63 - 1,
+			"packets": 1<<63 - 1,
+		}[prim.Field]
+		low, high, isRange := strings.Cut(prim.Value, "-")
+		if isRange && prim.Field != "port" && prim.Field != "as" {
+			return fail("ranges are only supported for port and as")
+		}
+		if isRange && prim.Op != "=" {
+			return fail("a range cannot be combined with %s", prim.Op)
+		}
+		lowN, err := strconv.ParseUint(low, 10, 64)
+		if err != nil || lowN > maximum {
+			return fail("invalid %s value %q", prim.Field, low)
+		}
+		prim.Value = strconv.FormatUint(lowN, 10)
+		if isRange {
+			highN, err := strconv.ParseUint(high, 10, 64)
+			if err != nil || highN > maximum || highN < lowN {
+				return fail("invalid %s range %q", prim.Field, low+"-"+high)
+			}
+			prim.High = strconv.FormatUint(highN, 10)
+		}
+	}
+	return nil
+}
+
+// querySource describes a table the query language can run against
+type querySource struct {
+	Table     string
+	TimeCol   string
+	BytesCol  string
+	PacketCol string
+	// RawColumns are returned when no group_by is given
+	RawColumns []queryColumn
+	RawOrder   string
+}
+
+// queryColumn is a selected result column
+type queryColumn struct {
+	Name string
+	Expr string
+	Kind string // "text", "int" or "time"
+}
+
+var querySources = map[string]*querySource{
+	"flows": {
+		Table:     "flows",
+		TimeCol:   "last",
+		BytesCol:  "doctets",
+		PacketCol: "dpkts",
+		RawColumns: []queryColumn{
+			{"exporter", "host(exporter)", "text"},
+			{"srcaddr", "host(srcaddr)", "text"},
+			{"dstaddr", "host(dstaddr)", "text"},
+			{"srcport", "srcport", "int"},
+			{"dstport", "dstport", "int"},
+			{"proto", "prot", "int"},
+			{"src_as", "src_as", "int"},
+			{"dst_as", "dst_as", "int"},
+			{"input", "input", "int"},
+			{"output", "output", "int"},
+			{"bytes", "doctets", "int"},
+			{"packets", "dpkts", "int"},
+			{"first", "first", "time"},
+			{"last", "last", "time"},
+		},
+		RawOrder: "last",
+	},
+	"hourly": {
+		Table:     "flows_hourly",
+		TimeCol:   "bucket",
+		BytesCol:  "total_bytes",
+		PacketCol: "total_packets",
+		RawColumns: []queryColumn{
+			{"bucket", "bucket", "time"},
+			{"exporter", "host(exporter)", "text"},
+			{"srcaddr", "host(srcaddr)", "text"},
+			{"dstaddr", "host(dstaddr)", "text"},
+			{"srcport", "srcport", "int"},
+			{"dstport", "dstport", "int"},
+			{"proto", "prot", "int"},
+			{"src_as", "src_as", "int"},
+			{"dst_as", "dst_as", "int"},
+			{"input", "input", "int"},
+			{"output", "output", "int"},
+			{"bytes", "total_bytes", "int"},
+			{"packets", "total_packets", "int"},
+		},
+		RawOrder: "bucket",
+	},
+}
+
+// queryGroupColumns are the fields accepted by group_by
+var queryGroupColumns = map[string]queryColumn{
+	"exporter": {"exporter", "host(exporter)", "text"},
+	"srcaddr":  {"srcaddr", "host(srcaddr)", "text"},
+	"dstaddr":  {"dstaddr", "host(dstaddr)", "text"},
+	"srcport":  {"srcport", "srcport", "int"},
+	"dstport":  {"dstport", "dstport", "int"},
+	"proto":    {"proto", "prot", "int"},
+	"src_as":   {"src_as", "src_as", "int"},
+	"dst_as":   {"dst_as", "dst_as", "int"},
+	"input":    {"input", "input", "int"},
+	"output":   {"output", "output", "int"},
+}
+
+// querySQLBuilder turns a parsed filter into a parameterized WHERE clause
+type querySQLBuilder struct {
+	source *querySource
+	args   []interface{}
+}
+
+// param registers a query argument and returns its placeholder
+func (b *querySQLBuilder) param(value interface{}) string {
+	b.args = append(b.args, value)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+// where renders an expression as SQL
+func (b *querySQLBuilder) where(expr queryExpr) (string, error) {
+	switch node := expr.(type) {
+	case queryBinary:
+		left, err := b.where(node.Left)
+		if err != nil {
+			return "", err
+		}
+		right, err := b.where(node.Right)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s %s %s)", left, strings.ToUpper(node.Op), right), nil
+	case queryNot:
+		inner, err := b.where(node.Expr)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("NOT (%s)", inner), nil
+	case queryPrimitive:
+		return b.primitive(node)
+	}
+	return "", fmt.Errorf("unsupported expression %T", expr)
+}
+
+func (b *querySQLBuilder) primitive(prim queryPrimitive) (string, error) {
+	var columns []string
+	pick := func(src, dst string) {
+		switch prim.Dir {
+		case "src", "in":
+			columns = []string{src}
+		case "dst", "out":
+			columns = []string{dst}
+		default:
+			columns = []string{src, dst}
+		}
+	}
+
+	cast := ""
+	switch prim.Field {
+	case "any":
+		return "TRUE", nil
+	case "ipv4":
+		return "family(srcaddr) = 4", nil
+	case "ipv6":
+		return "family(srcaddr) = 6", nil
+	case "host":
+		pick("srcaddr", "dstaddr")
+		cast = "::inet"
+	case "net":
+		pick("srcaddr", "dstaddr")
+		placeholder := b.param(prim.Value)
+		return b.combine(columns, prim.Op, func(col string) string {
+			return fmt.Sprintf("%s <<= %s::inet", col, placeholder)
+		}), nil
+	case "exporter":
+		columns = []string{"exporter"}
+		cast = "::inet"
+	case "port":
+		pick("srcport", "dstport")
+	case "as":
+		pick("src_as", "dst_as")
+	case "if":
+		pick("input", "output")
+	case "proto":
+		columns = []string{"prot"}
+	case "bytes":
+		columns = []string{b.source.BytesCol}
+	case "packets":
+		columns = []string{b.source.PacketCol}
+	default:
+		return "", &queryError{Pos: prim.Pos, Msg: fmt.Sprintf("unknown field %q", prim.Field)}
+	}
+
+	if prim.High != "" {
+		low := b.param(queryNumber(prim.Value))
+		high := b.param(queryNumber(prim.High))
+		return b.combine(columns, "=", func(col string) string {
+			return fmt.Sprintf("%s BETWEEN %s AND %s", col, low, high)
+		}), nil
+	}
+
+	var value interface{} = prim.Value
+	if cast == "" {
+		value = queryNumber(prim.Value)
+	}
+	placeholder := b.param(value) + cast
+	op := prim.Op
+	if op == "!=" {
+		// "port != 80" must hold on both sides, so compare positively and negate
+		op = "="
+	}
+	return b.combine(columns, prim.Op, func(col string) string {
+		return fmt.Sprintf("%s %s %s", col, op, placeholder)
+	}), nil
+}
+
+// combine ORs a condition over the given columns, negating it for "!="
+func (b *querySQLBuilder) combine(columns []string, op string, cond func(string) string) string {
+	parts := make([]string, len(columns))
+	for i, col := range columns {
+		parts[i] = cond(col)
+	}
+	clause := parts[0]
+	if len(parts) > 1 {
+		clause = "(" + strings.Join(parts, " OR ") + ")"
+	}
+	if op == "!=" {
+		clause = "NOT " + clause
+	}
+	return clause
+}
+
+// queryNumber converts a validated numeric value to int64
+func queryNumber(value string) int64 {
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n
+}
+
+// QueryRequest holds the parsed parameters of a query request
+type QueryRequest struct {
+	Source       *querySource
+	SourceName   string
+	Filter       string
+	Exporter     string
+	StartTime    time.Time
+	EndTime      time.Time
+	GroupBy      []queryColumn
+	OrderBy      string
+	Limit        int
+	SamplingRate int64
+	// ExporterRates scales each exporter by its own rate when the request
+	// covers all exporters
+	ExporterRates map[string]int64
+}
+
+// samplingFilter returns a filter carrying the sampling rates of the request
+func (req QueryRequest) samplingFilter() TrafficFilter {
+	return TrafficFilter{SamplingRate: req.SamplingRate, ExporterRates: req.ExporterRates}
+}
+
+// buildQuerySQL generates the full SELECT statement for a query request
+func buildQuerySQL(req QueryRequest) (string, []interface{}, []queryColumn, error) {
+	expr, err := parseQuery(req.Filter)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	b := &querySQLBuilder{source: req.Source}
+	filterSQL, err := b.where(expr)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	conditions := []string{filterSQL}
+	if req.Exporter != "" {
+		conditions = append(conditions, fmt.Sprintf("exporter = %s::inet", b.param(req.Exporter)))
+	}
+	if !req.StartTime.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%s >= %s", req.Source.TimeCol, b.param(toDBTime(req.StartTime))))
+	}
+	if !req.EndTime.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%s <= %s", req.Source.TimeCol, b.param(toDBTime(req.EndTime))))
+	}
+
+	var columns []queryColumn
+	groupClause := ""
+	orderClause := ""
+	if len(req.GroupBy) > 0 {
+		var groupExprs []string
+		for _, col := range req.GroupBy {
+			columns = append(columns, col)
+			groupExprs = append(groupExprs, col.Expr)
+		}
+		columns = append(columns,
+			queryColumn{"bytes", req.samplingFilter().sampledSum(req.Source.BytesCol), "int"},
+			queryColumn{"packets", req.samplingFilter().sampledSum(req.Source.PacketCol), "int"},
+			queryColumn{"flows", "COUNT(*)", "int"},
+		)
+		groupClause = " GROUP BY " + strings.Join(groupExprs, ", ")
+		orderBy := req.OrderBy
+		if orderBy == "" {
+			orderBy = "bytes"
+		}
+		orderClause = fmt.Sprintf(" ORDER BY %s DESC", orderBy)
+	} else {
+		columns = req.Source.RawColumns
+		switch req.OrderBy {
+		case "", "time":
+			orderClause = fmt.Sprintf(" ORDER BY %s DESC", req.Source.RawOrder)
+		case "bytes":
+			orderClause = fmt.Sprintf(" ORDER BY %s DESC", req.Source.BytesCol)
+		case "packets":
+			orderClause = fmt.Sprintf(" ORDER BY %s DESC", req.Source.PacketCol)
+		default:
+			return "", nil, nil, fmt.Errorf("order_by %q requires group_by", req.OrderBy)
+		}
+	}
+
+	selectExprs := make([]string, len(columns))
+	for i, col := range columns {
+		selectExprs[i] = fmt.Sprintf("%s AS %s", col.Expr, col.Name)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s%s%s LIMIT %s",
+		strings.Join(selectExprs, ", "),
+		req.Source.Table,
+		strings.Join(conditions, " AND "),
+		groupClause,
+		orderClause,
+		b.param(req.Limit),
+	)
+	return query, b.args, columns, nil
+}
+
+// parseQueryRequest reads the source from the path and the remaining
+// parameters from the query string. The filter is taken from "q" or, when
+// absent, from the path segments following the source.
+func parseQueryRequest(r *http.Request) (QueryRequest, error) {
+	sourceName, pathFilter, _ := strings.Cut(strings.Trim(r.PathValue("path"), "/"), "/")
+	if sourceName == "" {
+		sourceName = "hourly"
+	}
+	source, ok := querySources[sourceName]
+	if !ok {
+		return QueryRequest{}, fmt.Errorf("unknown source %q, use flows or hourly", sourceName)
+	}
+
+	// order_by has its own values here, so only the time range is shared
+	// with the traffic filters
+	start, end, err := parseTimeRange(r.URL.Query(), time.Hour)
+	if err != nil {
+		return QueryRequest{}, err
+	}
+	req := QueryRequest{
+		Source:     source,
+		SourceName: sourceName,
+		Filter:     r.URL.Query().Get("q"),
+		Exporter:   r.URL.Query().Get("exporter"),
+		StartTime:  start,
+		EndTime:    end,
+		OrderBy:    r.URL.Query().Get("order_by"),
+		Limit:      queryDefaultLimit,
+	}
+	if req.Filter == "" {
+		req.Filter = strings.ReplaceAll(pathFilter, "/", " ")
+	}
+	if req.Exporter != "" && net.ParseIP(req.Exporter) == nil {
+		return QueryRequest{}, fmt.Errorf("invalid exporter %q", req.Exporter)
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return QueryRequest{}, fmt.Errorf("invalid limit %q", limit)
+		}
+		req.Limit = min(n, queryMaxLimit)
+	}
+
+	switch req.OrderBy {
+	case "", "bytes", "packets", "flows", "time":
+	default:
+		return QueryRequest{}, fmt.Errorf("invalid order_by %q, use bytes, packets, flows or time", req.OrderBy)
+	}
+	if req.OrderBy == "flows" && r.URL.Query().Get("group_by") == "" {
+		return QueryRequest{}, fmt.Errorf("order_by flows requires group_by")
+	}
+
+	if groupBy := r.URL.Query().Get("group_by"); groupBy != "" {
+		seen := make(map[string]bool)
+		for _, name := range strings.Split(groupBy, ",") {
+			name = strings.TrimSpace(strings.ToLower(name))
+			if name == "prot" {
+				name = "proto"
+			}
+			col, ok := queryGroupColumns[name]
+			if !ok {
+				return QueryRequest{}, fmt.Errorf("invalid group_by field %q", name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				req.GroupBy = append(req.GroupBy, col)
+			}
+		}
+		if req.OrderBy == "time" {
+			return QueryRequest{}, fmt.Errorf("order_by time cannot be combined with group_by")
+		}
+	}
+	return req, nil
+}
+
+// writeQueryError sends a JSON error response
+func writeQueryError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// handleQueryRequest runs a filter expression against flows or flows_hourly
+//
+//	GET /api/v1/query/hourly?q=src+net+10.0.0.0/8+and+dst+port+443&group_by=srcaddr&limit=10
+func handleQueryRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := parseQueryRequest(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, err)
+		return
+	}
+	// A single exporter scales every row by its rate, all exporters scale
+	// each row by the rate of the exporter it came from
+	req.SamplingRate = getSamplingRate(req.Exporter, "")
+	if req.Exporter == "" {
+		req.ExporterRates = exporterSamplingRates()
+	}
+	scaled := len(req.GroupBy) > 0 && (req.SamplingRate > 1 || len(req.ExporterRates) > 0)
+
+	records, err := config.Flows.QueryFlows(req)
+	var qerr *queryError
+	if errors.As(err, &qerr) {
+		writeQueryError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Error running flow query: %v", err)
+		writeQueryError(w, http.StatusInternalServerError, fmt.Errorf("query failed"))
+		return
+	}
+
+	groupBy := make([]string, len(req.GroupBy))
+	for i, col := range req.GroupBy {
+		groupBy[i] = col.Name
+	}
+
+	response := map[string]interface{}{
+		"source":        req.SourceName,
+		"filter":        req.Filter,
+		"group_by":      groupBy,
+		"records":       records,
+		"count":         len(records),
+		"sampling_rate": req.SamplingRate,
+		"scaled":        scaled,
+	}
+	if len(req.ExporterRates) > 0 {
+		response["sampling_rates"] = req.ExporterRates
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
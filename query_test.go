@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exprString renders a parsed filter in prefix notation, e.g.
+// (or (and src port=80 proto=6) (not host=10.0.0.1))
+func exprString(expr queryExpr) string {
+	switch node := expr.(type) {
+	case queryBinary:
+		return fmt.Sprintf("(%s %s %s)", node.Op, exprString(node.Left), exprString(node.Right))
+	case queryNot:
+		return fmt.Sprintf("(not %s)", exprString(node.Expr))
+	case queryPrimitive:
+		s := node.Field
+		if node.Dir != "" {
+			s = node.Dir + " " + s
+		}
+		if node.Value != "" {
+			s += node.Op + node.Value
+		}
+		if node.High != "" {
+			s += "-" + node.High
+		}
+		return s
+	}
+	return fmt.Sprintf("%T", expr)
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"", "any"},
+		{"ipv4", "ipv4"},
+		{"src port 80", "src port=80"},
+		{"port != 53", "port!=53"},
+		{"bytes >= 1000", "bytes>=1000"},
+		{"proto udp", "proto=17"},
+		{"host 2001:DB8::1", "host=2001:db8::1"},
+
+		// and binds tighter than or, both are left associative
+		{"port 80 or port 443 and proto tcp", "(or port=80 (and port=443 proto=6))"},
+		{"port 80 and port 443 or proto tcp", "(or (and port=80 port=443) proto=6)"},
+		{"port 1 or port 2 or port 3", "(or (or port=1 port=2) port=3)"},
+		{"(port 80 or port 443) and proto tcp", "(and (or port=80 port=443) proto=6)"},
+		{"port 80 || port 443 && proto tcp", "(or port=80 (and port=443 proto=6))"},
+
+		// not binds tighter than and; ! is the same as not
+		{"not port 80 and proto tcp", "(and (not port=80) proto=6)"},
+		{"! port 80 and proto tcp", "(and (not port=80) proto=6)"},
+		{"!port 80", "(not port=80)"},
+		{"not (port 80 or port 443)", "(not (or port=80 port=443))"},
+		{"not not ipv6", "(not (not ipv6))"},
+		{"proto tcp and !(dst port 22)", "(and proto=6 (not dst port=22))"},
+
+		// networks are normalized to their CIDR
+		{"net 10.1.2.3/8", "net=10.0.0.0/8"},
+		{"src net 192.0.2.1", "src net=192.0.2.1/32"},
+		{"dst net 2001:db8::/32", "dst net=2001:db8::/32"},
+		{"net != 10.0.0.0/8", "net!=10.0.0.0/8"},
+
+		// ranges
+		{"port 1024-2048", "port=1024-2048"},
+		{"dst port 0-65535", "dst port=0-65535"},
+		{"src as 64512-65534", "src as=64512-65534"},
+		{"in if 3 and out if 4", "(and in if=3 out if=4)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			expr, err := parseQuery(tt.filter)
+			if err != nil {
+				t.Fatalf("parseQuery(%q): %v", tt.filter, err)
+			}
+			if got := exprString(expr); got != tt.want {
+				t.Errorf("parseQuery(%q) = %s, want %s", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		pos    int
+		msg    string
+	}{
+		{"port", 4, "expected value for port"},
+		{"port 80 and", 11, "unexpected end of filter"},
+		{"port 80 port 443", 8, `unexpected "port"`},
+		{"(port 80", 8, "missing closing parenthesis"},
+		{"port 80)", 7, `unexpected ")"`},
+		{"foo 1", 0, `unknown keyword "foo"`},
+		{"src if 3", 4, "expected host, net, port or as after"},
+		{"in port 3", 3, "expected if after"},
+		{"port 80 & port 443", 8, "unexpected character"},
+		{"host 300.1.1.1", 5, "invalid IP address"},
+		{"proto 7 and net 10.0.0.0/33", 16, "invalid network"},
+		{"port 70000", 5, "invalid port value"},
+		{"port 2048-1024", 5, "invalid port range"},
+		{"port > 1-2", 7, "a range cannot be combined with >"},
+		{"if 1-2", 3, "ranges are only supported for port and as"},
+		{"host > 10.0.0.1", 5, "operator > not supported for host"},
+		{"bytes 100", 6, "expected comparison operator after bytes"},
+		{"proto bogus", 6, "invalid protocol"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			_, err := parseQuery(tt.filter)
+			var qerr *queryError
+			if !errors.As(err, &qerr) {
+				t.Fatalf("parseQuery(%q) error = %v, want a queryError", tt.filter, err)
+			}
+			if qerr.Pos != tt.pos || !strings.Contains(qerr.Msg, tt.msg) {
+				t.Errorf("parseQuery(%q) error = %d %q, want %d %q", tt.filter, qerr.Pos, qerr.Msg, tt.pos, tt.msg)
+			}
+		})
+	}
+}
+
+func TestBuildQuerySQL(t *testing.T) {
+	defer setDBTimezone("")
+	if err := setDBTimezone("UTC"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		req   QueryRequest
+		where string
+		args  []interface{}
+		table string
+	}{
+		{
+			name:  "empty filter",
+			req:   QueryRequest{Source: querySources["hourly"], Limit: 10},
+			where: "WHERE TRUE ORDER BY",
+			args:  []interface{}{10},
+			table: "flows_hourly",
+		},
+		{
+			name:  "either side",
+			req:   QueryRequest{Source: querySources["flows"], Filter: "port 443 and proto tcp", Limit: 5},
+			where: "WHERE ((srcport = $1 OR dstport = $1) AND prot = $2) ORDER BY last DESC LIMIT $3",
+			args:  []interface{}{int64(443), int64(6), 5},
+			table: "flows",
+		},
+		{
+			name:  "negated port holds on both sides",
+			req:   QueryRequest{Source: querySources["flows"], Filter: "port != 53", Limit: 5},
+			where: "WHERE NOT (srcport = $1 OR dstport = $1) ORDER BY",
+			args:  []interface{}{int64(53), 5},
+			table: "flows",
+		},
+		{
+			name:  "network and range",
+			req:   QueryRequest{Source: querySources["hourly"], Filter: "src net 10.0.0.0/8 or not dst port 1024-2048", Limit: 5},
+			where: "WHERE (srcaddr <<= $1::inet OR NOT (dstport BETWEEN $2 AND $3)) ORDER BY",
+			args:  []interface{}{"10.0.0.0/8", int64(1024), int64(2048), 5},
+			table: "flows_hourly",
+		},
+		{
+			name:  "byte column of the source",
+			req:   QueryRequest{Source: querySources["hourly"], Filter: "bytes > 1000", Limit: 5},
+			where: "WHERE total_bytes > $1 ORDER BY",
+			args:  []interface{}{int64(1000), 5},
+			table: "flows_hourly",
+		},
+		{
+			name: "exporter and time range follow the filter",
+			req: QueryRequest{Source: querySources["flows"], Filter: "host 192.0.2.1", Exporter: "10.0.0.1",
+				StartTime: start, EndTime: end, Limit: 5},
+			where: "WHERE (srcaddr = $1::inet OR dstaddr = $1::inet) AND exporter = $2::inet AND last >= $3 AND last <= $4 ORDER BY",
+			args:  []interface{}{"192.0.2.1", "10.0.0.1", start, end, 5},
+			table: "flows",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, _, err := buildQuerySQL(tt.req)
+			if err != nil {
+				t.Fatalf("buildQuerySQL: %v", err)
+			}
+			if !strings.Contains(query, " FROM "+tt.table+" ") {
+				t.Errorf("query does not read %s: %s", tt.table, query)
+			}
+			if !strings.Contains(query, tt.where) {
+				t.Errorf("query = %s\nwant it to contain %s", query, tt.where)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %#v, want %#v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestBuildQuerySQLGroupBy(t *testing.T) {
+	req := QueryRequest{
+		Source:  querySources["hourly"],
+		Filter:  "dst port 443",
+		GroupBy: []queryColumn{queryGroupColumns["srcaddr"], queryGroupColumns["proto"]},
+		Limit:   10,
+	}
+	query, args, columns, err := buildQuerySQL(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT host(srcaddr) AS srcaddr, prot AS proto, SUM(total_bytes) AS bytes, SUM(total_packets) AS packets, COUNT(*) AS flows " +
+		"FROM flows_hourly WHERE dstport = $1 GROUP BY host(srcaddr), prot ORDER BY bytes DESC LIMIT $2"
+	if query != want {
+		t.Errorf("query = %s\nwant    %s", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{int64(443), 10}) {
+		t.Errorf("args = %#v", args)
+	}
+	var names []string
+	for _, col := range columns {
+		names = append(names, col.Name)
+	}
+	if got := strings.Join(names, ","); got != "srcaddr,proto,bytes,packets,flows" {
+		t.Errorf("columns = %s", got)
+	}
+
+	req.GroupBy = nil
+	req.OrderBy = "flows"
+	if _, _, _, err := buildQuerySQL(req); err == nil {
+		t.Error("order_by flows without group_by accepted")
+	}
+}
+
+func TestBuildQuerySQLExporterRates(t *testing.T) {
+	req := QueryRequest{
+		Source:        querySources["hourly"],
+		GroupBy:       []queryColumn{queryGroupColumns["srcaddr"]},
+		Limit:         10,
+		ExporterRates: map[string]int64{"192.0.2.2": 100, "192.0.2.1": 10},
+	}
+	query, _, _, err := buildQuerySQL(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SUM(total_bytes * CASE exporter WHEN '192.0.2.1'::inet THEN 10 WHEN '192.0.2.2'::inet THEN 100 ELSE 1 END) AS bytes"
+	if !strings.Contains(query, want) {
+		t.Errorf("query = %s\nwant it to contain %s", query, want)
+	}
+
+	// Rates of exporters that are not sampled leave the sums alone
+	req.ExporterRates = map[string]int64{}
+	if query, _, _, _ := buildQuerySQL(req); !strings.Contains(query, "SUM(total_bytes) AS bytes") {
+		t.Errorf("query without sampled exporters = %s", query)
+	}
+}
+
+// TestBuildQuerySQLNoInterpolation checks that no value of the filter ends
+// up in the SQL text, only in the arguments
+func TestBuildQuerySQLNoInterpolation(t *testing.T) {
+	filters := []string{
+		"host 192.0.2.123",
+		"net 198.51.100.0/24",
+		"exporter 203.0.113.77",
+		"port 31337 or as 4200000001",
+		"bytes > 987654321 and packets < 123456789",
+		"in if 424242",
+		"src port 40000-40999",
+	}
+	for _, filter := range filters {
+		query, args, _, err := buildQuerySQL(QueryRequest{Source: querySources["flows"], Filter: filter, Exporter: "192.0.2.250", Limit: 77})
+		if err != nil {
+			t.Fatalf("%s: %v", filter, err)
+		}
+		for _, arg := range args {
+			if s := fmt.Sprint(arg); strings.Contains(query, s) {
+				t.Errorf("%s: value %s interpolated into %s", filter, s, query)
+			}
+		}
+		placeholders := strings.Count(query, "$")
+		if placeholders < len(args) {
+			t.Errorf("%s: %d placeholders for %d args", filter, placeholders, len(args))
+		}
+		if !strings.Contains(query, fmt.Sprintf("LIMIT $%d", len(args))) {
+			t.Errorf("%s: the limit is not the last placeholder: %s", filter, query)
+		}
+	}
+}
+
+func TestQueryHandler(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+
+	w := serve(handleQueryRequest, httptest.NewRequest(http.MethodGet,
+		"/api/v1/query/hourly?q=dst+port+443&group_by=srcaddr,proto&order_by=flows"+testRange, nil), "path", "hourly")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var response struct {
+		Source  string                   `json:"source"`
+		GroupBy []string                 `json:"group_by"`
+		Records []map[string]interface{} `json:"records"`
+		Count   int                      `json:"count"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Source != "hourly" || strings.Join(response.GroupBy, ",") != "srcaddr,proto" || response.Count != 2 {
+		t.Fatalf("response = %+v", response)
+	}
+	if first := response.Records[0]; first["srcaddr"] != "10.0.0.1" || first["proto"] != 6.0 || first["flows"] != 2.0 || first["bytes"] != 4000.0 {
+		t.Errorf("first record = %v", first)
+	}
+
+	// The filter may also follow the source in the path
+	w = serve(handleQueryRequest, httptest.NewRequest(http.MethodGet,
+		"/api/v1/query/flows/src/host/10.0.0.3?exporter=192.0.2.1"+testRange, nil), "path", "flows/src/host/10.0.0.3")
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Count != 1 || response.Records[0]["dstport"] != 22.0 {
+		t.Errorf("path filter records = %v", response.Records)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		target string
+		error  string
+	}{
+		{"hourly", "/api/v1/query/hourly?q=port+80+and", "position 11: unexpected end of filter"},
+		{"bogus", "/api/v1/query/bogus", "unknown source"},
+		{"flows", "/api/v1/query/flows?order_by=flows", "requires group_by"},
+		{"flows", "/api/v1/query/flows?group_by=ttl", "invalid group_by"},
+	} {
+		w := serve(handleQueryRequest, httptest.NewRequest(http.MethodGet, tt.target, nil), "path", tt.path)
+		var body map[string]string
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(body["error"], tt.error) {
+			t.Errorf("%s: status %d, error %q, want 400 %q", tt.target, w.Code, body["error"], tt.error)
+		}
+	}
+}
+
+func TestQueryHandlerSampling(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	store.exporters[0].Data = map[string]interface{}{samplingRateKey: float64(10)}
+	store.exporters[1].Data = map[string]interface{}{samplingRateKey: float64(2)}
+
+	tests := []struct {
+		target string
+		want   map[string]float64
+		rates  map[string]int64
+	}{
+		// Over all exporters each flow is scaled by the rate of its exporter
+		{"/api/v1/query/hourly?q=dst+port+443&group_by=srcaddr" + testRange,
+			map[string]float64{"10.0.0.1": 40000, "10.9.9.9": 19998}, map[string]int64{"192.0.2.1": 10, "192.0.2.2": 2}},
+		{"/api/v1/query/hourly?q=dst+port+443&group_by=srcaddr&exporter=192.0.2.2" + testRange,
+			map[string]float64{"10.9.9.9": 19998}, nil},
+	}
+	for _, tt := range tests {
+		w := serve(handleQueryRequest, httptest.NewRequest(http.MethodGet, tt.target, nil), "path", "hourly")
+		var response struct {
+			Records       []map[string]interface{} `json:"records"`
+			Scaled        bool                     `json:"scaled"`
+			SamplingRates map[string]int64         `json:"sampling_rates"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %v: %s", tt.target, err, w.Body)
+		}
+		got := make(map[string]float64)
+		for _, record := range response.Records {
+			got[record["srcaddr"].(string)] = record["bytes"].(float64)
+		}
+		if !reflect.DeepEqual(got, tt.want) || !response.Scaled || !reflect.DeepEqual(response.SamplingRates, tt.rates) {
+			t.Errorf("%s: bytes = %v, scaled = %v, rates = %v, want %v", tt.target, got, response.Scaled, response.SamplingRates, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Rate is the traffic of an interface between two counter samples, stamped
+// with the time of the later one
+type Rate struct {
+	Timestamp time.Time `json:"timestamp"`
+	BitsIn    float64   `json:"bits_in"`
+	BitsOut   float64   `json:"bits_out"`
+	// Seconds since the previous sample
+	Interval float64 `json:"interval"`
+}
+
+// Deltas implying more than the interface speed plus this margin are
+// counter discontinuities, not traffic
+const rateSpeedMargin = 1.1
+
+// computeRates turns interface counter samples, oldest first, into bits per
+// second. Each rate is divided by the actual time between samples, so
+// irregular polling does not skew it. When a counter goes backwards it is
+// either a wrap, which is accounted for, or a reset of the device, in which
+// case that interval is left out rather than reported as zero. speed is the
+// interface speed in bits per second, or 0 if unknown.
+func computeRates(metrics []Metric, speed int64) []Rate {
+	if len(metrics) < 2 {
+		return []Rate{}
+	}
+	rates := make([]Rate, 0, len(metrics)-1)
+	prev := metrics[0]
+	for _, cur := range metrics[1:] {
+		dt := cur.Timestamp.Sub(prev.Timestamp).Seconds()
+		if dt <= 0 {
+			// Duplicate sample
+			continue
+		}
+		in, okIn := counterDelta(prev.OctetsIn, cur.OctetsIn, dt, speed)
+		out, okOut := counterDelta(prev.OctetsOut, cur.OctetsOut, dt, speed)
+		restarted := uptimeReset(prev.Uptime, cur.Uptime, dt)
+		prev = cur
+		if !okIn || !okOut || restarted {
+			continue
+		}
+		rates = append(rates, Rate{
+			Timestamp: cur.Timestamp,
+			BitsIn:    float64(in) * 8 / dt,
+			BitsOut:   float64(out) * 8 / dt,
+			Interval:  dt,
+		})
+	}
+	return rates
+}
+
+// counterDelta returns the octets counted between two samples of a counter,
+// or false if the counter was reset. Counters are stored as int64 and read
+// back as the uint64 the agent reported. A decrease is a wrap of a 32-bit
+// counter if both values fit in 32 bits, of a 64-bit one otherwise, as long
+// as the implied traffic fits the interface speed or, with no known speed,
+// covers less than half the counter range.
+func counterDelta(prev int64, cur int64, dt float64, speed int64) (uint64, bool) {
+	p, c := uint64(prev), uint64(cur)
+	var delta uint64
+	switch {
+	case c >= p:
+		delta = c - p
+	case p <= math.MaxUint32 && c <= math.MaxUint32:
+		delta = math.MaxUint32 - p + c + 1
+		if speed <= 0 && delta >= 1<<31 {
+			return 0, false
+		}
+	default:
+		delta = math.MaxUint64 - p + c + 1
+		if speed <= 0 && delta >= 1<<63 {
+			return 0, false
+		}
+	}
+	if speed > 0 && float64(delta)*8/dt > float64(speed)*rateSpeedMargin {
+		return 0, false
+	}
+	return delta, true
+}
+
+// uptimeReset reports whether the agent restarted between two samples taken
+// dt seconds apart: its sysUpTime, in hundredths of a second, went backwards
+// further than a wrap of the 32-bit TimeTicks explains. Samples without an
+// uptime never count as a restart.
+func uptimeReset(prev int64, cur int64, dt float64) bool {
+	if prev <= 0 || cur <= 0 || cur >= prev {
+		return false
+	}
+	elapsed := math.MaxUint32 - prev + cur + 1
+	return float64(elapsed) > dt*100*2
+}
+
+// findInterface returns the interfaces table row of an exporter ID and
+// ifIndex
+func findInterface(exporter string, iface string) (InterfaceConfig, bool) {
+	index, err := strconv.ParseInt(iface, 10, 64)
+	if err != nil {
+		return InterfaceConfig{}, false
+	}
+	interfaces, err := config.Metrics.InterfaceConfigs(exporter)
+	if err != nil {
+		log.Println(err)
+		return InterfaceConfig{}, false
+	}
+	for _, i := range interfaces {
+		if i.SnmpIndex == index {
+			return i, true
+		}
+	}
+	return InterfaceConfig{}, false
+}
+
+// interfaceSpeed returns the speed in bits per second of an interface as
+// stored in the interfaces table, or 0 if unknown
+func interfaceSpeed(exporter string, iface string) int64 {
+	i, _ := findInterface(exporter, iface)
+	return i.Speed
+}
+
+// interfaceRates loads the counters of an interface and converts them to
+// rates. One sample before start is needed for the first rate, so the
+// counters are read from one hour earlier.
+func interfaceRates(exporter string, iface string, start time.Time, end time.Time) ([]Rate, error) {
+	metrics, err := config.Metrics.InterfaceMetrics(exporter, iface, start.Add(-time.Hour), end)
+	if err != nil {
+		return nil, err
+	}
+	rates := computeRates(metrics, interfaceSpeed(exporter, iface))
+	first := 0
+	for first < len(rates) && rates[first].Timestamp.Before(start) {
+		first++
+	}
+	return rates[first:], nil
+}
+
+// getInterfaceRatesRequest returns the bits/s in and out of an interface.
+// start and end are RFC3339 or epoch seconds, defaulting to the last 24 hours.
+func getInterfaceRatesRequest(w http.ResponseWriter, r *http.Request) {
+	exporterStr := r.PathValue("exporter")
+	interfaceStr := r.PathValue("interface")
+	if !authorizeExporter(w, r, exporterStr, interfaceStr) {
+		return
+	}
+	start, _ := parseRequestTime(r.URL.Query().Get("start"))
+	end, _ := parseRequestTime(r.URL.Query().Get("end"))
+	if start.IsZero() {
+		start = time.Now().Add(-24 * time.Hour)
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	rates, err := interfaceRates(exporterStr, interfaceStr, start, end)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rates); err != nil {
+		log.Printf("Error encoding rates: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name  string
+		prev  int64
+		cur   int64
+		speed int64
+		want  uint64
+		ok    bool
+	}{
+		{"32-bit increase", 1000, 61000, 0, 60000, true},
+		{"32-bit wrap", math.MaxUint32 - 999, 1000, 0, 2000, true},
+		{"32-bit wrap within speed", 3e9, 100, 1e9, 1294967396, true},
+		// Over half the range without a speed, or above the speed
+		{"32-bit reset", 1e9, 100, 0, 0, false},
+		{"32-bit reset above speed", 3e9, 100, 1e8, 0, false},
+		{"64-bit increase", 1 << 40, 1<<40 + 7.5e6, 1e9, 7.5e6, true},
+		// Stored as int64, -1000 is 2^64-1000 on the agent
+		{"64-bit wrap", -1000, 1000, 0, 2000, true},
+		{"64-bit wrap within speed", -1000, 1000, 1e9, 2000, true},
+		{"64-bit reset", 1 << 40, 5, 0, 0, false},
+		{"64-bit reset with speed", 1 << 40, 5, 1e9, 0, false},
+		{"64-bit reset to 32-bit values", 5e9, 100, 0, 0, false},
+		{"increase above speed", 1 << 40, 1<<40 + 15e6, 1e6, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := counterDelta(tt.prev, tt.cur, 60, tt.speed)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: counterDelta(%d, %d) = %d, %v, want %d, %v", tt.name, tt.prev, tt.cur, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestUptimeReset(t *testing.T) {
+	tests := []struct {
+		prev int64
+		cur  int64
+		want bool
+	}{
+		{0, 100, false},
+		{100, 0, false},
+		{100000, 106000, false},
+		{500000, 100, true},
+		// TimeTicks wrap after 497 days: 6000 ticks are the 60 seconds
+		{math.MaxUint32 - 2999, 3000, false},
+	}
+	for _, tt := range tests {
+		if got := uptimeReset(tt.prev, tt.cur, 60); got != tt.want {
+			t.Errorf("uptimeReset(%d, %d) = %v, want %v", tt.prev, tt.cur, got, tt.want)
+		}
+	}
+}
+
+func TestComputeRates(t *testing.T) {
+	at := func(minutes int) time.Time { return testHour.Add(time.Duration(minutes) * time.Minute) }
+	metrics := []Metric{
+		{Timestamp: at(0), OctetsIn: -1000, OctetsOut: 1000, Uptime: 100000},
+		// 7500 octets in across the 64-bit wrap, 750 out
+		{Timestamp: at(1), OctetsIn: 6500, OctetsOut: 1750, Uptime: 106000},
+		// Counters went up, but the agent restarted in between
+		{Timestamp: at(2), OctetsIn: 14000, OctetsOut: 2500, Uptime: 3000},
+		{Timestamp: at(2), OctetsIn: 14000, OctetsOut: 2500, Uptime: 3000},
+		{Timestamp: at(3), OctetsIn: 21500, OctetsOut: 3250, Uptime: 9000},
+	}
+	want := []Rate{
+		{Timestamp: at(1), BitsIn: 1000, BitsOut: 100, Interval: 60},
+		{Timestamp: at(3), BitsIn: 1000, BitsOut: 100, Interval: 60},
+	}
+	if got := computeRates(metrics, 0); !slices.Equal(got, want) {
+		t.Errorf("rates = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Keys of the exporter data JSON holding the sampling configuration, e.g.
+//
+//	{"sampling_rate": 1000, "interface_sampling_rates": {"12": 100}}
+//
+// A per-interface rate takes precedence over the exporter-wide rate.
+const (
+	samplingRateKey           = "sampling_rate"
+	interfaceSamplingRatesKey = "interface_sampling_rates"
+)
+
+// getSamplingRate returns the configured 1:N sampling rate for an exporter
+// (inet address) and, when given, one of its interfaces (SNMP index).
+// Exporters without sampling configuration return 1.
+func getSamplingRate(exporter string, iface string) int64 {
+	if exporter == "" {
+		return 1
+	}
+	data, err := config.Metrics.ExporterData(exporter)
+	if err != nil {
+		log.Printf("Error reading sampling rate for %s: %v", exporter, err)
+		return 1
+	}
+	return samplingRateFromData(data, iface)
+}
+
+// samplingRateFromData resolves the sampling rate from exporter data JSON
+func samplingRateFromData(data map[string]interface{}, iface string) int64 {
+	if iface != "" {
+		if rates, ok := data[interfaceSamplingRatesKey].(map[string]interface{}); ok {
+			if rate, err := parseSamplingRate(rates[iface]); err == nil && rate > 0 {
+				return rate
+			}
+		}
+	}
+	if rate, err := parseSamplingRate(data[samplingRateKey]); err == nil && rate > 0 {
+		return rate
+	}
+	return 1
+}
+
+// parseSamplingRate accepts a JSON number or numeric string. A missing value
+// returns 0 without error.
+func parseSamplingRate(v interface{}) (int64, error) {
+	switch value := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		if value < 1 || value != math.Trunc(value) || value > math.MaxInt32 {
+			return 0, fmt.Errorf("sampling rate must be a positive integer, got %v", value)
+		}
+		return int64(value), nil
+	case string:
+		if value == "" {
+			return 0, nil
+		}
+		rate, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || rate < 1 || rate > math.MaxInt32 {
+			return 0, fmt.Errorf("sampling rate must be a positive integer, got %q", value)
+		}
+		return rate, nil
+	}
+	return 0, fmt.Errorf("sampling rate must be a number, got %T", v)
+}
+
+// normalizeSamplingConfig validates the sampling keys of exporter data JSON
+// and rewrites them as plain integers. Empty values remove the key.
+func normalizeSamplingConfig(data map[string]interface{}) error {
+	if data == nil {
+		return nil
+	}
+	rate, err := parseSamplingRate(data[samplingRateKey])
+	if err != nil {
+		return err
+	}
+	if rate == 0 {
+		delete(data, samplingRateKey)
+	} else {
+		data[samplingRateKey] = rate
+	}
+
+	raw, exists := data[interfaceSamplingRatesKey]
+	if !exists || raw == nil {
+		delete(data, interfaceSamplingRatesKey)
+		return nil
+	}
+	rates, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s must be an object of ifIndex to rate", interfaceSamplingRatesKey)
+	}
+	normalized := make(map[string]interface{}, len(rates))
+	for iface, value := range rates {
+		if _, err := strconv.ParseUint(iface, 10, 32); err != nil {
+			return fmt.Errorf("invalid interface index %q in %s", iface, interfaceSamplingRatesKey)
+		}
+		rate, err := parseSamplingRate(value)
+		if err != nil {
+			return fmt.Errorf("interface %s: %w", iface, err)
+		}
+		if rate > 0 {
+			normalized[iface] = rate
+		}
+	}
+	if len(normalized) == 0 {
+		delete(data, interfaceSamplingRatesKey)
+	} else {
+		data[interfaceSamplingRatesKey] = normalized
+	}
+	return nil
+}
+
+// sampledSum returns a SUM() expression scaled by the sampling rate. The rate
+// always comes from getSamplingRate, never from user input.
+func sampledSum(column string, rate int64) string {
+	if rate <= 1 {
+		return fmt.Sprintf("SUM(%s)", column)
+	}
+	return fmt.Sprintf("SUM(%s) * %d", column, rate)
+}
+
+// exporterSamplingRates returns the exporter-wide sampling rate of every
+// sampled exporter, keyed by normalized address. Queries over several
+// exporters scale each row by the rate of its exporter.
+func exporterSamplingRates() map[string]int64 {
+	exporters, err := config.Metrics.ExporterConfigs()
+	if err != nil {
+		log.Printf("Error reading sampling rates: %v", err)
+		return nil
+	}
+	rates := make(map[string]int64)
+	for _, exporter := range exporters {
+		if rate := samplingRateFromData(exporter.Data, ""); rate > 1 {
+			rates[normalizeExporterAddr(exporter.IPInet)] = rate
+		}
+	}
+	return rates
+}
+
+// sampledSumByExporter returns a SUM() expression scaling each row by the
+// sampling rate of its exporter. Exporters missing from rates count once.
+// Addresses and rates come from exporterSamplingRates, never from user input.
+func sampledSumByExporter(column string, rates map[string]int64) string {
+	var addrs []string
+	for addr := range rates {
+		if net.ParseIP(addr) != nil && rates[addr] > 1 {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return fmt.Sprintf("SUM(%s)", column)
+	}
+	slices.Sort(addrs)
+	var b strings.Builder
+	fmt.Fprintf(&b, "SUM(%s * CASE exporter", column)
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, " WHEN '%s'::inet THEN %d", addr, rates[addr])
+	}
+	b.WriteString(" ELSE 1 END)")
+	return b.String()
+}
+
+// sampledSum returns the SUM() expression of a column scaled by the sampling
+// rate of the filter, or by the rate of each exporter when it has ExporterRates
+func (filter TrafficFilter) sampledSum(column string) string {
+	if filter.ExporterRates != nil {
+		return sampledSumByExporter(column, filter.ExporterRates)
+	}
+	return sampledSum(column, filter.SamplingRate)
+}
+
+// recordRate returns the sampling rate scaling a flow of the filter
+func (filter TrafficFilter) recordRate(record TrafficRecord) int64 {
+	if filter.ExporterRates != nil {
+		return max(filter.ExporterRates[normalizeExporterAddr(record.Exporter)], 1)
+	}
+	return max(filter.SamplingRate, 1)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scan kinds: one source probing a port on many hosts, or many ports on
+// one host
+const (
+	scanHorizontal = "horizontal"
+	scanVertical   = "vertical"
+)
+
+const (
+	defaultScanWindow   = 5 * time.Minute
+	defaultScanMinHosts = 50
+	defaultScanMinPorts = 100
+	// Findings not seen for this long are dropped from the report
+	scanRetention = 24 * time.Hour
+)
+
+// ScanCandidate counts the TCP probes of one source towards one destination
+// port (horizontal) or one destination host (vertical). Probes are TCP flows
+// without ACK: SYN, FIN, NULL and XMAS scans never complete a handshake.
+type ScanCandidate struct {
+	Kind   string
+	Source string
+	// Set for horizontal scans
+	Port int64
+	// Set for vertical scans
+	Target string
+	// Distinct hosts (horizontal) or ports (vertical) probed
+	Distinct  int64
+	Flows     int64
+	Packets   int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// ScanFinding is a scan reported by the detector. Distinct is the count of
+// the last window it was seen in; PeakDistinct, Flows and Packets are the
+// highest of any window, as windows overlap.
+type ScanFinding struct {
+	Kind         string    `json:"kind"`
+	Source       string    `json:"source"`
+	Port         int64     `json:"port,omitempty"`
+	Target       string    `json:"target,omitempty"`
+	Distinct     int64     `json:"distinct"`
+	PeakDistinct int64     `json:"peak_distinct"`
+	Flows        int64     `json:"flows"`
+	Packets      int64     `json:"packets"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	Active       bool      `json:"active"`
+	// Sources in a services table network listed in CNETFLOW_SCAN_SUPPRESS
+	Suppressed bool          `json:"suppressed"`
+	Service    string        `json:"service,omitempty"`
+	Enrichment *IPEnrichment `json:"enrichment,omitempty"`
+}
+
+// ScanReport is the response of /api/v1/security/scans
+type ScanReport struct {
+	Enabled  bool          `json:"enabled"`
+	Interval string        `json:"interval,omitempty"`
+	Window   string        `json:"window,omitempty"`
+	MinHosts int64         `json:"min_hosts,omitempty"`
+	MinPorts int64         `json:"min_ports,omitempty"`
+	Findings []ScanFinding `json:"findings"`
+}
+
+// ScanDetector looks for scans in the raw flows of the last window once per
+// interval. Flows of all exporters are counted together, so a scan crossing
+// several routers is reported once.
+type ScanDetector struct {
+	interval time.Duration
+	window   time.Duration
+	minHosts int64
+	minPorts int64
+	// Names of services table entries whose networks are trusted scanners
+	suppress map[string]bool
+
+	mu       sync.Mutex
+	findings map[string]*ScanFinding
+}
+
+var scanDetector *ScanDetector
+
+// NewScanDetector parses the settings, empty strings selecting the defaults.
+// suppress is a comma-separated list of services table names.
+func NewScanDetector(interval time.Duration, window string, minHosts string, minPorts string, suppress string) (*ScanDetector, error) {
+	d := &ScanDetector{
+		interval: interval,
+		window:   defaultScanWindow,
+		minHosts: defaultScanMinHosts,
+		minPorts: defaultScanMinPorts,
+		suppress: make(map[string]bool),
+		findings: make(map[string]*ScanFinding),
+	}
+	if window != "" {
+		w, err := parseInterval("CNETFLOW_SCAN_WINDOW", window)
+		if err != nil {
+			return nil, err
+		}
+		d.window = w
+	}
+	var err error
+	if minHosts != "" {
+		if d.minHosts, err = strconv.ParseInt(minHosts, 10, 64); err != nil || d.minHosts < 2 {
+			return nil, fmt.Errorf("invalid CNETFLOW_SCAN_MIN_HOSTS %q, must be at least 2", minHosts)
+		}
+	}
+	if minPorts != "" {
+		if d.minPorts, err = strconv.ParseInt(minPorts, 10, 64); err != nil || d.minPorts < 2 {
+			return nil, fmt.Errorf("invalid CNETFLOW_SCAN_MIN_PORTS %q, must be at least 2", minPorts)
+		}
+	}
+	for _, name := range strings.Split(suppress, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			d.suppress[name] = true
+		}
+	}
+	return d, nil
+}
+
+// Run checks the flows every interval
+func (d *ScanDetector) Run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		d.Detect(now)
+	}
+}
+
+// Detect checks the flows of the window ending at now
+func (d *ScanDetector) Detect(now time.Time) {
+	filter := TrafficFilter{StartTime: now.Add(-d.window), EndTime: now}
+	var candidates []ScanCandidate
+	for _, kind := range []string{scanHorizontal, scanVertical} {
+		threshold := d.minHosts
+		if kind == scanVertical {
+			threshold = d.minPorts
+		}
+		found, err := config.Flows.ScanStats(filter, kind, threshold)
+		if err != nil {
+			log.Printf("Scan detection: %v", err)
+			return
+		}
+		candidates = append(candidates, found...)
+	}
+
+	var networks []ServiceNetwork
+	if len(d.suppress) > 0 && len(candidates) > 0 {
+		networks = getServiceNetworks()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, finding := range d.findings {
+		finding.Active = false
+	}
+	for _, candidate := range candidates {
+		kind := candidate.Kind
+		key := fmt.Sprintf("%s|%s|%d|%s", kind, candidate.Source, candidate.Port, candidate.Target)
+		finding, ok := d.findings[key]
+		if !ok {
+			finding = &ScanFinding{
+				Kind:      kind,
+				Source:    candidate.Source,
+				Port:      candidate.Port,
+				Target:    candidate.Target,
+				FirstSeen: candidate.FirstSeen,
+			}
+			for _, network := range networks {
+				if ipMatchesNetwork(candidate.Source, network.CIDR) {
+					finding.Service = network.Name
+					finding.Suppressed = d.suppress[network.Name]
+					break
+				}
+			}
+			d.findings[key] = finding
+		}
+		finding.Active = true
+		finding.Distinct = candidate.Distinct
+		finding.PeakDistinct = max(finding.PeakDistinct, candidate.Distinct)
+		finding.Flows = max(finding.Flows, candidate.Flows)
+		finding.Packets = max(finding.Packets, candidate.Packets)
+		if candidate.FirstSeen.Before(finding.FirstSeen) {
+			finding.FirstSeen = candidate.FirstSeen
+		}
+		finding.LastSeen = candidate.LastSeen
+		if !ok {
+			log.Printf("Scan %s from %s: %d distinct", kind, candidate.Source, candidate.Distinct)
+			if !finding.Suppressed {
+				notifier.Notify(scanNotifyEvent(*finding))
+			}
+		}
+	}
+	for key, finding := range d.findings {
+		if now.Sub(finding.LastSeen) > scanRetention {
+			delete(d.findings, key)
+		}
+	}
+}
+
+// Findings returns the findings, most recently seen first
+func (d *ScanDetector) Findings() []ScanFinding {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	findings := make([]ScanFinding, 0, len(d.findings))
+	for _, finding := range d.findings {
+		findings = append(findings, *finding)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if !findings[i].LastSeen.Equal(findings[j].LastSeen) {
+			return findings[i].LastSeen.After(findings[j].LastSeen)
+		}
+		return findings[i].PeakDistinct > findings[j].PeakDistinct
+	})
+	return findings
+}
+
+// scanNotifyEvent turns a new scan into a notification
+func scanNotifyEvent(finding ScanFinding) NotifyEvent {
+	what := fmt.Sprintf("%d hosts on port %d", finding.Distinct, finding.Port)
+	if finding.Kind == scanVertical {
+		what = fmt.Sprintf("%d ports on %s", finding.Distinct, finding.Target)
+	}
+	return NotifyEvent{
+		Source:   "scan",
+		Severity: severityWarning,
+		Title:    fmt.Sprintf("%s scan from %s", finding.Kind, finding.Source),
+		Message:  fmt.Sprintf("%s probed %s since %s", finding.Source, what, finding.FirstSeen.Format(time.RFC3339)),
+		Time:     finding.LastSeen,
+		Fields: map[string]interface{}{
+			"kind":     finding.Kind,
+			"source":   finding.Source,
+			"port":     finding.Port,
+			"target":   finding.Target,
+			"distinct": finding.Distinct,
+		},
+	}
+}
+
+// getScansRequest handles /api/v1/security/scans. kind=horizontal|vertical,
+// source= and active=true narrow the list; suppressed=true includes the
+// scans of trusted scanners.
+func getScansRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	kind := query.Get("kind")
+	if kind != "" && kind != scanHorizontal && kind != scanVertical {
+		http.Error(w, fmt.Sprintf("unsupported kind %q, use horizontal or vertical", kind), http.StatusBadRequest)
+		return
+	}
+	report := ScanReport{Findings: []ScanFinding{}}
+	if scanDetector != nil {
+		report.Enabled = true
+		report.Interval = scanDetector.interval.String()
+		report.Window = scanDetector.window.String()
+		report.MinHosts = scanDetector.minHosts
+		report.MinPorts = scanDetector.minPorts
+		source := query.Get("source")
+		for _, finding := range scanDetector.Findings() {
+			if (kind != "" && finding.Kind != kind) ||
+				(source != "" && finding.Source != source) ||
+				(query.Get("active") == "true" && !finding.Active) ||
+				(query.Get("suppressed") != "true" && finding.Suppressed) {
+				continue
+			}
+			report.Findings = append(report.Findings, finding)
+		}
+	}
+
+	if len(report.Findings) > 0 {
+		seen := make(map[string]bool)
+		var ips []string
+		for _, finding := range report.Findings {
+			if !seen[finding.Source] {
+				seen[finding.Source] = true
+				ips = append(ips, finding.Source)
+			}
+		}
+		enrichments := EnrichIPs(ips)
+		for i := range report.Findings {
+			report.Findings[i].Enrichment = enrichments[report.Findings[i].Source]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error encoding scan report: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// scanProbe is a flow of one packet from src to port of dst ending a minute
+// before end
+func scanProbe(src string, dst string, port int64, prot string, flags string, end time.Time) TrafficRecord {
+	return TrafficRecord{Exporter: "192.0.2.1", SrcAddr: src, DstAddr: dst, DstPort: port, Protocol: prot, TCPFlags: flags,
+		DPkts: 1, DOctets: 40, First: end.Add(-2 * time.Minute), Last: end.Add(-time.Minute)}
+}
+
+func TestScanDetector(t *testing.T) {
+	store := useMemoryStore(t)
+	store.AddServiceNetworks(ServiceNetwork{Name: "trusted", CIDR: "192.0.2.0/24"}, ServiceNetwork{Name: "web", CIDR: "10.6.6.0/24"})
+	now := testHour
+	var flows []TrafficRecord
+	for _, dst := range []string{"10.0.2.1", "10.0.2.2", "10.0.2.3"} {
+		// At the host threshold
+		flows = append(flows, scanProbe("10.6.6.6", dst, 22, "6", "2", now))
+		// UDP is not probed for
+		flows = append(flows, scanProbe("10.6.6.8", dst, 53, "17", "0", now))
+		// A trusted scanner
+		flows = append(flows, scanProbe("192.0.2.50", dst, 443, "6", "2", now))
+	}
+	flows = append(flows,
+		// An answered connection is no probe
+		scanProbe("10.6.6.6", "10.0.2.4", 22, "6", "18", now),
+		// One host short, the third one is outside the window
+		scanProbe("10.6.6.7", "10.0.2.1", 22, "6", "2", now),
+		scanProbe("10.6.6.7", "10.0.2.2", 22, "6", "2", now),
+		scanProbe("10.6.6.7", "10.0.2.3", 22, "6", "2", now.Add(-10*time.Minute)),
+	)
+	for port := int64(1); port <= 4; port++ {
+		// At the port threshold
+		flows = append(flows, scanProbe("10.7.7.7", "10.0.3.1", port, "6", "2", now))
+		// One port short
+		if port < 4 {
+			flows = append(flows, scanProbe("10.7.7.8", "10.0.3.1", port, "6", "41", now))
+		}
+	}
+	store.AddFlows(flows...)
+
+	detector, err := NewScanDetector(time.Minute, "", "3", "4", "trusted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	detector.Detect(now)
+	findings := make(map[string]ScanFinding)
+	for _, finding := range detector.Findings() {
+		findings[finding.Kind+" "+finding.Source] = finding
+	}
+	if len(findings) != 3 {
+		t.Fatalf("findings = %+v", findings)
+	}
+	horizontal := findings["horizontal 10.6.6.6"]
+	if horizontal.Port != 22 || horizontal.Distinct != 3 || horizontal.PeakDistinct != 3 || horizontal.Flows != 3 ||
+		!horizontal.Active || horizontal.Suppressed || horizontal.Service != "web" ||
+		!horizontal.FirstSeen.Equal(now.Add(-2*time.Minute)) || !horizontal.LastSeen.Equal(now.Add(-time.Minute)) {
+		t.Errorf("horizontal scan = %+v", horizontal)
+	}
+	vertical := findings["vertical 10.7.7.7"]
+	if vertical.Target != "10.0.3.1" || vertical.Distinct != 4 || vertical.Packets != 4 || !vertical.Active || vertical.Service != "" {
+		t.Errorf("vertical scan = %+v", vertical)
+	}
+	if trusted := findings["horizontal 192.0.2.50"]; !trusted.Suppressed || trusted.Service != "trusted" || trusted.Port != 443 {
+		t.Errorf("scan of the trusted scanner = %+v", trusted)
+	}
+
+	// A wider scan in a later window raises the peak; findings not seen in
+	// a window stay listed as inactive
+	later := now.Add(10 * time.Minute)
+	store.AddFlows(
+		scanProbe("10.6.6.6", "10.0.2.1", 22, "6", "2", later),
+		scanProbe("10.6.6.6", "10.0.2.2", 22, "6", "2", later),
+		scanProbe("10.6.6.6", "10.0.2.3", 22, "6", "2", later),
+		scanProbe("10.6.6.6", "10.0.2.5", 22, "6", "2", later),
+	)
+	detector.Detect(later)
+	for _, finding := range detector.Findings() {
+		if finding.Source == "10.6.6.6" {
+			if !finding.Active || finding.Distinct != 4 || finding.PeakDistinct != 4 ||
+				!finding.FirstSeen.Equal(now.Add(-2*time.Minute)) || !finding.LastSeen.Equal(later.Add(-time.Minute)) {
+				t.Errorf("horizontal scan seen again = %+v", finding)
+			}
+		} else if finding.Active {
+			t.Errorf("finding not seen again is active: %+v", finding)
+		}
+	}
+	detector.Detect(later.Add(10 * time.Minute))
+	findings = make(map[string]ScanFinding)
+	for _, finding := range detector.Findings() {
+		if finding.Active {
+			t.Errorf("finding of an empty window is active: %+v", finding)
+		}
+		findings[finding.Kind+" "+finding.Source] = finding
+	}
+	if len(findings) != 3 || findings["horizontal 10.6.6.6"].Distinct != 4 {
+		t.Errorf("findings of an empty window = %+v", findings)
+	}
+
+	// Dropped once not seen for the retention
+	detector.Detect(now.Add(scanRetention))
+	if findings := detector.Findings(); len(findings) != 1 || findings[0].Source != "10.6.6.6" {
+		t.Errorf("findings within the retention = %+v", findings)
+	}
+	detector.Detect(later.Add(scanRetention))
+	if findings := detector.Findings(); len(findings) != 0 {
+		t.Errorf("findings past the retention = %+v", findings)
+	}
+}
+
+func TestNewScanDetector(t *testing.T) {
+	detector, err := NewScanDetector(time.Minute, "", "", "", " trusted , ,scanners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detector.window != defaultScanWindow || detector.minHosts != defaultScanMinHosts || detector.minPorts != defaultScanMinPorts ||
+		len(detector.suppress) != 2 || !detector.suppress["trusted"] || !detector.suppress["scanners"] {
+		t.Errorf("defaults = %+v", detector)
+	}
+	for _, tt := range []struct{ window, minHosts, minPorts string }{
+		{"soon", "", ""},
+		{"", "1", ""},
+		{"", "many", ""},
+		{"", "", "1"},
+		{"", "", "-5"},
+	} {
+		if _, err := NewScanDetector(time.Minute, tt.window, tt.minHosts, tt.minPorts, ""); err == nil {
+			t.Errorf("NewScanDetector(%q, %q, %q) accepted", tt.window, tt.minHosts, tt.minPorts)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scope limits the users and API tokens assigned to it to some exporters
+// and interfaces, e.g. those of one customer team. Users without a scope see
+// every exporter; the role still decides what they may change.
+type Scope struct {
+	ID        int64           `json:"id"`
+	Name      string          `json:"name"`
+	Exporters []ScopeExporter `json:"exporters"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// ScopeExporter grants an exporter, given by ID or address. Interfaces are
+// SNMP indexes; empty grants all interfaces of the exporter.
+type ScopeExporter struct {
+	Exporter   string  `json:"exporter"`
+	Interfaces []int64 `json:"interfaces,omitempty"`
+}
+
+// ExporterScope is a Scope resolved against the configured exporters. A nil
+// *ExporterScope allows everything.
+type ExporterScope struct {
+	// Exporter IDs by ID string and by address
+	ids map[string]uint64
+	// Allowed SNMP indexes by exporter ID, nil for all interfaces
+	interfaces map[uint64]map[int64]bool
+}
+
+// normalizeExporterAddr strips an inet prefix length and normalizes the
+// address text, so "10.0.0.1/32" and "10.0.0.1" compare equal
+func normalizeExporterAddr(addr string) string {
+	addr = strings.Split(addr, "/")[0]
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// resolveScope looks up the named scope. A scope that no longer exists
+// resolves to one allowing nothing.
+func resolveScope(name string) (*ExporterScope, error) {
+	scopes, err := config.Auth.Scopes()
+	if err != nil {
+		return nil, err
+	}
+	exporters, err := config.Metrics.ExporterConfigs()
+	if err != nil {
+		return nil, err
+	}
+	scope := &ExporterScope{ids: make(map[string]uint64), interfaces: make(map[uint64]map[int64]bool)}
+	for _, s := range scopes {
+		if s.Name != name {
+			continue
+		}
+		for _, grant := range s.Exporters {
+			for _, exporter := range exporters {
+				id := strconv.FormatUint(exporter.ID, 10)
+				addr := normalizeExporterAddr(exporter.IPInet)
+				if grant.Exporter != id && normalizeExporterAddr(grant.Exporter) != addr {
+					continue
+				}
+				_, seen := scope.ids[id]
+				scope.ids[id] = exporter.ID
+				scope.ids[addr] = exporter.ID
+				if len(grant.Interfaces) == 0 {
+					scope.interfaces[exporter.ID] = nil
+				} else if !seen || scope.interfaces[exporter.ID] != nil {
+					if scope.interfaces[exporter.ID] == nil {
+						scope.interfaces[exporter.ID] = make(map[int64]bool)
+					}
+					for _, index := range grant.Interfaces {
+						scope.interfaces[exporter.ID][index] = true
+					}
+				}
+			}
+		}
+	}
+	return scope, nil
+}
+
+func (s *ExporterScope) exporterID(exporter string) (uint64, bool) {
+	id, ok := s.ids[exporter]
+	if !ok {
+		id, ok = s.ids[normalizeExporterAddr(exporter)]
+	}
+	return id, ok
+}
+
+// Exporter reports whether the exporter (ID or address) is in the scope,
+// with all or some of its interfaces
+func (s *ExporterScope) Exporter(exporter string) bool {
+	if s == nil {
+		return true
+	}
+	_, ok := s.exporterID(exporter)
+	return ok
+}
+
+// Interface reports whether an interface of the exporter is in the scope.
+// An empty iface stands for the whole exporter.
+func (s *ExporterScope) Interface(exporter string, iface string) bool {
+	if s == nil {
+		return true
+	}
+	id, ok := s.exporterID(exporter)
+	if !ok {
+		return false
+	}
+	allowed := s.interfaces[id]
+	if allowed == nil {
+		return true
+	}
+	index, err := strconv.ParseInt(iface, 10, 64)
+	return err == nil && allowed[index]
+}
+
+// InterfaceIndex is Interface for a numeric SNMP index
+func (s *ExporterScope) InterfaceIndex(exporter string, index int64) bool {
+	return s.Interface(exporter, strconv.FormatInt(index, 10))
+}
+
+type scopeKey struct{}
+
+// scopeFrom returns the scope of the caller, nil when it is not limited
+func scopeFrom(ctx context.Context) *ExporterScope {
+	scope, _ := ctx.Value(scopeKey{}).(*ExporterScope)
+	return scope
+}
+
+// authorizeExporter answers 403 and returns false unless the caller may see
+// the exporter (ID or address) and interface; an empty iface stands for all
+// interfaces of the exporter
+func authorizeExporter(w http.ResponseWriter, r *http.Request, exporter string, iface string) bool {
+	if scopeFrom(r.Context()).Interface(exporter, iface) {
+		return true
+	}
+	if exporter == "" {
+		http.Error(w, "An exporter is required for scoped users", http.StatusForbidden)
+	} else if iface == "" {
+		http.Error(w, fmt.Sprintf("Access to exporter %q denied", exporter), http.StatusForbidden)
+	} else {
+		http.Error(w, fmt.Sprintf("Access to interface %s of exporter %q denied", iface, exporter), http.StatusForbidden)
+	}
+	return false
+}
+
+// scopedPath reports whether an endpoint enforces scopes and may be used by
+// scoped callers. Endpoints reporting on all exporters at once, like the
+// flow query language or the DDoS report, are not listed.
+func scopedPath(path string) bool {
+	if !strings.HasPrefix(path, "/api/") {
+		return true
+	}
+	switch path {
+	case "/api/v1/auth/me", "/api/v1/auth/logout", "/api/v1/interfaces", "/api/v1/service-networks":
+		return true
+	}
+	for _, prefix := range []string{
+		"/api/v1/body/",
+		"/api/v1/interfaces/",
+		"/api/v1/exporters/",
+		"/api/v1/metrics/",
+		"/api/v1/billing/",
+		"/api/v1/baseline/",
+		"/api/v1/capacity/",
+		"/api/v1/flows/",
+		"/api/v1/traffic",
+		"/api/v1/protocols",
+		"/api/v1/enrichment",
+		"/api/v1/services/",
+		"/api/v1/service-networks/",
+	} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateScopeName checks that a user or token scope exists and is not
+// given to an admin, who could change the configuration of any exporter
+func validateScopeName(name string, role string) error {
+	if name == "" {
+		return nil
+	}
+	if role == roleAdmin {
+		return fmt.Errorf("admin users and tokens cannot be scoped")
+	}
+	scopes, err := config.Auth.Scopes()
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		if scope.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("scope %q not found", name)
+}
+
+func normalizeScope(scope *Scope) error {
+	scope.Name = strings.TrimSpace(scope.Name)
+	if scope.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if scope.Exporters == nil {
+		scope.Exporters = []ScopeExporter{}
+	}
+	for i, grant := range scope.Exporters {
+		grant.Exporter = strings.TrimSpace(grant.Exporter)
+		if grant.Exporter == "" {
+			return fmt.Errorf("exporter %d: exporter is required", i)
+		}
+		if _, err := strconv.ParseUint(grant.Exporter, 10, 64); err != nil && net.ParseIP(normalizeExporterAddr(grant.Exporter)) == nil {
+			return fmt.Errorf("exporter %d: %q is neither an ID nor an address", i, grant.Exporter)
+		}
+		scope.Exporters[i] = grant
+	}
+	return nil
+}
+
+// scopeInUse returns the users and tokens assigned to the scope
+func scopeInUse(name string) ([]string, error) {
+	users, err := config.Auth.Users()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := config.Auth.APITokens()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, user := range users {
+		if user.Scope == name {
+			names = append(names, "user "+user.Username)
+		}
+	}
+	for _, token := range tokens {
+		if token.Scope == name {
+			names = append(names, "token "+token.Name)
+		}
+	}
+	return names, nil
+}
+
+// authScopesRequest handles GET (list) and POST (create) on
+// /api/v1/auth/scopes
+func authScopesRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		scopes, err := config.Auth.Scopes()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying scopes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if scopes == nil {
+			scopes = []Scope{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scopes)
+
+	case http.MethodPost:
+		var scope Scope
+		if err := json.NewDecoder(r.Body).Decode(&scope); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := normalizeScope(&scope); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid scope: %v", err), http.StatusBadRequest)
+			return
+		}
+		if validateScopeName(scope.Name, roleRead) == nil {
+			http.Error(w, fmt.Sprintf("scope %q already exists", scope.Name), http.StatusConflict)
+			return
+		}
+		scope, err := config.Auth.CreateScope(scope)
+		if err != nil {
+			log.Printf("Error creating scope: %v", err)
+			http.Error(w, fmt.Sprintf("Error creating scope: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(scope)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authScopeRequest handles PUT and DELETE on /api/v1/auth/scopes/{id}. A
+// scope keeps its name, and cannot be deleted while assigned.
+func authScopeRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid scope id", http.StatusBadRequest)
+		return
+	}
+	scopes, err := config.Auth.Scopes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying scopes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var current *Scope
+	for i := range scopes {
+		if scopes[i].ID == id {
+			current = &scopes[i]
+		}
+	}
+	if current == nil {
+		http.Error(w, "Scope not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		var scope Scope
+		if err := json.NewDecoder(r.Body).Decode(&scope); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		scope.ID = id
+		scope.Name = current.Name
+		scope.CreatedAt = current.CreatedAt
+		if err := normalizeScope(&scope); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid scope: %v", err), http.StatusBadRequest)
+			return
+		}
+		found, err := config.Auth.UpdateScope(scope)
+		if err != nil {
+			log.Printf("Error updating scope: %v", err)
+			http.Error(w, fmt.Sprintf("Error updating scope: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Scope not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scope)
+
+	case http.MethodDelete:
+		assigned, err := scopeInUse(current.Name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying users: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if len(assigned) > 0 {
+			http.Error(w, fmt.Sprintf("Scope is assigned to %s", strings.Join(assigned, ", ")), http.StatusConflict)
+			return
+		}
+		found, err := config.Auth.DeleteScope(id)
+		if err != nil {
+			log.Printf("Error deleting scope: %v", err)
+			http.Error(w, fmt.Sprintf("Error deleting scope: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Scope not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
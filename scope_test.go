@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveScope(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	store.AddExporter(ExporterConfig{ID: 3, IPInet: "2001:db8::3/128", Name: "edge3"})
+	store.CreateScope(Scope{Name: "customer-a", Exporters: []ScopeExporter{
+		{Exporter: "1", Interfaces: []int64{3}},
+		{Exporter: "192.0.2.1/32", Interfaces: []int64{5}},
+		{Exporter: "2001:db8:0::3"},
+	}})
+	store.CreateScope(Scope{Name: "customer-b", Exporters: []ScopeExporter{
+		{Exporter: "192.0.2.2", Interfaces: []int64{3}},
+		// A grant of the whole exporter wins over interface grants
+		{Exporter: "2"},
+	}})
+
+	scope, err := resolveScope("customer-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		exporter string
+		iface    string
+		want     bool
+	}{
+		{"1", "3", true},
+		{"192.0.2.1", "5", true},
+		{"192.0.2.1/32", "3", true},
+		{"1", "4", false},
+		// Only some interfaces of exporter 1 are granted
+		{"1", "", false},
+		{"1", "three", false},
+		{"2", "3", false},
+		{"192.0.2.2", "", false},
+		{"3", "42", true},
+		{"2001:db8::3", "1", true},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := scope.Interface(tt.exporter, tt.iface); got != tt.want {
+			t.Errorf("customer-a: Interface(%q, %q) = %v, want %v", tt.exporter, tt.iface, got, tt.want)
+		}
+	}
+	if !scope.Exporter("192.0.2.1") || scope.Exporter("192.0.2.2") {
+		t.Error("customer-a: Exporter does not follow the grants")
+	}
+
+	scope, err = resolveScope("customer-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scope.Interface("2", "7") {
+		t.Error("customer-b: interface 7 of the granted exporter 2 denied")
+	}
+
+	// A deleted scope allows nothing, a nil one everything
+	scope, err = resolveScope("deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scope.Exporter("1") || scope.Interface("1", "3") {
+		t.Error("deleted scope allows exporter 1")
+	}
+	if !(*ExporterScope)(nil).Interface("2", "3") {
+		t.Error("nil scope denies exporter 2")
+	}
+}
+
+func TestAuthorizeExporter(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	store.CreateScope(Scope{Name: "customer-a", Exporters: []ScopeExporter{{Exporter: "1", Interfaces: []int64{3}}}})
+	scope, err := resolveScope("customer-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		scope    *ExporterScope
+		exporter string
+		iface    string
+		want     int
+	}{
+		{scope, "1", "3", http.StatusOK},
+		{scope, "192.0.2.1", "3", http.StatusOK},
+		{scope, "1", "4", http.StatusForbidden},
+		// A partly granted exporter is not granted as a whole
+		{scope, "1", "", http.StatusForbidden},
+		{scope, "2", "3", http.StatusForbidden},
+		{scope, "", "", http.StatusForbidden},
+		{nil, "2", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.scope != nil {
+			r = r.WithContext(context.WithValue(r.Context(), scopeKey{}, tt.scope))
+		}
+		w := httptest.NewRecorder()
+		ok := authorizeExporter(w, r, tt.exporter, tt.iface)
+		if ok != (tt.want == http.StatusOK) || w.Code != tt.want {
+			t.Errorf("authorizeExporter(%q, %q) = %v, status %d, want %d", tt.exporter, tt.iface, ok, w.Code, tt.want)
+		}
+	}
+}
+
+func TestScopedPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/index.html", true},
+		{"/api/v1/auth/me", true},
+		{"/api/v1/interfaces", true},
+		{"/api/v1/traffic/raw", true},
+		{"/api/v1/capacity/1/3", true},
+		// Reports over all exporters at once
+		{"/api/v1/capacity", false},
+		{"/api/v1/query/flows", false},
+		{"/api/v1/security/ddos", false},
+		{"/api/v1/alerts/active", false},
+		{"/api/v1/collector/stats", false},
+		{"/api/v1/postgres/metrics", false},
+	}
+	for _, tt := range tests {
+		if got := scopedPath(tt.path); got != tt.want {
+			t.Errorf("scopedPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// scopedClient sends requests through the auth middleware and the router
+// with an API token limited to interface 3 of exporter 1 (192.0.2.1)
+func scopedClient(t *testing.T) func(target string) *httptest.ResponseRecorder {
+	t.Helper()
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	store.AddInterface(InterfaceConfig{ID: 1, Exporter: 1, SnmpIndex: 3, Description: "ge-0/0/3"})
+	store.AddInterface(InterfaceConfig{ID: 2, Exporter: 1, SnmpIndex: 4, Description: "ge-0/0/4"})
+	store.AddInterface(InterfaceConfig{ID: 3, Exporter: 2, SnmpIndex: 3, Description: "eth3"})
+	store.CreateScope(Scope{Name: "customer-a", Exporters: []ScopeExporter{{Exporter: "1", Interfaces: []int64{3}}}})
+	store.CreateUser(User{Username: "alice", Role: roleRead, Scope: "customer-a"})
+	store.CreateAPIToken(APIToken{Name: "dashboard", Role: roleRead, Owner: "alice", Scope: "customer-a", Hash: hashSecret("cnf_scoped")})
+	handler := NewAuthMiddleware(newRouter(), tokenAuthenticator{})
+	return func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Authorization", "Bearer cnf_scoped")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+}
+
+func TestScopedRoutes(t *testing.T) {
+	get := scopedClient(t)
+	// Every per-exporter route, with {e} and {a} standing for the ID and
+	// the address of the exporter and {i} for the interface
+	routes := []string{
+		"/api/v1/body/{e}/{i}",
+		"/api/v1/body/{e}/{i}/0/0",
+		"/api/v1/metrics/{e}/{i}",
+		"/api/v1/metrics/{e}/{i}/tag",
+		"/api/v1/metrics/{e}/{i}/rate",
+		"/api/v1/metrics/{e}/{i}/0/0/js",
+		"/api/v1/metrics/{e}/{i}/0/0/png",
+		"/api/v1/billing/{e}/{i}",
+		"/api/v1/baseline/{e}/{i}",
+		"/api/v1/capacity/{e}/{i}",
+		"/api/v1/flows/{e}/{i}/0/0/src/bytes/input/png",
+		"/api/v1/flows/{e}/{i}/0/0/src/bytes/input/js",
+		"/api/v1/flows/container/{e}/{i}/0/0/src/bytes/input/js",
+		"/api/v1/flows/ports-timeseries/{e}/{i}/0/0/input/src/json",
+		"/api/v1/traffic?exporter={a}&interface={i}",
+		"/api/v1/traffic/raw?exporter={a}&interface={i}",
+		"/api/v1/traffic/top-talkers?exporter={a}&interface={i}&start=0&end=1",
+		"/api/v1/traffic/top-talkers-with-port?exporter={a}&interface={i}&start=0&end=1",
+		"/api/v1/protocols?exporter={a}&interface={i}",
+		"/api/v1/protocols/ip-stats?exporter={a}&interface={i}",
+	}
+	for _, route := range routes {
+		for _, tt := range []struct {
+			exporter string
+			addr     string
+			iface    string
+			want     bool
+		}{
+			{"1", "192.0.2.1", "3", true},
+			{"1", "192.0.2.1", "4", false},
+			{"2", "192.0.2.2", "3", false},
+		} {
+			target := strings.NewReplacer("{e}", tt.exporter, "{a}", tt.addr, "{i}", tt.iface).Replace(route)
+			w := get(target)
+			if tt.want && w.Code == http.StatusForbidden {
+				t.Errorf("%s: status 403 in scope: %s", target, w.Body)
+			}
+			if !tt.want && w.Code != http.StatusForbidden {
+				t.Errorf("%s: status %d, want 403", target, w.Code)
+			}
+		}
+	}
+
+	// Routes of a whole exporter need all its interfaces. The Highcharts
+	// page is only tried out of scope, as it exits without its template.
+	for _, target := range []string{
+		"/api/v1/metrics/2/3/js",
+		"/api/v1/metrics/1/4/js",
+		"/api/v1/traffic/data-range?exporter=192.0.2.2",
+		"/api/v1/traffic/raw?exporter=192.0.2.1",
+		"/api/v1/flows/interfaces/192.0.2.2/json",
+		"/api/v1/flows/192.0.2.2",
+		"/api/v1/flows/192.0.2.2/0",
+	} {
+		if w := get(target); w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", target, w.Code)
+		}
+	}
+
+	// Reports over all exporters are closed to scoped callers
+	for _, target := range []string{"/api/v1/query/flows", "/api/v1/security/ddos", "/api/v1/capacity", "/api/v1/config/exporters"} {
+		if w := get(target); w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", target, w.Code)
+		}
+	}
+}
+
+func TestScopedLists(t *testing.T) {
+	get := scopedClient(t)
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/api/v1/exporters/json", `[{"id":1,"ip_inet":"192.0.2.1","name":"edge1"}]`},
+		{"/api/v1/flows/exporters/json", `["192.0.2.1/32"]`},
+	}
+	for _, tt := range tests {
+		w := get(tt.target)
+		if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s: status %d, body %s, want %s", tt.target, w.Code, got, tt.want)
+		}
+	}
+
+	w := get("/api/v1/interfaces/json")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ge-0/0/3") ||
+		strings.Contains(w.Body.String(), "ge-0/0/4") || strings.Contains(w.Body.String(), "eth3") {
+		t.Errorf("interfaces: status %d, body %s", w.Code, w.Body)
+	}
+	// The interfaces of another exporter are filtered out, like the list
+	if w := get("/api/v1/interfaces/2/json"); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "eth3") {
+		t.Errorf("interfaces of exporter 2: status %d, body %s", w.Code, w.Body)
+	}
+}
+
+func TestScopedCraftedFilters(t *testing.T) {
+	get := scopedClient(t)
+	// Values that would widen the WHERE clause past the exporter, or read
+	// other tables through ORDER BY, are refused before any query
+	for _, target := range []string{
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&direction=exporter+IS+NOT+NULL+OR+input",
+		"/api/v1/traffic/raw?exporter=192.0.2.1&interface=3&direction=input+OR+TRUE",
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&order_by=(SELECT+snmp_community+FROM+exporters+LIMIT+1)",
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&order_dir=desc,(SELECT+1)",
+		"/api/v1/protocols?exporter=192.0.2.1&interface=3&direction=output+OR+1=1",
+		"/api/v1/protocols/ip-stats?exporter=192.0.2.1&interface=3&order_by=password_hash",
+	} {
+		if w := get(target); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400: %s", target, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Sealed secrets are stored as enc:v2:<key id>:<wrapped data key>:<ciphertext>.
+// Every value is encrypted with its own random AES-256-GCM data key, which is
+// encrypted ("wrapped") with a key of the keyring. Rotating the keyring only
+// rewraps the data keys. The field name and exporter ID are authenticated
+// with the value, so it cannot be moved to another column or exporter.
+const sealedPrefix = "enc:v2:"
+
+// Values sealed as enc:v1: only authenticate the field name. They are still
+// opened, and upgraded by Reseal.
+const sealedPrefixV1 = "enc:v1:"
+
+// Keyring holds the key encryption keys for SNMP secrets. The first key
+// seals new values; the others only open values sealed before a rotation.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+var secretKeys *Keyring
+
+// parseKeyring reads keys given as id:base64 (32 bytes), separated by commas
+// or newlines; the first one is the primary key
+func parseKeyring(s string) (*Keyring, error) {
+	keyring := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.FieldsFunc(s, func(c rune) bool { return c == ',' || c == '\n' || c == '\r' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || strings.ContainsAny(id, ": \t") {
+			return nil, fmt.Errorf("invalid secret key entry, use id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("secret key %s: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("secret key %s: must be 32 bytes, got %d", id, len(key))
+		}
+		if _, dup := keyring.keys[id]; dup {
+			return nil, fmt.Errorf("secret key %s is given twice", id)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[id] = aead
+		if keyring.primary == "" {
+			keyring.primary = id
+		}
+	}
+	if keyring.primary == "" {
+		return nil, errors.New("no secret keys given")
+	}
+	return keyring, nil
+}
+
+// loadKeyring builds the keyring from CNETFLOW_SECRET_KEYS or the file named
+// by CNETFLOW_SECRET_KEYS_FILE. It returns nil when neither is set.
+func loadKeyring(keys string, file string) (*Keyring, error) {
+	switch {
+	case keys != "" && file != "":
+		return nil, errors.New("set only one of CNETFLOW_SECRET_KEYS and CNETFLOW_SECRET_KEYS_FILE")
+	case file != "":
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return parseKeyring(string(content))
+	case keys != "":
+		return parseKeyring(keys)
+	}
+	return nil, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmSeal encrypts with a random nonce, which is prepended to the result
+func gcmSeal(aead cipher.AEAD, plaintext []byte, aad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad)
+}
+
+func gcmOpen(aead cipher.AEAD, sealed []byte, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// isSealed reports whether a stored value is encrypted
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix) || strings.HasPrefix(value, sealedPrefixV1)
+}
+
+// secretAAD returns the data authenticated with a value of the field of an
+// exporter
+func secretAAD(field string, id uint64) []byte {
+	return []byte(field + ":" + strconv.FormatUint(id, 10))
+}
+
+// Seal encrypts a secret of an exporter with the primary key. Without a
+// keyring, and for empty values, the value is returned as is.
+func (k *Keyring) Seal(field string, id uint64, value string) (string, error) {
+	if k == nil || value == "" {
+		return value, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := gcmSeal(aead, []byte(value), secretAAD(field, id))
+	return k.format(k.primary, gcmSeal(k.keys[k.primary], dataKey, []byte(k.primary)), ciphertext), nil
+}
+
+func (k *Keyring) format(id string, wrappedKey []byte, ciphertext []byte) string {
+	return sealedPrefix + id + ":" + base64.RawURLEncoding.EncodeToString(wrappedKey) + ":" + base64.RawURLEncoding.EncodeToString(ciphertext)
+}
+
+// unwrap parses a sealed value and decrypts its data key
+func (k *Keyring) unwrap(value string) (id string, dataKey []byte, ciphertext []byte, err error) {
+	value = strings.TrimPrefix(value, sealedPrefix)
+	parts := strings.Split(strings.TrimPrefix(value, sealedPrefixV1), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("malformed sealed value")
+	}
+	id = parts[0]
+	if k == nil {
+		return "", nil, nil, fmt.Errorf("value is sealed with key %s but no secret keys are configured", id)
+	}
+	kek, ok := k.keys[id]
+	if !ok {
+		return "", nil, nil, fmt.Errorf("value is sealed with unknown key %s", id)
+	}
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if ciphertext, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return "", nil, nil, err
+	}
+	if dataKey, err = gcmOpen(kek, wrappedKey, []byte(id)); err != nil {
+		return "", nil, nil, fmt.Errorf("unwrapping data key with key %s: %w", id, err)
+	}
+	return id, dataKey, ciphertext, nil
+}
+
+// Open decrypts a value sealed for the field of an exporter. Values that are
+// not sealed, stored before encryption was enabled, are returned as is.
+func (k *Keyring) Open(field string, id uint64, value string) (string, error) {
+	if !isSealed(value) {
+		return value, nil
+	}
+	_, dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	aad := secretAAD(field, id)
+	if strings.HasPrefix(value, sealedPrefixV1) {
+		aad = []byte(field)
+	}
+	plaintext, err := gcmOpen(aead, ciphertext, aad)
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s: %w", field, err)
+	}
+	return string(plaintext), nil
+}
+
+// Reseal brings a stored value up to date with the keyring: plaintext and
+// enc:v1: values are sealed again, and the data key of a value sealed with an
+// older key is rewrapped with the primary key. It reports whether the value
+// changed.
+func (k *Keyring) Reseal(field string, id uint64, value string) (string, bool, error) {
+	if k == nil || value == "" {
+		return value, false, nil
+	}
+	if !isSealed(value) || strings.HasPrefix(value, sealedPrefixV1) {
+		plaintext, err := k.Open(field, id, value)
+		if err != nil {
+			return value, false, err
+		}
+		sealed, err := k.Seal(field, id, plaintext)
+		if err != nil {
+			return value, false, err
+		}
+		return sealed, true, nil
+	}
+	kid, dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil || kid == k.primary {
+		return value, false, err
+	}
+	return k.format(k.primary, gcmSeal(k.keys[k.primary], dataKey, []byte(k.primary)), ciphertext), true, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testKeyring returns a keyring of the given key IDs, the first one primary
+func testKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	var entries []string
+	for _, id := range ids {
+		// The same ID always gets the same key
+		entries = append(entries, id+":"+base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%-32s", id))))
+	}
+	keyring, err := parseKeyring(strings.Join(entries, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// sealV1 seals a value the way enc:v1: did, authenticating the field only
+func sealV1(k *Keyring, field string, value string) string {
+	dataKey := make([]byte, 32)
+	aead, _ := newGCM(dataKey)
+	sealed := k.format(k.primary, gcmSeal(k.keys[k.primary], dataKey, []byte(k.primary)), gcmSeal(aead, []byte(value), []byte(field)))
+	return sealedPrefixV1 + strings.TrimPrefix(sealed, sealedPrefix)
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	keyring := testKeyring(t, "k1")
+	sealed, err := keyring.Seal("snmp_community", 1, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "enc:v2:k1:") || strings.Contains(sealed, "public") {
+		t.Fatalf("sealed = %s", sealed)
+	}
+	if value, err := keyring.Open("snmp_community", 1, sealed); err != nil || value != "public" {
+		t.Errorf("Open = %q, %v", value, err)
+	}
+	// A value copied to another column or exporter does not open
+	if _, err := keyring.Open("snmpv3_auth_pass", 1, sealed); err == nil {
+		t.Error("opened a value moved to another field")
+	}
+	if _, err := keyring.Open("snmp_community", 2, sealed); err == nil {
+		t.Error("opened a value moved to another exporter")
+	}
+
+	if value, err := keyring.Open("snmp_community", 1, "plain"); err != nil || value != "plain" {
+		t.Errorf("Open of plaintext = %q, %v", value, err)
+	}
+	if value, err := (*Keyring)(nil).Seal("snmp_community", 1, "plain"); err != nil || value != "plain" {
+		t.Errorf("Seal without keyring = %q, %v", value, err)
+	}
+	if _, err := (*Keyring)(nil).Open("snmp_community", 1, sealed); err == nil {
+		t.Error("opened a sealed value without keyring")
+	}
+}
+
+func TestKeyringReseal(t *testing.T) {
+	old := testKeyring(t, "k1")
+	legacy := sealV1(old, "snmp_community", "public")
+	rotated, err := old.Seal("snmpv3_auth_pass", 7, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := old.Open("snmp_community", 7, legacy); err != nil || value != "public" {
+		t.Fatalf("Open of enc:v1: = %q, %v", value, err)
+	}
+
+	keyring := testKeyring(t, "k2", "k1")
+	tests := []struct {
+		field   string
+		value   string
+		changed bool
+		plain   string
+	}{
+		{"snmp_community", "", false, ""},
+		{"snmp_community", "plain", true, "plain"},
+		{"snmp_community", legacy, true, "public"},
+		{"snmpv3_auth_pass", rotated, true, "secret"},
+	}
+	for _, tt := range tests {
+		value, changed, err := keyring.Reseal(tt.field, 7, tt.value)
+		if err != nil || changed != tt.changed {
+			t.Errorf("Reseal(%q) changed = %v, %v", tt.value, changed, err)
+			continue
+		}
+		if tt.value == "" {
+			continue
+		}
+		if !strings.HasPrefix(value, "enc:v2:k2:") {
+			t.Errorf("Reseal(%q) = %s", tt.value, value)
+		}
+		if plain, err := keyring.Open(tt.field, 7, value); err != nil || plain != tt.plain {
+			t.Errorf("Open(Reseal(%q)) = %q, %v", tt.value, plain, err)
+		}
+		// Up to date values are left alone
+		if _, changed, err := keyring.Reseal(tt.field, 7, value); changed || err != nil {
+			t.Errorf("second Reseal(%q) changed = %v, %v", tt.value, changed, err)
+		}
+	}
+
+	// The enc:v1: value is bound to its exporter once upgraded
+	upgraded, _, _ := keyring.Reseal("snmp_community", 7, legacy)
+	if _, err := keyring.Open("snmp_community", 8, upgraded); err == nil {
+		t.Error("opened an upgraded value moved to another exporter")
+	}
+
+	if _, _, err := testKeyring(t, "k3").Reseal("snmp_community", 7, legacy); err == nil {
+		t.Error("resealed a value of an unknown key")
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// sFlow v5 sample and record formats (enterprise 0)
+const (
+	sflowFlowSample         = 1
+	sflowExpandedFlowSample = 3
+
+	sflowRawPacketHeader = 1
+	sflowSampledIPv4     = 3
+	sflowSampledIPv6     = 4
+	sflowExtendedRouter  = 1002
+	sflowExtendedGateway = 1003
+
+	sflowHeaderEthernet = 1
+	sflowHeaderIPv4     = 11
+	sflowHeaderIPv6     = 12
+
+	// ifIndex value meaning "interface unknown/internal"
+	sflowInterfaceUnknown = 0x3fffffff
+)
+
+var errSflowTruncated = errors.New("sflow datagram truncated")
+
+// xdrReader walks the 4 byte aligned big-endian fields of an sFlow datagram
+type xdrReader struct {
+	data []byte
+	err  error
+}
+
+func (x *xdrReader) uint32() uint32 {
+	if x.err != nil || len(x.data) < 4 {
+		x.err = errSflowTruncated
+		return 0
+	}
+	v := binary.BigEndian.Uint32(x.data[0:4])
+	x.data = x.data[4:]
+	return v
+}
+
+// bytes returns n bytes and skips the XDR padding that follows them
+func (x *xdrReader) bytes(n int) []byte {
+	padded := (n + 3) &^ 3
+	if x.err != nil || n < 0 || len(x.data) < padded {
+		x.err = errSflowTruncated
+		return nil
+	}
+	v := x.data[:n]
+	x.data = x.data[padded:]
+	return v
+}
+
+// address reads an sFlow address (type followed by 4 or 16 bytes)
+func (x *xdrReader) address() net.IP {
+	switch x.uint32() {
+	case 1:
+		return net.IP(x.bytes(net.IPv4len))
+	case 2:
+		return net.IP(x.bytes(net.IPv6len))
+	}
+	return nil
+}
+
+// sflowSample holds the sample-level fields needed to build a flow
+type sflowSample struct {
+	SamplingRate uint32
+	Input        uint32
+	Output       uint32
+}
+
+// decodeSflow parses an sFlow v5 datagram. Flow samples are turned into
+// FlowDB records scaled by their sampling rate; counter samples are ignored.
+// The agent address from the datagram is used as exporter.
+func (c *FlowCollector) decodeSflow(data []byte, source net.IP) ([]FlowDB, error) {
+	x := &xdrReader{data: data}
+	if version := x.uint32(); version != 5 {
+		return nil, fmt.Errorf("unsupported sflow version %d", version)
+	}
+	agent := x.address()
+	subAgent := x.uint32()
+	sequence := x.uint32()
+	x.uint32() // uptime
+	numSamples := x.uint32()
+	if x.err != nil {
+		return nil, x.err
+	}
+	if agent == nil {
+		agent = source
+	}
+
+	key := fmt.Sprintf("sflow|%s|%d", agent, subAgent)
+	if lost := c.sequences.check(key, sequence, 1); lost > 0 {
+		c.sequenceGaps.Add(1)
+		c.lostDatagrams.Add(uint64(lost))
+		log.Printf("Collector: sflow sequence gap from %s/%d: %d datagrams lost before sequence %d", agent, subAgent, lost, sequence)
+	}
+
+	received := time.Now()
+	var flows []FlowDB
+	for i := uint32(0); i < numSamples; i++ {
+		format := x.uint32()
+		sample := &xdrReader{data: x.bytes(int(x.uint32()))}
+		if x.err != nil {
+			return flows, x.err
+		}
+		switch format {
+		case sflowFlowSample, sflowExpandedFlowSample:
+			flow, ok, err := decodeSflowFlowSample(sample, format == sflowExpandedFlowSample)
+			if err != nil {
+				return flows, err
+			}
+			if !ok {
+				continue
+			}
+			flow.Exporter = agent.String()
+			flow.First = received
+			flow.Last = received
+			flows = append(flows, flow)
+		}
+	}
+	return flows, nil
+}
+
+// decodeSflowFlowSample reads a (possibly expanded) flow sample and its flow
+// records. It reports false when no IP information could be extracted.
+func decodeSflowFlowSample(x *xdrReader, expanded bool) (FlowDB, bool, error) {
+	var sample sflowSample
+	x.uint32() // sequence number
+	if expanded {
+		x.uint32() // source id type
+		x.uint32() // source id index
+	} else {
+		x.uint32() // source id
+	}
+	sample.SamplingRate = x.uint32()
+	x.uint32() // sample pool
+	x.uint32() // drops
+	if expanded {
+		x.uint32() // input format
+		sample.Input = x.uint32()
+		x.uint32() // output format
+		sample.Output = x.uint32()
+	} else {
+		// Compact encoding: 2 bits format, 30 bits value
+		sample.Input = x.uint32() & 0x3fffffff
+		sample.Output = x.uint32() & 0x3fffffff
+	}
+	numRecords := x.uint32()
+	if x.err != nil {
+		return FlowDB{}, false, x.err
+	}
+
+	flow := FlowDB{
+		TCPFlags:  "0",
+		Protocol:  "0",
+		TOS:       "0",
+		SrcMask:   "0",
+		DstMask:   "0",
+		IPVersion: "4",
+	}
+	var frameLength uint32
+	found := false
+	for i := uint32(0); i < numRecords; i++ {
+		format := x.uint32()
+		record := &xdrReader{data: x.bytes(int(x.uint32()))}
+		if x.err != nil {
+			return flow, false, x.err
+		}
+		switch format {
+		case sflowRawPacketHeader:
+			protocol := record.uint32()
+			frameLength = record.uint32()
+			record.uint32() // stripped
+			header := record.bytes(int(record.uint32()))
+			if record.err == nil && parseSampledHeader(protocol, header, &flow) {
+				found = true
+			}
+		case sflowSampledIPv4:
+			frameLength = record.uint32()
+			flow.Protocol = strconv.Itoa(int(record.uint32()))
+			flow.SrcAddr = net.IP(record.bytes(net.IPv4len)).String()
+			flow.DstAddr = net.IP(record.bytes(net.IPv4len)).String()
+			flow.SrcPort = int64(record.uint32())
+			flow.DstPort = int64(record.uint32())
+			flow.TCPFlags = strconv.Itoa(int(record.uint32() & 0xff))
+			flow.TOS = strconv.Itoa(int(record.uint32() & 0xff))
+			flow.IPVersion = "4"
+			found = record.err == nil
+		case sflowSampledIPv6:
+			frameLength = record.uint32()
+			flow.Protocol = strconv.Itoa(int(record.uint32()))
+			flow.SrcAddr = net.IP(record.bytes(net.IPv6len)).String()
+			flow.DstAddr = net.IP(record.bytes(net.IPv6len)).String()
+			flow.SrcPort = int64(record.uint32())
+			flow.DstPort = int64(record.uint32())
+			flow.TCPFlags = strconv.Itoa(int(record.uint32() & 0xff))
+			flow.TOS = strconv.Itoa(int(record.uint32() & 0xff))
+			flow.IPVersion = "6"
+			found = record.err == nil
+		case sflowExtendedRouter:
+			record.address() // next hop
+			srcMask := record.uint32()
+			dstMask := record.uint32()
+			if record.err == nil {
+				flow.SrcMask = strconv.Itoa(int(srcMask))
+				flow.DstMask = strconv.Itoa(int(dstMask))
+			}
+		case sflowExtendedGateway:
+			srcAS, dstAS := parseSflowGateway(record)
+			if record.err == nil {
+				flow.SrcAS = int64(srcAS)
+				flow.DstAS = int64(dstAS)
+			}
+		}
+	}
+	if !found {
+		return flow, false, nil
+	}
+
+	rate := int64(sample.SamplingRate)
+	if rate == 0 {
+		rate = 1
+	}
+	flow.DPkts = rate
+	flow.DOctets = int64(frameLength) * rate
+	if sample.Input != sflowInterfaceUnknown {
+		flow.Input = int64(sample.Input)
+	}
+	if sample.Output != sflowInterfaceUnknown {
+		flow.Output = int64(sample.Output)
+	}
+	return flow, true, nil
+}
+
+// parseSflowGateway extracts the source AS and the last AS of the
+// destination path from an extended gateway record
+func parseSflowGateway(x *xdrReader) (uint32, uint32) {
+	x.address() // next hop
+	routerAS := x.uint32()
+	srcAS := x.uint32()
+	x.uint32() // source peer AS
+	dstAS := routerAS
+	segments := x.uint32()
+	for i := uint32(0); i < segments && x.err == nil; i++ {
+		x.uint32() // segment type
+		count := x.uint32()
+		for j := uint32(0); j < count && x.err == nil; j++ {
+			dstAS = x.uint32()
+		}
+	}
+	if srcAS == 0 {
+		srcAS = routerAS
+	}
+	return srcAS, dstAS
+}
+
+// parseSampledHeader decodes the Ethernet/IP/TCP/UDP headers of a sampled
+// packet into flow. It reports whether an IP header was found.
+func parseSampledHeader(protocol uint32, header []byte, flow *FlowDB) bool {
+	etherType := uint16(0)
+	switch protocol {
+	case sflowHeaderEthernet:
+		if len(header) < 14 {
+			return false
+		}
+		etherType = binary.BigEndian.Uint16(header[12:14])
+		header = header[14:]
+		// Skip 802.1Q / 802.1ad VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(header) >= 4 {
+			etherType = binary.BigEndian.Uint16(header[2:4])
+			header = header[4:]
+		}
+	case sflowHeaderIPv4:
+		etherType = 0x0800
+	case sflowHeaderIPv6:
+		etherType = 0x86dd
+	default:
+		return false
+	}
+
+	var nextHeader byte
+	var l4 []byte
+	switch etherType {
+	case 0x0800:
+		if len(header) < 20 {
+			return false
+		}
+		ihl := int(header[0]&0x0f) * 4
+		if ihl < 20 || len(header) < ihl {
+			return false
+		}
+		flow.IPVersion = "4"
+		flow.TOS = strconv.Itoa(int(header[1]))
+		nextHeader = header[9]
+		flow.SrcAddr = net.IP(header[12:16]).String()
+		flow.DstAddr = net.IP(header[16:20]).String()
+		// Only the first fragment carries the transport header
+		if binary.BigEndian.Uint16(header[6:8])&0x1fff == 0 {
+			l4 = header[ihl:]
+		}
+	case 0x86dd:
+		if len(header) < 40 {
+			return false
+		}
+		flow.IPVersion = "6"
+		flow.TOS = strconv.Itoa(int(binary.BigEndian.Uint16(header[0:2]) >> 4 & 0xff))
+		nextHeader = header[6]
+		flow.SrcAddr = net.IP(header[8:24]).String()
+		flow.DstAddr = net.IP(header[24:40]).String()
+		l4 = header[40:]
+		// Walk the common extension headers to reach the transport header
+		for l4 != nil && len(l4) >= 8 {
+			switch nextHeader {
+			case 0, 43, 60:
+				length := (int(l4[1]) + 1) * 8
+				nextHeader = l4[0]
+				if len(l4) < length {
+					l4 = nil
+				} else {
+					l4 = l4[length:]
+				}
+				continue
+			case 44:
+				nextHeader = l4[0]
+				l4 = l4[8:]
+				continue
+			}
+			break
+		}
+	default:
+		return false
+	}
+
+	flow.Protocol = strconv.Itoa(int(nextHeader))
+	switch nextHeader {
+	case 6:
+		if len(l4) >= 14 {
+			flow.SrcPort = int64(binary.BigEndian.Uint16(l4[0:2]))
+			flow.DstPort = int64(binary.BigEndian.Uint16(l4[2:4]))
+			flow.TCPFlags = strconv.Itoa(int(l4[13]))
+		}
+	case 17, 132:
+		if len(l4) >= 4 {
+			flow.SrcPort = int64(binary.BigEndian.Uint16(l4[0:2]))
+			flow.DstPort = int64(binary.BigEndian.Uint16(l4[2:4]))
+		}
+	}
+	return true
+}
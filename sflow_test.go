@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// xdr encodes 32-bit words
+func xdr(words ...uint32) []byte {
+	var b []byte
+	for _, word := range words {
+		b = binary.BigEndian.AppendUint32(b, word)
+	}
+	return b
+}
+
+// xdrOpaque encodes a format followed by the length of its body and the
+// body, as sFlow does for samples and records. Each part of the body is
+// padded to 4 bytes.
+func xdrOpaque(format uint32, body ...[]byte) []byte {
+	var data []byte
+	for _, part := range body {
+		data = append(data, part...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	return append(xdr(format, uint32(len(data))), data...)
+}
+
+// sflowDatagram builds a datagram of agent 192.0.2.9 holding the samples
+func sflowDatagram(sequence uint32, samples ...[]byte) []byte {
+	b := xdr(5, 1)
+	b = append(b, net.IPv4(192, 0, 2, 9).To4()...)
+	b = append(b, xdr(0, sequence, 60000, uint32(len(samples)))...)
+	for _, sample := range samples {
+		b = append(b, sample...)
+	}
+	return b
+}
+
+// sflowCompactSample builds a flow sample with the compact source and
+// interface encoding
+func sflowCompactSample(rate uint32, input uint32, output uint32, records ...[]byte) []byte {
+	body := [][]byte{xdr(1, 3, rate, rate*10, 0, input, output, uint32(len(records)))}
+	return xdrOpaque(sflowFlowSample, append(body, records...)...)
+}
+
+// sflowExpandedSample builds an expanded flow sample
+func sflowExpandedSample(rate uint32, input uint32, output uint32, records ...[]byte) []byte {
+	body := [][]byte{xdr(1, 0, 3, rate, rate*10, 0, 0, input, 0, output, uint32(len(records)))}
+	return xdrOpaque(sflowExpandedFlowSample, append(body, records...)...)
+}
+
+// sflowIPv4Record builds a sampled IPv4 record of a TCP packet
+func sflowIPv4Record(frameLength uint32) []byte {
+	body := xdr(frameLength, 6)
+	body = append(body, net.IPv4(10, 0, 0, 1).To4()...)
+	body = append(body, net.IPv4(10, 0, 1, 1).To4()...)
+	body = append(body, xdr(50000, 443, 0x18, 0)...)
+	return xdrOpaque(sflowSampledIPv4, body)
+}
+
+// sflowHeaderRecord builds a raw packet header record of an Ethernet frame
+// carrying a TCP SYN-ACK from 2001:db8::1 port 443
+func sflowHeaderRecord(frameLength uint32) []byte {
+	frame := make([]byte, 14+40+20)
+	binary.BigEndian.PutUint16(frame[12:14], 0x86dd)
+	ip := frame[14:]
+	ip[0] = 0x60
+	ip[6] = 6
+	copy(ip[8:24], net.ParseIP("2001:db8::1"))
+	copy(ip[24:40], net.ParseIP("2001:db8::2"))
+	tcp := ip[40:]
+	binary.BigEndian.PutUint16(tcp[0:2], 443)
+	binary.BigEndian.PutUint16(tcp[2:4], 50001)
+	tcp[13] = 0x12
+	return xdrOpaque(sflowRawPacketHeader, xdr(sflowHeaderEthernet, frameLength, 4, uint32(len(frame))), frame)
+}
+
+func TestDecodeSflow(t *testing.T) {
+	c := &FlowCollector{sequences: newSequenceTracker()}
+	source := net.ParseIP("198.51.100.1")
+	datagram := sflowDatagram(1,
+		sflowCompactSample(100, 3, 4, sflowIPv4Record(1500)),
+		// Counter samples are skipped
+		xdrOpaque(2, xdr(1, 3, 0)),
+		sflowExpandedSample(512, sflowInterfaceUnknown, 7, sflowHeaderRecord(64)),
+		// Compact unknown interfaces, and a rate of 0 read as unsampled
+		sflowCompactSample(0, 0x3fffffff, 0xbfffffff, sflowIPv4Record(1000)),
+		// No IP information: no flow
+		sflowCompactSample(100, 3, 4, xdrOpaque(sflowExtendedRouter, xdr(1, 0, 24, 16))),
+	)
+	flows, err := c.decodeSflow(datagram, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 3 {
+		t.Fatalf("flows = %+v", flows)
+	}
+
+	tests := []struct {
+		flow    FlowDB
+		src     string
+		srcPort int64
+		flags   string
+		version string
+		octets  int64
+		packets int64
+		input   int64
+		output  int64
+	}{
+		// 1500 byte frames sampled 1 in 100
+		{flows[0], "10.0.0.1", 50000, "24", "4", 150000, 100, 3, 4},
+		{flows[1], "2001:db8::1", 443, "18", "6", 32768, 512, 0, 7},
+		{flows[2], "10.0.0.1", 50000, "24", "4", 1000, 1, 0, 0},
+	}
+	for i, tt := range tests {
+		flow := tt.flow
+		if flow.Exporter != "192.0.2.9" || flow.SrcAddr != tt.src || flow.SrcPort != tt.srcPort || flow.Protocol != "6" ||
+			flow.TCPFlags != tt.flags || flow.IPVersion != tt.version {
+			t.Errorf("flow %d = %+v", i, flow)
+		}
+		if flow.DOctets != tt.octets || flow.DPkts != tt.packets {
+			t.Errorf("flow %d: %d octets, %d packets, want %d and %d", i, flow.DOctets, flow.DPkts, tt.octets, tt.packets)
+		}
+		if flow.Input != tt.input || flow.Output != tt.output {
+			t.Errorf("flow %d: interfaces %d/%d, want %d/%d", i, flow.Input, flow.Output, tt.input, tt.output)
+		}
+	}
+}
+
+func TestDecodeSflowTruncated(t *testing.T) {
+	source := net.ParseIP("198.51.100.1")
+	sample := sflowCompactSample(100, 3, 4, sflowIPv4Record(1500))
+	// A record claiming more bytes than its sample holds
+	short := sflowCompactSample(100, 3, 4, xdr(sflowSampledIPv4, 64, 1500))
+	// A sample field cut off inside a complete sample
+	cut := xdrOpaque(sflowFlowSample, xdr(1, 3, 100))
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		flows    int
+	}{
+		{"header", sflowDatagram(1, sample)[:20], 0},
+		{"sample", sflowDatagram(1, sample, sample)[:len(sflowDatagram(1, sample))+12], 1},
+		{"record", sflowDatagram(1, sample, short), 1},
+		{"sample fields", sflowDatagram(1, cut), 0},
+	}
+	for _, tt := range tests {
+		c := &FlowCollector{sequences: newSequenceTracker()}
+		flows, err := c.decodeSflow(tt.datagram, source)
+		if !errors.Is(err, errSflowTruncated) {
+			t.Errorf("%s: error %v, want truncated", tt.name, err)
+		}
+		// Samples decoded before the damage are kept
+		if len(flows) != tt.flows {
+			t.Errorf("%s: %d flows, want %d", tt.name, len(flows), tt.flows)
+		}
+	}
+}
+
+func TestDecodeSflowSequence(t *testing.T) {
+	c := &FlowCollector{sequences: newSequenceTracker()}
+	source := net.ParseIP("198.51.100.1")
+	for _, sequence := range []uint32{10, 11, 14, 1} {
+		if _, err := c.decodeSflow(sflowDatagram(sequence), source); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 12 and 13 are lost; going back to 1 is an agent restart
+	if gaps, lost := c.sequenceGaps.Load(), c.lostDatagrams.Load(); gaps != 1 || lost != 2 {
+		t.Errorf("%d gaps, %d lost datagrams, want 1 and 2", gaps, lost)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	// IF-MIB columns walked on every poll
+	oidIfOperStatus  = ".1.3.6.1.2.1.2.2.1.8"
+	oidIfHCInOctets  = ".1.3.6.1.2.1.31.1.1.1.6"
+	oidIfHCOutOctets = ".1.3.6.1.2.1.31.1.1.1.10"
+	// sysUpTime, read with the counters to tell resets from wraps
+	oidSysUpTime = ".1.3.6.1.2.1.1.3.0"
+
+	snmpDefaultPort = 161
+	snmpTimeout     = 5 * time.Second
+	snmpRetries     = 1
+	// Unreachable devices are retried with a doubling delay up to this cap
+	snmpMaxBackoff = 30 * time.Minute
+	// Key of the exporter data JSON overriding the agent UDP port, e.g. to
+	// point an exporter at a local agent simulator
+	snmpPortKey = "snmp_port"
+)
+
+// InterfaceSample is one polled row of interface_metrics
+type InterfaceSample struct {
+	SnmpIndex  int64
+	OctetsIn   uint64
+	OctetsOut  uint64
+	OperStatus int
+	// sysUpTime of the agent when polled, 0 if it did not answer
+	Uptime uint32
+}
+
+// PollerStats holds the counters exposed by /api/v1/poller/stats
+type PollerStats struct {
+	Enabled   bool                  `json:"enabled"`
+	Interval  string                `json:"interval,omitempty"`
+	Polls     uint64                `json:"polls"`
+	Failures  uint64                `json:"failures"`
+	Inserted  uint64                `json:"inserted"`
+	Exporters []ExporterPollerState `json:"exporters,omitempty"`
+}
+
+// ExporterPollerState describes the poller of one exporter
+type ExporterPollerState struct {
+	ID          uint64    `json:"id"`
+	Address     string    `json:"address"`
+	LastPoll    time.Time `json:"last_poll,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Failures    int       `json:"consecutive_failures"`
+	NextPoll    time.Time `json:"next_poll,omitempty"`
+	Interfaces  int       `json:"interfaces"`
+	SnmpVersion int       `json:"snmp_version"`
+}
+
+// SNMPPoller runs one goroutine per SNMP enabled exporter, walking the
+// interface counters every interval and storing them in interface_metrics.
+// The exporter list is re-read every interval, so exporters added or
+// reconfigured on the config page are picked up without a restart.
+type SNMPPoller struct {
+	interval time.Duration
+	done     chan struct{}
+
+	mu      sync.Mutex
+	workers map[uint64]*exporterPoller
+
+	polls    atomic.Uint64
+	failures atomic.Uint64
+	inserted atomic.Uint64
+}
+
+// exporterPoller polls a single exporter until stopped
+type exporterPoller struct {
+	target ExporterConfig
+	stop   chan struct{}
+
+	mu    sync.Mutex
+	state ExporterPollerState
+}
+
+var snmpPoller *SNMPPoller
+
+func NewSNMPPoller(interval time.Duration) *SNMPPoller {
+	return &SNMPPoller{
+		interval: interval,
+		done:     make(chan struct{}),
+		workers:  make(map[uint64]*exporterPoller),
+	}
+}
+
+// Run keeps one worker per exporter until Close is called
+func (p *SNMPPoller) Run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.sync()
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			p.mu.Lock()
+			for id, w := range p.workers {
+				close(w.stop)
+				delete(p.workers, id)
+			}
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (p *SNMPPoller) Close() {
+	close(p.done)
+}
+
+// sync starts workers for new exporters, restarts the ones whose SNMP
+// settings changed and stops the ones no longer configured
+func (p *SNMPPoller) sync() {
+	targets, err := config.Metrics.PollTargets()
+	if err != nil {
+		log.Printf("SNMP poller: loading exporters: %v", err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seen := make(map[uint64]bool)
+	for _, target := range targets {
+		seen[target.ID] = true
+		if w, ok := p.workers[target.ID]; ok {
+			if sameSNMPTarget(w.target, target) {
+				continue
+			}
+			close(w.stop)
+		}
+		w := &exporterPoller{target: target, stop: make(chan struct{})}
+		w.state = ExporterPollerState{ID: target.ID, Address: target.IPInet, SnmpVersion: target.SnmpVersion}
+		p.workers[target.ID] = w
+		go p.runWorker(w)
+	}
+	for id, w := range p.workers {
+		if !seen[id] {
+			close(w.stop)
+			delete(p.workers, id)
+		}
+	}
+}
+
+func sameSNMPTarget(a ExporterConfig, b ExporterConfig) bool {
+	return a.IPInet == b.IPInet &&
+		a.SnmpVersion == b.SnmpVersion &&
+		a.SnmpCommunity == b.SnmpCommunity &&
+		a.Snmpv3Username == b.Snmpv3Username &&
+		a.Snmpv3Level == b.Snmpv3Level &&
+		a.Snmpv3AuthProto == b.Snmpv3AuthProto &&
+		a.Snmpv3AuthPass == b.Snmpv3AuthPass &&
+		a.Snmpv3PrivProto == b.Snmpv3PrivProto &&
+		a.Snmpv3PrivPass == b.Snmpv3PrivPass &&
+		snmpPort(a) == snmpPort(b)
+}
+
+// runWorker polls one exporter, backing off while it is unreachable
+func (p *SNMPPoller) runWorker(w *exporterPoller) {
+	for {
+		n, err := p.pollExporter(w.target)
+		p.polls.Add(1)
+
+		w.mu.Lock()
+		w.state.LastPoll = time.Now()
+		if err != nil {
+			p.failures.Add(1)
+			w.state.Failures++
+			w.state.LastError = err.Error()
+			log.Printf("SNMP poller: %s: %v (failure %d)", w.target.IPInet, err, w.state.Failures)
+		} else {
+			w.state.Failures = 0
+			w.state.LastError = ""
+			w.state.Interfaces = n
+		}
+		delay := snmpBackoff(p.interval, w.state.Failures)
+		w.state.NextPoll = time.Now().Add(delay)
+		w.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// snmpBackoff returns the delay before the next poll after the given number
+// of consecutive failures
+func snmpBackoff(interval time.Duration, failures int) time.Duration {
+	if failures == 0 {
+		return interval
+	}
+	delay := interval
+	for i := 0; i < failures && delay < snmpMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, max(snmpMaxBackoff, interval))
+}
+
+// pollExporter walks the interface counters of one exporter and stores them.
+// It returns the number of interfaces stored.
+func (p *SNMPPoller) pollExporter(target ExporterConfig) (int, error) {
+	client, err := newSNMPClient(target)
+	if err != nil {
+		return 0, err
+	}
+	if err := client.Connect(); err != nil {
+		return 0, fmt.Errorf("connect: %w", err)
+	}
+	defer client.Conn.Close()
+
+	samples, err := walkInterfaceCounters(client)
+	if err != nil {
+		return 0, err
+	}
+
+	// Interfaces disabled on the config page are not stored
+	if ifaces, err := config.Metrics.InterfaceConfigs(strconv.FormatUint(target.ID, 10)); err == nil {
+		disabled := make(map[int64]bool)
+		for _, iface := range ifaces {
+			if !iface.Enabled {
+				disabled[iface.SnmpIndex] = true
+			}
+		}
+		kept := samples[:0]
+		for _, sample := range samples {
+			if !disabled[sample.SnmpIndex] {
+				kept = append(kept, sample)
+			}
+		}
+		samples = kept
+	}
+
+	if err := config.Metrics.InsertInterfaceMetrics(target.ID, time.Now(), samples); err != nil {
+		return 0, fmt.Errorf("insert: %w", err)
+	}
+	p.inserted.Add(uint64(len(samples)))
+	return len(samples), nil
+}
+
+// walkInterfaceCounters reads the 64-bit octet counters and the operational
+// status of every interface, and the agent's uptime. Interfaces without HC
+// counters are skipped.
+func walkInterfaceCounters(client *gosnmp.GoSNMP) ([]InterfaceSample, error) {
+	walk := client.BulkWalkAll
+	if client.Version == gosnmp.Version1 {
+		walk = client.WalkAll
+	}
+
+	byIndex := make(map[int64]*InterfaceSample)
+	var order []int64
+	for _, column := range []string{oidIfHCInOctets, oidIfHCOutOctets, oidIfOperStatus} {
+		pdus, err := walk(column)
+		if err != nil {
+			return nil, fmt.Errorf("walk %s: %w", column, err)
+		}
+		for _, pdu := range pdus {
+			index, err := strconv.ParseInt(strings.TrimPrefix(pdu.Name, column+"."), 10, 64)
+			if err != nil {
+				continue
+			}
+			sample, ok := byIndex[index]
+			if !ok {
+				if column == oidIfOperStatus {
+					// Status alone is not worth a row
+					continue
+				}
+				sample = &InterfaceSample{SnmpIndex: index}
+				byIndex[index] = sample
+				order = append(order, index)
+			}
+			value := gosnmp.ToBigInt(pdu.Value).Uint64()
+			switch column {
+			case oidIfHCInOctets:
+				sample.OctetsIn = value
+			case oidIfHCOutOctets:
+				sample.OctetsOut = value
+			case oidIfOperStatus:
+				sample.OperStatus = int(value)
+			}
+		}
+	}
+
+	// A missing uptime only weakens reset detection, it does not fail the poll
+	var uptime uint32
+	if result, err := client.Get([]string{oidSysUpTime}); err != nil {
+		log.Printf("Error reading sysUpTime of %s: %v", client.Target, err)
+	} else if len(result.Variables) == 1 && result.Variables[0].Type == gosnmp.TimeTicks {
+		uptime = uint32(gosnmp.ToBigInt(result.Variables[0].Value).Uint64())
+	}
+
+	samples := make([]InterfaceSample, 0, len(order))
+	for _, index := range order {
+		sample := *byIndex[index]
+		sample.Uptime = uptime
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// snmpPort returns the agent port of an exporter
+func snmpPort(target ExporterConfig) uint16 {
+	if v, ok := target.Data[snmpPortKey]; ok {
+		var port float64
+		switch v := v.(type) {
+		case float64:
+			port = v
+		case string:
+			port, _ = strconv.ParseFloat(v, 64)
+		}
+		if port > 0 && port <= math.MaxUint16 && port == math.Trunc(port) {
+			return uint16(port)
+		}
+	}
+	return snmpDefaultPort
+}
+
+// newSNMPClient builds a client from the stored exporter credentials
+func newSNMPClient(target ExporterConfig) (*gosnmp.GoSNMP, error) {
+	client := &gosnmp.GoSNMP{
+		Target:             target.IPInet,
+		Port:               snmpPort(target),
+		Transport:          "udp",
+		Community:          target.SnmpCommunity,
+		Timeout:            snmpTimeout,
+		Retries:            snmpRetries,
+		ExponentialTimeout: true,
+		MaxOids:            gosnmp.MaxOids,
+		MaxRepetitions:     25,
+	}
+
+	switch target.SnmpVersion {
+	case 1:
+		client.Version = gosnmp.Version1
+	case 2:
+		client.Version = gosnmp.Version2c
+	case 3:
+		client.Version = gosnmp.Version3
+		client.SecurityModel = gosnmp.UserSecurityModel
+		params := &gosnmp.UsmSecurityParameters{
+			UserName:                 target.Snmpv3Username,
+			AuthenticationPassphrase: target.Snmpv3AuthPass,
+			PrivacyPassphrase:        target.Snmpv3PrivPass,
+		}
+		switch target.Snmpv3Level {
+		case "noAuthNoPriv":
+			client.MsgFlags = gosnmp.NoAuthNoPriv
+		case "authNoPriv":
+			client.MsgFlags = gosnmp.AuthNoPriv
+		case "authPriv":
+			client.MsgFlags = gosnmp.AuthPriv
+		default:
+			return nil, fmt.Errorf("unsupported SNMPv3 security level %q", target.Snmpv3Level)
+		}
+		if client.MsgFlags != gosnmp.NoAuthNoPriv {
+			proto, ok := snmpAuthProtocols[strings.ToUpper(target.Snmpv3AuthProto)]
+			if !ok {
+				return nil, fmt.Errorf("unsupported SNMPv3 auth protocol %q", target.Snmpv3AuthProto)
+			}
+			params.AuthenticationProtocol = proto
+		}
+		if client.MsgFlags == gosnmp.AuthPriv {
+			proto, ok := snmpPrivProtocols[strings.ToUpper(target.Snmpv3PrivProto)]
+			if !ok {
+				return nil, fmt.Errorf("unsupported SNMPv3 privacy protocol %q", target.Snmpv3PrivProto)
+			}
+			params.PrivacyProtocol = proto
+		}
+		client.SecurityParameters = params
+	default:
+		return nil, fmt.Errorf("unsupported SNMP version %d", target.SnmpVersion)
+	}
+	return client, nil
+}
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA1":   gosnmp.SHA,
+	"SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256,
+	"SHA384": gosnmp.SHA384,
+	"SHA512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"DES":     gosnmp.DES,
+	"AES":     gosnmp.AES,
+	"AES128":  gosnmp.AES,
+	"AES192":  gosnmp.AES192,
+	"AES256":  gosnmp.AES256,
+	"AES192C": gosnmp.AES192C,
+	"AES256C": gosnmp.AES256C,
+}
+
+// parseInterval reads an interval setting such as
+// CNETFLOW_SNMP_POLL_INTERVAL as a Go duration or a number of seconds. An
+// empty value disables the job.
+func parseInterval(name string, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, serr := strconv.Atoi(s)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid %s %q", name, s)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < 10*time.Second {
+		return 0, fmt.Errorf("%s must be at least 10s", name)
+	}
+	return d, nil
+}
+
+func (p *SNMPPoller) Stats() PollerStats {
+	stats := PollerStats{
+		Enabled:  true,
+		Interval: p.interval.String(),
+		Polls:    p.polls.Load(),
+		Failures: p.failures.Load(),
+		Inserted: p.inserted.Load(),
+	}
+	p.mu.Lock()
+	for _, w := range p.workers {
+		w.mu.Lock()
+		stats.Exporters = append(stats.Exporters, w.state)
+		w.mu.Unlock()
+	}
+	p.mu.Unlock()
+	sort.Slice(stats.Exporters, func(i, j int) bool {
+		return stats.Exporters[i].ID < stats.Exporters[j].ID
+	})
+	return stats
+}
+
+// getPollerStatsRequest reports the SNMP poller counters as JSON
+func getPollerStatsRequest(w http.ResponseWriter, r *http.Request) {
+	stats := PollerStats{}
+	if snmpPoller != nil {
+		stats = snmpPoller.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("Error encoding poller stats: %v", err)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// snmpAgent simulates an SNMP agent on a local UDP port. It answers get,
+// getnext and getbulk requests from a fixed table, to v1/v2c requests with
+// its community and to v3 requests of its USM user.
+type snmpAgent struct {
+	t         *testing.T
+	conn      net.PacketConn
+	community string
+	usm       *gosnmp.UsmSecurityParameters
+	msgFlags  gosnmp.SnmpV3MsgFlags
+	oids      []string
+	values    map[string]gosnmp.SnmpPDU
+}
+
+const (
+	snmpAgentEngineID = "\x80\x00\x1f\x88\x80cnetflow-test"
+	// Counters of the reports sent for engine discovery and for requests
+	// that fail authentication or decryption
+	oidUnknownEngineIDs = ".1.3.6.1.6.3.15.1.1.4.0"
+	oidWrongDigests     = ".1.3.6.1.6.3.15.1.1.5.0"
+)
+
+func newSNMPAgent(t *testing.T, pdus []gosnmp.SnmpPDU) *snmpAgent {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &snmpAgent{t: t, conn: conn, values: make(map[string]gosnmp.SnmpPDU)}
+	for _, pdu := range pdus {
+		a.oids = append(a.oids, pdu.Name)
+		a.values[pdu.Name] = pdu
+	}
+	slices.SortFunc(a.oids, compareOIDs)
+	t.Cleanup(func() { conn.Close() })
+	return a
+}
+
+// v2c answers requests with the community
+func (a *snmpAgent) v2c(community string) *snmpAgent {
+	a.community = community
+	go a.serve(&gosnmp.GoSNMP{Version: gosnmp.Version2c})
+	return a
+}
+
+// v3 answers requests of the USM user
+func (a *snmpAgent) v3(flags gosnmp.SnmpV3MsgFlags, usm *gosnmp.UsmSecurityParameters) *snmpAgent {
+	usm.AuthoritativeEngineID = snmpAgentEngineID
+	usm.AuthoritativeEngineBoots = 1
+	usm.AuthoritativeEngineTime = 1
+	// Localize the keys to the engine ID
+	if err := usm.InitSecurityKeys(); err != nil {
+		a.t.Fatal(err)
+	}
+	a.usm, a.msgFlags = usm, flags
+	go a.serve(&gosnmp.GoSNMP{Version: gosnmp.Version3, SecurityModel: gosnmp.UserSecurityModel, MsgFlags: flags, SecurityParameters: usm})
+	return a
+}
+
+// target returns an exporter polling the agent
+func (a *snmpAgent) target() ExporterConfig {
+	_, port, _ := net.SplitHostPort(a.conn.LocalAddr().String())
+	return ExporterConfig{ID: 1, IPInet: "127.0.0.1", Data: map[string]interface{}{snmpPortKey: port}}
+}
+
+func (a *snmpAgent) serve(decoder *gosnmp.GoSNMP) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := a.handle(decoder, buf[:n])
+		if resp == nil {
+			continue
+		}
+		if out, err := resp.MarshalMsg(); err == nil {
+			a.conn.WriteTo(out, addr)
+		}
+	}
+}
+
+func (a *snmpAgent) handle(decoder *gosnmp.GoSNMP, msg []byte) *gosnmp.SnmpPacket {
+	req, err := decoder.SnmpDecodePacket(msg)
+	if a.usm != nil {
+		usm, _ := req.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		switch {
+		case req.Version != gosnmp.Version3 || usm == nil:
+			return nil
+		case usm.AuthoritativeEngineID == "":
+			// Engine discovery
+			return a.report(req, oidUnknownEngineIDs)
+		case err != nil || usm.UserName != a.usm.UserName || req.MsgFlags&gosnmp.AuthPriv != a.msgFlags&gosnmp.AuthPriv:
+			return a.report(req, oidWrongDigests)
+		}
+	} else if err != nil || req.Community != a.community {
+		return nil
+	}
+
+	resp := &gosnmp.SnmpPacket{
+		Version:            req.Version,
+		Community:          req.Community,
+		MsgFlags:           req.MsgFlags &^ gosnmp.Reportable,
+		SecurityModel:      req.SecurityModel,
+		SecurityParameters: req.SecurityParameters,
+		MsgID:              req.MsgID,
+		ContextEngineID:    req.ContextEngineID,
+		ContextName:        req.ContextName,
+		PDUType:            gosnmp.GetResponse,
+		RequestID:          req.RequestID,
+	}
+	for _, v := range req.Variables {
+		switch req.PDUType {
+		case gosnmp.GetRequest:
+			pdu, ok := a.values[v.Name]
+			if !ok {
+				pdu = gosnmp.SnmpPDU{Name: v.Name, Type: gosnmp.NoSuchObject}
+			}
+			resp.Variables = append(resp.Variables, pdu)
+		case gosnmp.GetNextRequest:
+			resp.Variables = append(resp.Variables, a.next(v.Name))
+		case gosnmp.GetBulkRequest:
+			name := v.Name
+			for i := uint32(0); i < req.MaxRepetitions; i++ {
+				pdu := a.next(name)
+				resp.Variables = append(resp.Variables, pdu)
+				if pdu.Type == gosnmp.EndOfMibView {
+					break
+				}
+				name = pdu.Name
+			}
+		}
+	}
+	return resp
+}
+
+// next returns the first variable after name
+func (a *snmpAgent) next(name string) gosnmp.SnmpPDU {
+	i, found := slices.BinarySearchFunc(a.oids, name, compareOIDs)
+	if found {
+		i++
+	}
+	if i == len(a.oids) {
+		return gosnmp.SnmpPDU{Name: name, Type: gosnmp.EndOfMibView}
+	}
+	return a.values[a.oids[i]]
+}
+
+// report answers a v3 request with a report of the given USM counter
+func (a *snmpAgent) report(req *gosnmp.SnmpPacket, oid string) *gosnmp.SnmpPacket {
+	usm := &gosnmp.UsmSecurityParameters{
+		AuthoritativeEngineID:    snmpAgentEngineID,
+		AuthoritativeEngineBoots: 1,
+		AuthoritativeEngineTime:  1,
+	}
+	if params, ok := req.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok {
+		usm.UserName = params.UserName
+	}
+	return &gosnmp.SnmpPacket{
+		Version:            gosnmp.Version3,
+		MsgFlags:           gosnmp.NoAuthNoPriv,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		SecurityParameters: usm,
+		MsgID:              req.MsgID,
+		ContextEngineID:    snmpAgentEngineID,
+		PDUType:            gosnmp.Report,
+		RequestID:          req.RequestID,
+		Variables:          []gosnmp.SnmpPDU{{Name: oid, Type: gosnmp.Counter32, Value: uint32(1)}},
+	}
+}
+
+func compareOIDs(a string, b string) int {
+	as, bs := strings.Split(strings.Trim(a, "."), "."), strings.Split(strings.Trim(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.ParseUint(as[i], 10, 64)
+		y, _ := strconv.ParseUint(bs[i], 10, 64)
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// interfaceTable returns the IF-MIB rows of a device with interfaces 1, 2
+// and 10, the last one without HC counters, surrounded by other objects
+func interfaceTable() []gosnmp.SnmpPDU {
+	counter := func(column string, index int, value uint64) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: column + "." + strconv.Itoa(index), Type: gosnmp.Counter64, Value: value}
+	}
+	status := func(index int, value int) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: oidIfOperStatus + "." + strconv.Itoa(index), Type: gosnmp.Integer, Value: value}
+	}
+	return []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(4200)},
+		{Name: oidIfDescr + ".1", Type: gosnmp.OctetString, Value: []byte("ge-0/0/0")},
+		status(1, 1),
+		status(2, 2),
+		status(10, 1),
+		counter(oidIfHCInOctets, 1, 1<<40),
+		counter(oidIfHCInOctets, 2, 2000),
+		counter(oidIfHCOutOctets, 1, 5000),
+		counter(oidIfHCOutOctets, 2, 6000),
+		{Name: ".1.3.6.1.2.1.31.1.1.1.15.1", Type: gosnmp.Gauge32, Value: uint(1000)},
+	}
+}
+
+func TestSNMPPollerCounters(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		t.Run("v"+strconv.Itoa(version), func(t *testing.T) {
+			store := useMemoryStore(t)
+			agent := newSNMPAgent(t, interfaceTable()).v2c("private")
+			target := agent.target()
+			target.SnmpVersion = version
+			target.SnmpCommunity = "private"
+
+			client, err := newSNMPClient(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Conn.Close()
+			samples, err := walkInterfaceCounters(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []InterfaceSample{
+				{SnmpIndex: 1, OctetsIn: 1 << 40, OctetsOut: 5000, OperStatus: 1, Uptime: 4200},
+				{SnmpIndex: 2, OctetsIn: 2000, OctetsOut: 6000, OperStatus: 2, Uptime: 4200},
+			}
+			if !slices.Equal(samples, want) {
+				t.Errorf("samples = %+v, want %+v", samples, want)
+			}
+
+			// Disabled interfaces are not stored
+			store.AddInterface(InterfaceConfig{ID: 1, Exporter: 1, SnmpIndex: 2, Enabled: false})
+			p := NewSNMPPoller(time.Minute)
+			if n, err := p.pollExporter(target); err != nil || n != 1 {
+				t.Fatalf("pollExporter = %d, %v", n, err)
+			}
+			start, end := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+			metrics, _ := store.InterfaceMetrics("1", "1", start, end)
+			if len(metrics) != 1 || metrics[0].OctetsIn != 1<<40 || metrics[0].OctetsOut != 5000 || metrics[0].Uptime != 4200 {
+				t.Errorf("metrics of interface 1 = %+v", metrics)
+			}
+			if metrics, _ := store.InterfaceMetrics("1", "2", start, end); len(metrics) != 0 {
+				t.Errorf("metrics of disabled interface 2 = %+v", metrics)
+			}
+		})
+	}
+}
+
+func TestSNMPv3Protocols(t *testing.T) {
+	agents := map[string]*snmpAgent{
+		"md5": newSNMPAgent(t, interfaceTable()).v3(gosnmp.AuthNoPriv, &gosnmp.UsmSecurityParameters{
+			UserName: "poller", AuthenticationProtocol: gosnmp.MD5, AuthenticationPassphrase: "authsecret",
+		}),
+		"sha256-aes": newSNMPAgent(t, interfaceTable()).v3(gosnmp.AuthPriv, &gosnmp.UsmSecurityParameters{
+			UserName: "poller", AuthenticationProtocol: gosnmp.SHA256, AuthenticationPassphrase: "authsecret",
+			PrivacyProtocol: gosnmp.AES, PrivacyPassphrase: "privsecret",
+		}),
+		"sha-aes256": newSNMPAgent(t, interfaceTable()).v3(gosnmp.AuthPriv, &gosnmp.UsmSecurityParameters{
+			UserName: "poller", AuthenticationProtocol: gosnmp.SHA, AuthenticationPassphrase: "authsecret",
+			PrivacyProtocol: gosnmp.AES256, PrivacyPassphrase: "privsecret",
+		}),
+	}
+	tests := []struct {
+		agent     string
+		level     string
+		authProto string
+		privProto string
+		ok        bool
+	}{
+		{"md5", "authNoPriv", "md5", "", true},
+		{"md5", "authNoPriv", "sha", "", false},
+		{"sha256-aes", "authPriv", "SHA256", "aes", true},
+		{"sha256-aes", "authPriv", "sha256", "AES128", true},
+		{"sha256-aes", "authPriv", "sha512", "aes", false},
+		{"sha256-aes", "authPriv", "sha256", "aes256", false},
+		{"sha256-aes", "authNoPriv", "sha256", "", false},
+		{"sha-aes256", "authPriv", "sha1", "aes256", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.agent+"/"+tt.authProto+"/"+tt.privProto, func(t *testing.T) {
+			target := agents[tt.agent].target()
+			target.SnmpVersion = 3
+			target.Snmpv3Username = "poller"
+			target.Snmpv3Level = tt.level
+			target.Snmpv3AuthProto = tt.authProto
+			target.Snmpv3AuthPass = "authsecret"
+			target.Snmpv3PrivProto = tt.privProto
+			target.Snmpv3PrivPass = "privsecret"
+
+			client, err := newSNMPClient(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Conn.Close()
+			samples, err := walkInterfaceCounters(client)
+			if tt.ok && (err != nil || len(samples) != 2) {
+				t.Errorf("walk = %+v, %v", samples, err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("walk with mismatched protocols succeeded: %+v", samples)
+			}
+		})
+	}
+}
+
+func TestNewSNMPClient(t *testing.T) {
+	v3 := func(level string, authProto string, privProto string) ExporterConfig {
+		return ExporterConfig{IPInet: "192.0.2.1", SnmpVersion: 3, Snmpv3Username: "poller", Snmpv3Level: level,
+			Snmpv3AuthProto: authProto, Snmpv3AuthPass: "authsecret", Snmpv3PrivProto: privProto, Snmpv3PrivPass: "privsecret"}
+	}
+	tests := []struct {
+		target ExporterConfig
+		flags  gosnmp.SnmpV3MsgFlags
+		auth   gosnmp.SnmpV3AuthProtocol
+		priv   gosnmp.SnmpV3PrivProtocol
+		err    string
+	}{
+		// Protocols not needed by the level are left unset
+		{v3("noAuthNoPriv", "bogus", "bogus"), gosnmp.NoAuthNoPriv, 0, 0, ""},
+		{v3("authNoPriv", "Sha384", "bogus"), gosnmp.AuthNoPriv, gosnmp.SHA384, 0, ""},
+		{v3("authPriv", "sha224", "aes192c"), gosnmp.AuthPriv, gosnmp.SHA224, gosnmp.AES192C, ""},
+		{v3("authPriv", "md5", "des"), gosnmp.AuthPriv, gosnmp.MD5, gosnmp.DES, ""},
+		{v3("authPriv", "", "aes"), 0, 0, 0, "auth protocol"},
+		{v3("authPriv", "sha", "blowfish"), 0, 0, 0, "privacy protocol"},
+		{v3("auth", "sha", "aes"), 0, 0, 0, "security level"},
+		{ExporterConfig{IPInet: "192.0.2.1", SnmpVersion: 4}, 0, 0, 0, "SNMP version"},
+	}
+	for _, tt := range tests {
+		client, err := newSNMPClient(tt.target)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%+v: error %v, want %q", tt.target, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt.target, err)
+			continue
+		}
+		usm := client.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if client.MsgFlags != tt.flags || usm.AuthenticationProtocol != tt.auth || usm.PrivacyProtocol != tt.priv {
+			t.Errorf("%s/%s/%s: flags %v, auth %v, priv %v", tt.target.Snmpv3Level, tt.target.Snmpv3AuthProto, tt.target.Snmpv3PrivProto,
+				client.MsgFlags, usm.AuthenticationProtocol, usm.PrivacyProtocol)
+		}
+	}
+
+	if client, _ := newSNMPClient(ExporterConfig{IPInet: "192.0.2.1", SnmpVersion: 2, Data: map[string]interface{}{snmpPortKey: float64(1161)}}); client.Port != 1161 {
+		t.Errorf("port = %d, want 1161", client.Port)
+	}
+}
+
+func TestSNMPBackoff(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{time.Minute, 0, time.Minute},
+		{time.Minute, 1, 2 * time.Minute},
+		{time.Minute, 3, 8 * time.Minute},
+		{time.Minute, 5, snmpMaxBackoff},
+		{time.Minute, 1000, snmpMaxBackoff},
+		// Intervals above the cap are not shortened
+		{time.Hour, 0, time.Hour},
+		{time.Hour, 3, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := snmpBackoff(tt.interval, tt.failures); got != tt.want {
+			t.Errorf("snmpBackoff(%s, %d) = %s, want %s", tt.interval, tt.failures, got, tt.want)
+		}
+	}
+}
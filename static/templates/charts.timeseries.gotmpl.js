@@ -14,36 +14,53 @@ chart = Highcharts.chart('{{.Container}}', {
     }
 });
 
-// Fetch interface metrics from Go backend (no PostgREST)
-// Uses query params start/end; values are provided by template in RFC3339-like format or epoch.
+// Fetch interface rates from Go backend (no PostgREST). Counter wraps and
+// resets are handled by the backend, the same way as for the PNG charts.
 setTimeout(function(){
     // Use epoch seconds to avoid timezone/format parsing issues on backend
     const params = new URLSearchParams({
         start: '{{.StartUnix}}',
         end: '{{.EndUnix}}'
     });
-    const url = `/api/v1/metrics/{{.Exporter}}/{{.Interface}}?${params.toString()}`;
+    const url = `/api/v1/metrics/{{.Exporter}}/{{.Interface}}/rate?${params.toString()}`;
 
-    $.getJSON(url, function(rows) {
-        if (!rows || !rows.length) return;
+    $.getJSON(url, function(rates) {
+        if (!rates || !rates.length) return;
         let seriesData_in = { type: 'line', name: 'bits/s in', data: [] };
         let seriesData_out = { type: 'line', name: 'bits/s out', data: [] };
 
-        for (let i = 1; i < rows.length; i++) {
-            const prev = rows[i - 1];
-            const cur = rows[i];
-            const last = Math.floor(Date.parse(prev.timestamp) / 1000);
-            const now = Math.floor(Date.parse(cur.timestamp) / 1000);
-            const dt = Math.max(1, now - last);
-            let rateIn = Math.floor(8 * (cur.octets_in - prev.octets_in) / dt);
-            let rateOut = Math.floor(8 * (cur.octets_out - prev.octets_out) / dt);
-            if (!isFinite(rateIn) || rateIn < 0) rateIn = 0;
-            if (!isFinite(rateOut) || rateOut < 0) rateOut = 0;
-            seriesData_in.data.push([Date.parse(cur.timestamp), rateIn]);
-            seriesData_out.data.push([Date.parse(cur.timestamp), rateOut]);
-        }
+        rates.forEach(function(rate) {
+            const ts = Date.parse(rate.timestamp);
+            seriesData_in.data.push([ts, Math.floor(rate.bits_in)]);
+            seriesData_out.data.push([ts, Math.floor(rate.bits_out)]);
+        });
 
         chart.addSeries(seriesData_in);
         chart.addSeries(seriesData_out);
+        addBaselineBands(chart, `/api/v1/baseline/{{.Exporter}}/{{.Interface}}?${params.toString()}`);
     });
 }, 100);
+
+// Expected bands from the hour-of-week baseline, drawn as a transparent
+// lower area with the band width stacked on top of it
+function addBaselineBands(chart, url) {
+    $.getJSON(url, function(baseline) {
+        if (!baseline || !baseline.bands) return;
+        [['in', 'expected in'], ['out', 'expected out']].forEach(function(dir) {
+            const lower = [];
+            const width = [];
+            baseline.bands.forEach(function(point) {
+                const band = point[dir[0]];
+                if (!band) return;
+                const ts = Date.parse(point.timestamp);
+                lower.push([ts, Math.floor(band.lower)]);
+                width.push([ts, Math.floor(band.upper - band.lower)]);
+            });
+            if (!lower.length) return;
+            const common = { type: 'area', step: 'left', stacking: 'normal', stack: dir[0], lineWidth: 0, enableMouseTracking: false, marker: { enabled: false } };
+            chart.addSeries(Object.assign({ name: dir[1], data: width, fillOpacity: 0.15 }, common), false);
+            chart.addSeries(Object.assign({ name: dir[1] + ' lower', data: lower, fillOpacity: 0, linkedTo: ':previous', showInLegend: false }, common), false);
+        });
+        chart.redraw();
+    });
+}
@@ -39,62 +39,41 @@
 
   // Build Go backend URL with query params (use epoch seconds to avoid parse issues)
   const params = new URLSearchParams({ start: '{{.StartUnix}}', end: '{{.EndUnix}}' });
-  const url = `/api/v1/metrics/{{.Exporter}}/{{.Interface}}?${params.toString()}`;
+  const url = `/api/v1/metrics/{{.Exporter}}/{{.Interface}}/rate?${params.toString()}`;
 
-  // Fetch and process data, compute deltas → rate using a Web Worker
-  $.getJSON(url, function(rows){
-    if (!rows || !rows.length) return;
-
-    const workerCode = `
-      self.onmessage = function(e){
-        const rows = e.data || [];
-        const inPts = [];
-        const outPts = [];
-        for (let i=1; i<rows.length; i++){
-          const prev = rows[i-1];
-          const cur = rows[i];
-          const last = Math.floor(Date.parse(prev.timestamp)/1000);
-          const now  = Math.floor(Date.parse(cur.timestamp)/1000);
-          const dt = Math.max(1, now - last);
-          let rateIn  = Math.floor(8 * (cur.octets_in  - prev.octets_in)  / dt);
-          let rateOut = Math.floor(8 * (cur.octets_out - prev.octets_out) / dt);
-          if (!isFinite(rateIn)  || rateIn  < 0) rateIn  = 0;
-          if (!isFinite(rateOut) || rateOut < 0) rateOut = 0;
-          inPts.push([Date.parse(cur.timestamp), rateIn]);
-          outPts.push([Date.parse(cur.timestamp), rateOut]);
-        }
-        self.postMessage({ inPts, outPts });
-      };
-    `;
-
-    const blob = new Blob([workerCode], { type: 'application/javascript' });
-    const worker = new Worker(URL.createObjectURL(blob));
-
-    worker.onmessage = function(ev){
-      const { inPts, outPts } = ev.data || {};
-      setTimeout(function(){ chart.series[0].setData(inPts, false); }, 0);
-      setTimeout(function(){ chart.series[1].setData(outPts, true); }, 0);
-      worker.terminate();
-    };
-    worker.onerror = function(){
-      const inPts = []; const outPts = [];
-      for (let i=1; i<rows.length; i++){
-        const prev = rows[i-1];
-        const cur = rows[i];
-        const last = Math.floor(Date.parse(prev.timestamp)/1000);
-        const now  = Math.floor(Date.parse(cur.timestamp)/1000);
-        const dt = Math.max(1, now - last);
-        let rateIn  = Math.floor(8 * (cur.octets_in  - prev.octets_in)  / dt);
-        let rateOut = Math.floor(8 * (cur.octets_out - prev.octets_out) / dt);
-        if (!isFinite(rateIn)  || rateIn  < 0) rateIn  = 0;
-        if (!isFinite(rateOut) || rateOut < 0) rateOut = 0;
-        inPts.push([Date.parse(cur.timestamp), rateIn]);
-        outPts.push([Date.parse(cur.timestamp), rateOut]);
-      }
-      setTimeout(function(){ chart.series[0].setData(inPts, false); }, 0);
-      setTimeout(function(){ chart.series[1].setData(outPts, true); }, 0);
-    };
+  // Rates come computed by the backend, wrap and reset aware
+  $.getJSON(url, function(rates){
+    if (!rates || !rates.length) return;
+    const inPts = [];
+    const outPts = [];
+    rates.forEach(function(rate){
+      const ts = Date.parse(rate.timestamp);
+      inPts.push([ts, Math.floor(rate.bits_in)]);
+      outPts.push([ts, Math.floor(rate.bits_out)]);
+    });
+    chart.series[0].setData(inPts, false);
+    chart.series[1].setData(outPts, true);
+  });
 
-    worker.postMessage(rows);
+  // Expected bands from the hour-of-week baseline, drawn as a transparent
+  // lower area with the band width stacked on top of it
+  $.getJSON(`/api/v1/baseline/{{.Exporter}}/{{.Interface}}?${params.toString()}`, function(baseline){
+    if (!baseline || !baseline.bands) return;
+    [['in', 'expected in'], ['out', 'expected out']].forEach(function(dir){
+      const lower = [];
+      const width = [];
+      baseline.bands.forEach(function(point){
+        const band = point[dir[0]];
+        if (!band) return;
+        const ts = Date.parse(point.timestamp);
+        lower.push([ts, Math.floor(band.lower)]);
+        width.push([ts, Math.floor(band.upper - band.lower)]);
+      });
+      if (!lower.length) return;
+      const common = { type: 'area', step: 'left', stacking: 'normal', stack: dir[0], lineWidth: 0, enableMouseTracking: false, marker: { enabled: false }, turboThreshold: 0 };
+      chart.addSeries(Object.assign({ name: dir[1], data: width, fillOpacity: 0.15 }, common), false);
+      chart.addSeries(Object.assign({ name: dir[1] + ' lower', data: lower, fillOpacity: 0, linkedTo: ':previous', showInLegend: false }, common), false);
+    });
+    chart.redraw();
   });
 })();
@@ -0,0 +1,164 @@
+package main
+
+import "time"
+
+// FlowStore reads and stores flow records and their aggregates. Handlers and
+// the collector reach the flow tables only through config.Flows, so they can
+// run against the in-memory store as well as Postgres.
+//
+// Time arguments and results are instants; implementations deal with the
+// database time zone. Byte and packet sums are scaled by
+// filter.SamplingRate when it is above 1, or per exporter by
+// filter.ExporterRates when the filter has them.
+type FlowStore interface {
+	// AggregateTraffic sums traffic grouped by "address", "port" or "pair".
+	// addressType selects srcaddr or dstaddr for address grouping.
+	AggregateTraffic(filter TrafficFilter, groupBy string, addressType string) ([]TrafficAggregated, error)
+	// DataRange returns the first and last bucket stored for an exporter
+	DataRange(exporter string) (time.Time, time.Time, error)
+	// RawFlows calls each for the unaggregated flows matching filter, newest
+	// first in (last, id) order, starting after the cursor when given. A
+	// limit of 0 reads all matching flows; each returns false to stop early.
+	RawFlows(filter TrafficFilter, after *rawFlowCursor, limit int, each func(TrafficRecord) bool) error
+	// TopTalkers returns the filter.Limit largest source/destination pairs
+	// seen on the interface in either direction, and the total of all pairs
+	TopTalkers(filter TrafficFilter) ([]TopTalker, int64, error)
+	// TopTalkersWithPort is TopTalkers grouped by destination port as well
+	TopTalkersWithPort(filter TrafficFilter) ([]TopTalkerWithPort, int64, error)
+	// ProtocolStats sums traffic per IP protocol, largest first
+	ProtocolStats(filter TrafficFilter) ([]ProtocolStats, error)
+	// ProtocolPortStats sums traffic per protocol and port pair, largest first
+	ProtocolPortStats(filter TrafficFilter, limit int) ([]ProtocolPortStats, error)
+	// ProtocolTimeSeries returns bytes per protocol for each hourly bucket
+	ProtocolTimeSeries(filter TrafficFilter) ([]ProtocolTimeSeriesPoint, error)
+	// IPProtocolStats sums traffic per local address and protocol, with the
+	// byte and packet totals of the whole selection
+	IPProtocolStats(filter TrafficFilter) ([]IPProtocolStats, int64, int64, error)
+	// IPProtocolPortStats sums traffic per local address, protocol and port
+	IPProtocolPortStats(filter TrafficFilter) ([]IPProtocolPortStats, error)
+	// HourlyFlows returns the hourly aggregate rows for the chart endpoints
+	HourlyFlows(filter TrafficFilter) ([]FlowData, error)
+	// Ports returns the port and protocol names of the ports table
+	Ports() ([]Service, error)
+	// DestinationStats sums the raw flows between filter.StartTime and
+	// EndTime per destination address, keeping those with at least
+	// filter.MinPackets packets, most packets first
+	DestinationStats(filter TrafficFilter) ([]DestinationStats, error)
+	// TopSources returns the filter.Limit source addresses sending the most
+	// packets in the raw flows matching filter
+	TopSources(filter TrafficFilter) ([]TrafficAggregated, error)
+	// ScanStats counts the TCP probes in the raw flows between
+	// filter.StartTime and EndTime per source and port (horizontal) or per
+	// source and host (vertical), keeping the groups that reach threshold
+	// distinct hosts or ports, largest first
+	ScanStats(filter TrafficFilter, kind string, threshold int64) ([]ScanCandidate, error)
+	// PortTimeSeries sums the bytes of every hourly bucket per protocol and
+	// port pair, oldest first
+	PortTimeSeries(filter TrafficFilter) ([]PortTimeSeriesPoint, error)
+	// FlowExporters lists the exporters with hourly flows, as inet text
+	FlowExporters() ([]string, error)
+	// FlowInterfaces lists the input and output ifIndexes seen in the hourly
+	// flows of an exporter, in ascending order
+	FlowInterfaces(exporter string) ([]int64, error)
+	// ServiceNetworks returns the networks of the services table
+	ServiceNetworks() ([]ServiceNetwork, error)
+	// QueryFlows runs a query language request and returns one record per
+	// row, keyed by column name. Invalid filters fail with a *queryError.
+	QueryFlows(req QueryRequest) ([]map[string]interface{}, error)
+	// InsertFlows stores a batch of collected flows
+	InsertFlows(flows []FlowDB) error
+}
+
+// MetricsStore covers the SNMP side of the schema: exporters, their
+// interfaces and the interface counters.
+type MetricsStore interface {
+	// InterfaceMetrics returns the counters of an interface, oldest first
+	InterfaceMetrics(exporter string, iface string, start time.Time, end time.Time) ([]Metric, error)
+	// ExporterConfigs lists exporters without their SNMP community and
+	// passwords, which are only flagged as set
+	ExporterConfigs() ([]ExporterConfig, error)
+	// ExporterSecrets returns the SNMP community, v3 auth and v3 privacy
+	// passwords of an exporter as stored, sealed when a keyring is set
+	ExporterSecrets(id uint64) ([]string, error)
+	// ExporterData returns the data JSON of the exporter with the given
+	// address, or nil if there is no such exporter
+	ExporterData(addr string) (map[string]interface{}, error)
+	// UpdateExporter replaces the settings of an exporter; an empty SNMP
+	// community or password keeps the stored one
+	UpdateExporter(exporter ExporterConfig) error
+	// InterfaceConfigs lists the interfaces of an exporter, or of all
+	// exporters when exporterID is empty
+	InterfaceConfigs(exporterID string) ([]InterfaceConfig, error)
+	UpdateInterface(iface InterfaceConfig) error
+	// SetInterfacesEnabled enables or disables every interface of an exporter
+	// and returns how many were changed
+	SetInterfacesEnabled(exporterID int64, enabled bool) (int64, error)
+	// SyncInterfaces applies a discovery to an exporter: added rows are
+	// inserted and changed rows, which may have a new ifIndex, are updated
+	// by ID. It is applied atomically.
+	SyncInterfaces(exporterID int64, added []InterfaceConfig, changed []InterfaceConfig) error
+	// PollTargets lists the exporters with SNMP configured, with decrypted
+	// credentials
+	PollTargets() ([]ExporterConfig, error)
+	// InsertInterfaceMetrics stores one poll of an exporter's interfaces
+	InsertInterfaceMetrics(exporterID uint64, at time.Time, samples []InterfaceSample) error
+	// RegisterExporter adds an exporter seen by the collector unless one
+	// with the address exists, reporting whether it was added
+	RegisterExporter(addr string) (bool, error)
+}
+
+// AlertStore keeps the alert rules and the history of their events
+type AlertStore interface {
+	AlertRules() ([]AlertRule, error)
+	// CreateAlertRule stores a new rule and returns it with its ID
+	CreateAlertRule(rule AlertRule) (AlertRule, error)
+	// UpdateAlertRule replaces a rule, returning false if it does not exist
+	UpdateAlertRule(rule AlertRule) (bool, error)
+	// DeleteAlertRule removes a rule, returning false if it does not exist
+	DeleteAlertRule(id int64) (bool, error)
+	InsertAlertEvent(event AlertEvent) error
+	// AlertEvents returns the events matching filter, newest first
+	AlertEvents(filter AlertEventFilter) ([]AlertEvent, error)
+	// ActiveAlerts returns the last event of every rule and subject that is
+	// still firing
+	ActiveAlerts() ([]AlertEvent, error)
+}
+
+// AuditStore keeps the log of configuration changes
+type AuditStore interface {
+	InsertAuditEntry(entry AuditEntry) error
+	// AuditEntries returns the entries matching filter, newest first
+	AuditEntries(filter AuditFilter) ([]AuditEntry, error)
+}
+
+// AuthStore keeps the local users and the API tokens
+type AuthStore interface {
+	Users() ([]User, error)
+	// UserByName returns nil if the user does not exist
+	UserByName(username string) (*User, error)
+	// CreateUser stores a new user and returns it with its ID
+	CreateUser(user User) (User, error)
+	// UpdateUser replaces a user, keeping its password if PasswordHash is
+	// empty; it returns false if the user does not exist
+	UpdateUser(user User) (bool, error)
+	// DeleteUser removes a user and the API tokens it owns, returning false
+	// if it does not exist
+	DeleteUser(id int64) (bool, error)
+	APITokens() ([]APIToken, error)
+	// CreateAPIToken stores a new token and returns it with its ID
+	CreateAPIToken(token APIToken) (APIToken, error)
+	// APITokenByHash returns nil if no token has the hash
+	APITokenByHash(hash string) (*APIToken, error)
+	// TouchAPIToken records when a token was last used
+	TouchAPIToken(id int64, at time.Time) error
+	// DeleteAPIToken removes a token, returning false if it does not exist
+	DeleteAPIToken(id int64) (bool, error)
+	Scopes() ([]Scope, error)
+	// CreateScope stores a new scope and returns it with its ID
+	CreateScope(scope Scope) (Scope, error)
+	// UpdateScope replaces the exporters of a scope, returning false if it
+	// does not exist
+	UpdateScope(scope Scope) (bool, error)
+	// DeleteScope removes a scope, returning false if it does not exist
+	DeleteScope(id int64) (bool, error)
+}
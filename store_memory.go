@@ -0,0 +1,1484 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is an in-memory FlowStore and MetricsStore for running the
+// handlers without a database, e.g. under httptest. It keeps raw flows only;
+// the hourly aggregates are computed from them with every flow counted as
+// one row of the hour its last packet was seen in.
+type memoryStore struct {
+	mu         sync.RWMutex
+	flows      []TrafficRecord
+	exporters  []ExporterConfig
+	interfaces []InterfaceConfig
+	metrics    map[string][]Metric
+	ports      []Service
+	services   []ServiceNetwork
+	rules      []AlertRule
+	events     []AlertEvent
+	users      []User
+	tokens     []APIToken
+	scopes     []Scope
+	audit      []AuditEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{metrics: make(map[string][]Metric)}
+}
+
+// AddFlows stores raw flow records; missing IDs are assigned in order
+func (s *memoryStore) AddFlows(records ...TrafficRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		if record.ID == 0 {
+			record.ID = uint64(len(s.flows) + 1)
+		}
+		s.flows = append(s.flows, record)
+	}
+}
+
+func (s *memoryStore) AddExporter(exporter ExporterConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exporters = append(s.exporters, exporter)
+}
+
+func (s *memoryStore) AddInterface(iface InterfaceConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interfaces = append(s.interfaces, iface)
+}
+
+// AddMetrics stores counters of an exporter (ID) and interface (SNMP index)
+func (s *memoryStore) AddMetrics(exporter string, iface string, metrics ...Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := exporter + "/" + iface
+	s.metrics[key] = append(s.metrics[key], metrics...)
+}
+
+func (s *memoryStore) AddPorts(ports ...Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ports = append(s.ports, ports...)
+}
+
+func (s *memoryStore) AddServiceNetworks(networks ...ServiceNetwork) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.services = append(s.services, networks...)
+}
+
+func flowBucket(record TrafficRecord) time.Time {
+	return record.Last.Truncate(time.Hour)
+}
+
+func flowProtocol(record TrafficRecord) int {
+	prot, _ := strconv.Atoi(record.Protocol)
+	return prot
+}
+
+// matchAddr reports whether addr satisfies an address filter
+func matchAddr(f AddrFilter, addr string) bool {
+	if !f.IsSet() {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	found := false
+	for _, host := range f.Hosts {
+		if ip != nil && ip.Equal(net.ParseIP(host)) {
+			found = true
+		}
+	}
+	for _, network := range f.Networks {
+		if _, n, err := net.ParseCIDR(network); err == nil && ip != nil && n.Contains(ip) {
+			found = true
+		}
+	}
+	return found != f.Negate
+}
+
+// matchRange reports whether v satisfies a port or protocol filter
+func matchRange(f RangeFilter, v int64) bool {
+	if !f.IsSet() {
+		return true
+	}
+	found := false
+	for _, r := range f.Ranges {
+		if v >= r[0] && v <= r[1] {
+			found = true
+		}
+	}
+	return found != f.Negate
+}
+
+// matchFlow applies the exporter, match and time filters of the hourly
+// queries. bothDirections matches the interface on input or output, as the
+// top-talker and IP protocol queries do; raw selects the raw flows time
+// column instead of the hourly bucket.
+func matchFlow(filter TrafficFilter, record TrafficRecord, bothDirections bool, raw bool) bool {
+	if filter.Exporter != "" && net.ParseIP(filter.Exporter).String() != net.ParseIP(record.Exporter).String() {
+		return false
+	}
+	if filter.Interface != "" {
+		input := strconv.FormatInt(record.Input, 10) == filter.Interface
+		output := strconv.FormatInt(record.Output, 10) == filter.Interface
+		switch {
+		case bothDirections:
+			if !input && !output {
+				return false
+			}
+		case filter.Direction == "output":
+			if !output {
+				return false
+			}
+		default:
+			if !input {
+				return false
+			}
+		}
+	}
+	ts := flowBucket(record)
+	if raw {
+		ts = record.Last
+	}
+	if !filter.StartTime.IsZero() && ts.Before(filter.StartTime) {
+		return false
+	}
+	if !filter.EndTime.IsZero() && ts.After(filter.EndTime) {
+		return false
+	}
+	return matchAddr(filter.SrcAddr, record.SrcAddr) &&
+		matchAddr(filter.DstAddr, record.DstAddr) &&
+		matchRange(filter.SrcPort, record.SrcPort) &&
+		matchRange(filter.DstPort, record.DstPort) &&
+		matchRange(filter.Protocol, int64(flowProtocol(record)))
+}
+
+// selectFlows returns the stored flows passing matchFlow
+func (s *memoryStore) selectFlows(filter TrafficFilter, bothDirections bool, raw bool) []TrafficRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var selected []TrafficRecord
+	for _, record := range s.flows {
+		if matchFlow(filter, record, bothDirections, raw) {
+			selected = append(selected, record)
+		}
+	}
+	return selected
+}
+
+// flowGroup accumulates the sums of one group of flows
+type flowGroup struct {
+	first   TrafficRecord
+	octets  int64
+	packets int64
+	flows   int64
+}
+
+// groupFlows sums flows by key, scaled by the sampling rate of the filter,
+// keeping groups in first-seen order
+func groupFlows(records []TrafficRecord, filter TrafficFilter, key func(TrafficRecord) string) []*flowGroup {
+	index := make(map[string]*flowGroup)
+	var groups []*flowGroup
+	for _, record := range records {
+		k := key(record)
+		g, ok := index[k]
+		if !ok {
+			g = &flowGroup{first: record}
+			index[k] = g
+			groups = append(groups, g)
+		}
+		rate := filter.recordRate(record)
+		g.octets += record.DOctets * rate
+		g.packets += record.DPkts * rate
+		g.flows++
+	}
+	// Largest first, the order of every aggregate query
+	slices.SortStableFunc(groups, func(a, b *flowGroup) int {
+		return cmp.Compare(b.octets, a.octets)
+	})
+	return groups
+}
+
+func (s *memoryStore) AggregateTraffic(filter TrafficFilter, groupBy string, addressType string) ([]TrafficAggregated, error) {
+	var selected []TrafficRecord
+	for _, record := range s.selectFlows(filter, false, false) {
+		if filter.SrcAS > 0 && record.SrcAS != int64(filter.SrcAS) {
+			continue
+		}
+		if filter.DstAS > 0 && record.DstAS != int64(filter.DstAS) {
+			continue
+		}
+		selected = append(selected, record)
+	}
+
+	var key func(TrafficRecord) string
+	switch groupBy {
+	case "address":
+		key = func(r TrafficRecord) string {
+			if addressType == "dstaddr" {
+				return r.DstAddr
+			}
+			return r.SrcAddr
+		}
+	case "port":
+		key = func(r TrafficRecord) string {
+			return fmt.Sprintf("%s|%d|%d|%s", r.SrcAddr, r.SrcPort, r.DstPort, r.Protocol)
+		}
+	case "pair":
+		key = func(r TrafficRecord) string { return r.SrcAddr + "|" + r.DstAddr }
+	default:
+		return nil, fmt.Errorf("unknown grouping %q", groupBy)
+	}
+
+	var records []TrafficAggregated
+	for _, g := range groupFlows(selected, filter, key) {
+		if (filter.MinOctets > 0 && g.octets < filter.MinOctets) ||
+			(filter.MaxOctets > 0 && g.octets > filter.MaxOctets) ||
+			(filter.MinPackets > 0 && g.packets < filter.MinPackets) ||
+			(filter.MaxPackets > 0 && g.packets > filter.MaxPackets) {
+			continue
+		}
+		record := TrafficAggregated{
+			TotalOctets:  g.octets,
+			TotalPackets: g.packets,
+			FlowCount:    g.flows,
+		}
+		switch groupBy {
+		case "address":
+			record.Address = key(g.first)
+		case "port":
+			record.Address = g.first.SrcAddr
+			record.SrcPort = g.first.SrcPort
+			record.DstPort = g.first.DstPort
+			record.Protocol = g.first.Protocol
+		case "pair":
+			record.SrcAddr = g.first.SrcAddr
+			record.DstAddr = g.first.DstAddr
+		}
+		records = append(records, record)
+	}
+
+	slices.SortStableFunc(records, func(a, b TrafficAggregated) int {
+		var c int
+		switch filter.OrderBy {
+		case "total_packets":
+			c = cmp.Compare(a.TotalPackets, b.TotalPackets)
+		case "flow_count":
+			c = cmp.Compare(a.FlowCount, b.FlowCount)
+		case "address":
+			c = strings.Compare(a.Address, b.Address)
+		default:
+			c = cmp.Compare(a.TotalOctets, b.TotalOctets)
+		}
+		if strings.EqualFold(filter.OrderDir, "desc") {
+			c = -c
+		}
+		return c
+	})
+
+	records = records[min(filter.Offset, len(records)):]
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func (s *memoryStore) DataRange(exporter string) (time.Time, time.Time, error) {
+	var minTime, maxTime time.Time
+	for _, record := range s.selectFlows(TrafficFilter{Exporter: exporter}, true, true) {
+		bucket := flowBucket(record)
+		if minTime.IsZero() || bucket.Before(minTime) {
+			minTime = bucket
+		}
+		if bucket.After(maxTime) {
+			maxTime = bucket
+		}
+	}
+	if minTime.IsZero() {
+		return minTime, maxTime, fmt.Errorf("no data for exporter %s", exporter)
+	}
+	return minTime, maxTime, nil
+}
+
+func (s *memoryStore) RawFlows(filter TrafficFilter, after *rawFlowCursor, limit int, each func(TrafficRecord) bool) error {
+	records := s.selectFlows(filter, false, true)
+	slices.SortFunc(records, func(a, b TrafficRecord) int {
+		if c := b.Last.Compare(a.Last); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	n := 0
+	for _, record := range records {
+		if after != nil {
+			last := toDBTime(record.Last)
+			if last.After(after.Last) || (last.Equal(after.Last) && record.ID >= after.ID) {
+				continue
+			}
+		}
+		if limit > 0 && n == limit {
+			break
+		}
+		n++
+		if !each(record) {
+			break
+		}
+	}
+	return nil
+}
+
+// protocolName mirrors the ports table lookup of the Postgres queries
+func (s *memoryStore) protocolName(protocol int) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.ports {
+		if p.Port == 0 && p.Protocol == protocol {
+			return p.Name
+		}
+	}
+	return fmt.Sprintf("Protocol-%d", protocol)
+}
+
+// serviceName returns the ports table name of a port, or "" if it has none
+func (s *memoryStore) serviceName(protocol int, port int64) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.ports {
+		if p.Port != 0 && p.Protocol == protocol && int64(p.Port) == port {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+func (s *memoryStore) TopTalkers(filter TrafficFilter) ([]TopTalker, int64, error) {
+	groups := groupFlows(s.selectFlows(filter, true, false), filter, func(r TrafficRecord) string {
+		return r.SrcAddr + "|" + r.DstAddr + "|" + r.Protocol
+	})
+	var total int64
+	for _, g := range groups {
+		total += g.octets
+	}
+	var talkers []TopTalker
+	for _, g := range groups {
+		if filter.Limit > 0 && len(talkers) == filter.Limit {
+			break
+		}
+		talker := TopTalker{
+			SrcAddr:      g.first.SrcAddr,
+			DstAddr:      g.first.DstAddr,
+			Protocol:     flowProtocol(g.first),
+			ProtocolName: s.protocolName(flowProtocol(g.first)),
+			TotalOctets:  g.octets,
+			TotalPackets: g.packets,
+			FlowCount:    g.flows,
+		}
+		if total > 0 {
+			talker.Percentage = float64(g.octets) / float64(total) * 100
+		}
+		talkers = append(talkers, talker)
+	}
+	return talkers, total, nil
+}
+
+func (s *memoryStore) TopTalkersWithPort(filter TrafficFilter) ([]TopTalkerWithPort, int64, error) {
+	groups := groupFlows(s.selectFlows(filter, true, false), filter, func(r TrafficRecord) string {
+		return fmt.Sprintf("%s|%s|%d|%s", r.SrcAddr, r.DstAddr, r.DstPort, r.Protocol)
+	})
+	var total int64
+	for _, g := range groups {
+		total += g.octets
+	}
+	var talkers []TopTalkerWithPort
+	for _, g := range groups {
+		if filter.Limit > 0 && len(talkers) == filter.Limit {
+			break
+		}
+		protocol := flowProtocol(g.first)
+		talker := TopTalkerWithPort{
+			SrcAddr:      g.first.SrcAddr,
+			DstAddr:      g.first.DstAddr,
+			DstPort:      int(g.first.DstPort),
+			ServiceName:  s.serviceName(protocol, g.first.DstPort),
+			Protocol:     protocol,
+			ProtocolName: s.protocolName(protocol),
+			TotalOctets:  g.octets,
+			TotalPackets: g.packets,
+			FlowCount:    g.flows,
+		}
+		if talker.ServiceName == "" {
+			talker.ServiceName = strconv.FormatInt(g.first.DstPort, 10)
+		}
+		if total > 0 {
+			talker.Percentage = float64(g.octets) / float64(total) * 100
+		}
+		talkers = append(talkers, talker)
+	}
+	return talkers, total, nil
+}
+
+func (s *memoryStore) ProtocolStats(filter TrafficFilter) ([]ProtocolStats, error) {
+	var stats []ProtocolStats
+	for _, g := range groupFlows(s.selectFlows(filter, false, false), filter, func(r TrafficRecord) string {
+		return r.Protocol
+	}) {
+		stats = append(stats, ProtocolStats{
+			Protocol:     flowProtocol(g.first),
+			TotalOctets:  g.octets,
+			TotalPackets: g.packets,
+			FlowCount:    g.flows,
+		})
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) ProtocolPortStats(filter TrafficFilter, limit int) ([]ProtocolPortStats, error) {
+	var stats []ProtocolPortStats
+	for _, g := range groupFlows(s.selectFlows(filter, false, false), filter, func(r TrafficRecord) string {
+		return fmt.Sprintf("%s|%d|%d", r.Protocol, r.SrcPort, r.DstPort)
+	}) {
+		if limit > 0 && len(stats) == limit {
+			break
+		}
+		stats = append(stats, ProtocolPortStats{
+			Protocol:     flowProtocol(g.first),
+			SrcPort:      int(g.first.SrcPort),
+			DstPort:      int(g.first.DstPort),
+			TotalOctets:  g.octets,
+			TotalPackets: g.packets,
+			FlowCount:    g.flows,
+		})
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) ProtocolTimeSeries(filter TrafficFilter) ([]ProtocolTimeSeriesPoint, error) {
+	rate := max(filter.SamplingRate, 1)
+	var timeSeries []ProtocolTimeSeriesPoint
+	for _, record := range s.selectFlows(filter, false, false) {
+		bucket := flowBucket(record)
+		i := slices.IndexFunc(timeSeries, func(p ProtocolTimeSeriesPoint) bool { return p.Timestamp.Equal(bucket) })
+		if i < 0 {
+			timeSeries = append(timeSeries, ProtocolTimeSeriesPoint{Timestamp: bucket, ProtocolData: make(map[int]int64)})
+			i = len(timeSeries) - 1
+		}
+		timeSeries[i].ProtocolData[flowProtocol(record)] += record.DOctets * rate
+	}
+	slices.SortFunc(timeSeries, func(a, b ProtocolTimeSeriesPoint) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	return timeSeries, nil
+}
+
+// localAddr is the address on our side of the interface
+func localAddr(filter TrafficFilter, record TrafficRecord) string {
+	if filter.Direction == "input" {
+		return record.DstAddr
+	}
+	return record.SrcAddr
+}
+
+func (s *memoryStore) IPProtocolStats(filter TrafficFilter) ([]IPProtocolStats, int64, int64, error) {
+	groups := groupFlows(s.selectFlows(filter, true, false), filter, func(r TrafficRecord) string {
+		return localAddr(filter, r) + "|" + r.Protocol
+	})
+	var totalOctets, totalPackets int64
+	var stats []IPProtocolStats
+	for _, g := range groups {
+		totalOctets += g.octets
+		totalPackets += g.packets
+		if len(stats) == 100 {
+			continue
+		}
+		stats = append(stats, IPProtocolStats{
+			IPAddress:    localAddr(filter, g.first),
+			Protocol:     flowProtocol(g.first),
+			ProtocolName: s.protocolName(flowProtocol(g.first)),
+			TotalOctets:  g.octets,
+			TotalPackets: g.packets,
+			FlowCount:    g.flows,
+		})
+	}
+	return stats, totalOctets, totalPackets, nil
+}
+
+func (s *memoryStore) IPProtocolPortStats(filter TrafficFilter) ([]IPProtocolPortStats, error) {
+	port := func(r TrafficRecord) int64 {
+		if r.DstPort != 0 {
+			return r.DstPort
+		}
+		return r.SrcPort
+	}
+	var stats []IPProtocolPortStats
+	for _, g := range groupFlows(s.selectFlows(filter, true, false), filter, func(r TrafficRecord) string {
+		return fmt.Sprintf("%s|%s|%d", localAddr(filter, r), r.Protocol, port(r))
+	}) {
+		if len(stats) == 100 {
+			break
+		}
+		protocol := flowProtocol(g.first)
+		stat := IPProtocolPortStats{
+			IPAddress:    localAddr(filter, g.first),
+			Protocol:     protocol,
+			ProtocolName: s.protocolName(protocol),
+			Port:         int(port(g.first)),
+			ServiceName:  s.serviceName(protocol, port(g.first)),
+			TotalOctets:  g.octets,
+			TotalPackets: g.packets,
+			FlowCount:    g.flows,
+		}
+		if stat.ServiceName == "" {
+			stat.ServiceName = fmt.Sprintf("Port-%d", stat.Port)
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) HourlyFlows(filter TrafficFilter) ([]FlowData, error) {
+	rate := max(filter.SamplingRate, 1)
+	var flows []FlowData
+	for _, record := range s.selectFlows(filter, false, false) {
+		flows = append(flows, FlowData{
+			Timestamp:    flowBucket(record),
+			SrcAddr:      record.SrcAddr,
+			DstAddr:      record.DstAddr,
+			SrcPort:      record.SrcPort,
+			DstPort:      record.DstPort,
+			SrcAs:        record.SrcAS,
+			DstAs:        record.DstAS,
+			Input:        record.Input,
+			Output:       record.Output,
+			TotalPackets: record.DPkts * rate,
+			TotalOctets:  record.DOctets * rate,
+		})
+	}
+	return flows, nil
+}
+
+func (s *memoryStore) Ports() ([]Service, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.ports), nil
+}
+
+func (s *memoryStore) DestinationStats(filter TrafficFilter) ([]DestinationStats, error) {
+	rate := max(filter.SamplingRate, 1)
+	index := make(map[string]*DestinationStats)
+	sources := make(map[string]map[string]bool)
+	var stats []*DestinationStats
+	for _, record := range s.selectFlows(filter, false, true) {
+		stat, ok := index[record.DstAddr]
+		if !ok {
+			stat = &DestinationStats{Address: record.DstAddr, Amplification: make(map[int64]int64)}
+			index[record.DstAddr] = stat
+			sources[record.DstAddr] = make(map[string]bool)
+			stats = append(stats, stat)
+		}
+		stat.Packets += record.DPkts * rate
+		stat.Octets += record.DOctets * rate
+		stat.Flows++
+		sources[record.DstAddr][record.SrcAddr] = true
+		flags, _ := strconv.Atoi(record.TCPFlags)
+		switch flowProtocol(record) {
+		case 6:
+			if flags&0x12 == 0x02 {
+				stat.SynPackets += record.DPkts * rate
+			}
+		case 17:
+			for _, amp := range amplificationPorts {
+				if record.SrcPort == amp.Port {
+					stat.Amplification[amp.Port] += record.DPkts * rate
+				}
+			}
+		}
+	}
+
+	var result []DestinationStats
+	for _, stat := range stats {
+		if stat.Packets < filter.MinPackets {
+			continue
+		}
+		stat.Sources = int64(len(sources[stat.Address]))
+		result = append(result, *stat)
+	}
+	slices.SortStableFunc(result, func(a, b DestinationStats) int {
+		return cmp.Compare(b.Packets, a.Packets)
+	})
+	return result, nil
+}
+
+func (s *memoryStore) TopSources(filter TrafficFilter) ([]TrafficAggregated, error) {
+	groups := groupFlows(s.selectFlows(filter, false, true), filter, func(r TrafficRecord) string {
+		return r.SrcAddr
+	})
+	slices.SortStableFunc(groups, func(a, b *flowGroup) int {
+		return cmp.Compare(b.packets, a.packets)
+	})
+	records := []TrafficAggregated{}
+	for _, g := range groups {
+		if filter.Limit > 0 && len(records) >= filter.Limit {
+			break
+		}
+		records = append(records, TrafficAggregated{
+			Address:      g.first.SrcAddr,
+			TotalOctets:  g.octets,
+			TotalPackets: g.packets,
+			FlowCount:    g.flows,
+		})
+	}
+	return records, nil
+}
+
+func (s *memoryStore) ScanStats(filter TrafficFilter, kind string, threshold int64) ([]ScanCandidate, error) {
+	index := make(map[string]*ScanCandidate)
+	distinct := make(map[string]map[string]bool)
+	var candidates []*ScanCandidate
+	for _, record := range s.selectFlows(filter, false, true) {
+		flags, _ := strconv.Atoi(record.TCPFlags)
+		if flowProtocol(record) != 6 || flags&0x10 != 0 {
+			continue
+		}
+		key := record.SrcAddr + "|" + strconv.FormatInt(record.DstPort, 10)
+		value := record.DstAddr
+		if kind == scanVertical {
+			key = record.SrcAddr + "|" + record.DstAddr
+			value = strconv.FormatInt(record.DstPort, 10)
+		}
+		candidate, ok := index[key]
+		if !ok {
+			candidate = &ScanCandidate{Kind: kind, Source: record.SrcAddr, FirstSeen: record.First, LastSeen: record.Last}
+			if kind == scanVertical {
+				candidate.Target = record.DstAddr
+			} else {
+				candidate.Port = record.DstPort
+			}
+			index[key] = candidate
+			distinct[key] = make(map[string]bool)
+			candidates = append(candidates, candidate)
+		}
+		distinct[key][value] = true
+		candidate.Flows++
+		candidate.Packets += record.DPkts
+		if record.First.Before(candidate.FirstSeen) {
+			candidate.FirstSeen = record.First
+		}
+		if record.Last.After(candidate.LastSeen) {
+			candidate.LastSeen = record.Last
+		}
+	}
+
+	var result []ScanCandidate
+	for key, candidate := range index {
+		candidate.Distinct = int64(len(distinct[key]))
+	}
+	for _, candidate := range candidates {
+		if candidate.Distinct >= threshold {
+			result = append(result, *candidate)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b ScanCandidate) int {
+		return cmp.Compare(b.Distinct, a.Distinct)
+	})
+	return result, nil
+}
+
+func (s *memoryStore) PortTimeSeries(filter TrafficFilter) ([]PortTimeSeriesPoint, error) {
+	groups := groupFlows(s.selectFlows(filter, false, false), filter, func(r TrafficRecord) string {
+		return fmt.Sprintf("%d|%d|%d|%d", flowBucket(r).Unix(), flowProtocol(r), r.SrcPort, r.DstPort)
+	})
+	points := make([]PortTimeSeriesPoint, len(groups))
+	for i, g := range groups {
+		prot := int64(flowProtocol(g.first))
+		points[i] = PortTimeSeriesPoint{
+			Bucket:     flowBucket(g.first),
+			Prot:       &prot,
+			SrcPort:    &g.first.SrcPort,
+			DstPort:    &g.first.DstPort,
+			TotalBytes: g.octets,
+		}
+	}
+	slices.SortStableFunc(points, func(a, b PortTimeSeriesPoint) int {
+		return a.Bucket.Compare(b.Bucket)
+	})
+	return points, nil
+}
+
+func (s *memoryStore) FlowExporters() ([]string, error) {
+	var exporters []string
+	for _, record := range s.selectFlows(TrafficFilter{}, false, false) {
+		addr, err := netip.ParseAddr(record.Exporter)
+		if err != nil {
+			continue
+		}
+		// inet text output keeps the prefix length
+		text := netip.PrefixFrom(addr, addr.BitLen()).String()
+		if !slices.Contains(exporters, text) {
+			exporters = append(exporters, text)
+		}
+	}
+	slices.Sort(exporters)
+	return exporters, nil
+}
+
+func (s *memoryStore) FlowInterfaces(exporter string) ([]int64, error) {
+	var indices []int64
+	for _, record := range s.selectFlows(TrafficFilter{Exporter: exporter}, false, false) {
+		for _, idx := range []int64{record.Input, record.Output} {
+			if !slices.Contains(indices, idx) {
+				indices = append(indices, idx)
+			}
+		}
+	}
+	slices.Sort(indices)
+	return indices, nil
+}
+
+func (s *memoryStore) ServiceNetworks() ([]ServiceNetwork, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]ServiceNetwork{}, s.services...), nil
+}
+
+func (s *memoryStore) QueryFlows(req QueryRequest) ([]map[string]interface{}, error) {
+	expr, err := parseQuery(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	raw := req.Source.Table == "flows"
+	var selected []TrafficRecord
+	for _, record := range s.selectFlows(TrafficFilter{Exporter: req.Exporter, StartTime: req.StartTime, EndTime: req.EndTime}, false, raw) {
+		if matchQuery(expr, record) {
+			selected = append(selected, record)
+		}
+	}
+
+	records := []map[string]interface{}{}
+	if len(req.GroupBy) == 0 {
+		var value func(TrafficRecord) int64
+		switch req.OrderBy {
+		case "", "time":
+			value = func(r TrafficRecord) int64 {
+				if raw {
+					return r.Last.UnixNano()
+				}
+				return flowBucket(r).UnixNano()
+			}
+		case "bytes":
+			value = func(r TrafficRecord) int64 { return r.DOctets }
+		case "packets":
+			value = func(r TrafficRecord) int64 { return r.DPkts }
+		default:
+			return nil, fmt.Errorf("order_by %q requires group_by", req.OrderBy)
+		}
+		slices.SortStableFunc(selected, func(a, b TrafficRecord) int {
+			return cmp.Compare(value(b), value(a))
+		})
+		for _, record := range selected[:min(req.Limit, len(selected))] {
+			row := make(map[string]interface{}, len(req.Source.RawColumns))
+			for _, col := range req.Source.RawColumns {
+				row[col.Name] = queryFieldValue(col.Name, record)
+			}
+			records = append(records, row)
+		}
+		return records, nil
+	}
+
+	groups := groupFlows(selected, req.samplingFilter(), func(r TrafficRecord) string {
+		key := make([]string, len(req.GroupBy))
+		for i, col := range req.GroupBy {
+			key[i] = fmt.Sprint(queryFieldValue(col.Name, r))
+		}
+		return strings.Join(key, "|")
+	})
+	switch req.OrderBy {
+	case "packets":
+		slices.SortStableFunc(groups, func(a, b *flowGroup) int { return cmp.Compare(b.packets, a.packets) })
+	case "flows":
+		slices.SortStableFunc(groups, func(a, b *flowGroup) int { return cmp.Compare(b.flows, a.flows) })
+	}
+	for _, g := range groups[:min(req.Limit, len(groups))] {
+		row := make(map[string]interface{}, len(req.GroupBy)+3)
+		for _, col := range req.GroupBy {
+			row[col.Name] = queryFieldValue(col.Name, g.first)
+		}
+		row["bytes"] = g.octets
+		row["packets"] = g.packets
+		row["flows"] = g.flows
+		records = append(records, row)
+	}
+	return records, nil
+}
+
+// queryFieldValue returns a result column of the query language for a flow,
+// typed as the Postgres store scans it
+func queryFieldValue(name string, r TrafficRecord) interface{} {
+	switch name {
+	case "bucket":
+		return flowBucket(r)
+	case "exporter":
+		return net.ParseIP(r.Exporter).String()
+	case "srcaddr":
+		return net.ParseIP(r.SrcAddr).String()
+	case "dstaddr":
+		return net.ParseIP(r.DstAddr).String()
+	case "srcport":
+		return r.SrcPort
+	case "dstport":
+		return r.DstPort
+	case "proto":
+		return int64(flowProtocol(r))
+	case "src_as":
+		return r.SrcAS
+	case "dst_as":
+		return r.DstAS
+	case "input":
+		return r.Input
+	case "output":
+		return r.Output
+	case "bytes":
+		return r.DOctets
+	case "packets":
+		return r.DPkts
+	case "first":
+		return r.First
+	case "last":
+		return r.Last
+	}
+	return nil
+}
+
+// matchQuery evaluates a parsed filter against a flow, mirroring the SQL of
+// querySQLBuilder
+func matchQuery(expr queryExpr, r TrafficRecord) bool {
+	switch node := expr.(type) {
+	case queryBinary:
+		if node.Op == "and" {
+			return matchQuery(node.Left, r) && matchQuery(node.Right, r)
+		}
+		return matchQuery(node.Left, r) || matchQuery(node.Right, r)
+	case queryNot:
+		return !matchQuery(node.Expr, r)
+	case queryPrimitive:
+		return matchQueryPrimitive(node, r)
+	}
+	return false
+}
+
+func matchQueryPrimitive(prim queryPrimitive, r TrafficRecord) bool {
+	pick := func(src, dst int64) []int64 {
+		switch prim.Dir {
+		case "src", "in":
+			return []int64{src}
+		case "dst", "out":
+			return []int64{dst}
+		}
+		return []int64{src, dst}
+	}
+	pickAddr := func() []string {
+		switch prim.Dir {
+		case "src":
+			return []string{r.SrcAddr}
+		case "dst":
+			return []string{r.DstAddr}
+		}
+		return []string{r.SrcAddr, r.DstAddr}
+	}
+
+	var values []int64
+	switch prim.Field {
+	case "any":
+		return true
+	case "ipv4":
+		return net.ParseIP(r.SrcAddr).To4() != nil
+	case "ipv6":
+		ip := net.ParseIP(r.SrcAddr)
+		return ip != nil && ip.To4() == nil
+	case "host", "net", "exporter":
+		addrs := pickAddr()
+		if prim.Field == "exporter" {
+			addrs = []string{r.Exporter}
+		}
+		found := false
+		for _, addr := range addrs {
+			if prim.Field == "net" {
+				_, network, err := net.ParseCIDR(prim.Value)
+				found = found || (err == nil && network.Contains(net.ParseIP(addr)))
+			} else {
+				found = found || net.ParseIP(addr).Equal(net.ParseIP(prim.Value))
+			}
+		}
+		return found != (prim.Op == "!=")
+	case "port":
+		values = pick(r.SrcPort, r.DstPort)
+	case "as":
+		values = pick(r.SrcAS, r.DstAS)
+	case "if":
+		values = pick(r.Input, r.Output)
+	case "proto":
+		values = []int64{int64(flowProtocol(r))}
+	case "bytes":
+		values = []int64{r.DOctets}
+	case "packets":
+		values = []int64{r.DPkts}
+	}
+
+	low := queryNumber(prim.Value)
+	found := false
+	for _, v := range values {
+		switch {
+		case prim.High != "":
+			found = found || (v >= low && v <= queryNumber(prim.High))
+		case prim.Op == "<":
+			found = found || v < low
+		case prim.Op == "<=":
+			found = found || v <= low
+		case prim.Op == ">":
+			found = found || v > low
+		case prim.Op == ">=":
+			found = found || v >= low
+		default:
+			found = found || v == low
+		}
+	}
+	return found != (prim.Op == "!=")
+}
+
+func (s *memoryStore) InsertFlows(flows []FlowDB) error {
+	now := time.Now()
+	records := make([]TrafficRecord, len(flows))
+	for i, flow := range flows {
+		records[i] = TrafficRecord{
+			InsertedAt: now,
+			Exporter:   flow.Exporter,
+			SrcAddr:    flow.SrcAddr,
+			DstAddr:    flow.DstAddr,
+			Input:      flow.Input,
+			Output:     flow.Output,
+			DPkts:      flow.DPkts,
+			DOctets:    flow.DOctets,
+			SrcPort:    flow.SrcPort,
+			DstPort:    flow.DstPort,
+			TCPFlags:   flow.TCPFlags,
+			Protocol:   flow.Protocol,
+			TOS:        flow.TOS,
+			SrcAS:      flow.SrcAS,
+			DstAS:      flow.DstAS,
+			SrcMask:    flow.SrcMask,
+			DstMask:    flow.DstMask,
+			IPVersion:  flow.IPVersion,
+			First:      flow.First,
+			Last:       flow.Last,
+		}
+	}
+	s.AddFlows(records...)
+	return nil
+}
+
+func (s *memoryStore) InterfaceMetrics(exporter string, iface string, start time.Time, end time.Time) ([]Metric, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var metrics []Metric
+	for _, metric := range s.metrics[exporter+"/"+iface] {
+		if !metric.Timestamp.Before(start) && !metric.Timestamp.After(end) {
+			metrics = append(metrics, metric)
+		}
+	}
+	slices.SortFunc(metrics, func(a, b Metric) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	return metrics, nil
+}
+
+func (s *memoryStore) ExporterConfigs() ([]ExporterConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	exporters := make([]ExporterConfig, len(s.exporters))
+	for i, exporter := range s.exporters {
+		exporter.SnmpCommunitySet = exporter.SnmpCommunity != ""
+		exporter.Snmpv3AuthPassSet = exporter.Snmpv3AuthPass != ""
+		exporter.Snmpv3PrivPassSet = exporter.Snmpv3PrivPass != ""
+		exporter.SnmpCommunity = ""
+		exporter.Snmpv3AuthPass = ""
+		exporter.Snmpv3PrivPass = ""
+		exporters[i] = exporter
+	}
+	return exporters, nil
+}
+
+func (s *memoryStore) ExporterSecrets(id uint64) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, exporter := range s.exporters {
+		if exporter.ID == id {
+			return []string{exporter.SnmpCommunity, exporter.Snmpv3AuthPass, exporter.Snmpv3PrivPass}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) ExporterData(addr string) (map[string]interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, exporter := range s.exporters {
+		if net.ParseIP(exporter.IPInet).Equal(net.ParseIP(addr)) {
+			return exporter.Data, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) UpdateExporter(exporter ExporterConfig) error {
+	// The data is stored as JSON, which reads numbers back as float64
+	dataJSON, err := json.Marshal(exporter.Data)
+	if err != nil {
+		return err
+	}
+	exporter.Data = nil
+	if err := json.Unmarshal(dataJSON, &exporter.Data); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.exporters {
+		if s.exporters[i].ID == exporter.ID {
+			// The address is not editable, and empty secrets are unchanged
+			exporter.IPInet = s.exporters[i].IPInet
+			exporter.SnmpCommunity = cmp.Or(exporter.SnmpCommunity, s.exporters[i].SnmpCommunity)
+			exporter.Snmpv3AuthPass = cmp.Or(exporter.Snmpv3AuthPass, s.exporters[i].Snmpv3AuthPass)
+			exporter.Snmpv3PrivPass = cmp.Or(exporter.Snmpv3PrivPass, s.exporters[i].Snmpv3PrivPass)
+			s.exporters[i] = exporter
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) InterfaceConfigs(exporterID string) ([]InterfaceConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var interfaces []InterfaceConfig
+	for _, iface := range s.interfaces {
+		if exporterID == "" || strconv.FormatInt(iface.Exporter, 10) == exporterID {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	slices.SortStableFunc(interfaces, func(a, b InterfaceConfig) int {
+		if c := cmp.Compare(a.Exporter, b.Exporter); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.SnmpIndex, b.SnmpIndex)
+	})
+	return interfaces, nil
+}
+
+func (s *memoryStore) UpdateInterface(iface InterfaceConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.interfaces {
+		if s.interfaces[i].ID == iface.ID {
+			s.interfaces[i].Enabled = iface.Enabled
+			s.interfaces[i].Alias = iface.Alias
+			s.interfaces[i].Bandwidth = iface.Bandwidth
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SetInterfacesEnabled(exporterID int64, enabled bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for i := range s.interfaces {
+		if s.interfaces[i].Exporter == exporterID {
+			s.interfaces[i].Enabled = enabled
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) SyncInterfaces(exporterID int64, added []InterfaceConfig, changed []InterfaceConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, iface := range changed {
+		for i := range s.interfaces {
+			if s.interfaces[i].ID == iface.ID && s.interfaces[i].Exporter == exporterID {
+				s.interfaces[i] = iface
+			}
+		}
+	}
+	var next uint64
+	for _, iface := range s.interfaces {
+		next = max(next, iface.ID)
+	}
+	for _, iface := range added {
+		next++
+		iface.ID = next
+		iface.Exporter = exporterID
+		s.interfaces = append(s.interfaces, iface)
+	}
+	return nil
+}
+
+func (s *memoryStore) PollTargets() ([]ExporterConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var targets []ExporterConfig
+	for _, exporter := range s.exporters {
+		if exporter.SnmpVersion >= 1 && exporter.SnmpVersion <= 3 {
+			targets = append(targets, exporter)
+		}
+	}
+	return targets, nil
+}
+
+func (s *memoryStore) InsertInterfaceMetrics(exporterID uint64, at time.Time, samples []InterfaceSample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sample := range samples {
+		key := strconv.FormatUint(exporterID, 10) + "/" + strconv.FormatInt(sample.SnmpIndex, 10)
+		s.metrics[key] = append(s.metrics[key], Metric{
+			Timestamp: at,
+			OctetsIn:  int64(sample.OctetsIn),
+			OctetsOut: int64(sample.OctetsOut),
+			Uptime:    int64(sample.Uptime),
+		})
+	}
+	return nil
+}
+
+func (s *memoryStore) RegisterExporter(addr string) (bool, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false, fmt.Errorf("invalid exporter address %q", addr)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next uint64
+	for _, exporter := range s.exporters {
+		if net.ParseIP(exporter.IPInet).Equal(ip) {
+			return false, nil
+		}
+		next = max(next, exporter.ID)
+	}
+	s.exporters = append(s.exporters, ExporterConfig{ID: next + 1, IPInet: addr, Name: addr})
+	return true, nil
+}
+
+func (s *memoryStore) AlertRules() ([]AlertRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.rules), nil
+}
+
+func (s *memoryStore) CreateAlertRule(rule AlertRule) (AlertRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rule.ID = 1
+	if len(s.rules) > 0 {
+		rule.ID = s.rules[len(s.rules)-1].ID + 1
+	}
+	rule.CreatedAt = time.Now()
+	s.rules = append(s.rules, rule)
+	return rule, nil
+}
+
+func (s *memoryStore) UpdateAlertRule(rule AlertRule) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rules {
+		if s.rules[i].ID == rule.ID {
+			rule.CreatedAt = s.rules[i].CreatedAt
+			s.rules[i] = rule
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) DeleteAlertRule(id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rules {
+		if s.rules[i].ID == id {
+			s.rules = slices.Delete(s.rules, i, i+1)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) InsertAlertEvent(event AlertEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event.ID = int64(len(s.events) + 1)
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memoryStore) AlertEvents(filter AlertEventFilter) ([]AlertEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var events []AlertEvent
+	for i := len(s.events) - 1; i >= 0; i-- {
+		event := s.events[i]
+		if filter.RuleID != 0 && event.RuleID != filter.RuleID {
+			continue
+		}
+		if !filter.Start.IsZero() && event.CreatedAt.Before(filter.Start) {
+			continue
+		}
+		if !filter.End.IsZero() && event.CreatedAt.After(filter.End) {
+			continue
+		}
+		events = append(events, event)
+		if filter.Limit > 0 && len(events) == filter.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStore) ActiveAlerts() ([]AlertEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	enabled := make(map[int64]bool)
+	for _, rule := range s.rules {
+		enabled[rule.ID] = rule.Enabled
+	}
+	seen := make(map[alertKey]bool)
+	var events []AlertEvent
+	for i := len(s.events) - 1; i >= 0; i-- {
+		event := s.events[i]
+		key := alertKey{event.RuleID, event.Subject}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if event.State == alertFiring && enabled[event.RuleID] {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStore) Users() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.users), nil
+}
+
+func (s *memoryStore) UserByName(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.Username == username {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) CreateUser(user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.users {
+		if existing.Username == user.Username {
+			return user, fmt.Errorf("user %q already exists", user.Username)
+		}
+	}
+	user.ID = 1
+	if len(s.users) > 0 {
+		user.ID = s.users[len(s.users)-1].ID + 1
+	}
+	user.CreatedAt = time.Now()
+	s.users = append(s.users, user)
+	return user, nil
+}
+
+func (s *memoryStore) UpdateUser(user User) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].ID == user.ID {
+			user.Username = s.users[i].Username
+			user.CreatedAt = s.users[i].CreatedAt
+			if user.PasswordHash == "" {
+				user.PasswordHash = s.users[i].PasswordHash
+			}
+			s.users[i] = user
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) DeleteUser(id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].ID == id {
+			username := s.users[i].Username
+			s.users = slices.Delete(s.users, i, i+1)
+			s.tokens = slices.DeleteFunc(s.tokens, func(token APIToken) bool {
+				return token.Owner == username
+			})
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) APITokens() ([]APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.tokens), nil
+}
+
+func (s *memoryStore) CreateAPIToken(token APIToken) (APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token.ID = 1
+	if len(s.tokens) > 0 {
+		token.ID = s.tokens[len(s.tokens)-1].ID + 1
+	}
+	token.CreatedAt = time.Now()
+	s.tokens = append(s.tokens, token)
+	return token, nil
+}
+
+func (s *memoryStore) APITokenByHash(hash string) (*APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, token := range s.tokens {
+		if token.Hash == hash {
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) TouchAPIToken(id int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.tokens {
+		if s.tokens[i].ID == id {
+			s.tokens[i].LastUsed = &at
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteAPIToken(id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.tokens {
+		if s.tokens[i].ID == id {
+			s.tokens = slices.Delete(s.tokens, i, i+1)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) Scopes() ([]Scope, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.scopes), nil
+}
+
+func (s *memoryStore) CreateScope(scope Scope) (Scope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scope.ID = 1
+	if len(s.scopes) > 0 {
+		scope.ID = s.scopes[len(s.scopes)-1].ID + 1
+	}
+	scope.CreatedAt = time.Now()
+	s.scopes = append(s.scopes, scope)
+	return scope, nil
+}
+
+func (s *memoryStore) UpdateScope(scope Scope) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.scopes {
+		if s.scopes[i].ID == scope.ID {
+			s.scopes[i].Exporters = scope.Exporters
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) DeleteScope(id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.scopes {
+		if s.scopes[i].ID == id {
+			s.scopes = slices.Delete(s.scopes, i, i+1)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) InsertAuditEntry(entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.ID = int64(len(s.audit) + 1)
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+func (s *memoryStore) AuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []AuditEntry
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		entry := s.audit[i]
+		if filter.Actor != "" && entry.Actor != filter.Actor {
+			continue
+		}
+		if filter.Endpoint != "" && !strings.Contains(entry.Endpoint, filter.Endpoint) {
+			continue
+		}
+		if filter.Target != "" && entry.Target != filter.Target && !strings.HasPrefix(entry.Target, filter.Target+" ") {
+			continue
+		}
+		if !filter.Start.IsZero() && entry.CreatedAt.Before(filter.Start) {
+			continue
+		}
+		if !filter.End.IsZero() && entry.CreatedAt.After(filter.End) {
+			continue
+		}
+		entries = append(entries, entry)
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+var (
+	_ FlowStore    = (*memoryStore)(nil)
+	_ MetricsStore = (*memoryStore)(nil)
+	_ AlertStore   = (*memoryStore)(nil)
+	_ AuthStore    = (*memoryStore)(nil)
+	_ AuditStore   = (*memoryStore)(nil)
+)
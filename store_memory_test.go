@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testHour is the hour the fixture flows were seen in
+var testHour = time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)
+
+// useMemoryStore installs an empty memoryStore as every store of config for
+// the duration of a test
+func useMemoryStore(t *testing.T) *memoryStore {
+	t.Helper()
+	saved := config
+	store := newMemoryStore()
+	config.Flows = store
+	config.Metrics = store
+	config.Alerts = store
+	config.Auth = store
+	config.Audit = store
+	t.Cleanup(func() { config = saved })
+	return store
+}
+
+// addTestFlows stores flows of exporter 192.0.2.1 (ID 1) seen on interface 3,
+// and one flow of exporter 192.0.2.2 (ID 2)
+func addTestFlows(store *memoryStore) {
+	store.AddExporter(ExporterConfig{ID: 1, IPInet: "192.0.2.1", Name: "edge1", SnmpVersion: 2, SnmpCommunity: "public"})
+	store.AddExporter(ExporterConfig{ID: 2, IPInet: "192.0.2.2", Name: "edge2"})
+	last := testHour.Add(15 * time.Minute)
+	flow := func(exporter, src, dst string, srcPort, dstPort int64, proto string, input, output, octets, packets int64) TrafficRecord {
+		return TrafficRecord{
+			Exporter: exporter, SrcAddr: src, DstAddr: dst, SrcPort: srcPort, DstPort: dstPort, Protocol: proto,
+			Input: input, Output: output, DOctets: octets, DPkts: packets,
+			First: last.Add(-time.Minute), Last: last,
+		}
+	}
+	store.AddFlows(
+		flow("192.0.2.1", "10.0.0.1", "10.0.1.1", 50000, 443, "6", 3, 4, 1000, 10),
+		flow("192.0.2.1", "10.0.0.1", "10.0.1.2", 50001, 443, "6", 3, 4, 3000, 20),
+		flow("192.0.2.1", "10.0.0.2", "10.0.1.1", 50002, 53, "17", 3, 5, 500, 5),
+		flow("192.0.2.1", "10.0.0.3", "10.0.1.1", 50003, 22, "6", 7, 3, 200, 2),
+		flow("192.0.2.2", "10.9.9.9", "10.0.1.1", 50004, 443, "6", 3, 4, 9999, 99),
+	)
+}
+
+// serve runs a handler on a request, with the given path values set
+func serve(handler http.HandlerFunc, r *http.Request, pathValues ...string) *httptest.ResponseRecorder {
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		r.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestMemoryStoreQueryFlows(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+
+	tests := []struct {
+		filter string
+		want   int
+	}{
+		{"", 5},
+		{"dst port 443", 3},
+		// != must hold on both sides, as in the SQL
+		{"port != 53", 4},
+		{"not port 443 and proto tcp", 1},
+		{"src net 10.0.0.0/24 and bytes >= 1000", 2},
+		{"exporter 192.0.2.2 or dst host 10.0.1.2", 2},
+		{"src port 50001-50003", 3},
+		{"in if 7 or out if 5", 2},
+		{"ipv6", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			records, err := store.QueryFlows(QueryRequest{Source: querySources["flows"], Filter: tt.filter, Limit: 100})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != tt.want {
+				t.Errorf("%d records, want %d: %v", len(records), tt.want, records)
+			}
+		})
+	}
+
+	records, err := store.QueryFlows(QueryRequest{
+		Source:       querySources["hourly"],
+		Filter:       "dst port 443",
+		Exporter:     "192.0.2.1",
+		GroupBy:      []queryColumn{queryGroupColumns["srcaddr"]},
+		SamplingRate: 10,
+		Limit:        10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0]["srcaddr"] != "10.0.0.1" || records[0]["bytes"] != int64(40000) || records[0]["flows"] != int64(2) {
+		t.Errorf("grouped records = %v", records)
+	}
+}
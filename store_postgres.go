@@ -0,0 +1,2400 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pgStore implements FlowStore and MetricsStore on the Postgres schema
+type pgStore struct {
+	db *sql.DB
+}
+
+func newPGStore(db *sql.DB) *pgStore {
+	return &pgStore{db: db}
+}
+
+var (
+	_ FlowStore    = (*pgStore)(nil)
+	_ MetricsStore = (*pgStore)(nil)
+	_ AlertStore   = (*pgStore)(nil)
+	_ AuthStore    = (*pgStore)(nil)
+	_ AuditStore   = (*pgStore)(nil)
+)
+
+// pgSchema holds the schema additions made by this service on top of the
+// collector database. Every statement must be safe to run on each start.
+var pgSchema = []string{
+	`ALTER TABLE interface_metrics ADD COLUMN IF NOT EXISTS oper_status smallint`,
+	`ALTER TABLE interface_metrics ADD COLUMN IF NOT EXISTS uptime bigint`,
+	`CREATE TABLE IF NOT EXISTS alert_rules (
+		id bigserial PRIMARY KEY,
+		name text NOT NULL,
+		kind text NOT NULL,
+		enabled boolean NOT NULL DEFAULT true,
+		exporter bigint NOT NULL DEFAULT 0,
+		interface text NOT NULL DEFAULT '',
+		direction text NOT NULL DEFAULT '',
+		host text NOT NULL DEFAULT '',
+		protocol integer NOT NULL DEFAULT 0,
+		threshold double precision NOT NULL,
+		clear_threshold double precision NOT NULL,
+		window_minutes integer NOT NULL,
+		for_count integer NOT NULL DEFAULT 1,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS alert_events (
+		id bigserial PRIMARY KEY,
+		rule_id bigint NOT NULL,
+		rule_name text NOT NULL,
+		subject text NOT NULL DEFAULT '',
+		state text NOT NULL,
+		value double precision NOT NULL,
+		threshold double precision NOT NULL,
+		message text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS alert_events_created_at_idx ON alert_events (created_at)`,
+	`CREATE INDEX IF NOT EXISTS alert_events_rule_idx ON alert_events (rule_id, subject, created_at)`,
+	`CREATE TABLE IF NOT EXISTS users (
+		id bigserial PRIMARY KEY,
+		username text NOT NULL UNIQUE,
+		password_hash text NOT NULL,
+		role text NOT NULL,
+		disabled boolean NOT NULL DEFAULT false,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+		id bigserial PRIMARY KEY,
+		name text NOT NULL,
+		role text NOT NULL,
+		owner text NOT NULL DEFAULT '',
+		token_hash text NOT NULL UNIQUE,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		expires_at timestamptz,
+		last_used_at timestamptz
+	)`,
+	`CREATE TABLE IF NOT EXISTS scopes (
+		id bigserial PRIMARY KEY,
+		name text NOT NULL UNIQUE,
+		exporters jsonb NOT NULL DEFAULT '[]',
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS scope text NOT NULL DEFAULT ''`,
+	`ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS scope text NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id bigserial PRIMARY KEY,
+		actor text NOT NULL,
+		auth_method text NOT NULL,
+		remote_addr text NOT NULL,
+		forwarded_for text NOT NULL DEFAULT '',
+		endpoint text NOT NULL,
+		target text NOT NULL,
+		before jsonb,
+		after jsonb,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at)`,
+}
+
+// migrate applies pgSchema
+func (s *pgStore) migrate() error {
+	for _, stmt := range pgSchema {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// buildTrafficQuery constructs SQL query based on filters
+func buildTrafficQuery(filter TrafficFilter, groupBy string, addressType string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	argIndex := 1
+
+	octetsSum := filter.sampledSum("total_bytes")
+	packetsSum := filter.sampledSum("total_packets")
+
+	// Base query - use flows_hourly for aggregated data
+	selectFields := ""
+	if groupBy == "address" {
+		addrField := "srcaddr"
+		if addressType == "dstaddr" {
+			addrField = "dstaddr"
+		}
+		selectFields = fmt.Sprintf(`
+			%s as address,
+			%s as total_octets,
+			%s as total_packets,
+			COUNT(*) as flow_count
+		`, addrField, octetsSum, packetsSum)
+	} else if groupBy == "port" {
+		addrField := "srcaddr"
+		selectFields = fmt.Sprintf(`
+			%s as address,
+			srcport,
+			dstport,
+			prot as protocol,
+			%s as total_octets,
+			%s as total_packets,
+			COUNT(*) as flow_count
+		`, addrField, octetsSum, packetsSum)
+	} else if groupBy == "pair" {
+		selectFields = fmt.Sprintf(`
+			srcaddr,
+			dstaddr,
+			%s as total_octets,
+			%s as total_packets,
+			COUNT(*) as flow_count`, octetsSum, packetsSum)
+	}
+
+	baseQuery := fmt.Sprintf(`
+		SELECT %s
+		FROM flows_hourly
+		WHERE 1=1
+	`, selectFields)
+
+	// Add filters
+	if filter.Exporter != "" {
+		conditions = append(conditions, fmt.Sprintf("exporter = $%d", argIndex))
+		args = append(args, filter.Exporter)
+		argIndex++
+	}
+
+	if filter.Interface != "" {
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.directionColumn(), argIndex))
+		args = append(args, filter.Interface)
+		argIndex++
+	}
+
+	if !filter.StartTime.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("bucket >= $%d", argIndex))
+		args = append(args, toDBTime(filter.StartTime))
+		argIndex++
+	}
+
+	if !filter.EndTime.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("bucket <= $%d", argIndex))
+		args = append(args, toDBTime(filter.EndTime))
+		argIndex++
+	}
+
+	matchConds, matchArgs := filter.matchConditions(argIndex)
+	conditions = append(conditions, matchConds...)
+	args = append(args, matchArgs...)
+	argIndex += len(matchArgs)
+
+	if filter.SrcAS > 0 {
+		conditions = append(conditions, fmt.Sprintf("src_as = $%d", argIndex))
+		args = append(args, filter.SrcAS)
+		argIndex++
+	}
+
+	if filter.DstAS > 0 {
+		conditions = append(conditions, fmt.Sprintf("dst_as = $%d", argIndex))
+		args = append(args, filter.DstAS)
+		argIndex++
+	}
+
+	// Build WHERE clause
+	whereClause := ""
+	if len(conditions) > 0 {
+		whereClause = " AND " + strings.Join(conditions, " AND ")
+	}
+
+	// GROUP BY clause
+	groupByClause := ""
+	if groupBy == "address" {
+
+		if addressType == "dstaddr" {
+			groupByClause = " GROUP BY dstaddr"
+		} else {
+			groupByClause = " GROUP BY srcaddr"
+		}
+
+	} else if groupBy == "port" {
+		groupByClause = " GROUP BY srcaddr, srcport, dstport, prot"
+	} else if groupBy == "pair" {
+		groupByClause = " GROUP BY srcaddr, dstaddr"
+	}
+
+	// Having clause for volume filters
+	havingClauses := []string{}
+	if filter.MinOctets > 0 {
+		havingClauses = append(havingClauses, fmt.Sprintf("%s >= %d", octetsSum, filter.MinOctets))
+	}
+	if filter.MaxOctets > 0 {
+		havingClauses = append(havingClauses, fmt.Sprintf("%s <= %d", octetsSum, filter.MaxOctets))
+	}
+	if filter.MinPackets > 0 {
+		havingClauses = append(havingClauses, fmt.Sprintf("%s >= %d", packetsSum, filter.MinPackets))
+	}
+	if filter.MaxPackets > 0 {
+		havingClauses = append(havingClauses, fmt.Sprintf("%s <= %d", packetsSum, filter.MaxPackets))
+	}
+
+	havingClause := ""
+	if len(havingClauses) > 0 {
+		havingClause = " HAVING " + strings.Join(havingClauses, " AND ")
+	}
+
+	// ORDER BY clause; request values are limited by parseOrder
+	orderDir := "ASC"
+	if strings.EqualFold(filter.OrderDir, "desc") {
+		orderDir = "DESC"
+	}
+	orderBy := filter.OrderBy
+	if orderBy == "address" && groupBy == "pair" {
+		orderBy = "srcaddr " + orderDir + ", dstaddr"
+	}
+	orderByClause := fmt.Sprintf(" ORDER BY %s %s", orderBy, orderDir)
+
+	// LIMIT and OFFSET
+	limitClause := ""
+	if filter.Limit > 0 {
+		limitClause = fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	if filter.Offset > 0 {
+		limitClause += fmt.Sprintf(" OFFSET %d", filter.Offset)
+	}
+
+	query := baseQuery + whereClause + groupByClause + havingClause + orderByClause + limitClause
+
+	return query, args
+}
+
+func (s *pgStore) AggregateTraffic(filter TrafficFilter, groupBy string, addressType string) ([]TrafficAggregated, error) {
+	query, args := buildTrafficQuery(filter, groupBy, addressType)
+
+	log.Println("Query:", query)
+	log.Println("Args:", args)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var records []TrafficAggregated
+	for rows.Next() {
+		var record TrafficAggregated
+
+		if groupBy == "address" {
+			err := rows.Scan(
+				&record.Address,
+				&record.TotalOctets,
+				&record.TotalPackets,
+				&record.FlowCount,
+			)
+			if err != nil {
+				log.Printf("Scan error: %v", err)
+				continue
+			}
+		} else if groupBy == "port" {
+			var protocol sql.NullString
+			err := rows.Scan(
+				&record.Address,
+				&record.SrcPort,
+				&record.DstPort,
+				&protocol,
+				&record.TotalOctets,
+				&record.TotalPackets,
+				&record.FlowCount,
+			)
+			if err != nil {
+				log.Printf("Scan error: %v", err)
+				continue
+			}
+			if protocol.Valid {
+				record.Protocol = protocol.String
+			}
+		} else if groupBy == "pair" {
+			err := rows.Scan(
+				&record.SrcAddr,
+				&record.DstAddr,
+				&record.TotalOctets,
+				&record.TotalPackets,
+				&record.FlowCount,
+			)
+			if err != nil {
+				log.Printf("Scan error: %v", err)
+				continue
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (s *pgStore) DataRange(exporter string) (time.Time, time.Time, error) {
+	var minTime, maxTime time.Time
+	query := "SELECT MIN(bucket), MAX(bucket) FROM flows_hourly WHERE exporter = $1::inet"
+	err := s.db.QueryRow(query, exporter).Scan(&minTime, &maxTime)
+	if err != nil {
+		return minTime, maxTime, err
+	}
+	return fromDBTime(minTime), fromDBTime(maxTime), nil
+}
+
+func (s *pgStore) RawFlows(filter TrafficFilter, after *rawFlowCursor, limit int, each func(TrafficRecord) bool) error {
+	// Build query for raw flows table
+	var conditions []string
+	var args []interface{}
+	argIndex := 1
+
+	if filter.Exporter != "" {
+		conditions = append(conditions, fmt.Sprintf("exporter = $%d::inet", argIndex))
+		args = append(args, filter.Exporter)
+		argIndex++
+	}
+
+	if filter.Interface != "" {
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.directionColumn(), argIndex))
+		args = append(args, filter.Interface)
+		argIndex++
+	}
+
+	if !filter.StartTime.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("last >= $%d", argIndex))
+		args = append(args, toDBTime(filter.StartTime))
+		argIndex++
+	}
+
+	if !filter.EndTime.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("last <= $%d", argIndex))
+		args = append(args, toDBTime(filter.EndTime))
+		argIndex++
+	}
+
+	matchConds, matchArgs := filter.matchConditions(argIndex)
+	conditions = append(conditions, matchConds...)
+	args = append(args, matchArgs...)
+	argIndex += len(matchArgs)
+
+	// Keyset pagination: continue strictly after the cursor in (last, id) order
+	if after != nil {
+		conditions = append(conditions, fmt.Sprintf("(last, id) < ($%d::timestamp, $%d)", argIndex, argIndex+1))
+		args = append(args, after.Last, after.ID)
+		argIndex += 2
+	}
+
+	whereClause := "WHERE " + strings.Join(conditions, " AND ")
+	if len(conditions) == 0 {
+		whereClause = ""
+	}
+
+	limitClause := ""
+	if limit > 0 {
+		limitClause = fmt.Sprintf("LIMIT $%d", argIndex)
+		args = append(args, limit)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			id, inserted_at, exporter, srcaddr, dstaddr, input, output,
+			dpkts, doctets, srcport, dstport, tcp_flags, prot, tos,
+			src_as, dst_as, src_mask, dst_mask, ip_version, first, last
+		FROM flows
+		%s
+		ORDER BY last DESC, id DESC
+		%s
+	`, whereClause, limitClause)
+
+	log.Println("Raw flows query:", query)
+	log.Println("Args:", args)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record, err := scanTrafficRecord(rows)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		if !each(record) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// scanTrafficRecord scans a row of the raw flows query
+func scanTrafficRecord(rows *sql.Rows) (TrafficRecord, error) {
+	var record TrafficRecord
+	err := rows.Scan(
+		&record.ID,
+		&record.InsertedAt,
+		&record.Exporter,
+		&record.SrcAddr,
+		&record.DstAddr,
+		&record.Input,
+		&record.Output,
+		&record.DPkts,
+		&record.DOctets,
+		&record.SrcPort,
+		&record.DstPort,
+		&record.TCPFlags,
+		&record.Protocol,
+		&record.TOS,
+		&record.SrcAS,
+		&record.DstAS,
+		&record.SrcMask,
+		&record.DstMask,
+		&record.IPVersion,
+		&record.First,
+		&record.Last,
+	)
+	record.InsertedAt = fromDBTime(record.InsertedAt)
+	record.First = fromDBTime(record.First)
+	record.Last = fromDBTime(record.Last)
+	return record, err
+}
+
+func (s *pgStore) TopTalkers(filter TrafficFilter) ([]TopTalker, int64, error) {
+	// Query for top talkers (srcaddr + dstaddr)
+	query := `
+		WITH talker_stats AS (
+			SELECT
+				srcaddr,
+				dstaddr,
+				prot as protocol,
+				SUM(total_bytes) * $6 as total_octets,
+				SUM(total_packets) * $6 as total_packets,
+				COUNT(*) as flow_count
+			FROM flows_hourly
+			WHERE exporter = $1::inet
+			  AND (input = $2::int OR output = $2::int)
+			  AND bucket >= $3::timestamp
+			  AND bucket <= $4::timestamp
+			GROUP BY srcaddr, dstaddr, prot
+		),
+		totals AS (
+			SELECT SUM(total_octets) as grand_total_octets
+			FROM talker_stats
+		)
+		SELECT
+			ts.srcaddr,
+			ts.dstaddr,
+			ts.protocol,
+			COALESCE(p.name, 'Protocol-' || ts.protocol::text) as protocol_name,
+			ts.total_octets,
+			ts.total_packets,
+			ts.flow_count,
+			t.grand_total_octets
+		FROM talker_stats ts
+		CROSS JOIN totals t
+		LEFT JOIN ports p ON ts.protocol = p.protocol AND p.number IS NULL
+		ORDER BY ts.total_octets DESC
+		LIMIT $5
+	`
+
+	rows, err := s.db.Query(query, filter.Exporter, filter.Interface, toDBTime(filter.StartTime), toDBTime(filter.EndTime), filter.Limit, max(filter.SamplingRate, 1))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var talkers []TopTalker
+	var grandTotalOctets int64
+
+	for rows.Next() {
+		var talker TopTalker
+		var totalOctets, totalPackets, flowCount, grandTotal sql.NullInt64
+		var protocol sql.NullInt64
+
+		err := rows.Scan(
+			&talker.SrcAddr,
+			&talker.DstAddr,
+			&protocol,
+			&talker.ProtocolName,
+			&totalOctets,
+			&totalPackets,
+			&flowCount,
+			&grandTotal,
+		)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+
+		if protocol.Valid {
+			talker.Protocol = int(protocol.Int64)
+		}
+		if totalOctets.Valid {
+			talker.TotalOctets = totalOctets.Int64
+		}
+		if totalPackets.Valid {
+			talker.TotalPackets = totalPackets.Int64
+		}
+		if flowCount.Valid {
+			talker.FlowCount = flowCount.Int64
+		}
+		if grandTotal.Valid {
+			grandTotalOctets = grandTotal.Int64
+			if grandTotalOctets > 0 {
+				talker.Percentage = float64(talker.TotalOctets) / float64(grandTotalOctets) * 100
+			}
+		}
+
+		talkers = append(talkers, talker)
+	}
+
+	return talkers, grandTotalOctets, nil
+}
+
+func (s *pgStore) TopTalkersWithPort(filter TrafficFilter) ([]TopTalkerWithPort, int64, error) {
+	// Query for top talkers with destination port
+	query := `
+		WITH talker_stats AS (
+			SELECT
+				srcaddr,
+				dstaddr,
+				dstport,
+				prot as protocol,
+				SUM(total_bytes) * $6 as total_octets,
+				SUM(total_packets) * $6 as total_packets,
+				COUNT(*) as flow_count
+			FROM flows_hourly
+			WHERE exporter = $1::inet
+			  AND (input = $2::int OR output = $2::int)
+			  AND bucket >= $3::timestamp
+			  AND bucket <= $4::timestamp
+			GROUP BY srcaddr, dstaddr, dstport, prot
+		),
+		totals AS (
+			SELECT SUM(total_octets) as grand_total_octets
+			FROM talker_stats
+		)
+		SELECT
+			ts.srcaddr,
+			ts.dstaddr,
+			ts.dstport,
+			COALESCE(p2.name, ts.dstport::text) as service_name,
+			ts.protocol,
+			COALESCE(p.name, 'Protocol-' || ts.protocol::text) as protocol_name,
+			ts.total_octets,
+			ts.total_packets,
+			ts.flow_count,
+			t.grand_total_octets
+		FROM talker_stats ts
+		CROSS JOIN totals t
+		LEFT JOIN ports p ON ts.protocol = p.protocol AND p.number IS NULL
+		LEFT JOIN ports p2 ON ts.dstport = p2.number AND ts.protocol = p2.protocol
+		ORDER BY ts.total_octets DESC
+		LIMIT $5
+	`
+
+	rows, err := s.db.Query(query, filter.Exporter, filter.Interface, toDBTime(filter.StartTime), toDBTime(filter.EndTime), filter.Limit, max(filter.SamplingRate, 1))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var talkers []TopTalkerWithPort
+	var grandTotalOctets int64
+
+	for rows.Next() {
+		var talker TopTalkerWithPort
+		var totalOctets, totalPackets, flowCount, grandTotal sql.NullInt64
+		var protocol, dstport sql.NullInt64
+		var serviceName sql.NullString
+
+		err := rows.Scan(
+			&talker.SrcAddr,
+			&talker.DstAddr,
+			&dstport,
+			&serviceName,
+			&protocol,
+			&talker.ProtocolName,
+			&totalOctets,
+			&totalPackets,
+			&flowCount,
+			&grandTotal,
+		)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+
+		if dstport.Valid {
+			talker.DstPort = int(dstport.Int64)
+		}
+		if serviceName.Valid {
+			talker.ServiceName = serviceName.String
+		}
+		if protocol.Valid {
+			talker.Protocol = int(protocol.Int64)
+		}
+		if totalOctets.Valid {
+			talker.TotalOctets = totalOctets.Int64
+		}
+		if totalPackets.Valid {
+			talker.TotalPackets = totalPackets.Int64
+		}
+		if flowCount.Valid {
+			talker.FlowCount = flowCount.Int64
+		}
+		if grandTotal.Valid {
+			grandTotalOctets = grandTotal.Int64
+			if grandTotalOctets > 0 {
+				talker.Percentage = float64(talker.TotalOctets) / float64(grandTotalOctets) * 100
+			}
+		}
+
+		talkers = append(talkers, talker)
+	}
+
+	return talkers, grandTotalOctets, nil
+}
+
+// hourlyConditions returns the WHERE clause shared by the flows_hourly
+// protocol queries
+func hourlyConditions(filter TrafficFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	argIndex := 1
+
+	if filter.Exporter != "" {
+		conditions = append(conditions, fmt.Sprintf("exporter = $%d::inet", argIndex))
+		args = append(args, filter.Exporter)
+		argIndex++
+	}
+
+	if filter.Interface != "" {
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.directionColumn(), argIndex))
+		args = append(args, filter.Interface)
+		argIndex++
+	}
+
+	if !filter.StartTime.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("bucket >= $%d", argIndex))
+		args = append(args, toDBTime(filter.StartTime))
+		argIndex++
+	}
+
+	if !filter.EndTime.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("bucket <= $%d", argIndex))
+		args = append(args, toDBTime(filter.EndTime))
+		argIndex++
+	}
+
+	matchConds, matchArgs := filter.matchConditions(argIndex)
+	conditions = append(conditions, matchConds...)
+	args = append(args, matchArgs...)
+
+	whereClause := ""
+	if len(conditions) > 0 {
+		whereClause = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	return whereClause, args
+}
+
+func (s *pgStore) ProtocolStats(filter TrafficFilter) ([]ProtocolStats, error) {
+	whereClause, args := hourlyConditions(filter)
+
+	query := fmt.Sprintf(`
+		SELECT
+			prot as protocol,
+			%s as total_octets,
+			%s as total_packets,
+			COUNT(*) as flow_count
+		FROM flows_hourly
+		%s
+		GROUP BY prot
+		ORDER BY total_octets DESC
+	`, filter.sampledSum("total_bytes"), filter.sampledSum("total_packets"), whereClause)
+
+	log.Println("Protocol stats query:", query)
+	log.Println("Args:", args)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []ProtocolStats
+	for rows.Next() {
+		var stat ProtocolStats
+		var protocol sql.NullInt64
+
+		err := rows.Scan(
+			&protocol,
+			&stat.TotalOctets,
+			&stat.TotalPackets,
+			&stat.FlowCount,
+		)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+
+		if protocol.Valid {
+			stat.Protocol = int(protocol.Int64)
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+func (s *pgStore) ProtocolPortStats(filter TrafficFilter, limit int) ([]ProtocolPortStats, error) {
+	whereClause, args := hourlyConditions(filter)
+
+	query := fmt.Sprintf(`
+		SELECT
+			prot as protocol,
+			srcport,
+			dstport,
+			%s as total_octets,
+			%s as total_packets,
+			COUNT(*) as flow_count
+		FROM flows_hourly
+		%s
+		GROUP BY prot, srcport, dstport
+		ORDER BY total_octets DESC
+		LIMIT %d
+	`, filter.sampledSum("total_bytes"), filter.sampledSum("total_packets"), whereClause, limit)
+
+	log.Println("Protocol port stats query:", query)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []ProtocolPortStats
+	for rows.Next() {
+		var stat ProtocolPortStats
+		var protocol, srcPort, dstPort sql.NullInt64
+
+		err := rows.Scan(
+			&protocol,
+			&srcPort,
+			&dstPort,
+			&stat.TotalOctets,
+			&stat.TotalPackets,
+			&stat.FlowCount,
+		)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+
+		stat.Protocol = int(protocol.Int64)
+		stat.SrcPort = int(srcPort.Int64)
+		stat.DstPort = int(dstPort.Int64)
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+func (s *pgStore) ProtocolTimeSeries(filter TrafficFilter) ([]ProtocolTimeSeriesPoint, error) {
+	whereClause, args := hourlyConditions(filter)
+
+	query := fmt.Sprintf(`
+		SELECT
+			bucket,
+			prot,
+			%s as total_octets
+		FROM flows_hourly
+		%s
+		GROUP BY bucket, prot
+		ORDER BY bucket ASC, prot ASC
+	`, filter.sampledSum("total_bytes"), whereClause)
+
+	log.Println("Protocol time series query:", query)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	// Rows arrive ordered by bucket, so points are appended in order
+	var timeSeries []ProtocolTimeSeriesPoint
+	for rows.Next() {
+		var timestamp time.Time
+		var protocol sql.NullInt64
+		var octets int64
+
+		err := rows.Scan(&timestamp, &protocol, &octets)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+
+		if !protocol.Valid {
+			continue
+		}
+		timestamp = fromDBTime(timestamp)
+
+		if n := len(timeSeries); n == 0 || !timeSeries[n-1].Timestamp.Equal(timestamp) {
+			timeSeries = append(timeSeries, ProtocolTimeSeriesPoint{
+				Timestamp:    timestamp,
+				ProtocolData: make(map[int]int64),
+			})
+		}
+		timeSeries[len(timeSeries)-1].ProtocolData[int(protocol.Int64)] = octets
+	}
+
+	return timeSeries, nil
+}
+
+func (s *pgStore) IPProtocolStats(filter TrafficFilter) ([]IPProtocolStats, int64, int64, error) {
+	// Build query to aggregate by IP address and protocol
+	// Use CASE to map known protocols from ports table, aggregate others as "Other"
+	matchConds, matchArgs := filter.matchConditions(7)
+	extraWhere := ""
+	if len(matchConds) > 0 {
+		extraWhere = "AND " + strings.Join(matchConds, " AND ")
+	}
+
+	query := fmt.Sprintf(`
+		WITH protocol_mapping AS (
+			SELECT DISTINCT protocol, name FROM ports
+		),
+		flow_data AS (
+			SELECT
+				CASE
+					WHEN $4 = 'input' THEN dstaddr
+					ELSE srcaddr
+				END as ip_address,
+				prot as protocol,
+				total_bytes * $6 as total_octets,
+				total_packets * $6 as total_packets
+			FROM flows_hourly
+			WHERE exporter = $1::inet
+			  AND (input = $2::int OR output = $2::int)
+			  AND bucket >= $3::timestamp
+			  AND bucket <= $5::timestamp
+			  %s
+		)
+		SELECT
+			fd.ip_address,
+			fd.protocol,
+			COALESCE(pm.name, 'Protocol-' || fd.protocol::text) as protocol_name,
+			SUM(fd.total_octets) as total_octets,
+			SUM(fd.total_packets) as total_packets,
+			COUNT(*) as flow_count,
+			SUM(SUM(fd.total_octets)) OVER () as grand_total_octets,
+			SUM(SUM(fd.total_packets)) OVER () as grand_total_packets
+		FROM flow_data fd
+		LEFT JOIN protocol_mapping pm ON fd.protocol = pm.protocol
+		GROUP BY fd.ip_address, fd.protocol, pm.name
+		ORDER BY total_octets DESC
+		LIMIT 100
+	`, extraWhere)
+
+	args := append([]interface{}{
+		filter.Exporter,
+		filter.Interface,
+		toDBTime(filter.StartTime),
+		filter.Direction,
+		toDBTime(filter.EndTime),
+		max(filter.SamplingRate, 1),
+	}, matchArgs...)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	var stats []IPProtocolStats
+	var grandTotalOctets, grandTotalPackets int64
+
+	for rows.Next() {
+		var stat IPProtocolStats
+		var totalOctets, totalPackets sql.NullInt64
+
+		err := rows.Scan(
+			&stat.IPAddress,
+			&stat.Protocol,
+			&stat.ProtocolName,
+			&totalOctets,
+			&totalPackets,
+			&stat.FlowCount,
+			&grandTotalOctets,
+			&grandTotalPackets,
+		)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+
+		if totalOctets.Valid {
+			stat.TotalOctets = totalOctets.Int64
+		}
+		if totalPackets.Valid {
+			stat.TotalPackets = totalPackets.Int64
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, grandTotalOctets, grandTotalPackets, nil
+}
+
+func (s *pgStore) IPProtocolPortStats(filter TrafficFilter) ([]IPProtocolPortStats, error) {
+	// Query to get IP + Protocol + Port with service names from services table
+	matchConds, matchArgs := filter.matchConditions(7)
+	extraWhere := ""
+	if len(matchConds) > 0 {
+		extraWhere = "AND " + strings.Join(matchConds, " AND ")
+	}
+
+	query := fmt.Sprintf(`
+		WITH flow_data AS (
+			SELECT
+				CASE
+					WHEN $4 = 'input' THEN dstaddr
+					ELSE srcaddr
+				END as ip_address,
+				prot as protocol,
+				COALESCE(dstport, srcport, 0) as port,
+				total_octets * $6 as total_octets,
+				total_packets * $6 as total_packets
+			FROM flows_agg_5min
+			WHERE exporter = $1::inet
+			  AND (input = $2::int OR output = $2::int)
+			  AND bucket_5min >= $3::timestamp
+			  AND bucket_5min <= $5::timestamp
+			  %s
+		)
+		SELECT
+			fd.ip_address,
+			fd.protocol,
+			COALESCE(p.name, 'Protocol-' || fd.protocol::text) as protocol_name,
+			fd.port,
+			COALESCE(p2.name, 'Port-' || fd.port::text) as service_name,
+			SUM(fd.total_octets) as total_octets,
+			SUM(fd.total_packets) as total_packets,
+			COUNT(*) as flow_count
+		FROM flow_data fd
+		LEFT JOIN ports p ON fd.protocol = p.protocol AND p.number IS NULL
+		LEFT JOIN ports p2 ON fd.port = p2.number AND fd.protocol = p2.protocol
+		GROUP BY fd.ip_address, fd.protocol, p.name, fd.port, p2.name
+		ORDER BY total_octets DESC
+		LIMIT 100
+	`, extraWhere)
+
+	args := append([]interface{}{
+		filter.Exporter,
+		filter.Interface,
+		toDBTime(filter.StartTime),
+		filter.Direction,
+		toDBTime(filter.EndTime),
+		max(filter.SamplingRate, 1),
+	}, matchArgs...)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []IPProtocolPortStats
+
+	for rows.Next() {
+		var stat IPProtocolPortStats
+		var totalOctets, totalPackets sql.NullInt64
+
+		err := rows.Scan(
+			&stat.IPAddress,
+			&stat.Protocol,
+			&stat.ProtocolName,
+			&stat.Port,
+			&stat.ServiceName,
+			&totalOctets,
+			&totalPackets,
+			&stat.FlowCount,
+		)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+
+		if totalOctets.Valid {
+			stat.TotalOctets = totalOctets.Int64
+		}
+		if totalPackets.Valid {
+			stat.TotalPackets = totalPackets.Int64
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+func (s *pgStore) HourlyFlows(filter TrafficFilter) ([]FlowData, error) {
+	rows, err := s.db.Query("select bucket as bucket, exporter, srcaddr, dstaddr, srcport, dstport, src_as, dst_as, total_packets, total_bytes as total_octets, input, output from flows_hourly where exporter=$1 and "+
+		filter.directionColumn()+
+		" = $2 and bucket >= $3 and bucket <= $4 ",
+		filter.Exporter, filter.Interface, toDBTime(filter.StartTime), toDBTime(filter.EndTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flows []FlowData
+	var sqltimestamp sql.NullTime
+	var sqlexporter sql.NullString
+	var sqlsrcaddr sql.NullString
+	var sqldstaddr sql.NullString
+	var sqlsrcport sql.NullInt64
+	var sqldstport sql.NullInt64
+	var sqlsrcas sql.NullInt64
+	var sqldstas sql.NullInt64
+	var sqlinput sql.NullInt64
+	var sqloutput sql.NullInt64
+	var sqloctets sql.NullInt64
+	var sqlpackets sql.NullInt64
+	samplingRate := max(filter.SamplingRate, 1)
+	for rows.Next() {
+		var flow FlowData
+		err := rows.Scan(&sqltimestamp, &sqlexporter, &sqlsrcaddr, &sqldstaddr, &sqlsrcport, &sqldstport, &sqlsrcas, &sqldstas, &sqlpackets, &sqloctets, &sqlinput, &sqloutput)
+		if err != nil {
+			return nil, err
+		}
+		flow.Timestamp = fromDBTime(sqltimestamp.Time)
+		flow.SrcAddr = sqlsrcaddr.String
+		flow.DstAddr = sqldstaddr.String
+		flow.SrcPort = sqlsrcport.Int64
+		flow.DstPort = sqldstport.Int64
+		flow.SrcAs = sqlsrcas.Int64
+		flow.DstAs = sqldstas.Int64
+		flow.Input = sqlinput.Int64
+		flow.Output = sqloutput.Int64
+		flow.TotalPackets = sqlpackets.Int64 * samplingRate
+		flow.TotalOctets = sqloctets.Int64 * samplingRate
+		flows = append(flows, flow)
+	}
+	return flows, rows.Err()
+}
+
+func (s *pgStore) Ports() ([]Service, error) {
+	rows, err := s.db.Query("select number,protocol,name,description from ports; ")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	services := []Service{}
+	for rows.Next() {
+		var service Service
+
+		var portsql sql.NullInt64
+		var protocolsql sql.NullInt64
+		var namesql sql.NullString
+		var descriptionsql sql.NullString
+		err := rows.Scan(
+			&portsql,
+			&protocolsql,
+			&namesql,
+			&descriptionsql,
+		)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		service.Port = int(portsql.Int64)
+		service.Protocol = int(protocolsql.Int64)
+		service.Name = namesql.String
+		service.Description = descriptionsql.String
+		services = append(services, service)
+	}
+	return services, rows.Err()
+}
+
+func (s *pgStore) DestinationStats(filter TrafficFilter) ([]DestinationStats, error) {
+	rate := max(filter.SamplingRate, 1)
+	// One filtered sum per amplification port, read back in the same order
+	var ampColumns strings.Builder
+	for _, amp := range amplificationPorts {
+		fmt.Fprintf(&ampColumns, ",\n\t\t\tCOALESCE(SUM(dpkts) FILTER (WHERE prot = 17 AND srcport = %d), 0) * $4", amp.Port)
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			host(dstaddr),
+			SUM(dpkts) * $4 as total_packets,
+			SUM(doctets) * $4 as total_octets,
+			COUNT(*) as flow_count,
+			COUNT(DISTINCT srcaddr) as sources,
+			COALESCE(SUM(dpkts) FILTER (WHERE prot = 6 AND (tcp_flags::int & 18) = 2), 0) * $4%s
+		FROM flows
+		WHERE exporter = $1::inet
+		  AND last >= $2::timestamp
+		  AND last <= $3::timestamp
+		GROUP BY dstaddr
+		HAVING SUM(dpkts) * $4 >= $5
+		ORDER BY total_packets DESC
+		LIMIT 1000
+	`, ampColumns.String())
+
+	rows, err := s.db.Query(query, filter.Exporter, toDBTime(filter.StartTime), toDBTime(filter.EndTime), rate, filter.MinPackets)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []DestinationStats
+	for rows.Next() {
+		var stat DestinationStats
+		amplification := make([]int64, len(amplificationPorts))
+		dest := []interface{}{&stat.Address, &stat.Packets, &stat.Octets, &stat.Flows, &stat.Sources, &stat.SynPackets}
+		for i := range amplification {
+			dest = append(dest, &amplification[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		stat.Amplification = make(map[int64]int64)
+		for i, amp := range amplificationPorts {
+			if amplification[i] > 0 {
+				stat.Amplification[amp.Port] = amplification[i]
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+func (s *pgStore) TopSources(filter TrafficFilter) ([]TrafficAggregated, error) {
+	matchConds, matchArgs := filter.matchConditions(6)
+	extraWhere := ""
+	if len(matchConds) > 0 {
+		extraWhere = "AND " + strings.Join(matchConds, " AND ")
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			host(srcaddr),
+			SUM(doctets) * $4 as total_octets,
+			SUM(dpkts) * $4 as total_packets,
+			COUNT(*) as flow_count
+		FROM flows
+		WHERE exporter = $1::inet
+		  AND last >= $2::timestamp
+		  AND last <= $3::timestamp
+		  %s
+		GROUP BY srcaddr
+		ORDER BY total_packets DESC
+		LIMIT $5
+	`, extraWhere)
+
+	args := append([]interface{}{
+		filter.Exporter,
+		toDBTime(filter.StartTime),
+		toDBTime(filter.EndTime),
+		max(filter.SamplingRate, 1),
+		filter.Limit,
+	}, matchArgs...)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []TrafficAggregated{}
+	for rows.Next() {
+		var record TrafficAggregated
+		if err := rows.Scan(&record.Address, &record.TotalOctets, &record.TotalPackets, &record.FlowCount); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *pgStore) ScanStats(filter TrafficFilter, kind string, threshold int64) ([]ScanCandidate, error) {
+	group, distinct := "dstport", "dstaddr"
+	if kind == scanVertical {
+		group, distinct = "host(dstaddr)", "dstport"
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			host(srcaddr),
+			%s,
+			COUNT(DISTINCT %s) as distinct_count,
+			COUNT(*) as flow_count,
+			SUM(dpkts) as total_packets,
+			MIN(first),
+			MAX(last)
+		FROM flows
+		WHERE last >= $1::timestamp
+		  AND last <= $2::timestamp
+		  AND prot = 6
+		  AND (tcp_flags::int & 16) = 0
+		GROUP BY srcaddr, %s
+		HAVING COUNT(DISTINCT %s) >= $3
+		ORDER BY distinct_count DESC
+		LIMIT 1000
+	`, group, distinct, group, distinct)
+
+	rows, err := s.db.Query(query, toDBTime(filter.StartTime), toDBTime(filter.EndTime), threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []ScanCandidate
+	for rows.Next() {
+		candidate := ScanCandidate{Kind: kind}
+		var key interface{} = &candidate.Port
+		if kind == scanVertical {
+			key = &candidate.Target
+		}
+		err := rows.Scan(&candidate.Source, key, &candidate.Distinct, &candidate.Flows,
+			&candidate.Packets, &candidate.FirstSeen, &candidate.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		candidate.FirstSeen = fromDBTime(candidate.FirstSeen)
+		candidate.LastSeen = fromDBTime(candidate.LastSeen)
+		candidates = append(candidates, candidate)
+	}
+	return candidates, rows.Err()
+}
+
+// flowInsertColumns lists the flows columns filled by the built-in collector,
+// in the same order as flowInsertValues returns them.
+var flowInsertColumns = []string{
+	"exporter", "srcaddr", "dstaddr", "input", "output", "dpkts", "doctets",
+	"srcport", "dstport", "tcp_flags", "prot", "tos", "src_as", "dst_as",
+	"src_mask", "dst_mask", "ip_version", "first", "last",
+}
+
+func (s *pgStore) PortTimeSeries(filter TrafficFilter) ([]PortTimeSeriesPoint, error) {
+	whereClause, args := hourlyConditions(filter)
+
+	query := fmt.Sprintf(`
+		SELECT bucket, prot, srcport, dstport, %s as total_bytes
+		FROM flows_hourly
+		%s
+		GROUP BY bucket, prot, srcport, dstport
+		ORDER BY bucket ASC
+	`, filter.sampledSum("total_bytes"), whereClause)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []PortTimeSeriesPoint
+	for rows.Next() {
+		var (
+			bucket     sql.NullTime
+			prot       sql.NullInt64
+			srcport    sql.NullInt64
+			dstport    sql.NullInt64
+			totalBytes sql.NullInt64
+		)
+		if err := rows.Scan(&bucket, &prot, &srcport, &dstport, &totalBytes); err != nil {
+			return nil, err
+		}
+		point := PortTimeSeriesPoint{TotalBytes: totalBytes.Int64}
+		if bucket.Valid {
+			point.Bucket = fromDBTime(bucket.Time)
+		}
+		if prot.Valid {
+			point.Prot = &prot.Int64
+		}
+		if srcport.Valid {
+			point.SrcPort = &srcport.Int64
+		}
+		if dstport.Valid {
+			point.DstPort = &dstport.Int64
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+func (s *pgStore) FlowExporters() ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT exporter::text FROM flows_hourly ORDER BY exporter::text")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exporters []string
+	for rows.Next() {
+		var exp sql.NullString
+		if err := rows.Scan(&exp); err != nil {
+			log.Println(err)
+			continue
+		}
+		if exp.Valid {
+			exporters = append(exporters, exp.String)
+		}
+	}
+	return exporters, rows.Err()
+}
+
+func (s *pgStore) FlowInterfaces(exporter string) ([]int64, error) {
+	query := `
+		SELECT DISTINCT input as ifindex
+		FROM flows_hourly
+		WHERE exporter = $1::inet AND input IS NOT NULL
+		UNION
+		SELECT DISTINCT output as ifindex
+		FROM flows_hourly
+		WHERE exporter = $1::inet AND output IS NOT NULL
+		ORDER BY ifindex`
+
+	rows, err := s.db.Query(query, exporter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var indices []int64
+	for rows.Next() {
+		var idx sql.NullInt64
+		if err := rows.Scan(&idx); err != nil {
+			log.Println(err)
+			continue
+		}
+		if idx.Valid {
+			indices = append(indices, idx.Int64)
+		}
+	}
+	return indices, rows.Err()
+}
+
+func (s *pgStore) ServiceNetworks() ([]ServiceNetwork, error) {
+	rows, err := s.db.Query("select addr, name from services; ")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ServiceNetwork{}
+	for rows.Next() {
+		var cidr sql.NullString
+		var name sql.NullString
+		if err := rows.Scan(&cidr, &name); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		entries = append(entries, ServiceNetwork{CIDR: cidr.String, Name: name.String})
+	}
+	return entries, rows.Err()
+}
+
+func (s *pgStore) QueryFlows(req QueryRequest) ([]map[string]interface{}, error) {
+	query, args, columns, err := buildQuerySQL(req)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Query language SQL:", query)
+	log.Println("Args:", args)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []map[string]interface{}{}
+	for rows.Next() {
+		holders := make([]interface{}, len(columns))
+		for i, col := range columns {
+			switch col.Kind {
+			case "int":
+				holders[i] = new(sql.NullInt64)
+			case "time":
+				holders[i] = new(sql.NullTime)
+			default:
+				holders[i] = new(sql.NullString)
+			}
+		}
+		if err := rows.Scan(holders...); err != nil {
+			log.Printf("Scan error: %v", err)
+			continue
+		}
+		record := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			switch v := holders[i].(type) {
+			case *sql.NullInt64:
+				if v.Valid {
+					record[col.Name] = v.Int64
+				} else {
+					record[col.Name] = nil
+				}
+			case *sql.NullTime:
+				if v.Valid {
+					record[col.Name] = fromDBTime(v.Time)
+				} else {
+					record[col.Name] = nil
+				}
+			case *sql.NullString:
+				if v.Valid {
+					record[col.Name] = v.String
+				} else {
+					record[col.Name] = nil
+				}
+			}
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// flowInsertValues returns the values for flowInsertColumns
+func flowInsertValues(flow FlowDB) []interface{} {
+	return []interface{}{
+		flow.Exporter, flow.SrcAddr, flow.DstAddr, flow.Input, flow.Output,
+		flow.DPkts, flow.DOctets, flow.SrcPort, flow.DstPort, flow.TCPFlags,
+		flow.Protocol, flow.TOS, flow.SrcAS, flow.DstAS, flow.SrcMask,
+		flow.DstMask, flow.IPVersion, toDBTime(flow.First), toDBTime(flow.Last),
+	}
+}
+
+// buildFlowInsert builds a multi-row parameterized INSERT for the given flows
+func buildFlowInsert(flows []FlowDB) (string, []interface{}) {
+	args := make([]interface{}, 0, len(flows)*len(flowInsertColumns))
+	rows := make([]string, 0, len(flows))
+	argIndex := 1
+	for _, flow := range flows {
+		placeholders := make([]string, len(flowInsertColumns))
+		for i := range flowInsertColumns {
+			placeholders[i] = fmt.Sprintf("$%d", argIndex)
+			argIndex++
+		}
+		// exporter, srcaddr and dstaddr are inet columns
+		for i := 0; i < 3; i++ {
+			placeholders[i] += "::inet"
+		}
+		rows = append(rows, "("+strings.Join(placeholders, ", ")+")")
+		args = append(args, flowInsertValues(flow)...)
+	}
+	query := fmt.Sprintf("INSERT INTO flows (%s) VALUES %s",
+		strings.Join(flowInsertColumns, ", "), strings.Join(rows, ",\n"))
+	return query, args
+}
+
+// InsertFlows writes a batch of flows in a single statement
+func (s *pgStore) InsertFlows(flows []FlowDB) error {
+	query, args := buildFlowInsert(flows)
+	_, err := s.db.Exec(query, args...)
+	return err
+}
+
+func (s *pgStore) InterfaceMetrics(exporter string, iface string, start time.Time, end time.Time) ([]Metric, error) {
+	rows, err := s.db.Query("select inserted_at,octets_in,octets_out,uptime from interface_metrics where exporter = $1 and snmp_index = $2 and (inserted_at >= $3 and inserted_at <= $4 )", exporter, iface, toDBTime(start), toDBTime(end))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metrics []Metric
+	for rows.Next() {
+		var metric Metric
+		var ts sql.NullTime
+		var octets_in sql.NullInt64
+		var octets_out sql.NullInt64
+		var uptime sql.NullInt64
+		err := rows.Scan(
+			&ts,
+			&octets_in,
+			&octets_out,
+			&uptime)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		if ts.Valid {
+			metric.Timestamp = fromDBTime(ts.Time)
+		}
+		if octets_out.Valid {
+			metric.OctetsOut = octets_out.Int64
+		}
+		if octets_in.Valid {
+			metric.OctetsIn = octets_in.Int64
+		}
+		if uptime.Valid {
+			metric.Uptime = uptime.Int64
+		}
+		metrics = append(metrics, metric)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Timestamp.Before(metrics[j].Timestamp)
+	})
+
+	return metrics, rows.Err()
+}
+
+func (s *pgStore) ExporterConfigs() ([]ExporterConfig, error) {
+	query := `
+		SELECT
+			id, ip_inet, name, snmp_version,
+			COALESCE(snmp_community, '') <> '',
+			snmpv3_username, snmpv3_level, snmpv3_auth_proto,
+			COALESCE(snmpv3_auth_pass, '') <> '',
+			snmpv3_priv_proto,
+			COALESCE(snmpv3_priv_pass, '') <> '',
+			data
+		FROM exporters
+		ORDER BY id
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exporters []ExporterConfig
+	for rows.Next() {
+		var exp ExporterConfig
+		var dataJSON []byte
+		err := rows.Scan(
+			&exp.ID,
+			&exp.IPInet,
+			&exp.Name,
+			&exp.SnmpVersion,
+			&exp.SnmpCommunitySet,
+			&exp.Snmpv3Username,
+			&exp.Snmpv3Level,
+			&exp.Snmpv3AuthProto,
+			&exp.Snmpv3AuthPassSet,
+			&exp.Snmpv3PrivProto,
+			&exp.Snmpv3PrivPassSet,
+			&dataJSON,
+		)
+		if err != nil {
+			log.Printf("Error scanning exporter: %v", err)
+			continue
+		}
+
+		// Parse JSON data
+		if len(dataJSON) > 0 {
+			json.Unmarshal(dataJSON, &exp.Data)
+		}
+		exporters = append(exporters, exp)
+	}
+	return exporters, rows.Err()
+}
+
+func (s *pgStore) ExporterSecrets(id uint64) ([]string, error) {
+	secrets := make([]string, 3)
+	err := s.db.QueryRow(`
+		SELECT COALESCE(snmp_community, ''), COALESCE(snmpv3_auth_pass, ''), COALESCE(snmpv3_priv_pass, '')
+		FROM exporters WHERE id = $1
+	`, id).Scan(&secrets[0], &secrets[1], &secrets[2])
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return secrets, err
+}
+
+func (s *pgStore) ExporterData(addr string) (map[string]interface{}, error) {
+	var dataJSON []byte
+	err := s.db.QueryRow("SELECT data FROM exporters WHERE ip_inet = $1::inet LIMIT 1", addr).Scan(&dataJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil || len(dataJSON) == 0 {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(dataJSON, &data); err != nil {
+		return nil, fmt.Errorf("invalid data JSON: %w", err)
+	}
+	return data, nil
+}
+
+func (s *pgStore) UpdateExporter(exporter ExporterConfig) error {
+	dataJSON, err := json.Marshal(exporter.Data)
+	if err != nil {
+		return err
+	}
+	for _, secret := range []struct {
+		field string
+		value *string
+	}{
+		{"snmp_community", &exporter.SnmpCommunity},
+		{"snmpv3_auth_pass", &exporter.Snmpv3AuthPass},
+		{"snmpv3_priv_pass", &exporter.Snmpv3PrivPass},
+	} {
+		if *secret.value, err = secretKeys.Seal(secret.field, exporter.ID, *secret.value); err != nil {
+			return fmt.Errorf("encrypting %s: %w", secret.field, err)
+		}
+	}
+
+	query := `
+		UPDATE exporters
+		SET name = $1,
+		    snmp_version = $2,
+		    snmp_community = COALESCE(NULLIF($3::text, ''), snmp_community),
+		    snmpv3_username = $4,
+		    snmpv3_level = $5,
+		    snmpv3_auth_proto = $6,
+		    snmpv3_auth_pass = COALESCE(NULLIF($7::text, ''), snmpv3_auth_pass),
+		    snmpv3_priv_proto = $8,
+		    snmpv3_priv_pass = COALESCE(NULLIF($9::text, ''), snmpv3_priv_pass),
+		    data = $10
+		WHERE id = $11
+	`
+
+	_, err = s.db.Exec(query,
+		exporter.Name,
+		exporter.SnmpVersion,
+		exporter.SnmpCommunity,
+		exporter.Snmpv3Username,
+		exporter.Snmpv3Level,
+		exporter.Snmpv3AuthProto,
+		exporter.Snmpv3AuthPass,
+		exporter.Snmpv3PrivProto,
+		exporter.Snmpv3PrivPass,
+		dataJSON,
+		exporter.ID,
+	)
+	return err
+}
+
+func (s *pgStore) InterfaceConfigs(exporterID string) ([]InterfaceConfig, error) {
+	var rows *sql.Rows
+	var err error
+
+	if exporterID != "" {
+		query := `
+			SELECT id, exporter, snmp_index, name, description, alias, speed, enabled, bandwidth
+			FROM interfaces
+			WHERE exporter = $1
+			ORDER BY snmp_index
+		`
+		rows, err = s.db.Query(query, exporterID)
+	} else {
+		query := `
+			SELECT id, exporter, snmp_index, name, description, alias, speed, enabled, bandwidth
+			FROM interfaces
+			ORDER BY exporter, snmp_index
+		`
+		rows, err = s.db.Query(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var interfaces []InterfaceConfig
+	for rows.Next() {
+		var iface InterfaceConfig
+		err := rows.Scan(
+			&iface.ID,
+			&iface.Exporter,
+			&iface.SnmpIndex,
+			&iface.Name,
+			&iface.Description,
+			&iface.Alias,
+			&iface.Speed,
+			&iface.Enabled,
+			&iface.Bandwidth,
+		)
+		if err != nil {
+			log.Printf("Error scanning interface: %v", err)
+			continue
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, rows.Err()
+}
+
+func (s *pgStore) UpdateInterface(iface InterfaceConfig) error {
+	query := `
+		UPDATE interfaces
+		SET enabled = $1,
+		    alias = $2,
+		    bandwidth = $3
+		WHERE id = $4
+	`
+	_, err := s.db.Exec(query, iface.Enabled, iface.Alias, iface.Bandwidth, iface.ID)
+	return err
+}
+
+func (s *pgStore) SetInterfacesEnabled(exporterID int64, enabled bool) (int64, error) {
+	result, err := s.db.Exec(`UPDATE interfaces SET enabled = $1 WHERE exporter = $2`, enabled, exporterID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *pgStore) SyncInterfaces(exporterID int64, added []InterfaceConfig, changed []InterfaceConfig) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Renumbered interfaces may swap ifIndexes, so they are parked on a
+	// negative index first to keep (exporter, snmp_index) unique throughout
+	for _, iface := range changed {
+		_, err := tx.Exec(`UPDATE interfaces SET snmp_index = -id WHERE id = $1 AND exporter = $2`, iface.ID, exporterID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, iface := range changed {
+		_, err := tx.Exec(`
+			UPDATE interfaces
+			SET snmp_index = $1, name = $2, description = $3, alias = $4, speed = $5
+			WHERE id = $6 AND exporter = $7
+		`, iface.SnmpIndex, iface.Name, iface.Description, iface.Alias, iface.Speed, iface.ID, exporterID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, iface := range added {
+		_, err := tx.Exec(`
+			INSERT INTO interfaces (exporter, snmp_index, name, description, alias, speed, enabled, bandwidth)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, exporterID, iface.SnmpIndex, iface.Name, iface.Description, iface.Alias, iface.Speed, iface.Enabled, iface.Bandwidth)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *pgStore) PollTargets() ([]ExporterConfig, error) {
+	query := `
+		SELECT
+			id, ip_inet, name, snmp_version, COALESCE(snmp_community, ''),
+			COALESCE(snmpv3_username, ''), COALESCE(snmpv3_level, ''),
+			COALESCE(snmpv3_auth_proto, ''), COALESCE(snmpv3_auth_pass, ''),
+			COALESCE(snmpv3_priv_proto, ''), COALESCE(snmpv3_priv_pass, ''), data
+		FROM exporters
+		WHERE snmp_version IN (1, 2, 3)
+		ORDER BY id
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []ExporterConfig
+	for rows.Next() {
+		var exp ExporterConfig
+		var name sql.NullString
+		var dataJSON []byte
+		err := rows.Scan(
+			&exp.ID,
+			&exp.IPInet,
+			&name,
+			&exp.SnmpVersion,
+			&exp.SnmpCommunity,
+			&exp.Snmpv3Username,
+			&exp.Snmpv3Level,
+			&exp.Snmpv3AuthProto,
+			&exp.Snmpv3AuthPass,
+			&exp.Snmpv3PrivProto,
+			&exp.Snmpv3PrivPass,
+			&dataJSON,
+		)
+		if err != nil {
+			log.Printf("Error scanning exporter: %v", err)
+			continue
+		}
+		exp.Name = name.String
+		if err := openExporterSecrets(&exp); err != nil {
+			log.Printf("Error decrypting SNMP credentials of %s: %v", exp.IPInet, err)
+			continue
+		}
+		if len(dataJSON) > 0 {
+			json.Unmarshal(dataJSON, &exp.Data)
+		}
+		targets = append(targets, exp)
+	}
+	return targets, rows.Err()
+}
+
+func (s *pgStore) InsertInterfaceMetrics(exporterID uint64, at time.Time, samples []InterfaceSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString("INSERT INTO interface_metrics (inserted_at, exporter, snmp_index, octets_in, octets_out, oper_status, uptime) VALUES ")
+	args := make([]interface{}, 0, len(samples)*7)
+	for i, sample := range samples {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&sb, "($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7)
+		// bigint columns: HC counters above 2^63 wrap to negative values
+		args = append(args, toDBTime(at), exporterID, sample.SnmpIndex, int64(sample.OctetsIn), int64(sample.OctetsOut), sample.OperStatus, nullUptime(sample.Uptime))
+	}
+	_, err := s.db.Exec(sb.String(), args...)
+	return err
+}
+
+// nullUptime stores an unknown sysUpTime as NULL
+func nullUptime(uptime uint32) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(uptime), Valid: uptime > 0}
+}
+
+// RegisterExporter inserts an exporter row unless one already exists for the
+// address; ip_bin is only filled for IPv4
+func (s *pgStore) RegisterExporter(addr string) (bool, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false, fmt.Errorf("invalid exporter address %q", addr)
+	}
+	var ipBin sql.NullInt64
+	if ip4 := ip.To4(); ip4 != nil {
+		ipBin = sql.NullInt64{Int64: int64(binary.BigEndian.Uint32(ip4)), Valid: true}
+	}
+	result, err := s.db.Exec(`
+		INSERT INTO exporters (ip_bin, ip_inet, name)
+		SELECT $1, $2::inet, $3
+		WHERE NOT EXISTS (SELECT 1 FROM exporters WHERE ip_inet = $2::inet)
+	`, ipBin, addr, addr)
+	if err != nil {
+		return false, err
+	}
+	added, _ := result.RowsAffected()
+	return added > 0, nil
+}
+
+const alertRuleColumns = `id, name, kind, enabled, exporter, interface, direction, host, protocol,
+	threshold, clear_threshold, window_minutes, for_count, created_at`
+
+func (s *pgStore) AlertRules() ([]AlertRule, error) {
+	rows, err := s.db.Query(`SELECT ` + alertRuleColumns + ` FROM alert_rules ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AlertRule
+	for rows.Next() {
+		var rule AlertRule
+		err := rows.Scan(
+			&rule.ID,
+			&rule.Name,
+			&rule.Kind,
+			&rule.Enabled,
+			&rule.Exporter,
+			&rule.Interface,
+			&rule.Direction,
+			&rule.Host,
+			&rule.Protocol,
+			&rule.Threshold,
+			&rule.ClearThreshold,
+			&rule.Window,
+			&rule.For,
+			&rule.CreatedAt,
+		)
+		if err != nil {
+			log.Printf("Error scanning alert rule: %v", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *pgStore) CreateAlertRule(rule AlertRule) (AlertRule, error) {
+	err := s.db.QueryRow(`
+		INSERT INTO alert_rules (name, kind, enabled, exporter, interface, direction, host, protocol,
+			threshold, clear_threshold, window_minutes, for_count)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id, created_at
+	`, rule.Name, rule.Kind, rule.Enabled, rule.Exporter, rule.Interface, rule.Direction, rule.Host, rule.Protocol,
+		rule.Threshold, rule.ClearThreshold, rule.Window, rule.For).Scan(&rule.ID, &rule.CreatedAt)
+	return rule, err
+}
+
+func (s *pgStore) UpdateAlertRule(rule AlertRule) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE alert_rules
+		SET name = $1, kind = $2, enabled = $3, exporter = $4, interface = $5, direction = $6, host = $7,
+		    protocol = $8, threshold = $9, clear_threshold = $10, window_minutes = $11, for_count = $12
+		WHERE id = $13
+	`, rule.Name, rule.Kind, rule.Enabled, rule.Exporter, rule.Interface, rule.Direction, rule.Host,
+		rule.Protocol, rule.Threshold, rule.ClearThreshold, rule.Window, rule.For, rule.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *pgStore) DeleteAlertRule(id int64) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM alert_rules WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *pgStore) InsertAlertEvent(event AlertEvent) error {
+	_, err := s.db.Exec(`
+		INSERT INTO alert_events (rule_id, rule_name, subject, state, value, threshold, message, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, event.RuleID, event.RuleName, event.Subject, event.State, event.Value, event.Threshold, event.Message, event.CreatedAt)
+	return err
+}
+
+func scanAlertEvents(rows *sql.Rows) ([]AlertEvent, error) {
+	defer rows.Close()
+	var events []AlertEvent
+	for rows.Next() {
+		var event AlertEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.RuleID,
+			&event.RuleName,
+			&event.Subject,
+			&event.State,
+			&event.Value,
+			&event.Threshold,
+			&event.Message,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			log.Printf("Error scanning alert event: %v", err)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *pgStore) AlertEvents(filter AlertEventFilter) ([]AlertEvent, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.RuleID != 0 {
+		args = append(args, filter.RuleID)
+		conditions = append(conditions, fmt.Sprintf("rule_id = $%d", len(args)))
+	}
+	if !filter.Start.IsZero() {
+		args = append(args, filter.Start)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !filter.End.IsZero() {
+		args = append(args, filter.End)
+		conditions = append(conditions, fmt.Sprintf("created_at <= $%d", len(args)))
+	}
+	whereClause := ""
+	if len(conditions) > 0 {
+		whereClause = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	limitClause := ""
+	if filter.Limit > 0 {
+		limitClause = fmt.Sprintf("LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT id, rule_id, rule_name, subject, state, value, threshold, message, created_at
+		FROM alert_events
+		%s
+		ORDER BY created_at DESC, id DESC
+		%s
+	`, whereClause, limitClause), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAlertEvents(rows)
+}
+
+func (s *pgStore) ActiveAlerts() ([]AlertEvent, error) {
+	rows, err := s.db.Query(`
+		SELECT id, rule_id, rule_name, subject, state, value, threshold, message, created_at
+		FROM (
+			SELECT DISTINCT ON (e.rule_id, e.subject) e.*
+			FROM alert_events e
+			JOIN alert_rules r ON r.id = e.rule_id AND r.enabled
+			ORDER BY e.rule_id, e.subject, e.created_at DESC, e.id DESC
+		) last
+		WHERE state = 'firing'
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanAlertEvents(rows)
+}
+
+func (s *pgStore) Users() ([]User, error) {
+	rows, err := s.db.Query(`SELECT id, username, password_hash, role, disabled, scope, created_at FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.Disabled, &user.Scope, &user.CreatedAt); err != nil {
+			log.Printf("Error scanning user: %v", err)
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *pgStore) UserByName(username string) (*User, error) {
+	var user User
+	err := s.db.QueryRow(`
+		SELECT id, username, password_hash, role, disabled, scope, created_at FROM users WHERE username = $1
+	`, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.Disabled, &user.Scope, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *pgStore) CreateUser(user User) (User, error) {
+	err := s.db.QueryRow(`
+		INSERT INTO users (username, password_hash, role, disabled, scope)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, user.Username, user.PasswordHash, user.Role, user.Disabled, user.Scope).Scan(&user.ID, &user.CreatedAt)
+	return user, err
+}
+
+func (s *pgStore) UpdateUser(user User) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE users
+		SET role = $1, disabled = $2, password_hash = COALESCE(NULLIF($3, ''), password_hash), scope = $4
+		WHERE id = $5
+	`, user.Role, user.Disabled, user.PasswordHash, user.Scope, user.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *pgStore) DeleteUser(id int64) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var username string
+	err = tx.QueryRow(`DELETE FROM users WHERE id = $1 RETURNING username`, id).Scan(&username)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM api_tokens WHERE owner = $1`, username); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+const apiTokenColumns = `id, name, role, owner, scope, token_hash, created_at, expires_at, last_used_at`
+
+func scanAPIToken(scanner interface{ Scan(...interface{}) error }) (APIToken, error) {
+	var token APIToken
+	var expires, lastUsed sql.NullTime
+	err := scanner.Scan(&token.ID, &token.Name, &token.Role, &token.Owner, &token.Scope, &token.Hash, &token.CreatedAt, &expires, &lastUsed)
+	if expires.Valid {
+		token.ExpiresAt = &expires.Time
+	}
+	if lastUsed.Valid {
+		token.LastUsed = &lastUsed.Time
+	}
+	return token, err
+}
+
+func (s *pgStore) APITokens() ([]APIToken, error) {
+	rows, err := s.db.Query(`SELECT ` + apiTokenColumns + ` FROM api_tokens ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			log.Printf("Error scanning API token: %v", err)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *pgStore) CreateAPIToken(token APIToken) (APIToken, error) {
+	err := s.db.QueryRow(`
+		INSERT INTO api_tokens (name, role, owner, scope, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, token.Name, token.Role, token.Owner, token.Scope, token.Hash, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	return token, err
+}
+
+func (s *pgStore) APITokenByHash(hash string) (*APIToken, error) {
+	token, err := scanAPIToken(s.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_hash = $1`, hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *pgStore) TouchAPIToken(id int64, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`, at, id)
+	return err
+}
+
+func (s *pgStore) DeleteAPIToken(id int64) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM api_tokens WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *pgStore) Scopes() ([]Scope, error) {
+	rows, err := s.db.Query(`SELECT id, name, exporters, created_at FROM scopes ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var scopes []Scope
+	for rows.Next() {
+		var scope Scope
+		var exporters []byte
+		if err := rows.Scan(&scope.ID, &scope.Name, &exporters, &scope.CreatedAt); err != nil {
+			log.Printf("Error scanning scope: %v", err)
+			continue
+		}
+		if err := json.Unmarshal(exporters, &scope.Exporters); err != nil {
+			log.Printf("Error decoding exporters of scope %s: %v", scope.Name, err)
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, rows.Err()
+}
+
+func (s *pgStore) CreateScope(scope Scope) (Scope, error) {
+	exporters, err := json.Marshal(scope.Exporters)
+	if err != nil {
+		return scope, err
+	}
+	err = s.db.QueryRow(`
+		INSERT INTO scopes (name, exporters) VALUES ($1, $2) RETURNING id, created_at
+	`, scope.Name, exporters).Scan(&scope.ID, &scope.CreatedAt)
+	return scope, err
+}
+
+func (s *pgStore) UpdateScope(scope Scope) (bool, error) {
+	exporters, err := json.Marshal(scope.Exporters)
+	if err != nil {
+		return false, err
+	}
+	result, err := s.db.Exec(`UPDATE scopes SET exporters = $1 WHERE id = $2`, exporters, scope.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *pgStore) DeleteScope(id int64) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM scopes WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *pgStore) InsertAuditEntry(entry AuditEntry) error {
+	_, err := s.db.Exec(`
+		INSERT INTO audit_log (actor, auth_method, remote_addr, forwarded_for, endpoint, target, before, after, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, entry.Actor, entry.AuthMethod, entry.RemoteAddr, entry.ForwardedFor, entry.Endpoint, entry.Target,
+		[]byte(entry.Before), []byte(entry.After), entry.CreatedAt)
+	return err
+}
+
+func (s *pgStore) AuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Actor != "" {
+		args = append(args, filter.Actor)
+		conditions = append(conditions, fmt.Sprintf("actor = $%d", len(args)))
+	}
+	if filter.Endpoint != "" {
+		args = append(args, "%"+filter.Endpoint+"%")
+		conditions = append(conditions, fmt.Sprintf("endpoint LIKE $%d", len(args)))
+	}
+	if filter.Target != "" {
+		args = append(args, filter.Target)
+		conditions = append(conditions, fmt.Sprintf("(target = $%d OR target LIKE $%d || ' %%')", len(args), len(args)))
+	}
+	if !filter.Start.IsZero() {
+		args = append(args, filter.Start)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !filter.End.IsZero() {
+		args = append(args, filter.End)
+		conditions = append(conditions, fmt.Sprintf("created_at <= $%d", len(args)))
+	}
+	whereClause := ""
+	if len(conditions) > 0 {
+		whereClause = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	limitClause := ""
+	if filter.Limit > 0 {
+		limitClause = fmt.Sprintf("LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT id, actor, auth_method, remote_addr, forwarded_for, endpoint, target, before, after, created_at
+		FROM audit_log
+		%s
+		ORDER BY created_at DESC, id DESC
+		%s
+	`, whereClause, limitClause), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after []byte
+		if err := rows.Scan(&entry.ID, &entry.Actor, &entry.AuthMethod, &entry.RemoteAddr, &entry.ForwardedFor,
+			&entry.Endpoint, &entry.Target, &before, &after, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entry.Before = before
+		entry.After = after
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// openExporterSecrets decrypts the SNMP credentials of an exporter in place
+func openExporterSecrets(exporter *ExporterConfig) error {
+	var err error
+	if exporter.SnmpCommunity, err = secretKeys.Open("snmp_community", exporter.ID, exporter.SnmpCommunity); err != nil {
+		return err
+	}
+	if exporter.Snmpv3AuthPass, err = secretKeys.Open("snmpv3_auth_pass", exporter.ID, exporter.Snmpv3AuthPass); err != nil {
+		return err
+	}
+	exporter.Snmpv3PrivPass, err = secretKeys.Open("snmpv3_priv_pass", exporter.ID, exporter.Snmpv3PrivPass)
+	return err
+}
+
+// serverTimezone returns the TimeZone setting of the database server, the
+// zone now() writes wall clock values in
+func (s *pgStore) serverTimezone() (string, error) {
+	var name string
+	err := s.db.QueryRow(`SHOW TimeZone`).Scan(&name)
+	return name, err
+}
+
+// resealSecrets encrypts SNMP credentials stored in plaintext and rewraps
+// those sealed with a key other than the primary one, after a key rotation.
+// It returns how many exporters were updated, and the errors of the
+// exporters that could not be.
+func (s *pgStore) resealSecrets() (int, error) {
+	if secretKeys == nil {
+		return 0, nil
+	}
+	rows, err := s.db.Query(`
+		SELECT id, COALESCE(snmp_community, ''), COALESCE(snmpv3_auth_pass, ''), COALESCE(snmpv3_priv_pass, '')
+		FROM exporters
+		ORDER BY id
+	`)
+	if err != nil {
+		return 0, err
+	}
+	type storedSecrets struct {
+		id        uint64
+		community string
+		authPass  string
+		privPass  string
+	}
+	var exporters []storedSecrets
+	for rows.Next() {
+		var e storedSecrets
+		if err := rows.Scan(&e.id, &e.community, &e.authPass, &e.privPass); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		exporters = append(exporters, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// An exporter that fails is left as it is and the others still updated
+	updated := 0
+	var errs []error
+	for _, e := range exporters {
+		community, c1, err1 := secretKeys.Reseal("snmp_community", e.id, e.community)
+		authPass, c2, err2 := secretKeys.Reseal("snmpv3_auth_pass", e.id, e.authPass)
+		privPass, c3, err3 := secretKeys.Reseal("snmpv3_priv_pass", e.id, e.privPass)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			log.Printf("Error encrypting the SNMP credentials of exporter %d: %v", e.id, err)
+			errs = append(errs, fmt.Errorf("exporter %d: %w", e.id, err))
+			continue
+		}
+		if !c1 && !c2 && !c3 {
+			continue
+		}
+		// Only rewrite values still as read, in case the UI changed them meanwhile
+		_, err := s.db.Exec(`
+			UPDATE exporters
+			SET snmp_community = $1, snmpv3_auth_pass = $2, snmpv3_priv_pass = $3
+			WHERE id = $4
+			  AND COALESCE(snmp_community, '') = $5
+			  AND COALESCE(snmpv3_auth_pass, '') = $6
+			  AND COALESCE(snmpv3_priv_pass, '') = $7
+		`, community, authPass, privPass, e.id, e.community, e.authPass, e.privPass)
+		if err != nil {
+			log.Printf("Error encrypting the SNMP credentials of exporter %d: %v", e.id, err)
+			errs = append(errs, fmt.Errorf("exporter %d: %w", e.id, err))
+			continue
+		}
+		updated++
+	}
+	return updated, errors.Join(errs...)
+}
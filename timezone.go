@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+	_ "time/tzdata" // the runtime image ships without a zoneinfo database
+)
+
+// The flow and metric tables store "timestamp without time zone" values
+// holding wall clock time of the database time zone, configured with DB_TZ
+// (falling back to TZ, then to the TimeZone setting of the database server,
+// then to UTC). Handlers work with instants only: request times are
+// converted with toDBTime before they reach SQL, scanned values with
+// fromDBTime before they are returned, and JSON responses carry RFC3339
+// timestamps with offsets.
+
+// dbLocation is the time zone of the wall clock values stored in the database
+var dbLocation = time.UTC
+
+// setDBTimezone selects the database time zone by IANA name. An empty name
+// selects UTC.
+func setDBTimezone(name string) error {
+	if name == "" {
+		dbLocation = time.UTC
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("invalid database time zone %q: %w", name, err)
+	}
+	dbLocation = loc
+	return nil
+}
+
+// toDBTime converts an instant to the database wall clock. The result is
+// tagged UTC so the driver sends the wall clock digits unchanged.
+func toDBTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	wall := t.In(dbLocation)
+	return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), time.UTC)
+}
+
+// fromDBTime interprets a scanned wall clock value in the database time zone.
+// Times inside a DST gap are moved forward by the gap; times repeated when
+// clocks go back resolve to one of the two instants.
+func fromDBTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	local := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), dbLocation)
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	if toDBTime(local).Before(wall) {
+		// time.Date read a gap time with the offset after the gap, which
+		// lands before it; the offset before the gap lands after it
+		_, offset := local.Zone()
+		return wall.Add(-time.Duration(offset) * time.Second).In(dbLocation)
+	}
+	return local
+}
+
+// parseRequestTime accepts RFC3339 timestamps or unix epoch seconds
+func parseRequestTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC3339 or epoch seconds", s)
+}
+
+// parseTimeRange reads the start and end parameters, defaulting to the span
+// before now
+func parseTimeRange(query url.Values, span time.Duration) (time.Time, time.Time, error) {
+	end := time.Now()
+	start := end.Add(-span)
+	if s := query.Get("start"); s != "" {
+		t, err := parseRequestTime(s)
+		if err != nil {
+			return start, end, fmt.Errorf("start: %w", err)
+		}
+		start = t
+	}
+	if s := query.Get("end"); s != "" {
+		t, err := parseRequestTime(s)
+		if err != nil {
+			return start, end, fmt.Errorf("end: %w", err)
+		}
+		end = t
+	}
+	return start, end, nil
+}
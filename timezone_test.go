@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// useDBTimezone sets DB_TZ for the duration of a test
+func useDBTimezone(t *testing.T, name string) *time.Location {
+	t.Helper()
+	if err := setDBTimezone(name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setDBTimezone("") })
+	return dbLocation
+}
+
+func wallClock(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05")
+}
+
+func TestSetDBTimezone(t *testing.T) {
+	useDBTimezone(t, "Europe/Berlin")
+	if err := setDBTimezone("Mars/Olympus_Mons"); err == nil || dbLocation.String() != "Europe/Berlin" {
+		t.Errorf("invalid zone: %v, location %s", err, dbLocation)
+	}
+	// Unset, the wall clock is UTC whatever the zone of the host
+	if err := setDBTimezone(""); err != nil || dbLocation != time.UTC {
+		t.Errorf("no zone: %v, location %s", err, dbLocation)
+	}
+	if got := toDBTime(time.Date(2025, 6, 1, 12, 0, 0, 0, time.FixedZone("UTC-3", -3*3600))); wallClock(got) != "2025-06-01 15:00:00" {
+		t.Errorf("wall clock without a zone = %s", wallClock(got))
+	}
+}
+
+func TestDBTimeSpringForward(t *testing.T) {
+	tests := []struct {
+		zone string
+		// The last instant before the clocks jump and the wall clock it has
+		before time.Time
+		wall   string
+		// A wall clock inside the gap and the instant it resolves to
+		gap  time.Time
+		want time.Time
+	}{
+		{
+			zone:   "America/New_York",
+			before: time.Date(2025, 3, 9, 6, 59, 0, 0, time.UTC),
+			wall:   "2025-03-09 01:59:00",
+			gap:    time.Date(2025, 3, 9, 2, 30, 0, 0, time.UTC),
+			want:   time.Date(2025, 3, 9, 7, 30, 0, 0, time.UTC), // 03:30 EDT
+		},
+		{
+			zone:   "Europe/Berlin",
+			before: time.Date(2025, 3, 30, 0, 59, 0, 0, time.UTC),
+			wall:   "2025-03-30 01:59:00",
+			gap:    time.Date(2025, 3, 30, 2, 30, 0, 0, time.UTC),
+			want:   time.Date(2025, 3, 30, 1, 30, 0, 0, time.UTC), // 03:30 CEST
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.zone, func(t *testing.T) {
+			useDBTimezone(t, tt.zone)
+			if got := wallClock(toDBTime(tt.before)); got != tt.wall {
+				t.Errorf("toDBTime(%v) = %s, want %s", tt.before, got, tt.wall)
+			}
+			// One minute later the clocks have jumped over the gap
+			next := toDBTime(tt.before.Add(time.Minute))
+			if next.Sub(toDBTime(tt.before)) != time.Hour+time.Minute {
+				t.Errorf("toDBTime across the gap = %s, want a one hour jump", wallClock(next))
+			}
+			// A wall clock that never existed moves forward by the gap
+			if got := fromDBTime(tt.gap); !got.Equal(tt.want) {
+				t.Errorf("fromDBTime(%s) = %v, want %v", wallClock(tt.gap), got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDBTimeFallBack(t *testing.T) {
+	tests := []struct {
+		zone string
+		// The two instants sharing the repeated wall clock
+		first  time.Time
+		second time.Time
+		wall   string
+	}{
+		{
+			zone:   "America/New_York",
+			first:  time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC), // 01:30 EDT
+			second: time.Date(2025, 11, 2, 6, 30, 0, 0, time.UTC), // 01:30 EST
+			wall:   "2025-11-02 01:30:00",
+		},
+		{
+			zone:   "Europe/Berlin",
+			first:  time.Date(2025, 10, 26, 0, 30, 0, 0, time.UTC), // 02:30 CEST
+			second: time.Date(2025, 10, 26, 1, 30, 0, 0, time.UTC), // 02:30 CET
+			wall:   "2025-10-26 02:30:00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.zone, func(t *testing.T) {
+			useDBTimezone(t, tt.zone)
+			for _, instant := range []time.Time{tt.first, tt.second} {
+				if got := wallClock(toDBTime(instant)); got != tt.wall {
+					t.Errorf("toDBTime(%v) = %s, want %s", instant, got, tt.wall)
+				}
+				if loc := toDBTime(instant).Location(); loc != time.UTC {
+					t.Errorf("toDBTime(%v) is tagged %v, want UTC", instant, loc)
+				}
+			}
+			// The stored wall clock cannot tell the two apart; it must come
+			// back as one of them, not as some third instant
+			got := fromDBTime(toDBTime(tt.second))
+			if !got.Equal(tt.first) && !got.Equal(tt.second) {
+				t.Errorf("fromDBTime(%s) = %v, want %v or %v", tt.wall, got.UTC(), tt.first, tt.second)
+			}
+		})
+	}
+}
+
+// TestDBTimeRoundTrip converts every quarter hour around both transitions
+// there and back; only the second pass of the repeated hour may change
+func TestDBTimeRoundTrip(t *testing.T) {
+	for _, zone := range []string{"America/New_York", "Europe/Berlin"} {
+		t.Run(zone, func(t *testing.T) {
+			loc := useDBTimezone(t, zone)
+			for _, day := range []time.Time{
+				time.Date(2025, 3, 8, 12, 0, 0, 0, time.UTC),
+				time.Date(2025, 3, 29, 12, 0, 0, 0, time.UTC),
+				time.Date(2025, 10, 25, 12, 0, 0, 0, time.UTC),
+				time.Date(2025, 11, 1, 12, 0, 0, 0, time.UTC),
+			} {
+				for step := time.Duration(0); step < 48*time.Hour; step += 15 * time.Minute {
+					instant := day.Add(step)
+					got := fromDBTime(toDBTime(instant))
+					if got.Equal(instant) {
+						continue
+					}
+					// Inside the repeated hour the wall clock matches an
+					// instant one hour earlier or later
+					_, offset := instant.In(loc).Zone()
+					_, gotOffset := got.Zone()
+					if got.Sub(instant).Abs() != time.Hour || offset == gotOffset {
+						t.Errorf("round trip of %v = %v", instant, got.UTC())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseTimeRangeDST(t *testing.T) {
+	useDBTimezone(t, "America/New_York")
+	query := url.Values{
+		// Both ends are 01:30 local time on the fall back night
+		"start": {"2025-11-02T01:30:00-04:00"},
+		"end":   {"2025-11-02T01:30:00-05:00"},
+	}
+	start, end, err := parseTimeRange(query, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := end.Sub(start); d != time.Hour {
+		t.Errorf("end - start = %v, want 1h", d)
+	}
+	if !start.Equal(time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC)) {
+		t.Errorf("start = %v", start.UTC())
+	}
+	if wallClock(toDBTime(start)) != "2025-11-02 01:30:00" || wallClock(toDBTime(end)) != "2025-11-02 01:30:00" {
+		t.Errorf("database wall clocks = %s, %s", wallClock(toDBTime(start)), wallClock(toDBTime(end)))
+	}
+	// RFC3339 round trip: a response carries the offset of the instant
+	for _, s := range query["start"] {
+		parsed, _, err := parseTimeRange(url.Values{"start": {s}}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fromDBTime(toDBTime(parsed)).Format(time.RFC3339); got != s {
+			t.Errorf("round trip of %s = %s", s, got)
+		}
+	}
+
+	// Spring forward: 01:59 EST and 03:00 EDT are one minute apart
+	start, end, err = parseTimeRange(url.Values{
+		"start": {"2025-03-09T01:59:00-05:00"},
+		"end":   {"2025-03-09T03:00:00-04:00"},
+	}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := end.Sub(start); d != time.Minute {
+		t.Errorf("end - start = %v, want 1m", d)
+	}
+	for _, tm := range []time.Time{start, end} {
+		if got := fromDBTime(toDBTime(tm)); got.Format(time.RFC3339) != tm.In(dbLocation).Format(time.RFC3339) {
+			t.Errorf("round trip of %v = %v", tm, got)
+		}
+	}
+
+	if _, _, err := parseTimeRange(url.Values{"start": {"2025-03-09 02:30"}}, time.Hour); err == nil {
+		t.Error("a time without offset was accepted")
+	}
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -18,11 +19,11 @@ type TrafficFilter struct {
 	Direction  string // "input" or "output"
 	StartTime  time.Time
 	EndTime    time.Time
-	SrcAddr    string
-	DstAddr    string
-	Protocol   string
-	SrcPort    int
-	DstPort    int
+	SrcAddr    AddrFilter
+	DstAddr    AddrFilter
+	Protocol   RangeFilter
+	SrcPort    RangeFilter
+	DstPort    RangeFilter
 	SrcAS      int
 	DstAS      int
 	MinOctets  int64
@@ -33,6 +34,12 @@ type TrafficFilter struct {
 	Offset     int
 	OrderBy    string
 	OrderDir   string // "asc" or "desc"
+	// SamplingRate scales byte and packet sums; resolved from the exporter
+	// configuration, never from the request
+	SamplingRate int64
+	// ExporterRates replaces SamplingRate for filters over several
+	// exporters with the rate of each exporter; see exporterSamplingRates
+	ExporterRates map[string]int64
 }
 
 // TrafficRecord represents a single traffic flow record
@@ -86,10 +93,12 @@ type TrafficResponse struct {
 	TotalOctets  int64               `json:"total_octets"`
 	TotalPackets int64               `json:"total_packets"`
 	UniqueAddrs  int                 `json:"unique_addrs"`
+	SamplingRate int64               `json:"sampling_rate"`
+	Scaled       bool                `json:"scaled"`
 }
 
 // parseTrafficFilter extracts filter parameters from request
-func parseTrafficFilter(r *http.Request) TrafficFilter {
+func parseTrafficFilter(r *http.Request) (TrafficFilter, error) {
 	filter := TrafficFilter{
 		Direction: "input",
 		Limit:     100,
@@ -102,39 +111,18 @@ func parseTrafficFilter(r *http.Request) TrafficFilter {
 
 	filter.Exporter = query.Get("exporter")
 	filter.Interface = query.Get("interface")
-	filter.Direction = query.Get("direction")
-	filter.SrcAddr = query.Get("srcaddr")
-	filter.DstAddr = query.Get("dstaddr")
-	filter.Protocol = query.Get("protocol")
-
-	// Time filters
-	// Note: Database stores timestamps without timezone in GMT-3
-	// Apply -3 hour offset to incoming UTC times
-	if startStr := query.Get("start"); startStr != "" {
-		if t, err := time.Parse(time.RFC3339, startStr); err == nil {
-			filter.StartTime = t.Add(-3 * time.Hour)
-		}
-	}
-	if endStr := query.Get("end"); endStr != "" {
-		if t, err := time.Parse(time.RFC3339, endStr); err == nil {
-			filter.EndTime = t.Add(-3 * time.Hour)
-		}
+	var err error
+	if filter.Direction, err = parseDirection(query.Get("direction")); err != nil {
+		return filter, err
 	}
-
-	// Default to last hour if not specified
-	if filter.StartTime.IsZero() {
-		filter.StartTime = time.Now().Add(-1 * time.Hour)
-	}
-	if filter.EndTime.IsZero() {
-		filter.EndTime = time.Now()
+	if err := parseMatchFilters(query, &filter); err != nil {
+		return filter, err
 	}
 
-	// Port filters
-	if srcPort := query.Get("srcport"); srcPort != "" {
-		filter.SrcPort, _ = strconv.Atoi(srcPort)
-	}
-	if dstPort := query.Get("dstport"); dstPort != "" {
-		filter.DstPort, _ = strconv.Atoi(dstPort)
+	// Time filters (instants; converted to the database time zone in SQL args)
+	filter.StartTime, filter.EndTime, err = parseTimeRange(query, time.Hour)
+	if err != nil {
+		return filter, err
 	}
 
 	// AS filters
@@ -168,260 +156,29 @@ func parseTrafficFilter(r *http.Request) TrafficFilter {
 	}
 
 	// Sorting
-	if orderBy := query.Get("order_by"); orderBy != "" {
-		filter.OrderBy = orderBy
-	}
-	if orderDir := query.Get("order_dir"); orderDir != "" {
-		filter.OrderDir = orderDir
-	}
-
-	// Ensure defaults
-	if filter.Direction == "" {
-		filter.Direction = "input"
-	}
-
-	return filter
-}
-
-// buildTrafficQuery constructs SQL query based on filters
-func buildTrafficQuery(filter TrafficFilter, groupBy string, addressType string) (string, []interface{}) {
-	var conditions []string
-	var args []interface{}
-	argIndex := 1
-
-	// Base query - use flows_hourly for aggregated data
-	selectFields := ""
-	if groupBy == "address" {
-		addrField := "srcaddr"
-		if addressType == "dstaddr" {
-			addrField = "dstaddr"
-		}
-		selectFields = fmt.Sprintf(`
-			%s as address,
-			SUM(total_bytes) as total_octets,
-			SUM(total_packets) as total_packets,
-			COUNT(*) as flow_count
-		`, addrField)
-	} else if groupBy == "port" {
-		addrField := "srcaddr"
-		selectFields = fmt.Sprintf(`
-			%s as address,
-			srcport,
-			dstport,
-			prot as protocol,
-			SUM(total_bytes) as total_octets,
-			SUM(total_packets) as total_packets,
-			COUNT(*) as flow_count
-		`, addrField)
-	} else if groupBy == "pair" {
-		selectFields = `
-			srcaddr,
-			dstaddr,
-			SUM(total_bytes) as total_octets,
-			SUM(total_packets) as total_packets,
-			COUNT(*) as flow_count`
-	}
-
-	baseQuery := fmt.Sprintf(`
-		SELECT %s
-		FROM flows_hourly
-		WHERE 1=1
-	`, selectFields)
-
-	// Add filters
-	if filter.Exporter != "" {
-		conditions = append(conditions, fmt.Sprintf("exporter = $%d", argIndex))
-		args = append(args, filter.Exporter)
-		argIndex++
-	}
-
-	if filter.Interface != "" {
-		conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.Direction, argIndex))
-		args = append(args, filter.Interface)
-		argIndex++
-	}
-
-	if !filter.StartTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("bucket AT TIME ZONE 'UTC' >= $%d", argIndex))
-		args = append(args, filter.StartTime)
-		argIndex++
-	}
-
-	if !filter.EndTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("bucket AT TIME ZONE 'UTC' <= $%d", argIndex))
-		args = append(args, filter.EndTime)
-		argIndex++
-	}
-
-	if filter.SrcAddr != "" {
-		conditions = append(conditions, fmt.Sprintf("srcaddr = $%d", argIndex))
-		args = append(args, filter.SrcAddr)
-		argIndex++
-	}
-
-	if filter.DstAddr != "" {
-		conditions = append(conditions, fmt.Sprintf("dstaddr = $%d", argIndex))
-		args = append(args, filter.DstAddr)
-		argIndex++
-	}
-
-	if filter.Protocol != "" {
-		conditions = append(conditions, fmt.Sprintf("prot = $%d", argIndex))
-		args = append(args, filter.Protocol)
-		argIndex++
-	}
-
-	if filter.SrcPort > 0 {
-		conditions = append(conditions, fmt.Sprintf("srcport = $%d", argIndex))
-		args = append(args, filter.SrcPort)
-		argIndex++
-	}
-
-	if filter.DstPort > 0 {
-		conditions = append(conditions, fmt.Sprintf("dstport = $%d", argIndex))
-		args = append(args, filter.DstPort)
-		argIndex++
-	}
-
-	if filter.SrcAS > 0 {
-		conditions = append(conditions, fmt.Sprintf("src_as = $%d", argIndex))
-		args = append(args, filter.SrcAS)
-		argIndex++
-	}
-
-	if filter.DstAS > 0 {
-		conditions = append(conditions, fmt.Sprintf("dst_as = $%d", argIndex))
-		args = append(args, filter.DstAS)
-		argIndex++
-	}
-
-	// Build WHERE clause
-	whereClause := ""
-	if len(conditions) > 0 {
-		whereClause = " AND " + strings.Join(conditions, " AND ")
-	}
-
-	// GROUP BY clause
-	groupByClause := ""
-	if groupBy == "address" {
-
-		if addressType == "dstaddr" {
-			groupByClause = " GROUP BY dstaddr"
-		} else {
-			groupByClause = " GROUP BY srcaddr"
-		}
-
-	} else if groupBy == "port" {
-		groupByClause = " GROUP BY srcaddr, srcport, dstport, prot"
-	} else if groupBy == "pair" {
-		groupByClause = " GROUP BY srcaddr, dstaddr"
-	}
-
-	// Having clause for volume filters
-	havingClauses := []string{}
-	if filter.MinOctets > 0 {
-		havingClauses = append(havingClauses, fmt.Sprintf("SUM(total_octets) >= %d", filter.MinOctets))
-	}
-	if filter.MaxOctets > 0 {
-		havingClauses = append(havingClauses, fmt.Sprintf("SUM(total_octets) <= %d", filter.MaxOctets))
-	}
-	if filter.MinPackets > 0 {
-		havingClauses = append(havingClauses, fmt.Sprintf("SUM(total_packets) >= %d", filter.MinPackets))
-	}
-	if filter.MaxPackets > 0 {
-		havingClauses = append(havingClauses, fmt.Sprintf("SUM(total_packets) <= %d", filter.MaxPackets))
-	}
-
-	havingClause := ""
-	if len(havingClauses) > 0 {
-		havingClause = " HAVING " + strings.Join(havingClauses, " AND ")
+	if err := parseOrder(query, &filter); err != nil {
+		return filter, err
 	}
 
-	// ORDER BY clause
-	orderByClause := fmt.Sprintf(" ORDER BY %s %s", filter.OrderBy, filter.OrderDir)
-
-	// LIMIT and OFFSET
-	limitClause := ""
-	if filter.Limit > 0 {
-		limitClause = fmt.Sprintf(" LIMIT %d", filter.Limit)
-	}
-	if filter.Offset > 0 {
-		limitClause += fmt.Sprintf(" OFFSET %d", filter.Offset)
-	}
-
-	query := baseQuery + whereClause + groupByClause + havingClause + orderByClause + limitClause
-
-	return query, args
+	return filter, nil
 }
 
 // getTrafficDataAggregated retrieves aggregated traffic data based on filters
 func getTrafficDataAggregated(filter TrafficFilter, groupBy string, addressType string) (*TrafficResponse, error) {
-	query, args := buildTrafficQuery(filter, groupBy, addressType)
-
-	log.Println("Query:", query)
-	log.Println("Args:", args)
-
-	rows, err := config.Db.Query(query, args...)
+	records, err := config.Flows.AggregateTraffic(filter, groupBy, addressType)
 	if err != nil {
-		return nil, fmt.Errorf("query error: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
 
-	var records []TrafficAggregated
 	var totalOctets int64
 	var totalPackets int64
-
-	for rows.Next() {
-		var record TrafficAggregated
-
-		if groupBy == "address" {
-			err := rows.Scan(
-				&record.Address,
-				&record.TotalOctets,
-				&record.TotalPackets,
-				&record.FlowCount,
-			)
-			if err != nil {
-				log.Printf("Scan error: %v", err)
-				continue
-			}
-		} else if groupBy == "port" {
-			var protocol sql.NullString
-			err := rows.Scan(
-				&record.Address,
-				&record.SrcPort,
-				&record.DstPort,
-				&protocol,
-				&record.TotalOctets,
-				&record.TotalPackets,
-				&record.FlowCount,
-			)
-			if err != nil {
-				log.Printf("Scan error: %v", err)
-				continue
-			}
-			if protocol.Valid {
-				record.Protocol = protocol.String
-			}
-		} else if groupBy == "pair" {
-			err := rows.Scan(
-				&record.SrcAddr,
-				&record.DstAddr,
-				&record.TotalOctets,
-				&record.TotalPackets,
-				&record.FlowCount,
-			)
-			if err != nil {
-				log.Printf("Scan error: %v", err)
-				continue
-			}
+	for i := range records {
+		if groupBy == "pair" {
 			// convenience combined address for UI/sorting
-			record.Address = fmt.Sprintf("%s → %s", record.SrcAddr, record.DstAddr)
+			records[i].Address = fmt.Sprintf("%s → %s", records[i].SrcAddr, records[i].DstAddr)
 		}
-
-		totalOctets += record.TotalOctets
-		totalPackets += record.TotalPackets
-		records = append(records, record)
+		totalOctets += records[i].TotalOctets
+		totalPackets += records[i].TotalPackets
 	}
 
 	// Calculate percentages and enrich IPs
@@ -485,6 +242,8 @@ func getTrafficDataAggregated(filter TrafficFilter, groupBy string, addressType
 		TotalOctets:  totalOctets,
 		TotalPackets: totalPackets,
 		UniqueAddrs:  len(uniqueAddrs),
+		SamplingRate: max(filter.SamplingRate, 1),
+		Scaled:       filter.SamplingRate > 1,
 	}
 
 	return response, nil
@@ -494,7 +253,16 @@ func getTrafficDataAggregated(filter TrafficFilter, groupBy string, addressType
 func getTrafficRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	filter := parseTrafficFilter(r)
+	filter, err := parseTrafficFilter(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
 	groupBy := r.URL.Query().Get("group_by")
 	if groupBy == "" {
 		groupBy = "address"
@@ -518,6 +286,10 @@ func getTrafficRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "interface parameter is required"}`, http.StatusBadRequest)
 		return
 	}
+	if !authorizeExporter(w, r, filter.Exporter, filter.Interface) {
+		return
+	}
+	filter.SamplingRate = getSamplingRate(filter.Exporter, filter.Interface)
 
 	response, err := getTrafficDataAggregated(filter, groupBy, addressType)
 	if err != nil {
@@ -526,6 +298,13 @@ func getTrafficRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if format != exportJSON {
+		if err := writeExport(w, r, format, "traffic", trafficExportRows(response.Records)); err != nil {
+			log.Printf("Error exporting traffic data: %v", err)
+		}
+		return
+	}
+
 	jsonBytes, err := json.Marshal(response)
 	if err != nil {
 		log.Printf("Error marshaling response: %v", err)
@@ -545,10 +324,12 @@ func getDataRangeRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "exporter parameter is required"}`, http.StatusBadRequest)
 		return
 	}
+	if !scopeFrom(r.Context()).Exporter(exporter) {
+		http.Error(w, fmt.Sprintf("Access to exporter %q denied", exporter), http.StatusForbidden)
+		return
+	}
 
-	var minTime, maxTime time.Time
-	query := "SELECT MIN(bucket), MAX(bucket) FROM flows_hourly WHERE exporter = $1::inet"
-	err := config.Db.QueryRow(query, exporter).Scan(&minTime, &maxTime)
+	minTime, maxTime, err := config.Flows.DataRange(exporter)
 	if err != nil {
 		log.Printf("Error querying data range: %v", err)
 		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
@@ -574,132 +355,75 @@ func getDataRangeRequest(w http.ResponseWriter, r *http.Request) {
 func getRawFlowsRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	filter := parseTrafficFilter(r)
-
-	// Build query for raw flows table
-	var conditions []string
-	var args []interface{}
-	argIndex := 1
-
-	if filter.Exporter != "" {
-		conditions = append(conditions, fmt.Sprintf("exporter = $%d::inet", argIndex))
-		args = append(args, filter.Exporter)
-		argIndex++
-	}
-
-	if filter.Interface != "" {
-		conditions = append(conditions, fmt.Sprintf("%s = $%d", filter.Direction, argIndex))
-		args = append(args, filter.Interface)
-		argIndex++
-	}
-
-	if !filter.StartTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("last AT TIME ZONE 'UTC' >= $%d", argIndex))
-		args = append(args, filter.StartTime)
-		argIndex++
-	}
-
-	if !filter.EndTime.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("last AT TIME ZONE 'UTC' <= $%d", argIndex))
-		args = append(args, filter.EndTime)
-		argIndex++
-	}
-
-	if filter.SrcAddr != "" {
-		conditions = append(conditions, fmt.Sprintf("srcaddr = $%d", argIndex))
-		args = append(args, filter.SrcAddr)
-		argIndex++
+	filter, err := parseTrafficFilter(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
 	}
-
-	if filter.DstAddr != "" {
-		conditions = append(conditions, fmt.Sprintf("dstaddr = $%d", argIndex))
-		args = append(args, filter.DstAddr)
-		argIndex++
+	// Without an interface, scoped callers need the whole exporter
+	if !authorizeExporter(w, r, filter.Exporter, filter.Interface) {
+		return
 	}
 
-	if filter.Protocol != "" {
-		conditions = append(conditions, fmt.Sprintf("prot = $%d", argIndex))
-		args = append(args, filter.Protocol)
-		argIndex++
+	// Keyset pagination: continue strictly after the cursor in (last, id) order
+	var after *rawFlowCursor
+	if cursorStr := r.URL.Query().Get("cursor"); cursorStr != "" {
+		cursor, err := decodeRawFlowCursor(cursorStr)
+		if err != nil {
+			http.Error(w, `{"error": "invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		after = &cursor
 	}
 
-	if filter.SrcPort > 0 {
-		conditions = append(conditions, fmt.Sprintf("srcport = $%d", argIndex))
-		args = append(args, filter.SrcPort)
-		argIndex++
+	stream := r.URL.Query().Get("format") == "ndjson"
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
 	}
-
-	if filter.DstPort > 0 {
-		conditions = append(conditions, fmt.Sprintf("dstport = $%d", argIndex))
-		args = append(args, filter.DstPort)
-		argIndex++
+	if stream && r.URL.Query().Get("limit") == "" {
+		// Streams are unbounded unless a limit is requested
+		limit = 0
+	} else if !stream && limit > rawFlowsMaxLimit {
+		limit = rawFlowsMaxLimit
 	}
 
-	whereClause := "WHERE " + strings.Join(conditions, " AND ")
-	if len(conditions) == 0 {
-		whereClause = ""
+	// One extra row tells whether another page exists
+	fetch := 0
+	if limit > 0 {
+		fetch = limit + 1
 	}
 
-	query := fmt.Sprintf(`
-		SELECT
-			id, inserted_at, exporter, srcaddr, dstaddr, input, output,
-			dpkts, doctets, srcport, dstport, tcp_flags, prot, tos,
-			src_as, dst_as, src_mask, dst_mask, ip_version, first, last
-		FROM flows
-		%s
-		ORDER BY last DESC
-		LIMIT $%d
-	`, whereClause, argIndex)
+	// Raw records are returned as exported; clients scale them if needed
+	samplingRate := getSamplingRate(filter.Exporter, filter.Interface)
 
-	args = append(args, filter.Limit)
-
-	log.Println("Raw flows query:", query)
-	log.Println("Args:", args)
-
-	rows, err := config.Db.Query(query, args...)
-	if err != nil {
-		log.Printf("Query error: %v", err)
-		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+	if stream {
+		streamRawFlows(w, filter, after, limit, fetch, samplingRate)
 		return
 	}
-	defer rows.Close()
-
-	var records []TrafficRecord
-	for rows.Next() {
-		var record TrafficRecord
-		err := rows.Scan(
-			&record.ID,
-			&record.InsertedAt,
-			&record.Exporter,
-			&record.SrcAddr,
-			&record.DstAddr,
-			&record.Input,
-			&record.Output,
-			&record.DPkts,
-			&record.DOctets,
-			&record.SrcPort,
-			&record.DstPort,
-			&record.TCPFlags,
-			&record.Protocol,
-			&record.TOS,
-			&record.SrcAS,
-			&record.DstAS,
-			&record.SrcMask,
-			&record.DstMask,
-			&record.IPVersion,
-			&record.First,
-			&record.Last,
-		)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			continue
+
+	records := []TrafficRecord{}
+	nextCursor := ""
+	err = config.Flows.RawFlows(filter, after, fetch, func(record TrafficRecord) bool {
+		if len(records) == limit {
+			nextCursor = rawFlowCursorOf(records[len(records)-1]).encode()
+			return false
 		}
 		records = append(records, record)
+		return true
+	})
+	if err != nil {
+		log.Printf("Error reading raw flows: %v", err)
+		http.Error(w, `{"error": "failed to read flows"}`, http.StatusInternalServerError)
+		return
 	}
 
 	response := map[string]interface{}{
-		"records": records,
-		"count":   len(records),
+		"records":       records,
+		"count":         len(records),
+		"next_cursor":   nextCursor,
+		"sampling_rate": samplingRate,
+		"scaled":        false,
 	}
 
 	jsonBytes, err := json.Marshal(response)
@@ -712,30 +436,109 @@ func getRawFlowsRequest(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonBytes)
 }
 
+// streamRawFlows writes flows as NDJSON while they are read. The cursor for
+// the next page, if any, is sent as the X-Next-Cursor trailer.
+func streamRawFlows(w http.ResponseWriter, filter TrafficFilter, after *rawFlowCursor, limit int, fetch int, samplingRate int64) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", "X-Next-Cursor")
+	w.Header().Set("X-Sampling-Rate", strconv.FormatInt(samplingRate, 10))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	var last TrafficRecord
+	written := 0
+	err := config.Flows.RawFlows(filter, after, fetch, func(record TrafficRecord) bool {
+		if limit > 0 && written == limit {
+			w.Header().Set("X-Next-Cursor", rawFlowCursorOf(last).encode())
+			return false
+		}
+		if err := encoder.Encode(record); err != nil {
+			// Client went away
+			log.Printf("Error streaming raw flows: %v", err)
+			return false
+		}
+		last = record
+		written++
+		if flusher != nil && written%rawFlowsFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Error reading raw flows: %v", err)
+	}
+}
+
+const (
+	rawFlowsMaxLimit   = 10000
+	rawFlowsFlushEvery = 1000
+)
+
+// rawFlowCursor is the keyset position of a raw flow in (last, id) order
+type rawFlowCursor struct {
+	Last time.Time
+	ID   uint64
+}
+
+func rawFlowCursorOf(record TrafficRecord) rawFlowCursor {
+	return rawFlowCursor{Last: toDBTime(record.Last), ID: record.ID}
+}
+
+// encode returns the opaque cursor string handed to clients
+func (c rawFlowCursor) encode() string {
+	raw := c.Last.Format(rawFlowCursorTimeFormat) + "|" + strconv.FormatUint(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// The cursor keeps the database wall clock so it compares exactly against the
+// stored value
+const rawFlowCursorTimeFormat = "2006-01-02T15:04:05.999999"
+
+func decodeRawFlowCursor(s string) (rawFlowCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return rawFlowCursor{}, err
+	}
+	lastStr, idStr, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return rawFlowCursor{}, errors.New("malformed cursor")
+	}
+	last, err := time.Parse(rawFlowCursorTimeFormat, lastStr)
+	if err != nil {
+		return rawFlowCursor{}, err
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return rawFlowCursor{}, err
+	}
+	return rawFlowCursor{Last: last, ID: id}, nil
+}
+
 // TopTalker represents a source address + destination address combination
 type TopTalker struct {
-	SrcAddr      string  `json:"srcaddr"`
-	DstAddr      string  `json:"dstaddr"`
-	Protocol     int     `json:"protocol"`
-	ProtocolName string  `json:"protocol_name"`
-	TotalOctets  int64   `json:"total_octets"`
-	TotalPackets int64   `json:"total_packets"`
-	FlowCount    int64   `json:"flow_count"`
-	Percentage   float64 `json:"percentage"`
+	SrcAddr      string  `json:"srcaddr" parquet:"srcaddr"`
+	DstAddr      string  `json:"dstaddr" parquet:"dstaddr"`
+	Protocol     int     `json:"protocol" parquet:"protocol"`
+	ProtocolName string  `json:"protocol_name" parquet:"protocol_name"`
+	TotalOctets  int64   `json:"total_octets" parquet:"total_octets"`
+	TotalPackets int64   `json:"total_packets" parquet:"total_packets"`
+	FlowCount    int64   `json:"flow_count" parquet:"flow_count"`
+	Percentage   float64 `json:"percentage" parquet:"percentage"`
 }
 
 // TopTalkerWithPort represents srcaddr + dstaddr + dstport combination
 type TopTalkerWithPort struct {
-	SrcAddr      string  `json:"srcaddr"`
-	DstAddr      string  `json:"dstaddr"`
-	DstPort      int     `json:"dstport"`
-	ServiceName  string  `json:"service_name"`
-	Protocol     int     `json:"protocol"`
-	ProtocolName string  `json:"protocol_name"`
-	TotalOctets  int64   `json:"total_octets"`
-	TotalPackets int64   `json:"total_packets"`
-	FlowCount    int64   `json:"flow_count"`
-	Percentage   float64 `json:"percentage"`
+	SrcAddr      string  `json:"srcaddr" parquet:"srcaddr"`
+	DstAddr      string  `json:"dstaddr" parquet:"dstaddr"`
+	DstPort      int     `json:"dstport" parquet:"dstport"`
+	ServiceName  string  `json:"service_name" parquet:"service_name"`
+	Protocol     int     `json:"protocol" parquet:"protocol"`
+	ProtocolName string  `json:"protocol_name" parquet:"protocol_name"`
+	TotalOctets  int64   `json:"total_octets" parquet:"total_octets"`
+	TotalPackets int64   `json:"total_packets" parquet:"total_packets"`
+	FlowCount    int64   `json:"flow_count" parquet:"flow_count"`
+	Percentage   float64 `json:"percentage" parquet:"percentage"`
 }
 
 // getTopTalkersRequest handles requests for top talkers (srcaddr + srcport combinations)
@@ -753,19 +556,28 @@ func getTopTalkersRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "exporter, interface, start, and end parameters are required"}`, http.StatusBadRequest)
 		return
 	}
+	if !authorizeExporter(w, r, exporter, interfaceStr) {
+		return
+	}
 
-	startTime, err := time.Parse(time.RFC3339, startStr)
+	startTime, err := parseRequestTime(startStr)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": "invalid start time: %v"}`, err), http.StatusBadRequest)
 		return
 	}
 
-	endTime, err := time.Parse(time.RFC3339, endStr)
+	endTime, err := parseRequestTime(endStr)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": "invalid end time: %v"}`, err), http.StatusBadRequest)
 		return
 	}
 
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
 	limitNum := 20
 	if limit != "" {
 		if l, err := strconv.Atoi(limit); err == nil && l > 0 {
@@ -773,99 +585,34 @@ func getTopTalkersRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Query for top talkers (srcaddr + dstaddr)
-	query := `
-		WITH talker_stats AS (
-			SELECT
-				srcaddr,
-				dstaddr,
-				prot as protocol,
-				SUM(total_bytes) as total_octets,
-				SUM(total_packets) as total_packets,
-				COUNT(*) as flow_count
-			FROM flows_hourly
-			WHERE exporter = $1::inet
-			  AND (input = $2::int OR output = $2::int)
-			  AND bucket AT TIME ZONE 'UTC' >= $3::timestamp
-			  AND bucket AT TIME ZONE 'UTC' <= $4::timestamp
-			GROUP BY srcaddr, dstaddr, prot
-		),
-		totals AS (
-			SELECT SUM(total_octets) as grand_total_octets
-			FROM talker_stats
-		)
-		SELECT
-			ts.srcaddr,
-			ts.dstaddr,
-			ts.protocol,
-			COALESCE(p.name, 'Protocol-' || ts.protocol::text) as protocol_name,
-			ts.total_octets,
-			ts.total_packets,
-			ts.flow_count,
-			t.grand_total_octets
-		FROM talker_stats ts
-		CROSS JOIN totals t
-		LEFT JOIN ports p ON ts.protocol = p.protocol AND p.number IS NULL
-		ORDER BY ts.total_octets DESC
-		LIMIT $5
-	`
-
-	rows, err := config.Db.Query(query, exporter, interfaceStr, startTime, endTime, limitNum)
+	samplingRate := getSamplingRate(exporter, interfaceStr)
+	filter := TrafficFilter{
+		Exporter:     exporter,
+		Interface:    interfaceStr,
+		StartTime:    startTime,
+		EndTime:      endTime,
+		Limit:        limitNum,
+		SamplingRate: samplingRate,
+	}
+	talkers, grandTotalOctets, err := config.Flows.TopTalkers(filter)
 	if err != nil {
 		log.Printf("Error querying top talkers: %v", err)
 		http.Error(w, fmt.Sprintf(`{"error": "database query failed: %v"}`, err), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var talkers []TopTalker
-	var grandTotalOctets int64
-
-	for rows.Next() {
-		var talker TopTalker
-		var totalOctets, totalPackets, flowCount, grandTotal sql.NullInt64
-		var protocol sql.NullInt64
-
-		err := rows.Scan(
-			&talker.SrcAddr,
-			&talker.DstAddr,
-			&protocol,
-			&talker.ProtocolName,
-			&totalOctets,
-			&totalPackets,
-			&flowCount,
-			&grandTotal,
-		)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			continue
-		}
 
-		if protocol.Valid {
-			talker.Protocol = int(protocol.Int64)
-		}
-		if totalOctets.Valid {
-			talker.TotalOctets = totalOctets.Int64
-		}
-		if totalPackets.Valid {
-			talker.TotalPackets = totalPackets.Int64
-		}
-		if flowCount.Valid {
-			talker.FlowCount = flowCount.Int64
-		}
-		if grandTotal.Valid {
-			grandTotalOctets = grandTotal.Int64
-			if grandTotalOctets > 0 {
-				talker.Percentage = float64(talker.TotalOctets) / float64(grandTotalOctets) * 100
-			}
+	if format != exportJSON {
+		if err := writeExport(w, r, format, "top-talkers", talkers); err != nil {
+			log.Printf("Error exporting top talkers: %v", err)
 		}
-
-		talkers = append(talkers, talker)
+		return
 	}
 
 	response := map[string]interface{}{
-		"talkers":      talkers,
-		"total_octets": grandTotalOctets,
+		"talkers":       talkers,
+		"total_octets":  grandTotalOctets,
+		"sampling_rate": samplingRate,
+		"scaled":        samplingRate > 1,
 	}
 
 	jsonBytes, err := json.Marshal(response)
@@ -893,19 +640,28 @@ func getTopTalkersWithPortRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "exporter, interface, start, and end parameters are required"}`, http.StatusBadRequest)
 		return
 	}
+	if !authorizeExporter(w, r, exporter, interfaceStr) {
+		return
+	}
 
-	startTime, err := time.Parse(time.RFC3339, startStr)
+	startTime, err := parseRequestTime(startStr)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": "invalid start time: %v"}`, err), http.StatusBadRequest)
 		return
 	}
 
-	endTime, err := time.Parse(time.RFC3339, endStr)
+	endTime, err := parseRequestTime(endStr)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": "invalid end time: %v"}`, err), http.StatusBadRequest)
 		return
 	}
 
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
 	limitNum := 20
 	if limit != "" {
 		if l, err := strconv.Atoi(limit); err == nil && l > 0 {
@@ -913,112 +669,34 @@ func getTopTalkersWithPortRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Query for top talkers with destination port
-	query := `
-		WITH talker_stats AS (
-			SELECT
-				srcaddr,
-				dstaddr,
-				dstport,
-				prot as protocol,
-				SUM(total_bytes) as total_octets,
-				SUM(total_packets) as total_packets,
-				COUNT(*) as flow_count
-			FROM flows_hourly
-			WHERE exporter = $1::inet
-			  AND (input = $2::int OR output = $2::int)
-			  AND bucket AT TIME ZONE 'UTC' >= $3::timestamp
-			  AND bucket AT TIME ZONE 'UTC' <= $4::timestamp
-			GROUP BY srcaddr, dstaddr, dstport, prot
-		),
-		totals AS (
-			SELECT SUM(total_octets) as grand_total_octets
-			FROM talker_stats
-		)
-		SELECT
-			ts.srcaddr,
-			ts.dstaddr,
-			ts.dstport,
-			COALESCE(p2.name, ts.dstport::text) as service_name,
-			ts.protocol,
-			COALESCE(p.name, 'Protocol-' || ts.protocol::text) as protocol_name,
-			ts.total_octets,
-			ts.total_packets,
-			ts.flow_count,
-			t.grand_total_octets
-		FROM talker_stats ts
-		CROSS JOIN totals t
-		LEFT JOIN ports p ON ts.protocol = p.protocol AND p.number IS NULL
-		LEFT JOIN ports p2 ON ts.dstport = p2.number AND ts.protocol = p2.protocol
-		ORDER BY ts.total_octets DESC
-		LIMIT $5
-	`
-
-	rows, err := config.Db.Query(query, exporter, interfaceStr, startTime, endTime, limitNum)
+	samplingRate := getSamplingRate(exporter, interfaceStr)
+	filter := TrafficFilter{
+		Exporter:     exporter,
+		Interface:    interfaceStr,
+		StartTime:    startTime,
+		EndTime:      endTime,
+		Limit:        limitNum,
+		SamplingRate: samplingRate,
+	}
+	talkers, grandTotalOctets, err := config.Flows.TopTalkersWithPort(filter)
 	if err != nil {
 		log.Printf("Error querying top talkers with port: %v", err)
 		http.Error(w, fmt.Sprintf(`{"error": "database query failed: %v"}`, err), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var talkers []TopTalkerWithPort
-	var grandTotalOctets int64
-
-	for rows.Next() {
-		var talker TopTalkerWithPort
-		var totalOctets, totalPackets, flowCount, grandTotal sql.NullInt64
-		var protocol, dstport sql.NullInt64
-		var serviceName sql.NullString
-
-		err := rows.Scan(
-			&talker.SrcAddr,
-			&talker.DstAddr,
-			&dstport,
-			&serviceName,
-			&protocol,
-			&talker.ProtocolName,
-			&totalOctets,
-			&totalPackets,
-			&flowCount,
-			&grandTotal,
-		)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			continue
-		}
 
-		if dstport.Valid {
-			talker.DstPort = int(dstport.Int64)
-		}
-		if serviceName.Valid {
-			talker.ServiceName = serviceName.String
-		}
-		if protocol.Valid {
-			talker.Protocol = int(protocol.Int64)
-		}
-		if totalOctets.Valid {
-			talker.TotalOctets = totalOctets.Int64
-		}
-		if totalPackets.Valid {
-			talker.TotalPackets = totalPackets.Int64
+	if format != exportJSON {
+		if err := writeExport(w, r, format, "top-talkers-with-port", talkers); err != nil {
+			log.Printf("Error exporting top talkers: %v", err)
 		}
-		if flowCount.Valid {
-			talker.FlowCount = flowCount.Int64
-		}
-		if grandTotal.Valid {
-			grandTotalOctets = grandTotal.Int64
-			if grandTotalOctets > 0 {
-				talker.Percentage = float64(talker.TotalOctets) / float64(grandTotalOctets) * 100
-			}
-		}
-
-		talkers = append(talkers, talker)
+		return
 	}
 
 	response := map[string]interface{}{
-		"talkers":      talkers,
-		"total_octets": grandTotalOctets,
+		"talkers":       talkers,
+		"total_octets":  grandTotalOctets,
+		"sampling_rate": samplingRate,
+		"scaled":        samplingRate > 1,
 	}
 
 	jsonBytes, err := json.Marshal(response)
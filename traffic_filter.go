@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Address, port and protocol filter parameters accept a comma separated list
+// of values, optionally negated with a leading "!":
+//
+//	srcaddr=10.1.0.0/16,192.0.2.7   dstport=1024-65535   protocol=!udp,icmp
+//
+// Addresses may be hosts or CIDR blocks (matched with inet containment),
+// ports and protocols may be single values or inclusive ranges.
+
+// AddrFilter matches an inet column against hosts and networks
+type AddrFilter struct {
+	Negate   bool
+	Hosts    []string
+	Networks []string
+}
+
+// RangeFilter matches an integer column against values and inclusive ranges
+type RangeFilter struct {
+	Negate bool
+	Ranges [][2]int64
+}
+
+// IsSet reports whether the filter restricts anything
+func (f AddrFilter) IsSet() bool {
+	return len(f.Hosts) > 0 || len(f.Networks) > 0
+}
+
+// IsSet reports whether the filter restricts anything
+func (f RangeFilter) IsSet() bool {
+	return len(f.Ranges) > 0
+}
+
+// splitFilterList strips the negation prefix and splits the list
+func splitFilterList(value string) (bool, []string) {
+	value = strings.TrimSpace(value)
+	negate := strings.HasPrefix(value, "!")
+	value = strings.TrimPrefix(value, "!")
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return negate, items
+}
+
+// parseAddrFilter parses a list of IP addresses and CIDR blocks
+func parseAddrFilter(value string) (AddrFilter, error) {
+	var f AddrFilter
+	negate, items := splitFilterList(value)
+	f.Negate = negate
+	for _, item := range items {
+		if strings.Contains(item, "/") {
+			_, network, err := net.ParseCIDR(item)
+			if err != nil {
+				return AddrFilter{}, fmt.Errorf("invalid network %q", item)
+			}
+			f.Networks = append(f.Networks, network.String())
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return AddrFilter{}, fmt.Errorf("invalid address %q", item)
+		}
+		f.Hosts = append(f.Hosts, ip.String())
+	}
+	return f, nil
+}
+
+// parseRangeFilter parses a list of numbers and ranges within [0, limit].
+// names optionally maps symbolic values (e.g. protocol names) to numbers.
+func parseRangeFilter(value string, limit int64, names map[string]int) (RangeFilter, error) {
+	var f RangeFilter
+	negate, items := splitFilterList(value)
+	f.Negate = negate
+	parse := func(s string) (int64, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return int64(n), nil
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || n < 0 || n > limit {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		return n, nil
+	}
+	for _, item := range items {
+		low, high, isRange := strings.Cut(item, "-")
+		lowN, err := parse(low)
+		if err != nil {
+			return RangeFilter{}, err
+		}
+		highN := lowN
+		if isRange {
+			if highN, err = parse(high); err != nil {
+				return RangeFilter{}, err
+			}
+			if highN < lowN {
+				return RangeFilter{}, fmt.Errorf("invalid range %q", item)
+			}
+		}
+		f.Ranges = append(f.Ranges, [2]int64{lowN, highN})
+	}
+	return f, nil
+}
+
+// SQL returns the condition for column and its arguments, numbering
+// placeholders from argIndex
+func (f AddrFilter) SQL(column string, argIndex int) (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+	for _, host := range f.Hosts {
+		parts = append(parts, fmt.Sprintf("%s = $%d::inet", column, argIndex))
+		args = append(args, host)
+		argIndex++
+	}
+	for _, network := range f.Networks {
+		parts = append(parts, fmt.Sprintf("%s <<= $%d::inet", column, argIndex))
+		args = append(args, network)
+		argIndex++
+	}
+	return joinFilterParts(parts, f.Negate), args
+}
+
+// SQL returns the condition for column and its arguments, numbering
+// placeholders from argIndex
+func (f RangeFilter) SQL(column string, argIndex int) (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+	for _, r := range f.Ranges {
+		if r[0] == r[1] {
+			parts = append(parts, fmt.Sprintf("%s = $%d", column, argIndex))
+			args = append(args, r[0])
+			argIndex++
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s BETWEEN $%d AND $%d", column, argIndex, argIndex+1))
+		args = append(args, r[0], r[1])
+		argIndex += 2
+	}
+	return joinFilterParts(parts, f.Negate), args
+}
+
+func joinFilterParts(parts []string, negate bool) string {
+	clause := "(" + strings.Join(parts, " OR ") + ")"
+	if negate {
+		clause = "NOT " + clause
+	}
+	return clause
+}
+
+// parseMatchFilters reads the address, port and protocol parameters shared by
+// the traffic and protocol endpoints
+func parseMatchFilters(query url.Values, filter *TrafficFilter) error {
+	var err error
+	if filter.SrcAddr, err = parseAddrFilter(query.Get("srcaddr")); err != nil {
+		return fmt.Errorf("srcaddr: %w", err)
+	}
+	if filter.DstAddr, err = parseAddrFilter(query.Get("dstaddr")); err != nil {
+		return fmt.Errorf("dstaddr: %w", err)
+	}
+	if filter.SrcPort, err = parseRangeFilter(query.Get("srcport"), 65535, nil); err != nil {
+		return fmt.Errorf("srcport: %w", err)
+	}
+	if filter.DstPort, err = parseRangeFilter(query.Get("dstport"), 65535, nil); err != nil {
+		return fmt.Errorf("dstport: %w", err)
+	}
+	if filter.Protocol, err = parseRangeFilter(query.Get("protocol"), 255, queryProtocols); err != nil {
+		return fmt.Errorf("protocol: %w", err)
+	}
+	return nil
+}
+
+// trafficOrderColumns are the aggregate columns the traffic can be sorted by
+var trafficOrderColumns = []string{"total_octets", "total_packets", "flow_count", "address"}
+
+// parseDirection validates the interface direction, input by default. The
+// direction names a column in SQL, so nothing else is accepted.
+func parseDirection(value string) (string, error) {
+	switch value {
+	case "":
+		return "input", nil
+	case "input", "output":
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid direction %q, use input or output", value)
+}
+
+// parseOrder validates the sort column and direction, which are pasted into
+// ORDER BY
+func parseOrder(query url.Values, filter *TrafficFilter) error {
+	if orderBy := query.Get("order_by"); orderBy != "" {
+		if !slices.Contains(trafficOrderColumns, orderBy) {
+			return fmt.Errorf("invalid order_by %q, use %s", orderBy, strings.Join(trafficOrderColumns, ", "))
+		}
+		filter.OrderBy = orderBy
+	}
+	if orderDir := strings.ToLower(query.Get("order_dir")); orderDir != "" {
+		if orderDir != "asc" && orderDir != "desc" {
+			return fmt.Errorf("invalid order_dir %q, use asc or desc", query.Get("order_dir"))
+		}
+		filter.OrderDir = orderDir
+	}
+	return nil
+}
+
+// directionColumn returns the flows column holding the interface of the
+// filter's direction
+func (filter TrafficFilter) directionColumn() string {
+	if filter.Direction == "output" {
+		return "output"
+	}
+	return "input"
+}
+
+// matchConditions returns the WHERE conditions for the address, port and
+// protocol filters, numbering placeholders from argIndex
+func (filter TrafficFilter) matchConditions(argIndex int) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(cond string, condArgs []interface{}) {
+		conditions = append(conditions, cond)
+		args = append(args, condArgs...)
+		argIndex += len(condArgs)
+	}
+	if filter.SrcAddr.IsSet() {
+		add(filter.SrcAddr.SQL("srcaddr", argIndex))
+	}
+	if filter.DstAddr.IsSet() {
+		add(filter.DstAddr.SQL("dstaddr", argIndex))
+	}
+	if filter.Protocol.IsSet() {
+		add(filter.Protocol.SQL("prot", argIndex))
+	}
+	if filter.SrcPort.IsSet() {
+		add(filter.SrcPort.SQL("srcport", argIndex))
+	}
+	if filter.DstPort.IsSet() {
+		add(filter.DstPort.SQL("dstport", argIndex))
+	}
+	return conditions, args
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testRange selects the hour of the fixture flows
+const testRange = "&start=2025-06-01T09:00:00Z&end=2025-06-01T12:00:00Z"
+
+func TestTrafficHandler(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+	store.AddServiceNetworks(ServiceNetwork{CIDR: "10.0.0.0/30", Name: "office"})
+	// Data JSON decodes numbers as float64
+	store.exporters[0].Data = map[string]interface{}{samplingRateKey: float64(10)}
+
+	w := serve(getTrafficRequest, httptest.NewRequest(http.MethodGet,
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&direction=input"+testRange, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var response TrafficResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Scaled || response.SamplingRate != 10 {
+		t.Errorf("sampling rate = %d, scaled = %v", response.SamplingRate, response.Scaled)
+	}
+	if response.TotalOctets != 45000 || response.TotalPackets != 350 || response.UniqueAddrs != 2 {
+		t.Errorf("totals = %d bytes, %d packets, %d addresses", response.TotalOctets, response.TotalPackets, response.UniqueAddrs)
+	}
+	if len(response.Records) != 2 {
+		t.Fatalf("records = %+v", response.Records)
+	}
+	first := response.Records[0]
+	if first.Address != "10.0.0.1" || first.TotalOctets != 40000 || first.FlowCount != 2 {
+		t.Errorf("largest source = %+v", first)
+	}
+	if first.Enrichment == nil || first.Enrichment.ServiceName != "office" {
+		t.Errorf("enrichment of %s = %+v", first.Address, first.Enrichment)
+	}
+
+	w = serve(getTrafficRequest, httptest.NewRequest(http.MethodGet,
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&direction=input&group_by=pair&srcport=50001-50002"+testRange, nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Records) != 2 || response.Records[0].Address != "10.0.0.1 → 10.0.1.2" {
+		t.Errorf("pairs = %+v", response.Records)
+	}
+}
+
+func TestTrafficHandlerErrors(t *testing.T) {
+	useMemoryStore(t)
+	for _, target := range []string{
+		"/api/v1/traffic?interface=3",
+		"/api/v1/traffic?exporter=192.0.2.1",
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&srcaddr=bogus",
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&start=yesterday",
+		// direction and order name columns in SQL
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&direction=exporter+IS+NOT+NULL+OR+input",
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&order_by=(SELECT+1)",
+		"/api/v1/traffic?exporter=192.0.2.1&interface=3&order_dir=desc,+1",
+	} {
+		if w := serve(getTrafficRequest, httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestRawFlowsHandler(t *testing.T) {
+	store := useMemoryStore(t)
+	addTestFlows(store)
+
+	w := serve(getRawFlowsRequest, httptest.NewRequest(http.MethodGet,
+		"/api/v1/traffic/raw?exporter=192.0.2.1&interface=3&direction=output"+testRange, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Records    []TrafficRecord `json:"records"`
+		NextCursor string          `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Records) != 1 || body.Records[0].SrcAddr != "10.0.0.3" {
+		t.Errorf("records = %+v", body.Records)
+	}
+
+	// Pages continue after the cursor, newest (highest ID) first
+	var ids []uint64
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		w = serve(getRawFlowsRequest, httptest.NewRequest(http.MethodGet,
+			"/api/v1/traffic/raw?exporter=192.0.2.1&limit=3&cursor="+cursor+testRange, nil))
+		body.NextCursor = ""
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range body.Records {
+			ids = append(ids, record.ID)
+		}
+		if cursor = body.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if fmt.Sprint(ids) != "[4 3 2 1]" {
+		t.Errorf("paged IDs = %v", ids)
+	}
+}
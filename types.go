@@ -23,16 +23,52 @@ type Metric struct {
 	Timestamp time.Time `json:"timestamp" db:"timestamp"`
 	OctetsIn  int64     `json:"octets_in" db:"octets_in"`
 	OctetsOut int64     `json:"octets_out" db:"octets_out"`
+	// sysUpTime of the agent in hundredths of a second, 0 if unknown
+	Uptime int64 `json:"uptime,omitempty" db:"uptime"`
 }
 
 type Config struct {
-	Bind_address     string
-	Conn_string      string
-	Maxmind_database string
-	Db               *sql.DB
-	Dbrest           string
-	TZ               string
-	Mmdb             *maxminddb.Reader
+	Bind_address      string
+	Collector_bind    string
+	Sflow_bind        string
+	Snmp_poll         string
+	Snmp_discovery    string
+	Alert_interval    string
+	Ddos_interval     string
+	Ddos_min_pps      string
+	Ddos_factor       string
+	Scan_interval     string
+	Scan_window       string
+	Scan_min_hosts    string
+	Scan_min_ports    string
+	Scan_suppress     string
+	Baseline_interval string
+	Baseline_weeks    string
+	Notify_config     string
+	Auth_mode         string
+	Admin_password    string
+	Oidc_issuer       string
+	Oidc_client_id    string
+	Oidc_secret       string
+	Oidc_redirect_url string
+	Oidc_scopes       string
+	Oidc_groups_claim string
+	Oidc_user_claim   string
+	Oidc_role_map     string
+	Secret_keys       string
+	Secret_keys_file  string
+	Conn_string       string
+	Maxmind_database  string
+	Db                *sql.DB
+	Flows             FlowStore
+	Metrics           MetricsStore
+	Alerts            AlertStore
+	Auth              AuthStore
+	Audit             AuditStore
+	Dbrest            string
+	TZ                string
+	DB_TZ             string
+	Mmdb              *maxminddb.Reader
 }
 
 type Coordinates struct {
@@ -166,6 +202,10 @@ type ExporterConfig struct {
 	Snmpv3PrivProto string                 `json:"snmpv3_priv_proto"`
 	Snmpv3PrivPass  string                 `json:"snmpv3_priv_pass"`
 	Data            map[string]interface{} `json:"data"`
+	// The SNMP secrets are write-only; these tell whether they are set
+	SnmpCommunitySet  bool `json:"snmp_community_set"`
+	Snmpv3AuthPassSet bool `json:"snmpv3_auth_pass_set"`
+	Snmpv3PrivPassSet bool `json:"snmpv3_priv_pass_set"`
 }
 
 // InterfaceConfig represents interface configuration for the config page